@@ -26,8 +26,15 @@ http.createServer(function (req, res) {
         process.exit(2)
     }
 
-    fn.trigger(req, res);
-    res.end();
+    // a trigger that reads the request body returns a promise, the response ends once it settles
+    Promise.resolve(fn.trigger(req, res)).catch(function (err) {
+        console.log(err)
+        res.statusCode = 500
+    }).then(function () {
+        if (!res.finished) {
+            res.end();
+        }
+    });
 }).listen(Number(port), function(){
     console.log("server start at port " + port); //the server object listens on port 3000
 });
\ No newline at end of file
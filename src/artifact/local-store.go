@@ -0,0 +1,95 @@
+package artifact
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalStore stores artifacts as files named by their content hash in a directory
+type LocalStore struct {
+	Dir string
+}
+
+// NewLocalStore creates a local artifact store in the directory
+func NewLocalStore(dir string) (*LocalStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalStore{Dir: dir}, nil
+}
+
+// Put writes the artifact to a temporary file then renames it, so a reader never sees a partial artifact
+func (s *LocalStore) Put(data []byte) (string, error) {
+	hash := Hash(data)
+	path := filepath.Join(s.Dir, hash)
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil
+	}
+
+	tmp, err := ioutil.TempFile(s.Dir, ".upload-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err = tmp.Close(); err != nil {
+		return "", err
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return "", err
+	}
+	return hash, os.Rename(tmp.Name(), path)
+}
+
+// Get reads and verifies the artifact
+func (s *LocalStore) Get(hash string) ([]byte, error) {
+	if err := validHash(hash); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(s.Dir, hash))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, Verify(hash, data)
+}
+
+// Delete deletes the artifact
+func (s *LocalStore) Delete(hash string) error {
+	if err := validHash(hash); err != nil {
+		return err
+	}
+	err := os.Remove(filepath.Join(s.Dir, hash))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// List lists the artifacts in the directory
+func (s *LocalStore) List() ([]Info, error) {
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	infos := []Info{}
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") || validHash(f.Name()) != nil {
+			continue
+		}
+		infos = append(infos, Info{Hash: f.Name(), Size: int(f.Size()), CreatedAt: f.ModTime()})
+	}
+	return infos, nil
+}
+
+// Close is a no-op for the local store
+func (s *LocalStore) Close() error {
+	return nil
+}
@@ -0,0 +1,95 @@
+package artifact
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewLocalStore(filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := []byte("module.exports = () => 'hello'")
+	hash, err := store.Put(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != Hash(source) {
+		t.Fatalf("got hash %s, want the content hash %s", hash, Hash(source))
+	}
+	if again, err := store.Put(source); err != nil || again != hash {
+		t.Fatalf("put the same artifact again got %s error %v", again, err)
+	}
+	corrupted, err := store.Put([]byte("corrupted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(store.Dir, corrupted), []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the temporary files of the uploads in progress are not artifacts
+	if err = ioutil.WriteFile(filepath.Join(store.Dir, ".upload-1"), source, 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := Hash([]byte("missing"))
+
+	cases := []struct {
+		name    string
+		hash    string
+		want    string
+		wantErr bool
+	}{
+		{"stored", hash, string(source), false},
+		{"missing", missing, "", true},
+		{"corrupted", corrupted, "", true},
+		{"not a hash", "../" + hash[3:], "", true},
+	}
+	for _, c := range cases {
+		t.Run("get "+c.name, func(t *testing.T) {
+			data, err := store.Get(c.hash)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("got error %v, want error %v", err, c.wantErr)
+			}
+			if !c.wantErr && string(data) != c.want {
+				t.Errorf("got %s, want %s", data, c.want)
+			}
+		})
+	}
+	if _, err = store.Get(missing); err != ErrNotFound {
+		t.Errorf("got error %v for a missing artifact, want %v", err, ErrNotFound)
+	}
+
+	infos, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := map[string]int{}
+	for _, info := range infos {
+		listed[info.Hash] = info.Size
+	}
+	if len(listed) != 2 || listed[hash] != len(source) {
+		t.Errorf("got artifacts %v, want %s and %s", listed, hash, corrupted)
+	}
+
+	if err = store.Delete(hash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Get(hash); err != ErrNotFound {
+		t.Errorf("got error %v after delete, want %v", err, ErrNotFound)
+	}
+	if err = store.Delete(hash); err != nil {
+		t.Errorf("deleting a deleted artifact got error %v", err)
+	}
+	if err = store.Delete("../store"); err == nil {
+		t.Error("deleting an invalid hash got no error")
+	}
+}
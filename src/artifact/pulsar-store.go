@@ -0,0 +1,333 @@
+package artifact
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/kafkaesque-io/pubsub-function/src/pulsardriver"
+	"github.com/kafkaesque-io/pubsub-function/src/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/**
+ * The pulsar artifact store splits an artifact into chunk messages keyed by <hash>/<chunk index>,
+ * so the artifact topic can be compacted like the database topic. A reader builds an index of the
+ * first chunk message of every artifact, and Get reads the chunks from there. An empty payload is a tombstone.
+**/
+
+// properties of an artifact chunk message
+const (
+	chunksProperty = "artifactChunks"
+	sizeProperty   = "artifactSize"
+)
+
+const (
+	defaultChunkSize = 512 * 1024
+	fetchTimeout     = 60 * time.Second
+)
+
+// chunkIndex locates the chunks of an artifact in the topic
+type chunkIndex struct {
+	info     Info
+	chunks   int
+	first    pulsar.MessageID
+	received map[int]bool
+}
+
+func (c *chunkIndex) complete() bool {
+	return c.first != nil && len(c.received) == c.chunks
+}
+
+// PulsarStore stores artifacts in a Pulsar topic on the database cluster
+type PulsarStore struct {
+	PulsarURL   string
+	PulsarToken string
+	TopicName   string
+	chunkSize   int
+	client      pulsar.Client
+	producer    pulsar.Producer
+	index       map[string]*chunkIndex
+	indexLock   sync.RWMutex
+	// synced is closed when the listener has read the artifact topic to the end for the first time
+	synced   chan struct{}
+	syncOnce sync.Once
+	closed   int32
+	logger   *log.Entry
+}
+
+// NewPulsarStore creates a pulsar artifact store and starts to index the artifact topic
+func NewPulsarStore() (*PulsarStore, error) {
+	config := util.GetConfig()
+	s := &PulsarStore{
+		PulsarURL:   config.PulsarBrokerURL,
+		PulsarToken: config.DbPassword,
+		TopicName:   util.AssignString(config.ArtifactTopic, config.DbName+"-artifacts"),
+		chunkSize:   util.StringToInt(config.ArtifactChunkSize, defaultChunkSize),
+		index:       make(map[string]*chunkIndex),
+		synced:      make(chan struct{}),
+		logger:      log.WithFields(log.Fields{"app": "pulsar-artifact-store"}),
+	}
+	if strings.HasPrefix(config.DbConnectionStr, "pulsar") {
+		s.PulsarURL = config.DbConnectionStr
+	}
+
+	var err error
+	if s.client, err = pulsardriver.NewPulsarClient(s.PulsarURL, s.PulsarToken); err != nil {
+		return nil, err
+	}
+	if s.producer, err = s.client.CreateProducer(pulsar.ProducerOptions{
+		Topic:           s.TopicName,
+		DisableBatching: true,
+	}); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for atomic.LoadInt32(&s.closed) == 0 {
+			if err := s.listen(); err != nil {
+				s.logger.Errorf("artifact listener terminated error %v", err)
+			}
+			time.Sleep(time.Second)
+		}
+	}()
+	return s, nil
+}
+
+// listen indexes the chunk messages of the artifact topic
+func (s *PulsarStore) listen() error {
+	reader, err := s.client.CreateReader(pulsar.ReaderOptions{
+		Topic:          s.TopicName,
+		StartMessageID: pulsar.EarliestMessageID(),
+		ReadCompacted:  true,
+	})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	s.indexLock.Lock()
+	s.index = make(map[string]*chunkIndex)
+	s.indexLock.Unlock()
+
+	caughtUp := false
+	for {
+		if !caughtUp && !reader.HasNext() {
+			caughtUp = true
+			s.syncOnce.Do(func() { close(s.synced) })
+		}
+		msg, err := reader.Next(context.Background())
+		if err != nil {
+			return err
+		}
+		s.indexChunk(msg)
+	}
+}
+
+func (s *PulsarStore) indexChunk(msg pulsar.Message) {
+	hash, chunk, err := parseChunkKey(msg.Key())
+	if err != nil {
+		s.logger.Errorf("ignore artifact message %v", err)
+		return
+	}
+
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+	if len(msg.Payload()) == 0 {
+		delete(s.index, hash)
+		return
+	}
+	entry, ok := s.index[hash]
+	if !ok {
+		entry = &chunkIndex{
+			info: Info{
+				Hash:      hash,
+				Size:      util.StringToInt(msg.Properties()[sizeProperty], 0),
+				CreatedAt: msg.PublishTime(),
+			},
+			chunks:   util.StringToInt(msg.Properties()[chunksProperty], 1),
+			received: make(map[int]bool),
+		}
+		s.index[hash] = entry
+	}
+	if chunk == 0 && entry.first == nil {
+		entry.first = msg.ID()
+	}
+	entry.received[chunk] = true
+}
+
+func chunkKey(hash string, chunk int) string {
+	return hash + "/" + strconv.Itoa(chunk)
+}
+
+func parseChunkKey(key string) (string, int, error) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 2 {
+		return "", 0, fmt.Errorf("invalid artifact chunk key %s", key)
+	}
+	chunk, err := strconv.Atoi(parts[1])
+	if err != nil || chunk < 0 {
+		return "", 0, fmt.Errorf("invalid artifact chunk key %s", key)
+	}
+	return parts[0], chunk, nil
+}
+
+// sync waits until the listener has read the artifact topic to the end
+func (s *PulsarStore) sync() error {
+	select {
+	case <-s.synced:
+		return nil
+	case <-time.After(fetchTimeout):
+		return errors.New("timed out reading the artifact topic")
+	}
+}
+
+// lookup returns the index of a complete artifact
+func (s *PulsarStore) lookup(hash string) (chunkIndex, bool) {
+	s.indexLock.RLock()
+	defer s.indexLock.RUnlock()
+	entry, ok := s.index[hash]
+	if !ok || !entry.complete() {
+		return chunkIndex{}, false
+	}
+	return *entry, true
+}
+
+// Put sends the chunks of the artifact unless the artifact is already stored
+func (s *PulsarStore) Put(data []byte) (string, error) {
+	hash := Hash(data)
+	if _, ok := s.lookup(hash); ok {
+		return hash, nil
+	}
+
+	chunks := (len(data) + s.chunkSize - 1) / s.chunkSize
+	if chunks == 0 {
+		return "", errors.New("artifact is empty")
+	}
+	for i := 0; i < chunks; i++ {
+		end := (i + 1) * s.chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		msg := pulsar.ProducerMessage{
+			Payload: data[i*s.chunkSize : end],
+			Key:     chunkKey(hash, i),
+			Properties: map[string]string{
+				chunksProperty: strconv.Itoa(chunks),
+				sizeProperty:   strconv.Itoa(len(data)),
+			},
+		}
+		if _, err := s.producer.Send(context.Background(), &msg); err != nil {
+			return "", err
+		}
+	}
+	return hash, nil
+}
+
+// Get reads the chunks of the artifact from its first chunk message and verifies the content hash
+func (s *PulsarStore) Get(hash string) ([]byte, error) {
+	if err := validHash(hash); err != nil {
+		return nil, err
+	}
+	if err := s.sync(); err != nil {
+		return nil, err
+	}
+	entry, ok := s.lookup(hash)
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	reader, err := s.client.CreateReader(pulsar.ReaderOptions{
+		Topic:                   s.TopicName,
+		StartMessageID:          entry.first,
+		StartMessageIDInclusive: true,
+		ReadCompacted:           true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+	chunks := make([][]byte, entry.chunks)
+	for received := 0; received < entry.chunks; {
+		msg, err := reader.Next(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read artifact %s error %v", hash, err)
+		}
+		chunkHash, chunk, err := parseChunkKey(msg.Key())
+		if err != nil || chunkHash != hash || chunk >= entry.chunks {
+			continue
+		}
+		if len(msg.Payload()) == 0 {
+			return nil, ErrNotFound
+		}
+		if chunks[chunk] == nil {
+			chunks[chunk] = msg.Payload()
+			received++
+		}
+	}
+
+	data := make([]byte, 0, entry.info.Size)
+	for _, chunk := range chunks {
+		data = append(data, chunk...)
+	}
+	return data, Verify(hash, data)
+}
+
+// Delete sends a tombstone for every chunk of the artifact
+func (s *PulsarStore) Delete(hash string) error {
+	if err := validHash(hash); err != nil {
+		return err
+	}
+	s.indexLock.RLock()
+	entry, ok := s.index[hash]
+	chunks := 0
+	if ok {
+		chunks = entry.chunks
+	}
+	s.indexLock.RUnlock()
+
+	for i := 0; i < chunks; i++ {
+		msg := pulsar.ProducerMessage{
+			Key: chunkKey(hash, i),
+		}
+		if _, err := s.producer.Send(context.Background(), &msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List lists the complete artifacts in the index
+func (s *PulsarStore) List() ([]Info, error) {
+	if err := s.sync(); err != nil {
+		return nil, err
+	}
+	s.indexLock.RLock()
+	defer s.indexLock.RUnlock()
+	infos := []Info{}
+	for _, entry := range s.index {
+		if entry.complete() {
+			infos = append(infos, entry.info)
+		}
+	}
+	return infos, nil
+}
+
+// Close flushes and closes the producer, and closes the client
+func (s *PulsarStore) Close() error {
+	atomic.StoreInt32(&s.closed, 1)
+	err := s.producer.Flush()
+	s.producer.Close()
+	s.client.Close()
+	return err
+}
@@ -0,0 +1,98 @@
+package artifact
+
+// artifact stores function sources by content hash so that any worker can fetch them
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kafkaesque-io/pubsub-function/src/util"
+)
+
+// ErrNotFound is returned when an artifact is not in the store
+var ErrNotFound = errors.New("artifact not found")
+
+// Info is the metadata of a stored artifact
+type Info struct {
+	Hash      string    `json:"hash"`
+	Size      int       `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Store is a content addressed artifact store
+type Store interface {
+	// Put stores the data and returns its content hash, storing the same data again is a no-op
+	Put(data []byte) (string, error)
+	// Get returns the data of the hash after it is verified against the hash
+	Get(hash string) ([]byte, error)
+	Delete(hash string) error
+	List() ([]Info, error)
+	Close() error
+}
+
+// store is a singleton of the configured artifact store
+var store Store
+
+var storeLock = &sync.Mutex{}
+
+// GetStore returns the artifact store of the ArtifactStoreType configuration
+func GetStore() (Store, error) {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	if store != nil {
+		return store, nil
+	}
+
+	var err error
+	switch storeType := util.AssignString(util.GetConfig().ArtifactStoreType, "local"); storeType {
+	case "local":
+		store, err = NewLocalStore(util.AssignString(util.GetConfig().ArtifactStoreDir, "/pulsar/artifacts"))
+	case "pulsar":
+		store, err = NewPulsarStore()
+	default:
+		err = fmt.Errorf("unsupported artifact store type %s", storeType)
+	}
+	if err != nil {
+		store = nil
+	}
+	return store, err
+}
+
+// CloseStore closes the artifact store if it has been created
+func CloseStore() error {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	if store == nil {
+		return nil
+	}
+	return store.Close()
+}
+
+// Hash is the content hash of the data, the hex encoded sha256 digest
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Verify verifies the data against the content hash
+func Verify(hash string, data []byte) error {
+	if actual := Hash(data); actual != hash {
+		return fmt.Errorf("artifact %s does not match its content hash %s", hash, actual)
+	}
+	return nil
+}
+
+// validHash rejects anything but a hex encoded sha256 digest, so a hash is safe as a file name
+func validHash(hash string) error {
+	if len(hash) != sha256.Size*2 {
+		return fmt.Errorf("invalid artifact hash %s", hash)
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return fmt.Errorf("invalid artifact hash %s", hash)
+	}
+	return nil
+}
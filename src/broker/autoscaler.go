@@ -0,0 +1,234 @@
+package broker
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kafkaesque-io/pubsub-function/src/cluster"
+	"github.com/kafkaesque-io/pubsub-function/src/lambda"
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+	"github.com/kafkaesque-io/pubsub-function/src/pulsardriver"
+	"github.com/kafkaesque-io/pubsub-function/src/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// the input topic stats and the instances of the autoscaler
+var (
+	topicStats    = pulsardriver.GetTopicStats
+	startInstance = lambda.CreateFnInstance
+	stopInstance  = lambda.StopInstance
+)
+
+// latencyWindow collects invocation latencies between two autoscaling evaluations
+type latencyWindow struct {
+	samples []time.Duration
+	lock    sync.Mutex
+}
+
+// maxLatencySamples bounds the memory of a window, the most recent samples are kept
+const maxLatencySamples = 1024
+
+func (w *latencyWindow) Add(latency time.Duration) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.samples) >= maxLatencySamples {
+		w.samples = w.samples[1:]
+	}
+	w.samples = append(w.samples, latency)
+}
+
+// Reset returns the p95 latency of the window and starts a new window
+func (w *latencyWindow) Reset() time.Duration {
+	w.lock.Lock()
+	samples := w.samples
+	w.samples = nil
+	w.lock.Unlock()
+
+	if len(samples) == 0 {
+		return 0
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	return samples[int(math.Ceil(float64(len(samples))*0.95))-1]
+}
+
+// runAutoscaler evaluates the autoscaling of all functions at every interval
+func runAutoscaler() {
+	interval, err := time.ParseDuration(util.AssignString(util.GetConfig().AutoscaleInterval, "15s"))
+	if err != nil {
+		log.Errorf("invalid AutoscaleInterval %v, use the default 15s", err)
+		interval = 15 * time.Second
+	}
+	for range time.Tick(interval) {
+		// the leader scales the functions for the whole cluster
+		if cluster.Enabled() && !cluster.IsLeader() {
+			continue
+		}
+		consumersLock.Lock()
+		consumers := []*FunctionConsumer{}
+		for _, c := range functionConsumers {
+			if c.cfg.Scaling.Enabled() {
+				consumers = append(consumers, c)
+			}
+		}
+		consumersLock.Unlock()
+
+		for _, c := range consumers {
+			c.autoscale(time.Now())
+		}
+	}
+}
+
+// desiredParallelism computes the number of instances for the backlog, and one more instance if the p95 latency
+// is beyond the target while all instances are busy
+func desiredParallelism(policy model.ScalingPolicy, current, backlog, inFlight int, p95 time.Duration) int {
+	desired := int(math.Ceil(float64(backlog) / float64(policy.GetTargetBacklog())))
+	target := policy.GetTargetLatency()
+	if target > 0 && p95 > target && current > 0 && inFlight >= current && desired <= current {
+		desired = current + 1
+	}
+	if desired < current && target > 0 && p95 > target {
+		// do not scale down while the latency is beyond the target
+		desired = current
+	}
+	return policy.Clamp(desired)
+}
+
+// backlog is the input subscription backlog from the Pulsar admin API,
+// or the local queued and in-flight invocations if the admin API is not available
+func (c *FunctionConsumer) backlog() int {
+	local := c.dispatcher.QueueLength() + c.dispatcher.InFlight()
+	adminURL := util.GetConfig().PulsarAdminURL
+	if adminURL == "" {
+		return local
+	}
+	stats, err := topicStats(adminURL, c.cfg.InputTopic.Token, c.cfg.InputTopic.TopicFullName)
+	if err != nil {
+		log.Warnf("function %s failed to get input topic stats error %v", c.cfg.ID, err)
+		return local
+	}
+	if sub, ok := stats.Subscriptions[subscriptionName(&c.cfg)]; ok {
+		return int(sub.MsgBacklog)
+	}
+	return local
+}
+
+// autoscale starts or stops instances toward the desired parallelism within the cooldowns
+func (c *FunctionConsumer) autoscale(now time.Time) {
+	policy := c.cfg.Scaling
+	current := c.instanceCount()
+	backlog, inFlight := c.backlog(), c.dispatcher.InFlight()
+	p95 := c.latencies.Reset()
+	desired := desiredParallelism(policy, current, backlog, inFlight, p95)
+	log.Debugf("function %s autoscale current %d desired %d backlog %d in-flight %d p95 %v",
+		c.cfg.ID, current, desired, backlog, inFlight, p95)
+
+	c.scaleLock.Lock()
+	defer c.scaleLock.Unlock()
+	switch {
+	case desired > current:
+		if now.Sub(c.lastScaleUp) < policy.GetScaleUpCooldown() {
+			return
+		}
+		c.lastScaleUp = now
+		if cluster.Enabled() {
+			c.setParallelism(desired)
+			return
+		}
+		c.scaleUp(desired - current)
+	case desired < current:
+		if now.Sub(c.lastScaleUp) < policy.GetScaleDownCooldown() || now.Sub(c.lastScaleDown) < policy.GetScaleDownCooldown() {
+			return
+		}
+		if desired == 0 && now.Sub(c.lastActive()) < policy.GetScaleDownCooldown() {
+			return
+		}
+		c.lastScaleDown = now
+		if cluster.Enabled() {
+			c.setParallelism(desired)
+			return
+		}
+		c.scaleDown(current - desired)
+	}
+}
+
+// setParallelism sets the number of instances for the cluster leader to assign across the workers
+func (c *FunctionConsumer) setParallelism(parallelism int) {
+	log.Infof("function %s scale to %d instances in the cluster", c.cfg.ID, parallelism)
+	if err := cluster.SetParallelism(c.cfg.ID, parallelism); err != nil {
+		log.Errorf("function %s failed to set parallelism error %v", c.cfg.ID, err)
+	}
+}
+
+// scaleUp starts more instances, the caller must hold the scale lock
+func (c *FunctionConsumer) scaleUp(count int) {
+	log.Infof("function %s scale up %d instances", c.cfg.ID, count)
+	started := []string{}
+	for i := 0; i < count; i++ {
+		url, err := startInstance(c.cfg)
+		if err != nil {
+			log.Errorf("function %s failed to start instance error %v", c.cfg.ID, err)
+			break
+		}
+		started = append(started, url)
+	}
+	if len(started) == 0 {
+		return
+	}
+
+	c.urlsLock.Lock()
+	c.urls = append(c.urls, started...)
+	urls := append([]string{}, c.urls...)
+	c.urlsLock.Unlock()
+	instances.WithLabelValues(c.cfg.ID).Set(float64(len(urls)))
+	c.saveURLs(urls)
+}
+
+// scaleDown takes instances out of the rotation and stops them once their in-flight invocations have timed out,
+// the caller must hold the scale lock
+func (c *FunctionConsumer) scaleDown(count int) {
+	log.Infof("function %s scale down %d instances", c.cfg.ID, count)
+	c.urlsLock.Lock()
+	if count > len(c.urls) {
+		count = len(c.urls)
+	}
+	stopped := c.urls[len(c.urls)-count:]
+	c.urls = append([]string{}, c.urls[:len(c.urls)-count]...)
+	urls := append([]string{}, c.urls...)
+	c.urlsLock.Unlock()
+	instances.WithLabelValues(c.cfg.ID).Set(float64(len(urls)))
+	c.saveURLs(urls)
+
+	go func() {
+		time.Sleep(c.cfg.GetTimeout())
+		for _, url := range stopped {
+			if err := stopInstance(url); err != nil {
+				log.Warnf("function %s failed to stop instance %s error %v", c.cfg.ID, url, err)
+			}
+		}
+	}()
+}
+
+// coldStart starts the first instance of a function scaled to zero
+func (c *FunctionConsumer) coldStart() {
+	c.scaleLock.Lock()
+	defer c.scaleLock.Unlock()
+	if c.instanceCount() > 0 {
+		return
+	}
+	log.Infof("function %s cold start", c.cfg.ID)
+	c.lastScaleUp = time.Now()
+	if !cluster.Enabled() {
+		c.scaleUp(1)
+		return
+	}
+
+	// wait for an instance to be assigned and started by a worker
+	c.setParallelism(1)
+	deadline := time.Now().Add(c.cfg.GetTimeout())
+	for c.instanceCount() == 0 && time.Now().Before(deadline) && c.ctx.Err() == nil {
+		time.Sleep(500 * time.Millisecond)
+	}
+}
@@ -0,0 +1,256 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kafkaesque-io/pubsub-function/src/db"
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+	"github.com/kafkaesque-io/pubsub-function/src/pulsardriver"
+	"github.com/kafkaesque-io/pubsub-function/src/util"
+)
+
+// fakeInstances is the metrics source and the instances of the autoscaler
+type fakeInstances struct {
+	lock    sync.Mutex
+	backlog int64
+	statErr error
+	next    int
+	stopped chan string
+}
+
+func (f *fakeInstances) setBacklog(backlog int64) {
+	f.lock.Lock()
+	f.backlog = backlog
+	f.lock.Unlock()
+}
+
+// stub replaces the autoscaler's topic stats and instances, it returns a function to restore them
+func (f *fakeInstances) stub() func() {
+	stats, start, stop := topicStats, startInstance, stopInstance
+	topicStats = func(adminURL, token, topicFullName string) (*pulsardriver.TopicStats, error) {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		if f.statErr != nil {
+			return nil, f.statErr
+		}
+		return &pulsardriver.TopicStats{Subscriptions: map[string]pulsardriver.SubscriptionStats{
+			"acme-fn": {MsgBacklog: f.backlog},
+		}}, nil
+	}
+	startInstance = func(cfg model.FunctionConfig) (string, error) {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		f.next++
+		return fmt.Sprintf("http://127.0.0.1:%d", 10001+f.next), nil
+	}
+	stopInstance = func(url string) error {
+		f.stopped <- url
+		return nil
+	}
+	return func() { topicStats, startInstance, stopInstance = stats, start, stop }
+}
+
+func TestDesiredParallelism(t *testing.T) {
+	policy := model.ScalingPolicy{MinParallelism: 1, MaxParallelism: 5, TargetBacklog: 10, TargetLatencyMs: 100}
+	cases := []struct {
+		name     string
+		policy   model.ScalingPolicy
+		current  int
+		backlog  int
+		inFlight int
+		p95      time.Duration
+		want     int
+	}{
+		{"backlog per instance", policy, 1, 25, 0, 0, 3},
+		{"clamped to the max", policy, 1, 1000, 0, 0, 5},
+		{"clamped to the min", policy, 3, 0, 0, 0, 1},
+		{"scale to zero", model.ScalingPolicy{MaxParallelism: 5}, 1, 0, 0, 0, 0},
+		{"default target backlog", model.ScalingPolicy{MaxParallelism: 5}, 1, 250, 0, 0, 3},
+		{"latency with busy instances", policy, 2, 10, 2, 200 * time.Millisecond, 3},
+		{"latency with idle instances", policy, 2, 20, 1, 200 * time.Millisecond, 2},
+		{"latency within the target", policy, 2, 20, 2, 50 * time.Millisecond, 2},
+		{"no scale down beyond the latency target", policy, 4, 0, 0, 200 * time.Millisecond, 4},
+		{"latency ignored without target", model.ScalingPolicy{MaxParallelism: 5, TargetBacklog: 10}, 2, 20, 2, time.Second, 2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := desiredParallelism(c.policy, c.current, c.backlog, c.inFlight, c.p95); got != c.want {
+				t.Errorf("got %d, want %d", got, c.want)
+			}
+		})
+	}
+}
+
+func TestLatencyWindow(t *testing.T) {
+	var w latencyWindow
+	if p95 := w.Reset(); p95 != 0 {
+		t.Errorf("got p95 %v of an empty window", p95)
+	}
+	for i := 100; i > 0; i-- {
+		w.Add(time.Duration(i) * time.Millisecond)
+	}
+	if p95 := w.Reset(); p95 != 95*time.Millisecond {
+		t.Errorf("got p95 %v, want 95ms", p95)
+	}
+	if p95 := w.Reset(); p95 != 0 {
+		t.Errorf("got p95 %v after reset", p95)
+	}
+}
+
+func TestBacklog(t *testing.T) {
+	defer func(adminURL string) { util.Config.PulsarAdminURL = adminURL }(util.Config.PulsarAdminURL)
+	f := &fakeInstances{backlog: 42}
+	defer f.stub()()
+
+	cases := []struct {
+		name         string
+		adminURL     string
+		statErr      error
+		subscription string
+		want         int
+	}{
+		{"subscription backlog", "http://localhost:8080", nil, "", 42},
+		{"local without admin url", "", nil, "", 3},
+		{"local on stats error", "http://localhost:8080", errors.New("unavailable"), "", 3},
+		{"local without the subscription", "http://localhost:8080", nil, "other", 3},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			util.Config.PulsarAdminURL = c.adminURL
+			f.statErr = c.statErr
+			cfg := testFunctionConfig()
+			cfg.InputTopic.Subscription = c.subscription
+			fc := NewFunctionConsumer(cfg)
+			for i := 0; i < 3; i++ {
+				fc.dispatcher.Dispatch(context.Background(), &Invocation{Message: &fakeMessage{payload: "a1"}, Consumer: &fakeConsumer{}})
+			}
+			if got := fc.backlog(); got != c.want {
+				t.Errorf("got backlog %d, want %d", got, c.want)
+			}
+		})
+	}
+}
+
+func TestAutoscale(t *testing.T) {
+	defer func(adminURL, cluster string) {
+		util.Config.PulsarAdminURL, util.Config.WorkerCluster = adminURL, cluster
+	}(util.Config.PulsarAdminURL, util.Config.WorkerCluster)
+	util.Config.PulsarAdminURL, util.Config.WorkerCluster = "http://localhost:8080", "false"
+	f := &fakeInstances{stopped: make(chan string, 10)}
+	defer f.stub()()
+	store, err := db.NewInMemoryHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(d db.Db) { singleDb = d }(singleDb)
+	singleDb = store
+
+	cfg := testFunctionConfig()
+	cfg.Timeout = 1
+	cfg.Scaling = model.ScalingPolicy{MaxParallelism: 4, TargetBacklog: 10, TargetLatencyMs: 100, ScaleUpCooldown: 30, ScaleDownCooldown: 300}
+	if _, err = store.Create(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	fc := NewFunctionConsumer(cfg)
+	start := time.Now()
+
+	steps := []struct {
+		name    string
+		elapsed time.Duration
+		backlog int64
+		latency time.Duration
+		want    int
+	}{
+		{"scale up for the backlog", 0, 25, 0, 3},
+		{"scale up cooldown", 10 * time.Second, 40, 0, 3},
+		{"scale up after the cooldown", 40 * time.Second, 40, 0, 4},
+		{"scale down cooldown after a scale up", 100 * time.Second, 10, 0, 4},
+		{"scale down after the cooldown", 400 * time.Second, 10, 0, 1},
+		{"scale down cooldown after a scale down", 500 * time.Second, 0, 0, 1},
+		{"no scale down beyond the latency target", 800 * time.Second, 0, 200 * time.Millisecond, 1},
+		{"scale to zero after the last message", 900 * time.Second, 0, 0, 0},
+	}
+	for _, step := range steps {
+		f.setBacklog(step.backlog)
+		if step.latency > 0 {
+			fc.latencies.Add(step.latency)
+		}
+		fc.autoscale(start.Add(step.elapsed))
+		if got := fc.instanceCount(); got != step.want {
+			t.Fatalf("%s got %d instances, want %d", step.name, got, step.want)
+		}
+		// a scale down stops the last started instances
+		if got := fc.nextURL(); step.want == 1 && got != cfg.WebhookURLs[0] {
+			t.Errorf("%s got instance %s, want %s", step.name, got, cfg.WebhookURLs[0])
+		}
+	}
+
+	// the scaled down instances are stopped after the invocation timeout
+	stopped := []string{}
+	for len(stopped) < 4 {
+		select {
+		case url := <-f.stopped:
+			stopped = append(stopped, url)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got stopped instances %v, want 4", stopped)
+		}
+	}
+	sort.Strings(stopped)
+	want := []string{"http://127.0.0.1:10001", "http://127.0.0.1:10002", "http://127.0.0.1:10003", "http://127.0.0.1:10004"}
+	if !reflect.DeepEqual(stopped, want) {
+		t.Errorf("got stopped instances %v, want %v", stopped, want)
+	}
+	doc, err := store.GetByKey(cfg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.WebhookURLs) != 0 {
+		t.Errorf("got saved instances %v, want none", doc.WebhookURLs)
+	}
+}
+
+func TestColdStart(t *testing.T) {
+	defer func(cluster string) { util.Config.WorkerCluster = cluster }(util.Config.WorkerCluster)
+	util.Config.WorkerCluster = "false"
+	f := &fakeInstances{}
+	defer f.stub()()
+	var invoked []string
+	defer stubInstances(func(ctx context.Context, url string, payload []byte, headers map[string]string) ([]byte, error) {
+		invoked = append(invoked, url)
+		return nil, nil
+	}, nil)()
+	store, err := db.NewInMemoryHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(d db.Db) { singleDb = d }(singleDb)
+	singleDb = store
+
+	cfg := testFunctionConfig()
+	cfg.WebhookURLs = nil
+	cfg.Scaling = model.ScalingPolicy{MaxParallelism: 2}
+	if _, err = store.Create(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	fc := NewFunctionConsumer(cfg)
+	// a message of a function scaled to zero starts an instance and invokes it
+	for i := 0; i < 2; i++ {
+		if err := fc.invoke(&Invocation{Message: &fakeMessage{payload: "a1"}, Consumer: &fakeConsumer{}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"http://127.0.0.1:10002", "http://127.0.0.1:10002"}
+	if !reflect.DeepEqual(invoked, want) {
+		t.Errorf("got invoked %v, want %v", invoked, want)
+	}
+	if doc, err := store.GetByKey(cfg.ID); err != nil || !reflect.DeepEqual(doc.WebhookURLs, want[:1]) {
+		t.Errorf("got saved instances %v error %v, want %v", doc.WebhookURLs, err, want[:1])
+	}
+}
@@ -0,0 +1,128 @@
+package broker
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/kafkaesque-io/pubsub-function/src/lambda"
+	"github.com/kafkaesque-io/pubsub-function/src/pulsardriver"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// receiveBatches receives messages into batches up to the max size and bytes. A batch is dispatched
+// when it is full, or when the max wait has passed since its first message.
+func (c *FunctionConsumer) receiveBatches(consumer pulsar.Consumer) {
+	policy := c.cfg.Batch
+	var next pulsar.Message
+	for {
+		first := next
+		next = nil
+		if first == nil {
+			msg, err := c.receive(c.ctx, consumer)
+			if err != nil {
+				return
+			}
+			first = msg
+		}
+
+		batch := []pulsar.Message{first}
+		size := len(first.Payload())
+		ctx, cancel := context.WithTimeout(c.ctx, policy.GetMaxWait())
+		for len(batch) < policy.MaxSize && size < policy.GetMaxBytes() {
+			msg, err := c.receive(ctx, consumer)
+			if err != nil {
+				// the max wait has passed
+				break
+			}
+			// the message starts the next batch rather than exceeding the max bytes
+			if size+len(msg.Payload()) > policy.GetMaxBytes() {
+				next = msg
+				break
+			}
+			batch = append(batch, msg)
+			size += len(msg.Payload())
+		}
+		cancel()
+
+		if err := c.dispatcher.Dispatch(c.ctx, &Invocation{Batch: batch, Consumer: consumer}); err != nil {
+			// the messages will be redelivered since they are not acknowledged
+			return
+		}
+	}
+}
+
+// invokeBatch invokes a function instance with a batch of messages,
+// each message is acknowledged or negatively acknowledged by its own result
+func (c *FunctionConsumer) invokeBatch(inv *Invocation) {
+	atomic.StoreInt64(&c.active, time.Now().UnixNano())
+	batchSize.WithLabelValues(c.cfg.ID).Observe(float64(len(inv.Batch)))
+	url := c.instanceURL(inv.Batch[0])
+	if url == "" {
+		log.Errorf("function %s has no running instance", c.cfg.ID)
+		inv.nack()
+		return
+	}
+
+	messages := make([]lambda.BatchMessage, len(inv.Batch))
+	for i, msg := range inv.Batch {
+		messages[i] = lambda.BatchMessage{
+			ID:          messageID(msg),
+			Key:         msg.Key(),
+			Topic:       msg.Topic(),
+			Properties:  msg.Properties(),
+			PublishTime: msg.PublishTime(),
+			Payload:     msg.Payload(),
+		}
+	}
+	format := c.cfg.Batch.GetFormat()
+	payload, contentType, err := lambda.EncodeBatch(messages, format)
+	if err != nil {
+		log.Errorf("function %s failed to encode batch error %v", c.cfg.ID, err)
+		inv.nack()
+		return
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.GetTimeout())
+	body, err := invokeInstance(ctx, url, payload, map[string]string{lambda.BatchHeader: format, "Content-Type": contentType})
+	cancel()
+	c.latencies.Add(time.Since(start))
+	c.trackTimeout(url, lambda.IsTimeout(err))
+	if err == nil {
+		var results map[string]lambda.BatchResult
+		if results, err = lambda.DecodeBatchResults(body); err == nil {
+			invocationLatency.WithLabelValues(c.cfg.ID, "success").Observe(time.Since(start).Seconds())
+			c.ackResults(inv, messages, results)
+			return
+		}
+		err = &lambda.InvocationError{Type: lambda.FunctionFailure, Err: err}
+	}
+	log.Errorf("function %s batch invocation error %v", c.cfg.ID, err)
+	invocationLatency.WithLabelValues(c.cfg.ID, string(lambda.FailureTypeOf(err))).Observe(time.Since(start).Seconds())
+	inv.nack()
+}
+
+// ackResults sends the output of each successful message to the output topic and acknowledges it,
+// a message without a result or with an error is negatively acknowledged
+func (c *FunctionConsumer) ackResults(inv *Invocation, messages []lambda.BatchMessage, results map[string]lambda.BatchResult) {
+	output := c.cfg.OutputTopic
+	for i, msg := range inv.Batch {
+		result, ok := results[messages[i].ID]
+		if !ok || result.Error != "" {
+			log.Errorf("function %s batch message %s failed %s", c.cfg.ID, messages[i].ID, result.Error)
+			inv.Consumer.Nack(msg)
+			continue
+		}
+		if output.TopicFullName != "" && result.Output != "" {
+			if err := pulsardriver.SendToPulsar(output.PulsarURL, output.Token, output.TopicFullName, []byte(result.Output), false); err != nil {
+				log.Errorf("function %s failed to send to output topic %s error %v", c.cfg.ID, output.TopicFullName, err)
+				inv.Consumer.Nack(msg)
+				continue
+			}
+		}
+		inv.Consumer.Ack(msg)
+	}
+}
@@ -0,0 +1,180 @@
+package broker
+
+// broker consumes function input topics and invokes the function instances
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kafkaesque-io/pubsub-function/src/cluster"
+	"github.com/kafkaesque-io/pubsub-function/src/db"
+	"github.com/kafkaesque-io/pubsub-function/src/lambda"
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+	"github.com/kafkaesque-io/pubsub-function/src/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var singleDb db.Db
+
+// functionConsumers is the registry of running function consumers, key is the function ID
+var functionConsumers = make(map[string]*FunctionConsumer)
+
+var consumersLock = &sync.Mutex{}
+
+// stopped is set by Shutdown so that no consumer is started afterwards
+var stopped bool
+
+// refreshSignal triggers an immediate reload of the function configurations
+var refreshSignal = make(chan struct{}, 1)
+
+// Init initializes database and starts the function consumers
+func Init() {
+	singleDb = db.NewDbWithPanic(util.GetConfig().PbDbType)
+
+	interval, err := time.ParseDuration(util.AssignString(util.GetConfig().PbDbInterval, "180s"))
+	if err != nil {
+		log.Errorf("invalid PbDbInterval %v, use the default 180s", err)
+		interval = 180 * time.Second
+	}
+
+	go func() {
+		// the consumers start with the urls of the instances restarted by the startup reconciliation
+		cluster.WaitReconciled()
+		for {
+			LoadConfig()
+			select {
+			case <-time.After(interval):
+			case <-refreshSignal:
+			}
+		}
+	}()
+	go runAutoscaler()
+}
+
+// Refresh triggers an immediate reload of the function configurations without blocking
+func Refresh() {
+	select {
+	case refreshSignal <- struct{}{}:
+	default:
+	}
+}
+
+// LoadConfig starts consumers of new or updated functions and stops consumers of removed functions
+func LoadConfig() {
+	fns, err := singleDb.Load()
+	if err != nil {
+		log.Errorf("broker failed to load functions error %v", err)
+		return
+	}
+
+	consumersLock.Lock()
+	defer consumersLock.Unlock()
+	if stopped {
+		return
+	}
+
+	active := make(map[string]bool)
+	workerID := util.GetWorkerID()
+	for _, fn := range fns {
+		if !consumes(fn, workerID) {
+			continue
+		}
+		active[fn.ID] = true
+		if c, ok := functionConsumers[fn.ID]; ok {
+			if c.cfg.UpdatedAt.Equal(fn.UpdatedAt) {
+				if cluster.Enabled() {
+					// instances are assigned by the cluster leader
+					c.setURLs(fn.WebhookURLs)
+					c.dispatcher.SetMaxConcurrency(fn.GetMaxConcurrency())
+				}
+				continue
+			}
+			log.Infof("function %s has been updated, restart its consumer", fn.ID)
+			c.Stop()
+		}
+		c := NewFunctionConsumer(*fn)
+		functionConsumers[fn.ID] = c
+		go c.Run()
+	}
+
+	for id, c := range functionConsumers {
+		if !active[id] {
+			log.Infof("function %s has been removed, stop its consumer", id)
+			c.Stop()
+			delete(functionConsumers, id)
+		}
+	}
+}
+
+// StopConsumer stops the consumer of a function and waits for its in-flight invocations, so that the instances
+// they invoke can be stopped afterwards. The next refresh starts the consumer again if the function is active.
+func StopConsumer(functionID string) {
+	consumersLock.Lock()
+	defer consumersLock.Unlock()
+	if c, ok := functionConsumers[functionID]; ok {
+		log.Infof("stop the consumer of function %s", functionID)
+		c.Stop()
+		delete(functionConsumers, functionID)
+	}
+}
+
+// consumes returns whether the broker of a worker consumes the input topic of a function.
+// A function scaled to zero is still consumed for cold start, the consumer of a suspended function is stopped
+// and resumes from the durable subscription. Outside of a worker cluster, a database can be shared by workers and
+// a worker only consumes its own functions, since the instances of other workers are not reachable.
+func consumes(fn *model.FunctionConfig, workerID string) bool {
+	if fn.FunctionStatus != model.Activated || !consumesInput(fn) || fn.InputTopic.TopicFullName == "" ||
+		(len(fn.WebhookURLs) == 0 && !fn.Scaling.Enabled()) {
+		return false
+	}
+	return cluster.Enabled() || fn.RunsOn(workerID)
+}
+
+// consumesInput returns whether the broker consumes the input topic of a function
+func consumesInput(fn *model.FunctionConfig) bool {
+	return fn.TriggerType == lambda.PulsarTrigger || fn.TriggerType == lambda.WindowTrigger
+}
+
+// SetInstances replaces the instances in the rotation of a function consumer without restarting it,
+// the default max concurrency follows the number of instances
+func SetInstances(cfg *model.FunctionConfig) {
+	consumersLock.Lock()
+	defer consumersLock.Unlock()
+	if c, ok := functionConsumers[cfg.ID]; ok {
+		c.setURLs(cfg.WebhookURLs)
+		c.dispatcher.SetMaxConcurrency(cfg.GetMaxConcurrency())
+	}
+}
+
+// Shutdown stops all function consumers and waits for their in-flight invocations until the context is done.
+// Messages not acknowledged by then are redelivered to other workers.
+func Shutdown(ctx context.Context) {
+	consumersLock.Lock()
+	stopped = true
+	consumers := functionConsumers
+	functionConsumers = make(map[string]*FunctionConsumer)
+	consumersLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, c := range consumers {
+			wg.Add(1)
+			go func(c *FunctionConsumer) {
+				defer wg.Done()
+				c.Stop()
+			}(c)
+		}
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Infof("stopped %d function consumers", len(consumers))
+	case <-ctx.Done():
+		log.Warnf("function consumers did not drain before the shutdown deadline")
+	}
+}
@@ -0,0 +1,190 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/kafkaesque-io/pubsub-function/src/db"
+	"github.com/kafkaesque-io/pubsub-function/src/lambda"
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+	"github.com/kafkaesque-io/pubsub-function/src/util"
+)
+
+func TestConsumes(t *testing.T) {
+	defer func(cluster string) { util.Config.WorkerCluster = cluster }(util.Config.WorkerCluster)
+
+	cases := []struct {
+		name    string
+		cluster bool
+		update  func(fn *model.FunctionConfig)
+		want    bool
+	}{
+		{"function of this worker", false, func(fn *model.FunctionConfig) {}, true},
+		{"function not started by any worker", false, func(fn *model.FunctionConfig) { fn.WorkerID = "" }, true},
+		{"function of another worker", false, func(fn *model.FunctionConfig) { fn.WorkerID = "worker-2" }, false},
+		{"function of another worker in the cluster", true, func(fn *model.FunctionConfig) { fn.WorkerID = "worker-2" }, true},
+		{"suspended function", false, func(fn *model.FunctionConfig) { fn.FunctionStatus = model.Suspended }, false},
+		{"http trigger", false, func(fn *model.FunctionConfig) { fn.TriggerType = lambda.HTTPTrigger }, false},
+		{"no input topic", false, func(fn *model.FunctionConfig) { fn.InputTopic.TopicFullName = "" }, false},
+		{"no instance", false, func(fn *model.FunctionConfig) { fn.WebhookURLs = nil }, false},
+		{"scaled to zero", false, func(fn *model.FunctionConfig) {
+			fn.WebhookURLs = nil
+			fn.Scaling = model.ScalingPolicy{MinParallelism: 0, MaxParallelism: 2}
+		}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			util.Config.WorkerCluster = "false"
+			if c.cluster {
+				util.Config.WorkerCluster = "true"
+			}
+			fn := testFunctionConfig()
+			fn.FunctionStatus = model.Activated
+			fn.TriggerType = lambda.PulsarTrigger
+			fn.WorkerID = "worker-1"
+			c.update(&fn)
+			if got := consumes(&fn, "worker-1"); got != c.want {
+				t.Errorf("got consumes %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+// startConsumers registers the consumers of functions receiving from fake consumers, as Run after subscribing
+func startConsumers(cfgs []model.FunctionConfig, consumers []*fakeConsumer) {
+	consumersLock.Lock()
+	defer consumersLock.Unlock()
+	for i, cfg := range cfgs {
+		c := NewFunctionConsumer(cfg)
+		functionConsumers[cfg.ID] = c
+		go func(consumer *fakeConsumer) {
+			defer close(c.done)
+			c.consume(consumer)
+		}(consumers[i])
+	}
+}
+
+func resetConsumers() {
+	consumersLock.Lock()
+	defer consumersLock.Unlock()
+	functionConsumers = make(map[string]*FunctionConsumer)
+	stopped = false
+}
+
+func TestShutdownDrainsInvocations(t *testing.T) {
+	defer resetConsumers()
+	var started, finished int64
+	defer stubInstances(func(ctx context.Context, url string, payload []byte, headers map[string]string) ([]byte, error) {
+		atomic.AddInt64(&started, 1)
+		defer atomic.AddInt64(&finished, 1)
+		time.Sleep(10 * time.Millisecond)
+		if strings.HasSuffix(string(payload), "0") {
+			return nil, &lambda.InvocationError{Type: lambda.FunctionFailure, Err: errors.New("status 500")}
+		}
+		return nil, nil
+	}, nil)()
+
+	const messages = 50
+	cfgs, consumers := []model.FunctionConfig{}, []*fakeConsumer{}
+	for _, name := range []string{"fn", "fn2"} {
+		cfg := testFunctionConfig()
+		cfg.Name, cfg.ID = name, model.FunctionKey("acme", name)
+		cfg.MaxConcurrency, cfg.QueueDepth = 4, 10
+		consumer := &fakeConsumer{messages: make(chan pulsar.Message, messages)}
+		for i := 0; i < messages; i++ {
+			consumer.messages <- &fakeMessage{payload: fmt.Sprintf("%s-%d", name, i)}
+		}
+		cfgs, consumers = append(cfgs, cfg), append(consumers, consumer)
+	}
+	startConsumers(cfgs, consumers)
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&started) < 8 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	Shutdown(ctx)
+	if ctx.Err() != nil {
+		t.Fatal("the consumers did not drain before the deadline")
+	}
+	// every invocation started before the shutdown has finished, and no invocation starts afterwards
+	n := atomic.LoadInt64(&started)
+	if f := atomic.LoadInt64(&finished); f != n {
+		t.Errorf("got %d finished of %d started invocations after the shutdown", f, n)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if got := atomic.LoadInt64(&started); got != n {
+		t.Errorf("got %d invocations started after the shutdown", got-n)
+	}
+	settled := 0
+	for _, consumer := range consumers {
+		for _, payload := range consumer.nacked {
+			if !strings.HasSuffix(payload, "0") {
+				t.Errorf("got %s nacked, only the failed invocations are nacked", payload)
+			}
+		}
+		settled += consumer.settled()
+	}
+	// the messages received but not invoked are neither acknowledged nor nacked, they are redelivered
+	if int64(settled) != n || n >= 2*messages {
+		t.Errorf("got %d settled messages of %d invocations, want all invocations settled before all %d messages", settled, n, 2*messages)
+	}
+	// a refresh after the shutdown does not start the consumers of the active functions again
+	store, err := db.NewInMemoryHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(d db.Db) { singleDb = d }(singleDb)
+	singleDb = store
+	for i := range cfgs {
+		cfgs[i].FunctionStatus, cfgs[i].TriggerType = model.Activated, lambda.PulsarTrigger
+		if _, err = store.Create(&cfgs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	LoadConfig()
+	consumersLock.Lock()
+	defer consumersLock.Unlock()
+	if len(functionConsumers) != 0 {
+		t.Errorf("got %d consumers started after the shutdown", len(functionConsumers))
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	defer resetConsumers()
+	release := make(chan struct{})
+	var started int64
+	defer stubInstances(func(ctx context.Context, url string, payload []byte, headers map[string]string) ([]byte, error) {
+		atomic.AddInt64(&started, 1)
+		<-release
+		return nil, nil
+	}, nil)()
+
+	consumer := &fakeConsumer{messages: make(chan pulsar.Message, 1)}
+	consumer.messages <- &fakeMessage{payload: "a1"}
+	startConsumers([]model.FunctionConfig{testFunctionConfig()}, []*fakeConsumer{consumer})
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&started) < 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// a hung invocation does not hold the shutdown past the deadline
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	Shutdown(ctx)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("got shutdown after %v, want at the deadline", elapsed)
+	}
+	if n := consumer.settled(); n != 0 {
+		t.Errorf("got %d settled messages, want the hung invocation redelivered", n)
+	}
+	close(release)
+}
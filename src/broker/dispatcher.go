@@ -0,0 +1,343 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/kafkaesque-io/pubsub-function/src/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// a failed invocation of a key is retried in place with backoff so that the later messages of the key
+// do not overtake it, the messages of the key are negatively acknowledged once the retries are exhausted
+const (
+	laneRetries      = 5
+	laneRetryBackoff = 200 * time.Millisecond
+
+	// keyBlockTimeout bounds how long a failed key waits for the redelivery of its failed message,
+	// twice the default negative acknowledgement redelivery delay of the consumer
+	keyBlockTimeout = 2 * time.Minute
+)
+
+// Invocation is a message received from the input topic waiting for function invocation
+type Invocation struct {
+	Message pulsar.Message
+	// Batch is the messages of a batch invocation, Message is nil
+	Batch    []pulsar.Message
+	Consumer pulsar.Consumer
+	queuedAt time.Time
+}
+
+// key is the message key of the invocation, a batch has no key
+func (inv *Invocation) key() string {
+	if inv.Message == nil {
+		return ""
+	}
+	return inv.Message.Key()
+}
+
+// nack negatively acknowledges the messages of an invocation for redelivery
+func (inv *Invocation) nack() {
+	if inv.Message != nil {
+		inv.Consumer.Nack(inv.Message)
+	}
+	for _, msg := range inv.Batch {
+		inv.Consumer.Nack(msg)
+	}
+}
+
+// Dispatcher queues invocations and runs them within the max concurrency.
+// The queue is bounded, Dispatch blocks when the queue is full so that the consumer stops receiving.
+type Dispatcher struct {
+	name   string
+	queue  chan *Invocation
+	sema   util.Sema
+	lock   sync.RWMutex
+	handle func(*Invocation) error
+	wg     sync.WaitGroup
+
+	// the semaphore also holds the slot waiting for the next invocation
+	inFlight int64
+
+	// keyed dispatch runs the invocations of a message key one at a time in the order received,
+	// an invocation waiting for its key is parked in the key's lane without a concurrency slot
+	keyed     bool
+	lanes     map[string][]*Invocation
+	parked    int
+	unparked  chan struct{}
+	lanesLock sync.Mutex
+
+	// a failed key is blocked until its failed message is redelivered, the later messages of the key
+	// are negatively acknowledged meanwhile so that they do not start a new lane ahead of it
+	blocked map[string]blockedKey
+
+	// the backoff of the first retry of a failed invocation of a key
+	retryBackoff time.Duration
+	blockTimeout time.Duration
+}
+
+// blockedKey is the failed message a key waits for
+type blockedKey struct {
+	id    []byte
+	until time.Time
+}
+
+// NewDispatcher creates a dispatcher, a keyed dispatcher keeps the order of the messages with the same key.
+// The handler acknowledges the messages it has processed, it returns an error without acknowledging them
+// when the invocation fails.
+func NewDispatcher(name string, maxConcurrency, queueDepth int, keyed bool, handle func(*Invocation) error) *Dispatcher {
+	return &Dispatcher{
+		name:     name,
+		queue:    make(chan *Invocation, queueDepth),
+		sema:     util.NewSema(maxConcurrency),
+		handle:   handle,
+		keyed:    keyed,
+		lanes:    make(map[string][]*Invocation),
+		unparked: make(chan struct{}, 1),
+		blocked:  make(map[string]blockedKey),
+
+		retryBackoff: laneRetryBackoff,
+		blockTimeout: keyBlockTimeout,
+	}
+}
+
+// Dispatch queues an invocation, it blocks while the queue is full until the context is done
+func (d *Dispatcher) Dispatch(ctx context.Context, inv *Invocation) error {
+	inv.queuedAt = time.Now()
+	select {
+	case d.queue <- inv:
+	default:
+		consumerPaused.WithLabelValues(d.name).Set(1)
+		select {
+		case d.queue <- inv:
+			consumerPaused.WithLabelValues(d.name).Set(0)
+		case <-ctx.Done():
+			consumerPaused.WithLabelValues(d.name).Set(0)
+			return ctx.Err()
+		}
+	}
+	queueLength.WithLabelValues(d.name).Set(float64(len(d.queue)))
+	return nil
+}
+
+// Run takes invocations off the queue whenever a concurrency slot is available until the context is done.
+// Wait must be called after Run returns, since Run adds the invocations it starts to the wait group.
+func (d *Dispatcher) Run(ctx context.Context) {
+	for {
+		// a slot is released to the semaphore it was acquired from, the max concurrency can change in between
+		d.lock.RLock()
+		sema := d.sema
+		d.lock.RUnlock()
+		if err := sema.AcquireWithContext(ctx); err != nil {
+			return
+		}
+		// the slot can be acquired after the context is done, the queued invocations are redelivered
+		if ctx.Err() != nil {
+			sema.Release()
+			return
+		}
+		select {
+		case inv := <-d.queue:
+			queueLength.WithLabelValues(d.name).Set(float64(len(d.queue)))
+			queueWait.WithLabelValues(d.name).Observe(time.Since(inv.queuedAt).Seconds())
+			key := inv.key()
+			if !d.keyed || key == "" {
+				d.wg.Add(1)
+				go func(inv *Invocation) {
+					defer d.wg.Done()
+					if err := d.invoke(inv); err != nil {
+						log.Errorf("function %s invocation error %v", d.name, err)
+						inv.nack()
+					}
+					sema.Release()
+				}(inv)
+				continue
+			}
+			if d.isBlocked(key, inv) {
+				// the failed message of the key is redelivered before this one
+				inv.nack()
+				sema.Release()
+				continue
+			}
+			if !d.startLane(key, inv) {
+				// the key is in flight, the invocation runs after the ones before it in the lane
+				sema.Release()
+				if err := d.waitParked(ctx); err != nil {
+					return
+				}
+				continue
+			}
+			d.wg.Add(1)
+			go func(inv *Invocation) {
+				defer d.wg.Done()
+				d.runLane(ctx, key, inv)
+				sema.Release()
+			}(inv)
+		case <-ctx.Done():
+			sema.Release()
+			return
+		}
+	}
+}
+
+// invoke runs an invocation and tracks the in-flight invocations
+func (d *Dispatcher) invoke(inv *Invocation) error {
+	inFlight.WithLabelValues(d.name).Set(float64(atomic.AddInt64(&d.inFlight, 1)))
+	err := d.handle(inv)
+	inFlight.WithLabelValues(d.name).Set(float64(atomic.AddInt64(&d.inFlight, -1)))
+	return err
+}
+
+// startLane starts the lane of a key, or parks the invocation in the lane if the key is in flight
+func (d *Dispatcher) startLane(key string, inv *Invocation) bool {
+	d.lanesLock.Lock()
+	defer d.lanesLock.Unlock()
+	if lane, ok := d.lanes[key]; ok {
+		d.lanes[key] = append(lane, inv)
+		d.parked++
+		return false
+	}
+	d.lanes[key] = []*Invocation{}
+	return true
+}
+
+// isBlocked returns whether a key waits for the redelivery of its failed message.
+// The key is unblocked when the failed message is received again, or after the block timeout
+// in case the failed message is sent to the dead letter topic instead.
+func (d *Dispatcher) isBlocked(key string, inv *Invocation) bool {
+	d.lanesLock.Lock()
+	defer d.lanesLock.Unlock()
+	b, ok := d.blocked[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(b.until) || bytes.Equal(b.id, inv.Message.ID().Serialize()) {
+		delete(d.blocked, key)
+		return false
+	}
+	return true
+}
+
+// runLane runs the invocations of a key one at a time until the lane is empty.
+// The instance of a key may change in between but the next invocation only starts after the previous one,
+// so that adding or removing instances does not reorder a key. The parked invocations are not acknowledged
+// once the context is done, they are redelivered. When an invocation fails after its retries, it and the
+// parked invocations of its key are negatively acknowledged, the lane stops and the key is blocked
+// until the failed message is redelivered.
+func (d *Dispatcher) runLane(ctx context.Context, key string, inv *Invocation) {
+	for inv != nil {
+		failed := d.invokeInOrder(ctx, key, inv) != nil
+
+		d.lanesLock.Lock()
+		lane := d.lanes[key]
+		if failed {
+			d.block(key, inv)
+		}
+		if len(lane) == 0 || failed || ctx.Err() != nil {
+			d.parked -= len(lane)
+			delete(d.lanes, key)
+			inv = nil
+		} else {
+			inv = lane[0]
+			d.lanes[key] = lane[1:]
+			d.parked--
+		}
+		d.lanesLock.Unlock()
+		if failed {
+			for _, parked := range lane {
+				parked.nack()
+			}
+		}
+		select {
+		case d.unparked <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// block blocks a key until its failed invocation is redelivered, the expired blocks of other keys are removed.
+// It is called with the lanes lock held.
+func (d *Dispatcher) block(key string, inv *Invocation) {
+	now := time.Now()
+	for k, b := range d.blocked {
+		if now.After(b.until) {
+			delete(d.blocked, k)
+		}
+	}
+	d.blocked[key] = blockedKey{id: inv.Message.ID().Serialize(), until: now.Add(d.blockTimeout)}
+}
+
+// invokeInOrder runs the invocation of a key, a failure is retried with backoff until the retries are
+// exhausted or the context is done, then the invocation is negatively acknowledged
+func (d *Dispatcher) invokeInOrder(ctx context.Context, key string, inv *Invocation) error {
+	backoff := d.retryBackoff
+	for retry := 0; ; retry++ {
+		err := d.invoke(inv)
+		if err == nil {
+			return nil
+		}
+		if retry == laneRetries || ctx.Err() != nil {
+			log.Errorf("function %s invocation of key %s error %v", d.name, key, err)
+			inv.nack()
+			return err
+		}
+		log.Warnf("function %s invocation of key %s error %v, retry in %v", d.name, key, err, backoff)
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			inv.nack()
+			return ctx.Err()
+		}
+	}
+}
+
+// waitParked blocks while the parked invocations are as many as the queue depth,
+// so that the consumer stops receiving when all messages wait for a few keys
+func (d *Dispatcher) waitParked(ctx context.Context) error {
+	for {
+		d.lanesLock.Lock()
+		parked := d.parked
+		d.lanesLock.Unlock()
+		queueLength.WithLabelValues(d.name).Set(float64(len(d.queue) + parked))
+		if parked < cap(d.queue) {
+			return nil
+		}
+		select {
+		case <-d.unparked:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// SetMaxConcurrency changes the max concurrency, it applies after the slot being waited for
+func (d *Dispatcher) SetMaxConcurrency(maxConcurrency int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.sema.Size != maxConcurrency {
+		d.sema = util.NewSema(maxConcurrency)
+	}
+}
+
+// QueueLength is the number of invocations waiting in the queue, including the ones parked for their keys
+func (d *Dispatcher) QueueLength() int {
+	d.lanesLock.Lock()
+	defer d.lanesLock.Unlock()
+	return len(d.queue) + d.parked
+}
+
+// InFlight is the number of in-flight invocations
+func (d *Dispatcher) InFlight() int {
+	return int(atomic.LoadInt64(&d.inFlight))
+}
+
+// Wait waits for all in-flight invocations to complete, it is called after Run has returned
+func (d *Dispatcher) Wait() {
+	d.wg.Wait()
+}
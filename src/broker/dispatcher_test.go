@@ -0,0 +1,453 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+)
+
+type fakeMessage struct {
+	pulsar.Message
+	key       string
+	payload   string
+	eventTime time.Time
+}
+
+// fakeMessageID identifies a message by its payload, a redelivered message has the same payload
+type fakeMessageID struct {
+	pulsar.MessageID
+	payload string
+}
+
+func (id fakeMessageID) Serialize() []byte {
+	return []byte(id.payload)
+}
+
+func (m *fakeMessage) ID() pulsar.MessageID {
+	return fakeMessageID{payload: m.payload}
+}
+
+func (m *fakeMessage) Key() string {
+	return m.key
+}
+
+func (m *fakeMessage) Payload() []byte {
+	return []byte(m.payload)
+}
+
+func (m *fakeMessage) EventTime() time.Time {
+	return m.eventTime
+}
+
+func (m *fakeMessage) PublishTime() time.Time {
+	return m.eventTime
+}
+
+func (m *fakeMessage) Topic() string {
+	return "persistent://acme/fn/input"
+}
+
+func (m *fakeMessage) Properties() map[string]string {
+	return nil
+}
+
+// fakeConsumer receives the messages of its channel, and records the acknowledged and the negatively
+// acknowledged payloads
+type fakeConsumer struct {
+	pulsar.Consumer
+	messages chan pulsar.Message
+	lock     sync.Mutex
+	acked    []string
+	nacked   []string
+}
+
+func (c *fakeConsumer) Receive(ctx context.Context) (pulsar.Message, error) {
+	select {
+	case msg := <-c.messages:
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *fakeConsumer) Ack(msg pulsar.Message) {
+	c.lock.Lock()
+	c.acked = append(c.acked, string(msg.Payload()))
+	c.lock.Unlock()
+}
+
+func (c *fakeConsumer) Nack(msg pulsar.Message) {
+	c.lock.Lock()
+	c.nacked = append(c.nacked, string(msg.Payload()))
+	c.lock.Unlock()
+}
+
+func (c *fakeConsumer) settled() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.acked) + len(c.nacked)
+}
+
+func TestDispatcherFailures(t *testing.T) {
+	cases := []struct {
+		name  string
+		keyed bool
+		// payloads of the messages with the key as the first letter
+		messages []string
+		// the number of times a payload fails, -1 always
+		failures map[string]int
+		// the invocations are held until the queue is empty and this many invocations are parked
+		parked      int
+		invocations map[string][]string
+		acked       []string
+		nacked      []string
+	}{
+		{"transient failure retried in order", true, []string{"a1", "a2", "a3"}, map[string]int{"a1": 2}, 2,
+			map[string][]string{"a": {"a1", "a1", "a1", "a2", "a3"}}, []string{"a1", "a2", "a3"}, nil},
+		{"exhausted retries nack the key", true, []string{"a1", "a2", "a3"}, map[string]int{"a1": -1}, 2,
+			map[string][]string{"a": {"a1", "a1", "a1", "a1", "a1", "a1"}}, nil, []string{"a1", "a2", "a3"}},
+		{"other keys continue", true, []string{"b1", "a1", "a2", "b2"}, map[string]int{"a1": -1}, 2,
+			map[string][]string{"a": {"a1", "a1", "a1", "a1", "a1", "a1"}, "b": {"b1", "b2"}}, []string{"b1", "b2"}, []string{"a1", "a2"}},
+		{"round robin nacks without retry", false, []string{"a1", "a2", "a3"}, map[string]int{"a1": -1}, 0,
+			map[string][]string{"a": {"a1", "a2", "a3"}}, []string{"a2", "a3"}, []string{"a1"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			consumer := &fakeConsumer{}
+			var lock sync.Mutex
+			invocations := map[string][]string{}
+			failures := map[string]int{}
+			for k, v := range c.failures {
+				failures[k] = v
+			}
+
+			var d *Dispatcher
+			held := make(chan struct{})
+			var hold sync.Once
+			d = NewDispatcher("test", len(c.messages), len(c.messages), c.keyed, func(inv *Invocation) error {
+				hold.Do(func() {
+					for len(d.queue) > 0 || d.QueueLength() != c.parked {
+						time.Sleep(time.Millisecond)
+					}
+					close(held)
+				})
+				<-held
+				payload := string(inv.Message.Payload())
+				lock.Lock()
+				invocations[payload[:1]] = append(invocations[payload[:1]], payload)
+				fail := failures[payload]
+				if fail > 0 {
+					failures[payload]--
+				}
+				lock.Unlock()
+				if fail != 0 {
+					return errors.New("failed")
+				}
+				inv.Consumer.Ack(inv.Message)
+				return nil
+			})
+			d.retryBackoff = time.Millisecond
+
+			ctx, cancel := context.WithCancel(context.Background())
+			for _, payload := range c.messages {
+				msg := &fakeMessage{key: payload[:1], payload: payload}
+				if err := d.Dispatch(ctx, &Invocation{Message: msg, Consumer: consumer}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			done := make(chan struct{})
+			go func() {
+				d.Run(ctx)
+				close(done)
+			}()
+			deadline := time.Now().Add(5 * time.Second)
+			for consumer.settled() < len(c.messages) && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			cancel()
+			<-done
+			d.Wait()
+
+			if !c.keyed {
+				// the invocations of different messages run concurrently
+				sort.Strings(invocations["a"])
+			}
+			sort.Strings(consumer.acked)
+			sort.Strings(consumer.nacked)
+			if !reflect.DeepEqual(invocations, c.invocations) {
+				t.Errorf("got invocations %v, want %v", invocations, c.invocations)
+			}
+			if !reflect.DeepEqual(consumer.acked, c.acked) {
+				t.Errorf("got acked %v, want %v", consumer.acked, c.acked)
+			}
+			if !reflect.DeepEqual(consumer.nacked, c.nacked) {
+				t.Errorf("got nacked %v, want %v", consumer.nacked, c.nacked)
+			}
+			if n := d.QueueLength(); n != 0 {
+				t.Errorf("got queue length %d after the invocations settled", n)
+			}
+		})
+	}
+}
+
+func TestDispatcherBlocksFailedKey(t *testing.T) {
+	consumer := &fakeConsumer{}
+	var lock sync.Mutex
+	invocations := []string{}
+	failing := true
+	// a single slot keeps the later messages of the key in the queue while the first one fails
+	d := NewDispatcher("test", 1, 4, true, func(inv *Invocation) error {
+		payload := string(inv.Message.Payload())
+		lock.Lock()
+		defer lock.Unlock()
+		invocations = append(invocations, payload)
+		if payload == "a1" && failing {
+			return errors.New("failed")
+		}
+		inv.Consumer.Ack(inv.Message)
+		return nil
+	})
+	d.retryBackoff = time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+		d.Wait()
+	}()
+	dispatch := func(payloads ...string) {
+		for _, payload := range payloads {
+			msg := &fakeMessage{key: payload[:1], payload: payload}
+			if err := d.Dispatch(ctx, &Invocation{Message: msg, Consumer: consumer}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	settle := func(n int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for consumer.settled() < n && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		consumer.lock.Lock()
+		defer consumer.lock.Unlock()
+		if len(consumer.acked)+len(consumer.nacked) != n {
+			t.Fatalf("got acked %v nacked %v, want %d settled", consumer.acked, consumer.nacked, n)
+		}
+	}
+	check := func(acked, nacked []string) {
+		consumer.lock.Lock()
+		defer consumer.lock.Unlock()
+		if !reflect.DeepEqual(consumer.acked, acked) || !reflect.DeepEqual(consumer.nacked, nacked) {
+			t.Errorf("got acked %v nacked %v, want acked %v nacked %v", consumer.acked, consumer.nacked, acked, nacked)
+		}
+	}
+
+	dispatch("a1", "a2", "b1", "a3")
+	settle(4)
+	// the later messages of the failed key are not invoked ahead of the failed one, other keys continue
+	check([]string{"b1"}, []string{"a1", "a2", "a3"})
+
+	lock.Lock()
+	failing = false
+	lock.Unlock()
+	// a message of the key redelivered before the failed one waits for it again
+	dispatch("a2")
+	settle(5)
+	check([]string{"b1"}, []string{"a1", "a2", "a3", "a2"})
+
+	dispatch("a1", "a2", "a3")
+	settle(8)
+	check([]string{"b1", "a1", "a2", "a3"}, []string{"a1", "a2", "a3", "a2"})
+
+	lock.Lock()
+	defer lock.Unlock()
+	want := []string{"a1", "a1", "a1", "a1", "a1", "a1", "b1", "a1", "a2", "a3"}
+	if !reflect.DeepEqual(invocations, want) {
+		t.Errorf("got invocations %v, want %v", invocations, want)
+	}
+}
+
+func TestDispatcherBlockTimeout(t *testing.T) {
+	consumer := &fakeConsumer{}
+	d := NewDispatcher("test", 1, 4, true, func(inv *Invocation) error {
+		if string(inv.Message.Payload()) == "a1" {
+			return errors.New("failed")
+		}
+		inv.Consumer.Ack(inv.Message)
+		return nil
+	})
+	d.retryBackoff = time.Millisecond
+	d.blockTimeout = 50 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+		d.Wait()
+	}()
+
+	// the failed message is sent to the dead letter topic and never redelivered
+	d.Dispatch(ctx, &Invocation{Message: &fakeMessage{key: "a", payload: "a1"}, Consumer: consumer})
+	deadline := time.Now().Add(5 * time.Second)
+	for consumer.settled() < 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(2 * d.blockTimeout)
+	d.Dispatch(ctx, &Invocation{Message: &fakeMessage{key: "a", payload: "a2"}, Consumer: consumer})
+	for consumer.settled() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	consumer.lock.Lock()
+	defer consumer.lock.Unlock()
+	if !reflect.DeepEqual(consumer.acked, []string{"a2"}) || !reflect.DeepEqual(consumer.nacked, []string{"a1"}) {
+		t.Errorf("got acked %v nacked %v after the block timeout, want acked [a2] nacked [a1]", consumer.acked, consumer.nacked)
+	}
+}
+
+func TestDispatcherMaxConcurrency(t *testing.T) {
+	cases := []struct {
+		name           string
+		keyed          bool
+		maxConcurrency int
+		messages       int
+	}{
+		{"round robin", false, 3, 12},
+		{"keyed", true, 3, 12},
+		{"single slot", false, 1, 4},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			consumer := &fakeConsumer{}
+			var lock sync.Mutex
+			running, peak := 0, 0
+			var d *Dispatcher
+			d = NewDispatcher("test", c.maxConcurrency, c.messages, c.keyed, func(inv *Invocation) error {
+				lock.Lock()
+				running++
+				if running > peak {
+					peak = running
+				}
+				if n := d.InFlight(); n > c.maxConcurrency {
+					t.Errorf("got %d in-flight invocations, want at most %d", n, c.maxConcurrency)
+				}
+				lock.Unlock()
+				time.Sleep(5 * time.Millisecond)
+				lock.Lock()
+				running--
+				lock.Unlock()
+				inv.Consumer.Ack(inv.Message)
+				return nil
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			for i := 0; i < c.messages; i++ {
+				// a distinct key per message so that the keyed dispatch runs them concurrently
+				msg := &fakeMessage{key: string(rune('a' + i)), payload: string(rune('a' + i))}
+				if err := d.Dispatch(ctx, &Invocation{Message: msg, Consumer: consumer}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			done := make(chan struct{})
+			go func() {
+				d.Run(ctx)
+				close(done)
+			}()
+			deadline := time.Now().Add(5 * time.Second)
+			for consumer.settled() < c.messages && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			cancel()
+			<-done
+			d.Wait()
+
+			if n := len(consumer.acked); n != c.messages {
+				t.Errorf("got %d acked, want %d", n, c.messages)
+			}
+			if peak != c.maxConcurrency {
+				t.Errorf("got %d concurrent invocations at peak, want %d", peak, c.maxConcurrency)
+			}
+		})
+	}
+}
+
+func TestDispatcherQueueFull(t *testing.T) {
+	consumer := &fakeConsumer{}
+	d := NewDispatcher("test", 1, 2, false, func(inv *Invocation) error {
+		inv.Consumer.Ack(inv.Message)
+		return nil
+	})
+	dispatch := func(ctx context.Context, payload string) error {
+		return d.Dispatch(ctx, &Invocation{Message: &fakeMessage{payload: payload}, Consumer: consumer})
+	}
+
+	// the queue holds the queue depth of invocations while the dispatcher is not running
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, payload := range []string{"a1", "a2"} {
+		if err := dispatch(ctx, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	timeout, cancelTimeout := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancelTimeout()
+	if err := dispatch(timeout, "a3"); err != context.DeadlineExceeded {
+		t.Fatalf("got error %v dispatching to a full queue, want %v", err, context.DeadlineExceeded)
+	}
+
+	// a blocked dispatch proceeds once the dispatcher takes an invocation off the queue
+	dispatched := make(chan error, 1)
+	go func() {
+		dispatched <- dispatch(ctx, "a3")
+	}()
+	select {
+	case err := <-dispatched:
+		t.Fatalf("got dispatch returned %v while the queue is full", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if n := d.QueueLength(); n != 2 {
+		t.Errorf("got queue length %d, want 2", n)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(done)
+	}()
+	select {
+	case err := <-dispatched:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dispatch is still blocked after the dispatcher started")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for consumer.settled() < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+	d.Wait()
+
+	sort.Strings(consumer.acked)
+	if want := []string{"a1", "a2", "a3"}; !reflect.DeepEqual(consumer.acked, want) {
+		t.Errorf("got acked %v, want %v", consumer.acked, want)
+	}
+}
@@ -0,0 +1,398 @@
+package broker
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/kafkaesque-io/pubsub-function/src/cluster"
+	"github.com/kafkaesque-io/pubsub-function/src/lambda"
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+	"github.com/kafkaesque-io/pubsub-function/src/pulsardriver"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// recycleTimeoutThreshold is the number of consecutive timeouts before an instance is recycled
+const recycleTimeoutThreshold = 3
+
+// maxReceiveBackoff bounds the backoff of retrying a failed receive
+const maxReceiveBackoff = 10 * time.Second
+
+// invokeInstance and recycleInstance invoke and replace the function instances
+var (
+	invokeInstance  = lambda.Invoke
+	recycleInstance = lambda.RecycleInstance
+)
+
+// FunctionConsumer consumes the input topic of a function and invokes its instances
+type FunctionConsumer struct {
+	cfg        model.FunctionConfig
+	key        string
+	dispatcher *Dispatcher
+	ctx        context.Context
+	cancel     context.CancelFunc
+	done       chan struct{}
+	next       uint64
+
+	// instance urls are replaced when an instance is recycled
+	urls      []string
+	timeouts  map[string]int
+	recycling map[string]bool
+	urlsLock  sync.RWMutex
+
+	// the hash ring of the key ordered dispatch is rebuilt when the instances change
+	ring     *hashRing
+	ringURLs []string
+
+	// autoscaling state
+	latencies     latencyWindow
+	active        int64
+	lastScaleUp   time.Time
+	lastScaleDown time.Time
+	scaleLock     sync.Mutex
+}
+
+// NewFunctionConsumer creates a function consumer
+func NewFunctionConsumer(cfg model.FunctionConfig) *FunctionConsumer {
+	ctx, cancel := context.WithCancel(context.Background())
+	now := time.Now()
+	c := &FunctionConsumer{
+		cfg:       cfg,
+		key:       cfg.ID + cfg.InputTopic.TopicFullName + subscriptionName(&cfg),
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		urls:      append([]string{}, cfg.WebhookURLs...),
+		timeouts:  make(map[string]int),
+		recycling: make(map[string]bool),
+		active:    now.UnixNano(),
+		// the instances started at deployment are kept for a scale down cooldown
+		lastScaleDown: now,
+	}
+	queueDepth := cfg.GetQueueDepth()
+	if cfg.Batch.Enabled() {
+		// the queue depth counts messages, a queued batch holds up to the max size of messages
+		queueDepth = (queueDepth + cfg.Batch.MaxSize - 1) / cfg.Batch.MaxSize
+	}
+	c.dispatcher = NewDispatcher(cfg.ID, cfg.GetMaxConcurrency(), queueDepth, cfg.KeyOrdered(), c.invoke)
+	instances.WithLabelValues(cfg.ID).Set(float64(len(cfg.WebhookURLs)))
+	return c
+}
+
+// subscriptionName is the durable subscription of the function, default to tenant-function
+func subscriptionName(cfg *model.FunctionConfig) string {
+	return cfg.GetSubscription()
+}
+
+// consumerConfig bounds the client prefetch queue by the invocation queue depth,
+// routes messages failed after the max redeliveries to the dead letter topic, and sets the Key_Shared policy
+func (c *FunctionConsumer) consumerConfig() pulsardriver.ConsumerConfig {
+	cfg := pulsardriver.ConsumerConfig{ReceiverQueueSize: c.cfg.GetQueueDepth()}
+	// the policy has been validated with the function config
+	cfg.KeyShared, _ = c.cfg.InputTopic.GetKeySharedPolicy()
+	if c.cfg.MaxRedeliveries > 0 {
+		cfg.DLQ = &pulsar.DLQPolicy{
+			MaxDeliveries:   uint32(c.cfg.MaxRedeliveries),
+			DeadLetterTopic: c.cfg.GetDeadLetterTopic(subscriptionName(&c.cfg)),
+		}
+	}
+	return cfg
+}
+
+// Run subscribes to the input topic and dispatches messages until the consumer is stopped
+func (c *FunctionConsumer) Run() {
+	defer close(c.done)
+
+	input := c.cfg.InputTopic
+	var consumer pulsar.Consumer
+	for {
+		var err error
+		consumer, err = pulsardriver.GetPulsarConsumerWithConfig(input.PulsarURL, input.Token, input.TopicFullName,
+			subscriptionName(&c.cfg), input.InitialPosition, input.SubscriptionType, c.key, c.consumerConfig())
+		if err == nil {
+			break
+		}
+		log.Errorf("function %s failed to subscribe %s error %v", c.cfg.ID, input.TopicFullName, err)
+		select {
+		case <-time.After(10 * time.Second):
+		case <-c.ctx.Done():
+			return
+		}
+	}
+	c.consume(consumer)
+}
+
+// consume dispatches the messages of the subscription until the consumer is stopped
+func (c *FunctionConsumer) consume(consumer pulsar.Consumer) {
+	if c.cfg.TriggerType == lambda.WindowTrigger {
+		c.runWindows(consumer)
+		return
+	}
+	// the consumer is done only after the dispatcher stops starting invocations, so that Stop can wait for them
+	dispatched := make(chan struct{})
+	go func() {
+		defer close(dispatched)
+		c.dispatcher.Run(c.ctx)
+	}()
+	defer func() { <-dispatched }()
+	if c.cfg.Batch.Enabled() {
+		c.receiveBatches(consumer)
+		return
+	}
+	for {
+		msg, err := c.receive(c.ctx, consumer)
+		if err != nil {
+			return
+		}
+		if err = c.dispatcher.Dispatch(c.ctx, &Invocation{Message: msg, Consumer: consumer}); err != nil {
+			// the message will be redelivered since it is not acknowledged
+			return
+		}
+	}
+}
+
+// receive receives the next message, a receive error is retried with backoff until the context is done
+func (c *FunctionConsumer) receive(ctx context.Context, consumer pulsar.Consumer) (pulsar.Message, error) {
+	backoff := 100 * time.Millisecond
+	for {
+		msg, err := consumer.Receive(ctx)
+		if err == nil {
+			return msg, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		log.Errorf("function %s consumer receive error %v, retry in %v", c.cfg.ID, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if backoff *= 2; backoff > maxReceiveBackoff {
+			backoff = maxReceiveBackoff
+		}
+	}
+}
+
+// Stop stops receiving messages, waits for in-flight invocations, and closes the consumer.
+// The queued messages are not acknowledged so that they are redelivered.
+func (c *FunctionConsumer) Stop() {
+	c.cancel()
+	<-c.done
+	c.dispatcher.Wait()
+	pulsardriver.CancelPulsarConsumer(c.key)
+}
+
+// setURLs replaces the instances in the rotation
+func (c *FunctionConsumer) setURLs(urls []string) {
+	c.urlsLock.Lock()
+	c.urls = append([]string{}, urls...)
+	c.urlsLock.Unlock()
+	instances.WithLabelValues(c.cfg.ID).Set(float64(len(urls)))
+}
+
+// instanceCount is the number of instances in the rotation
+func (c *FunctionConsumer) instanceCount() int {
+	c.urlsLock.RLock()
+	defer c.urlsLock.RUnlock()
+	return len(c.urls)
+}
+
+// lastActive is the time of the last invocation
+func (c *FunctionConsumer) lastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.active))
+}
+
+// nextURL picks a function instance in round robin
+func (c *FunctionConsumer) nextURL() string {
+	c.urlsLock.RLock()
+	defer c.urlsLock.RUnlock()
+	if len(c.urls) == 0 {
+		return ""
+	}
+	return c.urls[atomic.AddUint64(&c.next, 1)%uint64(len(c.urls))]
+}
+
+// keyURL picks the function instance of a message key by consistent hashing
+func (c *FunctionConsumer) keyURL(key string) string {
+	c.urlsLock.Lock()
+	defer c.urlsLock.Unlock()
+	if c.ring == nil || !sameURLs(c.ringURLs, c.urls) {
+		c.ringURLs = append([]string{}, c.urls...)
+		c.ring = newHashRing(c.ringURLs)
+	}
+	return c.ring.get(key)
+}
+
+// pickURL picks the instance by the message key for the key ordered dispatch, otherwise in round robin
+func (c *FunctionConsumer) pickURL(msg pulsar.Message) string {
+	if c.cfg.KeyOrdered() && msg.Key() != "" {
+		return c.keyURL(msg.Key())
+	}
+	return c.nextURL()
+}
+
+// instanceURL picks the instance of a message, a scaled to zero function is cold started
+func (c *FunctionConsumer) instanceURL(msg pulsar.Message) string {
+	url := c.pickURL(msg)
+	if url == "" && c.cfg.Scaling.Enabled() {
+		c.coldStart()
+		url = c.pickURL(msg)
+	}
+	return url
+}
+
+func sameURLs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// invoke invokes a function instance with the message and sends the result to the output topic.
+// A failed invocation returns an error without acknowledging the message, the dispatcher retries it or
+// negatively acknowledges it for redelivery until the max redeliveries is reached.
+func (c *FunctionConsumer) invoke(inv *Invocation) error {
+	if inv.Batch != nil {
+		// each message of a batch is acknowledged by its result
+		c.invokeBatch(inv)
+		return nil
+	}
+	msg := inv.Message
+	atomic.StoreInt64(&c.active, time.Now().UnixNano())
+	url := c.instanceURL(msg)
+	if url == "" {
+		return fmt.Errorf("no running instance")
+	}
+
+	// an in-flight invocation is not cancelled by Stop, it is bounded by the function timeout
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.GetTimeout())
+	body, err := invokeInstance(ctx, url, msg.Payload(), messageHeaders(msg))
+	cancel()
+	c.latencies.Add(time.Since(start))
+	c.trackTimeout(url, lambda.IsTimeout(err))
+	if err != nil {
+		invocationLatency.WithLabelValues(c.cfg.ID, string(lambda.FailureTypeOf(err))).Observe(time.Since(start).Seconds())
+		return err
+	}
+	invocationLatency.WithLabelValues(c.cfg.ID, "success").Observe(time.Since(start).Seconds())
+
+	output := c.cfg.OutputTopic
+	if output.TopicFullName != "" && len(body) > 0 {
+		if err = pulsardriver.SendToPulsar(output.PulsarURL, output.Token, output.TopicFullName, body, false); err != nil {
+			return fmt.Errorf("failed to send to output topic %s error %v", output.TopicFullName, err)
+		}
+	}
+	inv.Consumer.Ack(msg)
+	return nil
+}
+
+// messageHeaders passes the message metadata to the function as http headers
+func messageHeaders(msg pulsar.Message) map[string]string {
+	headers := map[string]string{
+		lambda.MessageIDHeader: messageID(msg),
+		lambda.TopicHeader:     msg.Topic(),
+	}
+	if msg.Key() != "" {
+		headers[lambda.MessageKeyHeader] = msg.Key()
+	}
+	for k, v := range msg.Properties() {
+		headers[lambda.PropertyHeaderPrefix+k] = v
+	}
+	return headers
+}
+
+// messageID is the base64 encoded message id
+func messageID(msg pulsar.Message) string {
+	return base64.StdEncoding.EncodeToString(msg.ID().Serialize())
+}
+
+// trackTimeout counts consecutive timeouts of an instance and recycles the instance at the threshold
+func (c *FunctionConsumer) trackTimeout(url string, timeout bool) {
+	c.urlsLock.Lock()
+	if !timeout {
+		delete(c.timeouts, url)
+		c.urlsLock.Unlock()
+		return
+	}
+	c.timeouts[url]++
+	recycle := c.timeouts[url] >= recycleTimeoutThreshold && !c.recycling[url]
+	if recycle {
+		c.recycling[url] = true
+	}
+	c.urlsLock.Unlock()
+
+	if recycle {
+		go c.recycle(url)
+	}
+}
+
+// recycle replaces a hung instance and updates the function's webhook urls
+func (c *FunctionConsumer) recycle(url string) {
+	log.Warnf("function %s instance %s timed out %d times, recycle the instance", c.cfg.ID, url, recycleTimeoutThreshold)
+	if cluster.Enabled() {
+		c.stopHungInstance(url)
+		return
+	}
+	newURL, err := recycleInstance(c.cfg, url)
+	if err != nil {
+		log.Errorf("function %s failed to recycle instance %s error %v", c.cfg.ID, url, err)
+	}
+
+	c.urlsLock.Lock()
+	urls := []string{}
+	for _, v := range c.urls {
+		if v != url {
+			urls = append(urls, v)
+		}
+	}
+	if newURL != "" {
+		urls = append(urls, newURL)
+	}
+	c.urls = urls
+	delete(c.timeouts, url)
+	delete(c.recycling, url)
+	c.urlsLock.Unlock()
+	instances.WithLabelValues(c.cfg.ID).Set(float64(len(urls)))
+	c.saveURLs(urls)
+}
+
+// stopHungInstance stops a hung instance on this worker, the cluster worker replaces it with a new instance
+func (c *FunctionConsumer) stopHungInstance(url string) {
+	if lambda.IsRunning(url) {
+		if err := lambda.StopInstance(url); err != nil {
+			log.Errorf("function %s failed to stop instance %s error %v", c.cfg.ID, url, err)
+		}
+	} else {
+		log.Warnf("function %s hung instance %s runs on another worker", c.cfg.ID, url)
+	}
+	c.urlsLock.Lock()
+	delete(c.timeouts, url)
+	delete(c.recycling, url)
+	c.urlsLock.Unlock()
+}
+
+// saveURLs updates the function's webhook urls in the database
+// the function config keeps the same UpdatedAt so that the consumer is not restarted
+func (c *FunctionConsumer) saveURLs(urls []string) {
+	doc, err := singleDb.GetByKey(c.cfg.ID)
+	if err != nil {
+		log.Errorf("function %s failed to load config error %v", c.cfg.ID, err)
+		return
+	}
+	doc.WebhookURLs = urls
+	if _, err = singleDb.Update(doc); err != nil {
+		log.Errorf("function %s failed to update webhook urls error %v", c.cfg.ID, err)
+	}
+}
@@ -0,0 +1,241 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kafkaesque-io/pubsub-function/src/db"
+	"github.com/kafkaesque-io/pubsub-function/src/lambda"
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+)
+
+// stubInstances replaces the instance invocation and recycling, it returns a function to restore them
+func stubInstances(invoke func(context.Context, string, []byte, map[string]string) ([]byte, error),
+	recycle func(model.FunctionConfig, string) (string, error)) func() {
+	invoker, recycler := invokeInstance, recycleInstance
+	invokeInstance, recycleInstance = invoke, recycle
+	return func() { invokeInstance, recycleInstance = invoker, recycler }
+}
+
+func testFunctionConfig() model.FunctionConfig {
+	return model.FunctionConfig{
+		Name:        "fn",
+		Tenant:      "acme",
+		ID:          model.FunctionKey("acme", "fn"),
+		Parallelism: 1,
+		InputTopic:  model.FunctionTopic{TopicFullName: "persistent://acme/fn/input"},
+		WebhookURLs: []string{"http://127.0.0.1:10001"},
+	}
+}
+
+func TestInvocationTimeout(t *testing.T) {
+	cases := []struct {
+		name    string
+		timeout int
+		want    time.Duration
+	}{
+		{"default", 0, model.DefaultTimeout * time.Second},
+		{"function timeout", 5, 5 * time.Second},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var got time.Duration
+			defer stubInstances(func(ctx context.Context, url string, payload []byte, headers map[string]string) ([]byte, error) {
+				deadline, ok := ctx.Deadline()
+				if !ok {
+					t.Fatal("got an invocation without deadline")
+				}
+				got = time.Until(deadline)
+				return nil, nil
+			}, nil)()
+
+			cfg := testFunctionConfig()
+			cfg.Timeout = c.timeout
+			consumer := &fakeConsumer{}
+			if err := NewFunctionConsumer(cfg).invoke(&Invocation{Message: &fakeMessage{payload: "a1"}, Consumer: consumer}); err != nil {
+				t.Fatal(err)
+			}
+			if got > c.want || got < c.want-time.Second {
+				t.Errorf("got invocation timeout %v, want %v", got, c.want)
+			}
+			if !reflect.DeepEqual(consumer.acked, []string{"a1"}) {
+				t.Errorf("got acked %v, want [a1]", consumer.acked)
+			}
+		})
+	}
+}
+
+func TestInvocationFailures(t *testing.T) {
+	cases := []struct {
+		name    string
+		err     error
+		failure lambda.FailureType
+	}{
+		{"timeout", &lambda.InvocationError{Type: lambda.TimeoutFailure, Err: context.DeadlineExceeded}, lambda.TimeoutFailure},
+		{"function error", &lambda.InvocationError{Type: lambda.FunctionFailure, Err: errors.New("status 500")}, lambda.FunctionFailure},
+		{"connection refused", &lambda.InvocationError{Type: lambda.ConnectionFailure, Err: errors.New("connection refused")}, lambda.ConnectionFailure},
+		{"unclassified", errors.New("broken pipe"), lambda.ConnectionFailure},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			defer stubInstances(func(ctx context.Context, url string, payload []byte, headers map[string]string) ([]byte, error) {
+				return nil, c.err
+			}, func(cfg model.FunctionConfig, url string) (string, error) {
+				return url, nil
+			})()
+
+			cfg := testFunctionConfig()
+			cfg.MaxRedeliveries = 3
+			fc := NewFunctionConsumer(cfg)
+			consumer := &fakeConsumer{}
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				fc.dispatcher.Run(ctx)
+				close(done)
+			}()
+			if err := fc.dispatcher.Dispatch(ctx, &Invocation{Message: &fakeMessage{payload: "a1"}, Consumer: consumer}); err != nil {
+				t.Fatal(err)
+			}
+			deadline := time.Now().Add(5 * time.Second)
+			for consumer.settled() < 1 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			cancel()
+			<-done
+			fc.dispatcher.Wait()
+
+			if got := lambda.FailureTypeOf(c.err); got != c.failure {
+				t.Errorf("got failure type %q, want %q", got, c.failure)
+			}
+			// a failed invocation is negatively acknowledged for the redelivery until the dead letter policy applies
+			if len(consumer.acked) != 0 || !reflect.DeepEqual(consumer.nacked, []string{"a1"}) {
+				t.Errorf("got acked %v nacked %v, want nacked [a1]", consumer.acked, consumer.nacked)
+			}
+		})
+	}
+}
+
+func TestDeadLetterPolicy(t *testing.T) {
+	cases := []struct {
+		name            string
+		maxRedeliveries int
+		deadLetterTopic string
+		subscription    string
+		wantTopic       string
+	}{
+		{"no redelivery limit", 0, "", "", ""},
+		{"default topic", 3, "", "", "persistent://acme/fn/input-acme-fn-DLQ"},
+		{"default topic of the subscription", 3, "", "sub", "persistent://acme/fn/input-sub-DLQ"},
+		{"dead letter topic", 5, "persistent://acme/fn/failed", "", "persistent://acme/fn/failed"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := testFunctionConfig()
+			cfg.MaxRedeliveries = c.maxRedeliveries
+			cfg.DeadLetterTopic = c.deadLetterTopic
+			cfg.InputTopic.Subscription = c.subscription
+			dlq := NewFunctionConsumer(cfg).consumerConfig().DLQ
+			if c.wantTopic == "" {
+				if dlq != nil {
+					t.Errorf("got dead letter policy %+v, want none", dlq)
+				}
+				return
+			}
+			if dlq == nil {
+				t.Fatal("got no dead letter policy")
+			}
+			if dlq.MaxDeliveries != uint32(c.maxRedeliveries) || dlq.DeadLetterTopic != c.wantTopic {
+				t.Errorf("got max deliveries %d topic %s, want %d %s", dlq.MaxDeliveries, dlq.DeadLetterTopic, c.maxRedeliveries, c.wantTopic)
+			}
+		})
+	}
+}
+
+func TestRecycleAfterTimeouts(t *testing.T) {
+	timeout := &lambda.InvocationError{Type: lambda.TimeoutFailure, Err: context.DeadlineExceeded}
+	failure := &lambda.InvocationError{Type: lambda.FunctionFailure, Err: errors.New("status 500")}
+	cases := []struct {
+		name     string
+		results  []error
+		recycled bool
+	}{
+		{"consecutive timeouts", []error{timeout, timeout, timeout}, true},
+		{"success resets the timeouts", []error{timeout, timeout, nil, timeout, timeout}, false},
+		{"other failures reset the timeouts", []error{timeout, timeout, failure, timeout, timeout}, false},
+		{"fewer timeouts", []error{timeout, timeout}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			store, err := db.NewInMemoryHandler()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func(d db.Db) { singleDb = d }(singleDb)
+			singleDb = store
+
+			cfg := testFunctionConfig()
+			oldURL, newURL := cfg.WebhookURLs[0], "http://127.0.0.1:10002"
+			if _, err = store.Create(&cfg); err != nil {
+				t.Fatal(err)
+			}
+			var lock sync.Mutex
+			results := append([]error{}, c.results...)
+			recycled := make(chan string, 1)
+			defer stubInstances(func(ctx context.Context, url string, payload []byte, headers map[string]string) ([]byte, error) {
+				lock.Lock()
+				defer lock.Unlock()
+				err := results[0]
+				results = results[1:]
+				return nil, err
+			}, func(cfg model.FunctionConfig, url string) (string, error) {
+				recycled <- url
+				return newURL, nil
+			})()
+
+			fc := NewFunctionConsumer(cfg)
+			for range c.results {
+				fc.invoke(&Invocation{Message: &fakeMessage{payload: "a1"}, Consumer: &fakeConsumer{}})
+			}
+			if !c.recycled {
+				select {
+				case url := <-recycled:
+					t.Fatalf("got instance %s recycled", url)
+				case <-time.After(20 * time.Millisecond):
+				}
+				if got := fc.nextURL(); got != oldURL {
+					t.Errorf("got instance %s, want %s", got, oldURL)
+				}
+				return
+			}
+
+			select {
+			case url := <-recycled:
+				if url != oldURL {
+					t.Errorf("got instance %s recycled, want %s", url, oldURL)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the instance is not recycled")
+			}
+			// the new instance replaces the hung one in the rotation and in the function config
+			deadline := time.Now().Add(5 * time.Second)
+			for fc.nextURL() != newURL && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if got := fc.nextURL(); got != newURL {
+				t.Errorf("got instance %s after recycling, want %s", got, newURL)
+			}
+			for time.Now().Before(deadline) {
+				if doc, err := store.GetByKey(cfg.ID); err == nil && reflect.DeepEqual(doc.WebhookURLs, []string{newURL}) {
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+			t.Error("the function config is not updated with the new instance")
+		})
+	}
+}
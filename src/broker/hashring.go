@@ -0,0 +1,60 @@
+package broker
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// ringReplicas is the number of points of an instance on the hash ring, more points spread the keys evenly
+const ringReplicas = 64
+
+// hashRing maps message keys to function instances by consistent hashing.
+// Adding or removing an instance only moves the keys of the ring positions it takes over or gives up.
+type hashRing struct {
+	points []uint32
+	urls   map[uint32]string
+}
+
+// newHashRing builds the hash ring of the instances
+func newHashRing(urls []string) *hashRing {
+	r := &hashRing{urls: make(map[uint32]string, len(urls)*ringReplicas)}
+	for _, url := range urls {
+		for i := 0; i < ringReplicas; i++ {
+			point := hashKey(url + "#" + strconv.Itoa(i))
+			if _, ok := r.urls[point]; ok {
+				continue
+			}
+			r.urls[point] = url
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// get returns the instance of a key, the first instance clockwise from the key on the ring
+func (r *hashRing) get(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.urls[r.points[i]]
+}
+
+// hashKey hashes a key with fnv-1a and the murmur3 finalizer, which spreads similar keys across the ring
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
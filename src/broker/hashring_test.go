@@ -0,0 +1,63 @@
+package broker
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHashRing(t *testing.T) {
+	urls := []string{"http://a:3000", "http://b:3001", "http://c:3002"}
+	keys := make([]string, 3000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	before := newHashRing(urls)
+
+	cases := []struct {
+		name  string
+		urls  []string
+		added map[string]bool
+	}{
+		{"same instances", urls, map[string]bool{}},
+		{"same instances reordered", []string{urls[2], urls[0], urls[1]}, map[string]bool{}},
+		{"instance added", append(append([]string{}, urls...), "http://d:3003"), map[string]bool{"http://d:3003": true}},
+		{"instance removed", urls[:2], map[string]bool{}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			after := newHashRing(c.urls)
+			alive := map[string]bool{}
+			for _, url := range c.urls {
+				alive[url] = true
+			}
+			for _, key := range keys {
+				from, to := before.get(key), after.get(key)
+				if from == to {
+					continue
+				}
+				// a key only moves off a removed instance or onto an added one
+				if !alive[to] || (alive[from] && !c.added[to]) {
+					t.Fatalf("key %s moved from %s to %s", key, from, to)
+				}
+			}
+		})
+	}
+}
+
+func TestHashRingSpread(t *testing.T) {
+	urls := []string{"http://a:3000", "http://b:3001", "http://c:3002", "http://d:3003"}
+	ring := newHashRing(urls)
+	counts := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		counts[ring.get(fmt.Sprintf("key-%d", i))]++
+	}
+	for _, url := range urls {
+		// an even spread is 2500 keys per instance
+		if counts[url] < 1250 || counts[url] > 3750 {
+			t.Errorf("instance %s has %d of 10000 keys", url, counts[url])
+		}
+	}
+	if got := newHashRing(nil).get("key"); got != "" {
+		t.Errorf("got instance %q from an empty ring", got)
+	}
+}
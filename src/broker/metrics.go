@@ -0,0 +1,70 @@
+package broker
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// function invocation metrics, labelled by the function ID
+var (
+	queueLength = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "pubsub_function",
+		Name:      "queue_length",
+		Help:      "Number of messages waiting for function invocation",
+	}, []string{"function"})
+
+	queueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "pubsub_function",
+		Name:      "queue_wait_seconds",
+		Help:      "Time a message waits in the queue before function invocation",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"function"})
+
+	inFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "pubsub_function",
+		Name:      "inflight_invocations",
+		Help:      "Number of concurrent function invocations",
+	}, []string{"function"})
+
+	consumerPaused = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "pubsub_function",
+		Name:      "consumer_paused",
+		Help:      "1 if the consumer stops receiving because the invocation queue is full",
+	}, []string{"function"})
+
+	instances = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "pubsub_function",
+		Name:      "instances",
+		Help:      "Number of function instances in the invocation rotation",
+	}, []string{"function"})
+
+	invocationLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "pubsub_function",
+		Name:      "invocation_seconds",
+		Help:      "Function invocation latency",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"function", "result"})
+
+	batchSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "pubsub_function",
+		Name:      "batch_size",
+		Help:      "Number of messages of a batch invocation",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 11),
+	}, []string{"function"})
+
+	windowSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "pubsub_function",
+		Name:      "window_size",
+		Help:      "Number of messages of a window invocation",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+	}, []string{"function"})
+
+	lateMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pubsub_function",
+		Name:      "late_messages_total",
+		Help:      "Number of messages dropped for arriving after their windows closed",
+	}, []string{"function"})
+)
+
+func init() {
+	prometheus.MustRegister(queueLength, queueWait, inFlight, consumerPaused, instances, invocationLatency, batchSize, windowSize, lateMessages)
+}
@@ -0,0 +1,142 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/kafkaesque-io/pubsub-function/src/lambda"
+	"github.com/kafkaesque-io/pubsub-function/src/pulsardriver"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// windowTick is the interval to close the event time windows passed by the watermark
+const windowTick = 100 * time.Millisecond
+
+// maxWindowRetryBackoff bounds the backoff of retrying a failed window invocation
+const maxWindowRetryBackoff = 30 * time.Second
+
+// runWindows assigns the received messages to windows and invokes the function once per closed window.
+// Windows are invoked one at a time in order, the consumer stops receiving while a window is retried.
+func (c *FunctionConsumer) runWindows(consumer pulsar.Consumer) {
+	w := newWindower(c.cfg.Window)
+	messages := make(chan pulsar.Message)
+	go func() {
+		for {
+			msg, err := c.receive(c.ctx, consumer)
+			if err != nil {
+				return
+			}
+			select {
+			case messages <- msg:
+			case <-c.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(windowTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			// the messages of the open windows are not acknowledged so that they are redelivered
+			return
+		case msg := <-messages:
+			if !w.add(msg, time.Now()) {
+				log.Warnf("function %s drops message %s later than the allowed lateness", c.cfg.ID, messageID(msg))
+				lateMessages.WithLabelValues(c.cfg.ID).Inc()
+				consumer.Ack(msg)
+			}
+		case <-ticker.C:
+		}
+		for _, win := range w.closed(time.Now()) {
+			if !c.invokeWindow(win) {
+				return
+			}
+			for _, msg := range win.release() {
+				consumer.Ack(msg)
+			}
+		}
+	}
+}
+
+// invokeWindow invokes the function with the messages of a window and sends the result to the output topic.
+// A failed window is retried with backoff until it succeeds, it returns false if the consumer is stopped.
+func (c *FunctionConsumer) invokeWindow(win *window) bool {
+	windowSize.WithLabelValues(c.cfg.ID).Observe(float64(len(win.messages)))
+	messages := make([]lambda.BatchMessage, len(win.messages))
+	for i, m := range win.messages {
+		messages[i] = lambda.BatchMessage{
+			ID:          messageID(m.msg),
+			Key:         m.msg.Key(),
+			Topic:       m.msg.Topic(),
+			Properties:  m.msg.Properties(),
+			PublishTime: m.msg.PublishTime(),
+			Payload:     m.msg.Payload(),
+		}
+	}
+	format := c.cfg.Window.GetFormat()
+	payload, contentType, err := lambda.EncodeBatch(messages, format)
+	if err != nil {
+		// the messages are redelivered after the consumer restarts
+		log.Errorf("function %s failed to encode window error %v", c.cfg.ID, err)
+		return false
+	}
+	headers := map[string]string{
+		lambda.BatchHeader:       format,
+		"Content-Type":           contentType,
+		lambda.WindowStartHeader: win.start.Format(time.RFC3339Nano),
+		lambda.WindowEndHeader:   win.end.Format(time.RFC3339Nano),
+	}
+
+	backoff := time.Second
+	for {
+		err = c.invokeWindowOnce(win, payload, headers)
+		if err == nil {
+			return true
+		}
+		log.Errorf("function %s window %s to %s failed, retry in %v error %v",
+			c.cfg.ID, headers[lambda.WindowStartHeader], headers[lambda.WindowEndHeader], backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-c.ctx.Done():
+			return false
+		}
+		if backoff *= 2; backoff > maxWindowRetryBackoff {
+			backoff = maxWindowRetryBackoff
+		}
+	}
+}
+
+// invokeWindowOnce invokes a function instance with a window and produces the result to the output topic
+func (c *FunctionConsumer) invokeWindowOnce(win *window, payload []byte, headers map[string]string) error {
+	atomic.StoreInt64(&c.active, time.Now().UnixNano())
+	url := c.instanceURL(win.messages[0].msg)
+	if url == "" {
+		return fmt.Errorf("no running instance")
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.GetTimeout())
+	body, err := invokeInstance(ctx, url, payload, headers)
+	cancel()
+	c.latencies.Add(time.Since(start))
+	c.trackTimeout(url, lambda.IsTimeout(err))
+	if err != nil {
+		invocationLatency.WithLabelValues(c.cfg.ID, string(lambda.FailureTypeOf(err))).Observe(time.Since(start).Seconds())
+		return err
+	}
+	invocationLatency.WithLabelValues(c.cfg.ID, "success").Observe(time.Since(start).Seconds())
+
+	output := c.cfg.OutputTopic
+	if len(body) > 0 {
+		if err = pulsardriver.SendToPulsar(output.PulsarURL, output.Token, output.TopicFullName, body, false); err != nil {
+			return fmt.Errorf("failed to send to output topic %s error %v", output.TopicFullName, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package broker
+
+import (
+	"sort"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+)
+
+// windowIdleTimeout is how long the input is without a message before event time advances with the wall clock,
+// so that the last windows of an idle topic close
+const windowIdleTimeout = time.Second
+
+// windowMessage is a message held by the open windows, it is acknowledged once no window holds it
+type windowMessage struct {
+	msg       pulsar.Message
+	eventTime time.Time
+	refs      int
+}
+
+// window is the messages from start to end, the end is exclusive for event time windows.
+// The start and end of a count window are the event times of its first and last messages.
+type window struct {
+	start    time.Time
+	end      time.Time
+	messages []*windowMessage
+}
+
+// windower assigns messages to windows and closes the windows by count or by the event time watermark.
+// It is not thread safe, the window consumer owns it.
+type windower struct {
+	policy model.WindowPolicy
+
+	// open event time windows sorted by end
+	windows []*window
+
+	// messages of the current count window, a sliding count window keeps the messages of the next window
+	buffer   []*windowMessage
+	arrivals int
+
+	// the watermark is the max event time, it advances with the wall clock while the input is idle
+	watermark    time.Time
+	lastReceived time.Time
+}
+
+func newWindower(policy model.WindowPolicy) *windower {
+	return &windower{policy: policy}
+}
+
+// eventTime is the event time of a message, or the publish time if the producer did not set it
+func eventTime(msg pulsar.Message) time.Time {
+	if t := msg.EventTime(); !t.IsZero() {
+		return t
+	}
+	return msg.PublishTime()
+}
+
+// currentWatermark returns the watermark at the wall clock time
+func (w *windower) currentWatermark(now time.Time) time.Time {
+	if w.watermark.IsZero() {
+		return w.watermark
+	}
+	if idle := now.Sub(w.lastReceived); idle > windowIdleTimeout {
+		return w.watermark.Add(idle)
+	}
+	return w.watermark
+}
+
+// add assigns a message to its windows, it returns false if the message is too late for any open window
+func (w *windower) add(msg pulsar.Message, now time.Time) bool {
+	m := &windowMessage{msg: msg, eventTime: eventTime(msg)}
+	if w.policy.ByCount() {
+		// the buffer holds a reference until the message leaves the last window it can be in
+		m.refs = 1
+		w.buffer = append(w.buffer, m)
+		w.arrivals++
+		return true
+	}
+
+	watermark := w.currentWatermark(now)
+	w.lastReceived = now
+	if m.eventTime.After(watermark) {
+		w.watermark = m.eventTime
+	} else {
+		w.watermark = watermark
+	}
+
+	if w.policy.GetType() == model.SessionWindow {
+		return w.addToSession(m, watermark)
+	}
+	size, slide := w.policy.GetSize(), w.policy.GetSize()
+	if w.policy.GetType() == model.SlidingWindow {
+		slide = w.policy.GetSlide()
+	}
+	lateness := w.policy.GetAllowedLateness()
+	// the windows of a message start at the multiples of the slide within the window size before its event time
+	start := m.eventTime.Truncate(slide)
+	for ; start.After(m.eventTime.Add(-size)); start = start.Add(-slide) {
+		end := start.Add(size)
+		if !end.Add(lateness).After(watermark) {
+			// the window has closed
+			break
+		}
+		win := w.windowOf(start, end)
+		win.messages = append(win.messages, m)
+		m.refs++
+	}
+	return m.refs > 0
+}
+
+// windowOf returns the open event time window, a new window is inserted in the order of the end
+func (w *windower) windowOf(start, end time.Time) *window {
+	for _, win := range w.windows {
+		if win.start.Equal(start) {
+			return win
+		}
+	}
+	win := &window{start: start, end: end}
+	i := sort.Search(len(w.windows), func(i int) bool { return w.windows[i].end.After(end) })
+	w.windows = append(w.windows, nil)
+	copy(w.windows[i+1:], w.windows[i:])
+	w.windows[i] = win
+	return win
+}
+
+// addToSession adds a message to the sessions within the gap of its event time and merges them,
+// or starts a new session
+func (w *windower) addToSession(m *windowMessage, watermark time.Time) bool {
+	gap := w.policy.GetGap()
+	merged := &window{start: m.eventTime, end: m.eventTime, messages: []*windowMessage{m}}
+	open := []*window{}
+	for _, win := range w.windows {
+		if m.eventTime.Before(win.start.Add(-gap)) || m.eventTime.After(win.end.Add(gap)) {
+			open = append(open, win)
+			continue
+		}
+		if win.start.Before(merged.start) {
+			merged.start = win.start
+		}
+		if win.end.After(merged.end) {
+			merged.end = win.end
+		}
+		merged.messages = append(merged.messages, win.messages...)
+	}
+	if len(merged.messages) == 1 && !m.eventTime.Add(gap).Add(w.policy.GetAllowedLateness()).After(watermark) {
+		return false
+	}
+	sort.SliceStable(merged.messages, func(i, j int) bool { return merged.messages[i].eventTime.Before(merged.messages[j].eventTime) })
+	m.refs = 1
+	i := sort.Search(len(open), func(i int) bool { return open[i].end.After(merged.end) })
+	open = append(open, nil)
+	copy(open[i+1:], open[i:])
+	open[i] = merged
+	w.windows = open
+	return true
+}
+
+// closed removes and returns the windows to invoke in order
+func (w *windower) closed(now time.Time) []*window {
+	if w.policy.ByCount() {
+		return w.closedByCount()
+	}
+
+	watermark := w.currentWatermark(now)
+	// a session closes after the gap past its last message
+	closeAfter := w.policy.GetAllowedLateness()
+	if w.policy.GetType() == model.SessionWindow {
+		closeAfter += w.policy.GetGap()
+	}
+	i := 0
+	for i < len(w.windows) && !w.windows[i].end.Add(closeAfter).After(watermark) {
+		i++
+	}
+	closed := w.windows[:i:i]
+	w.windows = w.windows[i:]
+	return closed
+}
+
+// closedByCount closes a tumbling window of count messages,
+// or a sliding window of the last count messages every slide count messages
+func (w *windower) closedByCount() []*window {
+	count := w.policy.Count
+	if w.policy.GetType() == model.TumblingWindow {
+		if len(w.buffer) < count {
+			return nil
+		}
+		win := countWindow(w.buffer[:count])
+		w.buffer = w.buffer[count:]
+		for _, m := range win.messages {
+			// the window takes over the reference of the buffer
+			m.refs = 1
+		}
+		w.arrivals = 0
+		return []*window{win}
+	}
+
+	if w.arrivals < w.policy.SlideCount {
+		return nil
+	}
+	w.arrivals = 0
+	first := len(w.buffer) - count
+	if first < 0 {
+		first = 0
+	}
+	win := countWindow(w.buffer[first:])
+	for _, m := range win.messages {
+		m.refs++
+	}
+	// the messages that are not in the next window leave the buffer, the window still holds them
+	keep := count - w.policy.SlideCount
+	if len(w.buffer) > keep {
+		for _, m := range w.buffer[:len(w.buffer)-keep] {
+			m.refs--
+		}
+		w.buffer = append([]*windowMessage{}, w.buffer[len(w.buffer)-keep:]...)
+	}
+	return []*window{win}
+}
+
+func countWindow(messages []*windowMessage) *window {
+	win := &window{messages: append([]*windowMessage{}, messages...)}
+	win.start = messages[0].eventTime
+	win.end = messages[len(messages)-1].eventTime
+	return win
+}
+
+// release releases the messages of an invoked window, it returns the messages that no window holds any more
+func (win *window) release() []pulsar.Message {
+	acks := []pulsar.Message{}
+	for _, m := range win.messages {
+		m.refs--
+		if m.refs == 0 {
+			acks = append(acks, m.msg)
+		}
+	}
+	return acks
+}
@@ -0,0 +1,120 @@
+package broker
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+)
+
+func TestWindower(t *testing.T) {
+	base := time.Date(2020, 6, 15, 0, 0, 0, 0, time.UTC)
+	ms := func(v int) time.Time { return base.Add(time.Duration(v) * time.Millisecond) }
+	// a message is received at the wall clock time now with its event time at, both in milliseconds
+	type event struct{ at, now int }
+	inOrder := func(ats ...int) []event {
+		events := []event{}
+		for _, at := range ats {
+			events = append(events, event{at, at})
+		}
+		return events
+	}
+	cases := []struct {
+		name    string
+		policy  model.WindowPolicy
+		events  []event
+		windows [][]int
+		dropped []int
+		// the messages still held by an open count window
+		held []int
+	}{
+		{"tumbling count", model.WindowPolicy{Count: 2}, inOrder(1, 2, 3, 4, 5),
+			[][]int{{1, 2}, {3, 4}}, nil, []int{5}},
+		{"sliding count", model.WindowPolicy{Type: model.SlidingWindow, Count: 3, SlideCount: 2}, inOrder(1, 2, 3, 4, 5, 6),
+			[][]int{{1, 2}, {2, 3, 4}, {4, 5, 6}}, nil, []int{6}},
+		{"tumbling time", model.WindowPolicy{SizeMs: 1000}, inOrder(100, 500, 1200, 2500),
+			[][]int{{100, 500}, {1200}, {2500}}, nil, nil},
+		{"sliding time", model.WindowPolicy{Type: model.SlidingWindow, SizeMs: 1000, SlideMs: 500}, inOrder(100, 600, 1100),
+			[][]int{{100}, {100, 600}, {600, 1100}, {1100}}, nil, nil},
+		{"session", model.WindowPolicy{Type: model.SessionWindow, GapMs: 1000}, inOrder(0, 500, 3000, 3200),
+			[][]int{{0, 500}, {3000, 3200}}, nil, nil},
+		{"sessions merged by a message between them", model.WindowPolicy{Type: model.SessionWindow, GapMs: 1000, AllowedLatenessMs: 2000},
+			[]event{{0, 0}, {1800, 100}, {900, 200}, {5000, 5000}},
+			[][]int{{0, 900, 1800}, {5000}}, nil, nil},
+		{"late message within the allowed lateness", model.WindowPolicy{SizeMs: 1000, AllowedLatenessMs: 500},
+			[]event{{100, 100}, {1200, 1200}, {900, 1300}, {1600, 1600}, {400, 1700}},
+			[][]int{{100, 900}, {1200, 1600}}, []int{400}, nil},
+		{"late message without lateness", model.WindowPolicy{SizeMs: 1000},
+			[]event{{100, 100}, {1200, 1200}, {900, 1300}},
+			[][]int{{100}, {1200}}, []int{900}, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := newWindower(c.policy)
+			windows := [][]int{}
+			dropped := []int{}
+			acked := map[int]int{}
+			invoke := func(closed []*window) {
+				for _, win := range closed {
+					ats := []int{}
+					for _, m := range win.messages {
+						at, _ := strconv.Atoi(string(m.msg.Payload()))
+						ats = append(ats, at)
+					}
+					windows = append(windows, ats)
+					for _, msg := range win.release() {
+						at, _ := strconv.Atoi(string(msg.Payload()))
+						acked[at]++
+					}
+				}
+			}
+			now := 0
+			for _, e := range c.events {
+				now = e.now
+				msg := &fakeMessage{payload: strconv.Itoa(e.at), eventTime: ms(e.at)}
+				if !w.add(msg, ms(now)) {
+					dropped = append(dropped, e.at)
+				}
+				invoke(w.closed(ms(now)))
+			}
+			// the watermark advances with the wall clock once the input is idle
+			invoke(w.closed(ms(now + 60000)))
+
+			if !reflect.DeepEqual(windows, c.windows) {
+				t.Errorf("got windows %v, want %v", windows, c.windows)
+			}
+			if len(dropped) > 0 || len(c.dropped) > 0 {
+				if !reflect.DeepEqual(dropped, c.dropped) {
+					t.Errorf("got dropped %v, want %v", dropped, c.dropped)
+				}
+			}
+			// every message in a window is acknowledged once, after the last window that holds it
+			held := []int{}
+			for _, e := range c.events {
+				if n := acked[e.at]; n > 1 {
+					t.Errorf("message %d is acknowledged %d times", e.at, n)
+				} else if n == 0 && !contains(c.dropped, e.at) {
+					held = append(held, e.at)
+				}
+			}
+			sort.Ints(held)
+			if len(held) > 0 || len(c.held) > 0 {
+				if !reflect.DeepEqual(held, c.held) {
+					t.Errorf("got unacknowledged %v, want %v", held, c.held)
+				}
+			}
+		})
+	}
+}
+
+func contains(values []int, v int) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,239 @@
+package cluster
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errNewerEpoch is returned when a function has been assigned by a newer leader
+var errNewerEpoch = errors.New("assigned by a newer leader epoch")
+
+// assignInstances assigns the desired instances of every function to the alive workers,
+// and publishes the instance urls reported by the assigned workers as the function's webhook urls.
+// The assignments are stamped with the leader epoch, the leader steps down when it finds a newer epoch.
+func assignInstances(fns []*model.FunctionConfig, workers []*model.Worker, epoch int64) {
+	for _, fn := range fns {
+		if fn.AssignmentEpoch > epoch {
+			log.Warnf("function %s is assigned by a newer leader epoch %d than %d", fn.ID, fn.AssignmentEpoch, epoch)
+			Resign()
+			return
+		}
+	}
+
+	assignments := computeAssignments(fns, workers)
+
+	byID := make(map[string]*model.Worker)
+	for _, w := range workers {
+		byID[w.ID] = w
+	}
+	for _, fn := range fns {
+		assignment := assignments[fn.ID]
+		urls := []string{}
+		for _, workerID := range sortedKeys(assignment) {
+			urls = append(urls, byID[workerID].Instances[fn.ID]...)
+		}
+		if sameAssignment(assignment, fn.Assignments) && sameURLs(urls, fn.WebhookURLs) && fn.AssignmentEpoch == epoch {
+			continue
+		}
+
+		if err := writeAssignment(fn, assignment, urls, epoch); err == errNewerEpoch {
+			log.Warnf("function %s is assigned by a newer leader epoch than %d", fn.ID, epoch)
+			Resign()
+			return
+		} else if err != nil {
+			log.Errorf("failed to update function %s assignment error %v", fn.ID, err)
+		}
+	}
+}
+
+// writeAssignment writes only the assignment fields into the latest function config, so that a concurrent
+// change of the function is not overwritten. The assignment is dropped if the function has changed since it was
+// loaded, the next tick assigns it again. The function config keeps the same UpdatedAt so that the function
+// instances are not restarted.
+func writeAssignment(fn *model.FunctionConfig, assignment map[string]int, urls []string, epoch int64) error {
+	current, err := singleDb.GetByKey(fn.ID)
+	if err != nil {
+		return err
+	}
+	if current.AssignmentEpoch > epoch {
+		return errNewerEpoch
+	}
+	if !current.UpdatedAt.Equal(fn.UpdatedAt) || desiredInstances(current) != desiredInstances(fn) {
+		log.Infof("function %s has changed since the assignment, it is assigned in the next tick", fn.ID)
+		return nil
+	}
+	current.Assignments = assignment
+	current.WebhookURLs = urls
+	current.AssignmentEpoch = epoch
+	_, err = singleDb.Update(current)
+	return err
+}
+
+// computeAssignments assigns the instances of every function to workers by capacity.
+// Existing assignments on alive workers are kept, missing instances are spread to the workers with the fewest
+// instances of the function then the lowest load, and instances are moved from the most to the least loaded workers
+// so that a joined worker takes its share.
+func computeAssignments(fns []*model.FunctionConfig, workers []*model.Worker) map[string]map[string]int {
+	capacity := make(map[string]int)
+	load := make(map[string]int)
+	for _, w := range workers {
+		capacity[w.ID] = w.Capacity
+		load[w.ID] = 0
+	}
+
+	sorted := append([]*model.FunctionConfig{}, fns...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+
+	assignments := make(map[string]map[string]int)
+	for _, fn := range sorted {
+		desired := desiredInstances(fn)
+		assignment := make(map[string]int)
+		total := 0
+		for _, workerID := range sortedKeys(fn.Assignments) {
+			count := fn.Assignments[workerID]
+			if _, alive := capacity[workerID]; !alive {
+				continue
+			}
+			if count > desired-total {
+				count = desired - total
+			}
+			if count > 0 {
+				assignment[workerID] = count
+				load[workerID] += count
+				total += count
+			}
+		}
+		assignments[fn.ID] = assignment
+	}
+
+	for _, fn := range sorted {
+		assignment := assignments[fn.ID]
+		for total := sum(assignment); total < desiredInstances(fn); total++ {
+			workerID := pickWorker(workers, assignment, load, capacity)
+			if workerID == "" {
+				log.Warnf("function %s has %d unassigned instances, no worker has capacity", fn.ID, desiredInstances(fn)-total)
+				break
+			}
+			assignment[workerID]++
+			load[workerID]++
+		}
+	}
+
+	rebalance(sorted, workers, assignments, load, capacity)
+	return assignments
+}
+
+// desiredInstances is the number of instances of an activated function, a function in any other status has none
+func desiredInstances(fn *model.FunctionConfig) int {
+	if fn.FunctionStatus != model.Activated {
+		return 0
+	}
+	return fn.DesiredInstances()
+}
+
+// pickWorker picks the worker with capacity that has the fewest instances of the function, then the lowest load
+func pickWorker(workers []*model.Worker, assignment map[string]int, load, capacity map[string]int) string {
+	picked := ""
+	for _, w := range workers {
+		if load[w.ID] >= capacity[w.ID] {
+			continue
+		}
+		if picked == "" || assignment[w.ID] < assignment[picked] ||
+			(assignment[w.ID] == assignment[picked] && loadRatio(w.ID, load, capacity) < loadRatio(picked, load, capacity)) {
+			picked = w.ID
+		}
+	}
+	return picked
+}
+
+// rebalance moves one instance at a time from the most to the least loaded worker while it lowers the max load
+func rebalance(fns []*model.FunctionConfig, workers []*model.Worker, assignments map[string]map[string]int, load, capacity map[string]int) {
+	if len(workers) < 2 {
+		return
+	}
+	for moves := 0; moves < len(fns)*len(workers); moves++ {
+		most, least := workers[0].ID, workers[0].ID
+		for _, w := range workers {
+			if loadRatio(w.ID, load, capacity) > loadRatio(most, load, capacity) {
+				most = w.ID
+			}
+			if loadRatio(w.ID, load, capacity) < loadRatio(least, load, capacity) {
+				least = w.ID
+			}
+		}
+		if load[least] >= capacity[least] || float64(load[least]+1)/float64(capacity[least]) >= loadRatio(most, load, capacity) {
+			return
+		}
+
+		// move an instance of the function with the most instances on the most loaded worker
+		moved := ""
+		for _, fn := range fns {
+			assignment := assignments[fn.ID]
+			if assignment[most] > 0 && (moved == "" || assignment[most]-assignment[least] > assignments[moved][most]-assignments[moved][least]) {
+				moved = fn.ID
+			}
+		}
+		if moved == "" {
+			return
+		}
+		assignment := assignments[moved]
+		if assignment[most]--; assignment[most] == 0 {
+			delete(assignment, most)
+		}
+		assignment[least]++
+		load[most]--
+		load[least]++
+	}
+}
+
+func loadRatio(workerID string, load, capacity map[string]int) float64 {
+	if capacity[workerID] <= 0 {
+		return 1
+	}
+	return float64(load[workerID]) / float64(capacity[workerID])
+}
+
+func sum(assignment map[string]int) int {
+	total := 0
+	for _, count := range assignment {
+		total += count
+	}
+	return total
+}
+
+func sortedKeys(assignment map[string]int) []string {
+	keys := []string{}
+	for k := range assignment {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sameAssignment(a, b map[string]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func sameURLs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
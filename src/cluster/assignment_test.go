@@ -0,0 +1,184 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kafkaesque-io/pubsub-function/src/db"
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+)
+
+func activated(id string, parallelism int, assignments map[string]int) *model.FunctionConfig {
+	return &model.FunctionConfig{ID: id, FunctionStatus: model.Activated, Parallelism: parallelism, Assignments: assignments}
+}
+
+func workersOf(capacities ...int) []*model.Worker {
+	workers := []*model.Worker{}
+	for i, capacity := range capacities {
+		workers = append(workers, &model.Worker{ID: string(rune('a' + i)), Capacity: capacity})
+	}
+	return workers
+}
+
+func TestComputeAssignments(t *testing.T) {
+	cases := []struct {
+		name    string
+		fns     []*model.FunctionConfig
+		workers []*model.Worker
+		want    map[string]map[string]int
+	}{
+		{
+			name:    "spread new instances",
+			fns:     []*model.FunctionConfig{activated("f1", 3, nil)},
+			workers: workersOf(10, 10),
+			want:    map[string]map[string]int{"f1": {"a": 2, "b": 1}},
+		},
+		{
+			name:    "keep existing assignments",
+			fns:     []*model.FunctionConfig{activated("f1", 1, map[string]int{"b": 1}), activated("f2", 1, nil)},
+			workers: workersOf(10, 10),
+			want:    map[string]map[string]int{"f1": {"b": 1}, "f2": {"a": 1}},
+		},
+		{
+			name:    "reassign from a dead worker",
+			fns:     []*model.FunctionConfig{activated("f1", 2, map[string]int{"a": 1, "dead": 1})},
+			workers: workersOf(10, 10),
+			want:    map[string]map[string]int{"f1": {"a": 1, "b": 1}},
+		},
+		{
+			name:    "scale down keeps the first workers",
+			fns:     []*model.FunctionConfig{activated("f1", 1, map[string]int{"a": 1, "b": 1})},
+			workers: workersOf(10, 10),
+			want:    map[string]map[string]int{"f1": {"a": 1}},
+		},
+		{
+			name:    "suspended function has no instances",
+			fns:     []*model.FunctionConfig{{ID: "f1", FunctionStatus: model.Suspended, Parallelism: 2, Assignments: map[string]int{"a": 2}}},
+			workers: workersOf(10),
+			want:    map[string]map[string]int{"f1": {}},
+		},
+		{
+			name:    "capacity exhausted",
+			fns:     []*model.FunctionConfig{activated("f1", 5, nil)},
+			workers: workersOf(2, 1),
+			want:    map[string]map[string]int{"f1": {"a": 2, "b": 1}},
+		},
+		{
+			name:    "joined worker takes its share",
+			fns:     []*model.FunctionConfig{activated("f1", 2, map[string]int{"a": 2}), activated("f2", 2, map[string]int{"a": 2})},
+			workers: workersOf(4, 4),
+			want:    map[string]map[string]int{"f1": {"a": 1, "b": 1}, "f2": {"a": 1, "b": 1}},
+		},
+		{
+			name:    "no worker",
+			fns:     []*model.FunctionConfig{activated("f1", 1, nil)},
+			workers: workersOf(),
+			want:    map[string]map[string]int{"f1": {}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := computeAssignments(c.fns, c.workers)
+			if len(got) != len(c.want) {
+				t.Fatalf("got %v, want %v", got, c.want)
+			}
+			for id, want := range c.want {
+				if !sameAssignment(got[id], want) {
+					t.Errorf("function %s got %v, want %v", id, got[id], want)
+				}
+			}
+		})
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	cases := []struct {
+		name        string
+		assignments map[string]map[string]int
+		capacities  []int
+		wantLoad    map[string]int
+	}{
+		{"balanced", map[string]map[string]int{"f1": {"a": 1, "b": 1}}, []int{2, 2}, map[string]int{"a": 1, "b": 1}},
+		{"move to an empty worker", map[string]map[string]int{"f1": {"a": 4}}, []int{4, 4}, map[string]int{"a": 2, "b": 2}},
+		{"by capacity ratio", map[string]map[string]int{"f1": {"a": 6}}, []int{8, 4}, map[string]int{"a": 4, "b": 2}},
+		{"single worker", map[string]map[string]int{"f1": {"a": 3}}, []int{4}, map[string]int{"a": 3}},
+		{"full worker takes no instance", map[string]map[string]int{"f1": {"a": 3, "b": 1}}, []int{4, 1}, map[string]int{"a": 3, "b": 1}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			workers := workersOf(c.capacities...)
+			fns := []*model.FunctionConfig{}
+			load := map[string]int{}
+			capacity := map[string]int{}
+			for _, w := range workers {
+				capacity[w.ID] = w.Capacity
+				load[w.ID] = 0
+			}
+			for id, assignment := range c.assignments {
+				fns = append(fns, &model.FunctionConfig{ID: id})
+				for workerID, count := range assignment {
+					load[workerID] += count
+				}
+			}
+			rebalance(fns, workers, c.assignments, load, capacity)
+			if !sameAssignment(load, c.wantLoad) {
+				t.Errorf("got load %v, want %v", load, c.wantLoad)
+			}
+			actual := map[string]int{}
+			for _, assignment := range c.assignments {
+				for workerID, count := range assignment {
+					actual[workerID] += count
+				}
+			}
+			if !sameAssignment(actual, c.wantLoad) {
+				t.Errorf("got assignments %v, want load %v", c.assignments, c.wantLoad)
+			}
+		})
+	}
+}
+
+func TestWriteAssignmentKeepsConcurrentChanges(t *testing.T) {
+	handler, err := db.NewInMemoryHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	singleDb = handler
+	defer func() { singleDb = nil }()
+
+	fn := &model.FunctionConfig{Tenant: "t", Name: "f", FunctionStatus: model.Activated, Parallelism: 1}
+	if _, err = singleDb.Create(fn); err != nil {
+		t.Fatal(err)
+	}
+	loaded, _ := singleDb.GetByKey(fn.ID)
+
+	// a termination is recorded after the leader loaded the functions, it keeps the UpdatedAt
+	current, _ := singleDb.GetByKey(fn.ID)
+	current.Terminations = []model.InstanceTermination{{Function: fn.ID, Reason: model.InstanceExited}}
+	singleDb.Update(current)
+	if err = writeAssignment(loaded, map[string]int{"a": 1}, []string{"http://a:3000"}, 1); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := singleDb.GetByKey(fn.ID)
+	if got.Assignments["a"] != 1 || len(got.Terminations) != 1 {
+		t.Errorf("got assignments %v terminations %v, want both written", got.Assignments, got.Terminations)
+	}
+
+	// the function is updated after the leader loaded the functions
+	loaded, _ = singleDb.GetByKey(fn.ID)
+	current, _ = singleDb.GetByKey(fn.ID)
+	current.Parallelism = 2
+	current.UpdatedAt = time.Now().Add(time.Second)
+	singleDb.Update(current)
+	if err = writeAssignment(loaded, map[string]int{"b": 1}, []string{"http://b:3000"}, 1); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = singleDb.GetByKey(fn.ID)
+	if got.Parallelism != 2 || got.Assignments["a"] != 1 {
+		t.Errorf("got parallelism %d assignments %v, want the update kept and the stale assignment dropped", got.Parallelism, got.Assignments)
+	}
+
+	// a newer leader has assigned the function
+	if err = writeAssignment(got, map[string]int{"b": 2}, nil, 0); err != errNewerEpoch {
+		t.Errorf("got error %v, want %v", err, errNewerEpoch)
+	}
+}
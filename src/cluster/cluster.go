@@ -0,0 +1,210 @@
+package cluster
+
+// cluster registers the worker, runs the function instances assigned to the worker,
+// and assigns the function instances across the workers when the worker is the leader
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kafkaesque-io/pubsub-function/src/db"
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+	"github.com/kafkaesque-io/pubsub-function/src/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// a worker without heartbeat for deadIntervals is removed from the assignment,
+// and its registration is deleted after purgeIntervals
+const (
+	deadIntervals  = 3
+	purgeIntervals = 30
+)
+
+var singleDb db.Db
+
+var self model.Worker
+
+var interval time.Duration
+
+// onChange is called when the instance urls of any function have changed
+var onChange func()
+
+var lock = &sync.RWMutex{}
+
+// tickLock serializes a tick with the shutdown so that no instance is started after the shutdown
+var tickLock = &sync.Mutex{}
+
+// stopped is set by Shutdown to stop the heartbeat, the election and the duties
+var stopped int32
+
+func isStopped() bool {
+	return atomic.LoadInt32(&stopped) == 1
+}
+
+// Enabled returns whether the worker cluster is enabled
+func Enabled() bool {
+	return util.StringToBool(util.GetConfig().WorkerCluster)
+}
+
+// Init starts the leader election and the cluster wide duties, and registers this worker when the cluster is enabled.
+// onChange is called when the instance urls of functions have changed.
+func Init(changed func()) {
+	singleDb = db.NewDbWithPanic(util.GetConfig().PbDbType)
+	startElection()
+	startDuties()
+	if Enabled() {
+		join(changed)
+	} else {
+		go reconcileStartup()
+	}
+}
+
+// join registers this worker and starts the heartbeat
+func join(changed func()) {
+	onChange = changed
+
+	var err error
+	interval, err = time.ParseDuration(util.AssignString(util.GetConfig().WorkerHeartbeatInterval, "10s"))
+	if err != nil {
+		log.Errorf("invalid WorkerHeartbeatInterval %v, use the default 10s", err)
+		interval = 10 * time.Second
+	}
+	now := time.Now()
+	self = model.Worker{
+		ID:        util.GetWorkerID(),
+		Address:   util.GetWorkerAddress(),
+		Capacity:  util.StringToInt(util.GetConfig().WorkerCapacity, 100),
+		Instances: make(map[string][]string),
+		StartedAt: now,
+	}
+	log.Infof("worker %s joins the cluster with address %s capacity %d", self.ID, self.Address, self.Capacity)
+
+	go func() {
+		reconcileStartup()
+		for !isStopped() {
+			time.Sleep(interval)
+			tick()
+		}
+	}()
+}
+
+// Shutdown stops the heartbeat, the election and the duties, gives up the leadership, and leaves the cluster
+// so that the leader reassigns the instances of this worker without waiting for the heartbeat to expire
+func Shutdown() {
+	atomic.StoreInt32(&stopped, 1)
+	if singleDb == nil {
+		return
+	}
+	tickLock.Lock()
+	defer tickLock.Unlock()
+	if leaderElector != nil {
+		leaderElector.release(time.Now())
+	}
+	if Enabled() {
+		log.Infof("worker %s leaves the cluster", self.ID)
+		if _, err := singleDb.DeleteWorker(self.ID); err != nil {
+			log.Errorf("worker %s failed to leave the cluster error %v", self.ID, err)
+		}
+	}
+}
+
+// tick runs the assigned instances, sends the heartbeat, and assigns instances if this worker is the leader
+func tick() {
+	tickLock.Lock()
+	defer tickLock.Unlock()
+	if isStopped() {
+		return
+	}
+	fns, err := singleDb.Load()
+	if err != nil {
+		log.Errorf("worker %s failed to load functions error %v", self.ID, err)
+		return
+	}
+	instances := reconcileInstances(fns)
+
+	lock.Lock()
+	self.Instances = instances
+	self.HeartbeatAt = time.Now()
+	worker := self
+	lock.Unlock()
+	if _, err = singleDb.UpdateWorker(&worker); err != nil {
+		log.Errorf("worker %s failed to send heartbeat error %v", self.ID, err)
+	}
+
+	workers, err := singleDb.GetWorkers()
+	if err != nil {
+		log.Errorf("worker %s failed to get workers error %v", self.ID, err)
+		return
+	}
+	alive := aliveWorkers(workers, time.Now())
+	if leading, epoch := leaderElector.isLeader(time.Now()); leading {
+		assignInstances(fns, alive, epoch)
+		purgeWorkers(workers, time.Now())
+	}
+	if fns, err = singleDb.Load(); err == nil {
+		notifyURLChanges(fns)
+	}
+}
+
+// aliveWorkers returns the workers with a heartbeat within the ttl sorted by ID
+func aliveWorkers(workers []*model.Worker, now time.Time) []*model.Worker {
+	alive := []*model.Worker{}
+	for _, w := range workers {
+		if w.Alive(now, deadIntervals*interval) {
+			alive = append(alive, w)
+		}
+	}
+	sort.Slice(alive, func(i, j int) bool { return alive[i].ID < alive[j].ID })
+	return alive
+}
+
+// purgeWorkers deletes the registration of workers that have been dead for a long time
+func purgeWorkers(workers []*model.Worker, now time.Time) {
+	for _, w := range workers {
+		if !w.Alive(now, purgeIntervals*interval) {
+			log.Infof("delete the registration of dead worker %s", w.ID)
+			if _, err := singleDb.DeleteWorker(w.ID); err != nil {
+				log.Errorf("failed to delete worker %s error %v", w.ID, err)
+			}
+		}
+	}
+}
+
+// SetParallelism sets the number of instances of a function for the leader to assign
+// the function config keeps the same UpdatedAt so that the function instances are not restarted
+func SetParallelism(functionID string, parallelism int) error {
+	doc, err := singleDb.GetByKey(functionID)
+	if err != nil {
+		return err
+	}
+	if doc.Parallelism == parallelism {
+		return nil
+	}
+	doc.Parallelism = parallelism
+	_, err = singleDb.Update(doc)
+	return err
+}
+
+// lastURLs tracks the instance urls of the functions to notify changes
+var lastURLs = make(map[string]string)
+
+// notifyURLChanges calls onChange if the instance urls of any function have changed since the last tick
+func notifyURLChanges(fns []*model.FunctionConfig) {
+	urls := make(map[string]string)
+	changed := false
+	for _, fn := range fns {
+		urls[fn.ID] = fmt.Sprint(fn.WebhookURLs)
+		if lastURLs[fn.ID] != urls[fn.ID] {
+			changed = true
+		}
+	}
+	changed = changed || len(urls) != len(lastURLs)
+	lastURLs = urls
+	if changed && onChange != nil {
+		onChange()
+	}
+}
@@ -0,0 +1,230 @@
+package cluster
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kafkaesque-io/pubsub-function/src/artifact"
+	"github.com/kafkaesque-io/pubsub-function/src/lambda"
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+	"github.com/kafkaesque-io/pubsub-function/src/pulsardriver"
+	"github.com/kafkaesque-io/pubsub-function/src/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// every worker garbage collects its function sources not referenced by any function every sourceGCInterval,
+// and the leader the artifacts. A source younger than sourceGCMinAge may belong to a function being deployed.
+const (
+	sourceGCInterval = time.Hour
+	sourceGCMinAge   = 10 * time.Minute
+)
+
+// startDuties runs the cluster wide duties on the leader, and the local duties on every worker
+func startDuties() {
+	go runCron()
+	go runLocal(sourceGCInterval, collectSources)
+	go runEvery(sourceGCInterval, collectArtifacts)
+
+	config := util.GetConfig()
+	if config.PbDbType == "pulsarAsDb" && config.PulsarAdminURL != "" {
+		compaction, err := time.ParseDuration(util.AssignString(config.DbCompactionInterval, "1h"))
+		if err != nil {
+			log.Errorf("invalid DbCompactionInterval %v, use the default 1h", err)
+			compaction = time.Hour
+		}
+		go runEvery(compaction, compactDb)
+	}
+}
+
+// runEvery runs the duty at every interval when this worker is the leader, the duty is passed the leader epoch
+// to check before each of its side effects
+func runEvery(interval time.Duration, duty func(epoch int64)) {
+	for !isStopped() {
+		time.Sleep(interval)
+		if leaderElector == nil {
+			continue
+		}
+		if leading, epoch := leaderElector.isLeader(time.Now()); leading {
+			duty(epoch)
+		}
+	}
+}
+
+// runLocal runs the duty of this worker at every interval
+func runLocal(interval time.Duration, duty func()) {
+	for !isStopped() {
+		time.Sleep(interval)
+		duty()
+	}
+}
+
+// stillLeading returns whether this worker still leads in the epoch. The lease is read again from the database,
+// so that a leader that has been fenced off by a newer epoch stops before its next side effect.
+func stillLeading(epoch int64) bool {
+	if leaderElector == nil {
+		return false
+	}
+	if leading, current := leaderElector.isLeader(time.Now()); !leading || current != epoch {
+		return false
+	}
+	lease, err := singleDb.GetLease(leaderLeaseName)
+	if err != nil || lease == nil {
+		return false
+	}
+	if lease.Epoch != epoch || lease.HolderID != leaderElector.workerID {
+		log.Warnf("worker %s is fenced off by the leader %s epoch %d", leaderElector.workerID, lease.HolderID, lease.Epoch)
+		Resign()
+		return false
+	}
+	return true
+}
+
+// runCron fires the cron triggered functions at the start of every minute
+func runCron() {
+	for !isStopped() {
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(next.Sub(now))
+		if leaderElector == nil {
+			continue
+		}
+		if leading, epoch := leaderElector.isLeader(time.Now()); leading {
+			fireCron(next, epoch)
+		}
+	}
+}
+
+// fireCron invokes an instance of every cron triggered function whose schedule matches the minute
+func fireCron(minute time.Time, epoch int64) {
+	fns, err := singleDb.Load()
+	if err != nil {
+		log.Errorf("failed to load functions for cron triggers error %v", err)
+		return
+	}
+	for _, fn := range fns {
+		if fn.FunctionStatus != model.Activated || fn.TriggerType != lambda.CronTrigger || fn.Cron == "" {
+			continue
+		}
+		schedule, err := model.ParseCron(fn.Cron)
+		if err != nil {
+			log.Errorf("function %s has invalid cron %s error %v", fn.ID, fn.Cron, err)
+			continue
+		}
+		if schedule.Matches(minute) {
+			go invokeCron(*fn, minute, epoch)
+		}
+	}
+}
+
+// invokeCron invokes a function instance and sends the result to the output topic,
+// both only while this worker still leads in the epoch
+func invokeCron(fn model.FunctionConfig, minute time.Time, epoch int64) {
+	if len(fn.WebhookURLs) == 0 {
+		log.Errorf("cron function %s has no running instance", fn.ID)
+		return
+	}
+	url := fn.WebhookURLs[minute.Unix()/60%int64(len(fn.WebhookURLs))]
+	if !stillLeading(epoch) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), fn.GetTimeout())
+	defer cancel()
+	body, err := lambda.Invoke(ctx, url, []byte(minute.UTC().Format(time.RFC3339)), nil)
+	if err != nil {
+		log.Errorf("cron function %s invocation error %v", fn.ID, err)
+		return
+	}
+	output := fn.OutputTopic
+	if output.TopicFullName != "" && len(body) > 0 {
+		if !stillLeading(epoch) {
+			log.Warnf("cron function %s drops the output of minute %v after the leadership is lost", fn.ID, minute)
+			return
+		}
+		if err = pulsardriver.SendToPulsar(output.PulsarURL, output.Token, output.TopicFullName, body, false); err != nil {
+			log.Errorf("cron function %s failed to send to output topic %s error %v", fn.ID, output.TopicFullName, err)
+		}
+	}
+}
+
+// collectSources deletes the function sources of deleted functions on this worker
+func collectSources() {
+	fns, err := singleDb.Load()
+	if err != nil {
+		log.Errorf("failed to load functions for source garbage collection error %v", err)
+		return
+	}
+	sources := make(map[string]bool)
+	for _, fn := range fns {
+		if path, err := filepath.Abs(fn.FunctionFilePath); err == nil {
+			sources[path] = true
+		}
+	}
+
+	cutoff := time.Now().Add(-sourceGCMinAge)
+	filepath.Walk(lambda.SourceBaseDir(), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(path, ".js") || info.ModTime().After(cutoff) {
+			return nil
+		}
+		if abs, err := filepath.Abs(path); err == nil && !sources[abs] {
+			log.Infof("delete source %s of a deleted function", path)
+			if err = os.Remove(path); err != nil {
+				log.Errorf("failed to delete source %s error %v", path, err)
+			}
+		}
+		return nil
+	})
+}
+
+// collectArtifacts deletes the artifacts that no function references, created before the source gc min age
+func collectArtifacts(epoch int64) {
+	fns, err := singleDb.Load()
+	if err != nil {
+		log.Errorf("failed to load functions for artifact garbage collection error %v", err)
+		return
+	}
+	hashes := make(map[string]bool)
+	for _, fn := range fns {
+		hashes[fn.SourceHash] = true
+	}
+
+	cutoff := time.Now().Add(-sourceGCMinAge)
+	store, err := artifact.GetStore()
+	if err != nil {
+		log.Errorf("failed to get artifact store error %v", err)
+		return
+	}
+	artifacts, err := store.List()
+	if err != nil {
+		log.Errorf("failed to list artifacts error %v", err)
+		return
+	}
+	for _, a := range artifacts {
+		if !hashes[a.Hash] && a.CreatedAt.Before(cutoff) {
+			if !stillLeading(epoch) {
+				return
+			}
+			log.Infof("delete artifact %s of a deleted function", a.Hash)
+			if err = store.Delete(a.Hash); err != nil {
+				log.Errorf("failed to delete artifact %s error %v", a.Hash, err)
+			}
+		}
+	}
+}
+
+// compactDb compacts the database topic so that only the latest document of every key is kept
+func compactDb(epoch int64) {
+	if !stillLeading(epoch) {
+		return
+	}
+	config := util.GetConfig()
+	if err := pulsardriver.CompactTopic(config.PulsarAdminURL, config.DbPassword, config.DbName); err != nil {
+		log.Errorf("failed to compact database topic %s error %v", config.DbName, err)
+		return
+	}
+	log.Infof("triggered compaction of database topic %s", config.DbName)
+}
@@ -0,0 +1,230 @@
+package cluster
+
+import (
+	"sync"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/kafkaesque-io/pubsub-function/src/db"
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+	"github.com/kafkaesque-io/pubsub-function/src/pulsardriver"
+	"github.com/kafkaesque-io/pubsub-function/src/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// leaderLeaseName is the name of the lease of the cluster leader
+const leaderLeaseName = "leader"
+
+// elector elects the leader by an exclusive subscription on the leader topic.
+// The holder of the subscription writes a lease with a new epoch to the database topic and renews it.
+// It steps down when the lease cannot be renewed in time or a lease of a newer epoch is found.
+type elector struct {
+	workerID string
+	ttl      time.Duration
+	consumer pulsar.Consumer
+	leading  bool
+	epoch    int64
+	// the leader acts after the lease of the previous leader expires, and until its own lease expires
+	activeAt  time.Time
+	expiresAt time.Time
+	lock      sync.RWMutex
+}
+
+var leaderElector *elector
+
+// startElection runs the leader election until the process exits
+func startElection() {
+	ttl, err := time.ParseDuration(util.AssignString(util.GetConfig().LeaderLeaseTTL, "30s"))
+	if err != nil {
+		log.Errorf("invalid LeaderLeaseTTL %v, use the default 30s", err)
+		ttl = 30 * time.Second
+	}
+	leaderElector = &elector{workerID: util.GetWorkerID(), ttl: ttl}
+
+	go func() {
+		for !isStopped() {
+			leaderElector.run(time.Now())
+			time.Sleep(ttl / 3)
+		}
+	}()
+}
+
+// run campaigns for the leadership, or renews the lease of the leader
+func (e *elector) run(now time.Time) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if isStopped() {
+		return
+	}
+
+	current, err := singleDb.GetLease(leaderLeaseName)
+	if err != nil {
+		current = nil
+	}
+	if e.leading {
+		e.renew(now, current)
+		return
+	}
+	if !e.acquire() {
+		return
+	}
+
+	lease := model.LeaderLease{
+		Name:      leaderLeaseName,
+		HolderID:  e.workerID,
+		Epoch:     1,
+		RenewedAt: now,
+		ExpiresAt: now.Add(e.ttl),
+	}
+	e.activeAt = now
+	if current != nil {
+		lease.Epoch = current.Epoch + 1
+		if current.HolderID != e.workerID && !current.Expired(now) {
+			e.activeAt = current.ExpiresAt
+		}
+	}
+	if _, err = singleDb.UpdateLease(&lease); err != nil {
+		log.Errorf("worker %s failed to write leader lease error %v", e.workerID, err)
+		e.stepDown()
+		return
+	}
+	e.leading, e.epoch, e.expiresAt = true, lease.Epoch, lease.ExpiresAt
+	log.Infof("worker %s is elected as the leader epoch %d, active at %v", e.workerID, e.epoch, e.activeAt)
+}
+
+// acquire tries to hold the exclusive subscription of the leader topic
+// the leadership does not require a subscription when the database is not shared with other workers
+func (e *elector) acquire() bool {
+	config := util.GetConfig()
+	if config.PbDbType != "pulsarAsDb" {
+		return true
+	}
+	consumer, err := pulsardriver.AcquireExclusiveSubscription(config.DbConnectionStr, config.DbPassword, config.DbName+"-leader", "leader")
+	if err != nil {
+		log.Debugf("worker %s is a follower %v", e.workerID, err)
+		return false
+	}
+	e.consumer = consumer
+	return true
+}
+
+// renew renews the lease of the leader, the caller must hold the lock
+func (e *elector) renew(now time.Time, current *model.LeaderLease) {
+	if current != nil && (current.Epoch > e.epoch || (current.Epoch == e.epoch && current.HolderID != e.workerID)) {
+		log.Warnf("worker %s is fenced off by the leader %s epoch %d", e.workerID, current.HolderID, current.Epoch)
+		e.stepDown()
+		return
+	}
+	lease := model.LeaderLease{
+		Name:      leaderLeaseName,
+		HolderID:  e.workerID,
+		Epoch:     e.epoch,
+		RenewedAt: now,
+		ExpiresAt: now.Add(e.ttl),
+	}
+	if _, err := singleDb.UpdateLease(&lease); err != nil {
+		log.Errorf("worker %s failed to renew leader lease error %v", e.workerID, err)
+		if !now.Before(e.expiresAt) {
+			e.stepDown()
+		}
+		return
+	}
+	e.expiresAt = lease.ExpiresAt
+}
+
+// stepDown releases the exclusive subscription so that another worker can be elected, the caller must hold the lock
+func (e *elector) stepDown() {
+	if e.leading {
+		log.Warnf("worker %s steps down as the leader epoch %d", e.workerID, e.epoch)
+	}
+	e.leading = false
+	if e.consumer != nil {
+		e.consumer.Close()
+		e.consumer = nil
+	}
+}
+
+// release expires the lease of the leader so that the next leader acts without waiting for the ttl
+func (e *elector) release(now time.Time) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.leading {
+		lease := model.LeaderLease{
+			Name:      leaderLeaseName,
+			HolderID:  e.workerID,
+			Epoch:     e.epoch,
+			RenewedAt: now,
+			ExpiresAt: now,
+		}
+		if _, err := singleDb.UpdateLease(&lease); err != nil {
+			log.Errorf("worker %s failed to release leader lease error %v", e.workerID, err)
+		}
+	}
+	e.stepDown()
+}
+
+// isLeader returns whether the worker can act as the leader and the epoch to fence its writes
+func (e *elector) isLeader(now time.Time) (bool, int64) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.leading && !now.Before(e.activeAt) && now.Before(e.expiresAt), e.epoch
+}
+
+// IsLeader returns whether this worker is the leader
+func IsLeader() bool {
+	if leaderElector == nil {
+		return false
+	}
+	leading, _ := leaderElector.isLeader(time.Now())
+	return leading
+}
+
+// Resign gives up the leadership, the lease expires so that another worker is elected
+func Resign() {
+	if leaderElector == nil {
+		return
+	}
+	leaderElector.lock.Lock()
+	defer leaderElector.lock.Unlock()
+	leaderElector.stepDown()
+}
+
+// Status is the leadership and membership of the cluster seen by this worker
+type Status struct {
+	WorkerID       string          `json:"workerId"`
+	ClusterEnabled bool            `json:"clusterEnabled"`
+	IsLeader       bool            `json:"isLeader"`
+	Leader         string          `json:"leader"`
+	Epoch          int64           `json:"epoch"`
+	LeaseExpiresAt time.Time       `json:"leaseExpiresAt"`
+	Workers        []*model.Worker `json:"workers,omitempty"`
+}
+
+// GetStatus returns the leader lease and the alive workers from the database
+func GetStatus() (Status, error) {
+	status := Status{
+		WorkerID:       util.GetWorkerID(),
+		ClusterEnabled: Enabled(),
+		IsLeader:       IsLeader(),
+	}
+	// the http only mode reads the status from the database without joining the election
+	d := singleDb
+	if d == nil {
+		var err error
+		if d, err = db.NewDb(util.GetConfig().PbDbType); err != nil {
+			return status, err
+		}
+	}
+	if lease, err := d.GetLease(leaderLeaseName); err == nil && lease != nil {
+		status.Leader, status.Epoch, status.LeaseExpiresAt = lease.HolderID, lease.Epoch, lease.ExpiresAt
+	}
+	if status.ClusterEnabled {
+		workers, err := d.GetWorkers()
+		if err != nil {
+			return status, err
+		}
+		status.Workers = workers
+	}
+	return status, nil
+}
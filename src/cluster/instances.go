@@ -0,0 +1,92 @@
+package cluster
+
+import (
+	"time"
+
+	"github.com/kafkaesque-io/pubsub-function/src/lambda"
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// localFunction is the running instances of a function on this worker
+type localFunction struct {
+	updatedAt time.Time
+	urls      []string
+}
+
+// localFunctions is only accessed by the heartbeat loop, key is the function ID
+var localFunctions = make(map[string]*localFunction)
+
+// reconcileInstances starts and stops the local instances to match the assignment of this worker.
+// Instances that have exited are replaced, and all instances are restarted when the function is updated.
+// It returns the urls of the running instances.
+func reconcileInstances(fns []*model.FunctionConfig) map[string][]string {
+	assigned := make(map[string]bool)
+	for _, fn := range fns {
+		desired := fn.Assignments[self.ID]
+		if desired == 0 {
+			continue
+		}
+		assigned[fn.ID] = true
+		local, ok := localFunctions[fn.ID]
+		if !ok {
+			local = &localFunction{updatedAt: fn.UpdatedAt}
+			localFunctions[fn.ID] = local
+		}
+
+		if !local.updatedAt.Equal(fn.UpdatedAt) {
+			log.Infof("function %s has been updated, restart its instances on worker %s", fn.ID, self.ID)
+			stopInstances(fn.ID, local.urls)
+			local.urls = nil
+			local.updatedAt = fn.UpdatedAt
+		}
+
+		running := []string{}
+		for _, url := range local.urls {
+			if lambda.IsRunning(url) {
+				running = append(running, url)
+			}
+		}
+		if len(running) < desired {
+			if err := lambda.EnsureSource(*fn); err != nil {
+				log.Errorf("function %s cannot start on worker %s error %v", fn.ID, self.ID, err)
+				desired = len(running)
+			}
+		}
+		for len(running) < desired {
+			url, err := lambda.CreateFnInstance(*fn)
+			if err != nil {
+				log.Errorf("function %s failed to start instance on worker %s error %v", fn.ID, self.ID, err)
+				break
+			}
+			running = append(running, url)
+		}
+		if len(running) > desired {
+			stopInstances(fn.ID, running[desired:])
+			running = running[:desired]
+		}
+		local.urls = running
+	}
+
+	instances := make(map[string][]string)
+	for id, local := range localFunctions {
+		if !assigned[id] {
+			stopInstances(id, local.urls)
+			delete(localFunctions, id)
+			continue
+		}
+		if len(local.urls) > 0 {
+			instances[id] = append([]string{}, local.urls...)
+		}
+	}
+	return instances
+}
+
+func stopInstances(functionID string, urls []string) {
+	for _, url := range urls {
+		if err := lambda.StopInstance(url); err != nil {
+			log.Warnf("function %s failed to stop instance %s error %v", functionID, url, err)
+		}
+	}
+}
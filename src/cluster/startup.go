@@ -0,0 +1,177 @@
+package cluster
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kafkaesque-io/pubsub-function/src/lambda"
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+	"github.com/kafkaesque-io/pubsub-function/src/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// startup reconciliation states
+const (
+	ReconcilePending = "pending"
+	ReconcileRunning = "running"
+	ReconcileDone    = "done"
+)
+
+// ReconcileStatus is the progress of restarting the functions of this worker after the worker starts
+type ReconcileStatus struct {
+	State      string            `json:"state"`
+	Functions  int               `json:"functions"`
+	Reconciled int               `json:"reconciled"`
+	Failed     map[string]string `json:"failed,omitempty"`
+	StartedAt  time.Time         `json:"startedAt"`
+	FinishedAt time.Time         `json:"finishedAt"`
+}
+
+var reconciliation = ReconcileStatus{State: ReconcilePending, Failed: make(map[string]string)}
+
+var reconciliationLock = &sync.RWMutex{}
+
+// reconciled is closed when the startup reconciliation is done
+var reconciled = make(chan struct{})
+
+// GetReconcileStatus returns the progress of the startup reconciliation, nil if the worker does not run functions
+func GetReconcileStatus() *ReconcileStatus {
+	if singleDb == nil {
+		return nil
+	}
+	reconciliationLock.RLock()
+	defer reconciliationLock.RUnlock()
+	status := reconciliation
+	status.Failed = make(map[string]string)
+	for k, v := range reconciliation.Failed {
+		status.Failed[k] = v
+	}
+	return &status
+}
+
+// WaitReconciled blocks until the functions of this worker have been restarted,
+// so that the consumers are started with the webhook urls of the new instances
+func WaitReconciled() {
+	<-reconciled
+}
+
+// reconcileStartup restarts the instances of the activated functions after the worker starts.
+// The webhook urls in the database point to the instances of the previous process, they are replaced with the new instances.
+// In a worker cluster, the first heartbeat starts the instances assigned to this worker and the leader publishes their urls.
+func reconcileStartup() {
+	defer close(reconciled)
+	updateReconciliation(func(s *ReconcileStatus) {
+		s.State = ReconcileRunning
+		s.StartedAt = time.Now()
+	})
+	defer updateReconciliation(func(s *ReconcileStatus) {
+		s.State = ReconcileDone
+		s.FinishedAt = time.Now()
+	})
+
+	// the database topic must be read to the end before the functions are loaded
+	if err := singleDb.Sync(); err != nil {
+		log.Errorf("startup reconciliation failed to sync the database error %v", err)
+	}
+
+	if Enabled() {
+		tick()
+		fns, err := singleDb.Load()
+		if err != nil {
+			log.Errorf("startup reconciliation failed to load functions error %v", err)
+			return
+		}
+		assigned := []*model.FunctionConfig{}
+		for _, fn := range fns {
+			if fn.Assignments[self.ID] > 0 {
+				assigned = append(assigned, fn)
+			}
+		}
+		updateReconciliation(func(s *ReconcileStatus) { s.Functions = len(assigned) })
+		for _, fn := range assigned {
+			if desired := fn.Assignments[self.ID]; desired > 0 {
+				running := 0
+				if local, ok := localFunctions[fn.ID]; ok {
+					running = len(local.urls)
+				}
+				reportReconciled(fn.ID, fmt.Errorf("started %d of %d instances", running, desired), running >= desired)
+			}
+		}
+		return
+	}
+
+	fns, err := singleDb.Load()
+	if err != nil {
+		log.Errorf("startup reconciliation failed to load functions error %v", err)
+		return
+	}
+	// a database can be shared by workers outside of a worker cluster, a worker only restarts its own functions
+	workerID := util.GetWorkerID()
+	activated := []*model.FunctionConfig{}
+	for _, fn := range fns {
+		if fn.FunctionStatus != model.Activated {
+			continue
+		}
+		if !fn.RunsOn(workerID) {
+			log.Infof("startup reconciliation skips function %s of worker %s", fn.ID, fn.WorkerID)
+			continue
+		}
+		activated = append(activated, fn)
+	}
+	updateReconciliation(func(s *ReconcileStatus) { s.Functions = len(activated) })
+	for _, fn := range activated {
+		err := restartFunction(fn)
+		reportReconciled(fn.ID, err, err == nil)
+	}
+}
+
+// restartFunction starts the desired instances of a function on this worker and saves their urls.
+// Only the urls and the worker are written into the latest function config, which keeps the same UpdatedAt
+// so that it is not considered updated. A function saved without a worker is claimed by this worker.
+func restartFunction(fn *model.FunctionConfig) error {
+	if err := lambda.EnsureSource(*fn); err != nil {
+		return err
+	}
+	urls := []string{}
+	var err error
+	for len(urls) < fn.DesiredInstances() {
+		var url string
+		if url, err = lambda.CreateFnInstance(*fn); err != nil {
+			break
+		}
+		urls = append(urls, url)
+	}
+	log.Infof("function %s restarted %d instances %v", fn.ID, len(urls), urls)
+
+	current, getErr := singleDb.GetByKey(fn.ID)
+	if getErr != nil {
+		return getErr
+	}
+	current.WebhookURLs = urls
+	current.WorkerID = util.GetWorkerID()
+	if _, updateErr := singleDb.Update(current); updateErr != nil {
+		return updateErr
+	}
+	return err
+}
+
+func reportReconciled(functionID string, err error, ok bool) {
+	if !ok {
+		log.Errorf("startup reconciliation of function %s failed %v", functionID, err)
+	}
+	updateReconciliation(func(s *ReconcileStatus) {
+		if ok {
+			s.Reconciled++
+		} else {
+			s.Failed[functionID] = err.Error()
+		}
+	})
+}
+
+func updateReconciliation(update func(*ReconcileStatus)) {
+	reconciliationLock.Lock()
+	defer reconciliationLock.Unlock()
+	update(&reconciliation)
+}
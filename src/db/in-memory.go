@@ -2,6 +2,7 @@ package db
 
 import (
 	"errors"
+	"sync"
 	"time"
 
 	"github.com/kafkaesque-io/pubsub-function/src/model"
@@ -17,14 +18,23 @@ import (
 
 // InMemoryHandler is the in memory cache driver
 type InMemoryHandler struct {
-	functions map[string]model.FunctionConfig
-	logger    *log.Entry
+	functions    map[string]model.FunctionConfig
+	roleBindings map[string]model.RoleBinding
+	revocations  map[string]model.Revocation
+	workers      map[string]model.Worker
+	leases       map[string]model.LeaderLease
+	logger       *log.Entry
+	lock         sync.RWMutex
 }
 
 //Init is a Db interface method.
 func (s *InMemoryHandler) Init() error {
 	s.logger = log.WithFields(log.Fields{"app": "inmemory-db"})
 	s.functions = make(map[string]model.FunctionConfig)
+	s.roleBindings = make(map[string]model.RoleBinding)
+	s.revocations = make(map[string]model.Revocation)
+	s.workers = make(map[string]model.Worker)
+	s.leases = make(map[string]model.LeaderLease)
 	return nil
 }
 
@@ -52,6 +62,12 @@ func NewInMemoryHandler() (*InMemoryHandler, error) {
 
 // Create creates a new document
 func (s *InMemoryHandler) Create(functionCfg *model.FunctionConfig) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.create(functionCfg)
+}
+
+func (s *InMemoryHandler) create(functionCfg *model.FunctionConfig) (string, error) {
 	key, err := getKey(functionCfg)
 	if err != nil {
 		return key, err
@@ -72,7 +88,7 @@ func (s *InMemoryHandler) Create(functionCfg *model.FunctionConfig) (string, err
 
 // GetByTopic gets a document by the topic name and pulsar URL
 func (s *InMemoryHandler) GetByTopic(tenant, functionName string) (*model.FunctionConfig, error) {
-	key, err := model.GetKeyFromNames(tenant, functionName)
+	key, err := getKey(&model.FunctionConfig{Tenant: tenant, Name: functionName})
 	if err != nil {
 		return &model.FunctionConfig{}, err
 	}
@@ -81,6 +97,8 @@ func (s *InMemoryHandler) GetByTopic(tenant, functionName string) (*model.Functi
 
 // GetByKey gets a document by the key
 func (s *InMemoryHandler) GetByKey(hashedTopicKey string) (*model.FunctionConfig, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	if v, ok := s.functions[hashedTopicKey]; ok {
 		return &v, nil
 	}
@@ -89,9 +107,12 @@ func (s *InMemoryHandler) GetByKey(hashedTopicKey string) (*model.FunctionConfig
 
 // Load loads the entire database as a list
 func (s *InMemoryHandler) Load() ([]*model.FunctionConfig, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	results := []*model.FunctionConfig{}
 	for _, v := range s.functions {
-		results = append(results, &v)
+		fn := v
+		results = append(results, &fn)
 	}
 	log.Infof("load database table size %d", len(results))
 	return results, nil
@@ -99,13 +120,15 @@ func (s *InMemoryHandler) Load() ([]*model.FunctionConfig, error) {
 
 // Update updates or creates a topic config document
 func (s *InMemoryHandler) Update(functionCfg *model.FunctionConfig) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	key, err := getKey(functionCfg)
 	if err != nil {
 		return key, err
 	}
 
 	if _, ok := s.functions[key]; !ok {
-		return s.Create(functionCfg)
+		return s.create(functionCfg)
 	}
 
 	v := s.functions[key]
@@ -122,7 +145,7 @@ func (s *InMemoryHandler) Update(functionCfg *model.FunctionConfig) (string, err
 
 // Delete deletes a document
 func (s *InMemoryHandler) Delete(tenant, functionName string) (string, error) {
-	key, err := model.GetKeyFromNames(tenant, functionName)
+	key, err := getKey(&model.FunctionConfig{Tenant: tenant, Name: functionName})
 	if err != nil {
 		return "", err
 	}
@@ -131,6 +154,8 @@ func (s *InMemoryHandler) Delete(tenant, functionName string) (string, error) {
 
 // DeleteByKey deletes a document based on key
 func (s *InMemoryHandler) DeleteByKey(hashedTopicKey string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	if _, ok := s.functions[hashedTopicKey]; !ok {
 		return "", errors.New(DocNotFound)
 	}
@@ -138,3 +163,130 @@ func (s *InMemoryHandler) DeleteByKey(hashedTopicKey string) (string, error) {
 	delete(s.functions, hashedTopicKey)
 	return hashedTopicKey, nil
 }
+
+// GetRoleBindings gets all role bindings of a tenant
+func (s *InMemoryHandler) GetRoleBindings(tenant string) ([]*model.RoleBinding, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	results := []*model.RoleBinding{}
+	for _, v := range s.roleBindings {
+		if v.Tenant == tenant {
+			binding := v
+			results = append(results, &binding)
+		}
+	}
+	return results, nil
+}
+
+// UpdateRoleBinding updates or creates a role binding
+func (s *InMemoryHandler) UpdateRoleBinding(binding *model.RoleBinding) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if v, ok := s.roleBindings[binding.ID]; ok {
+		binding.CreatedAt = v.CreatedAt
+	}
+	binding.UpdatedAt = time.Now()
+	s.roleBindings[binding.ID] = *binding
+	return binding.ID, nil
+}
+
+// DeleteRoleBinding deletes a role binding
+func (s *InMemoryHandler) DeleteRoleBinding(tenant, bindingKey string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if v, ok := s.roleBindings[bindingKey]; !ok || v.Tenant != tenant {
+		return "", errors.New(DocNotFound)
+	}
+	delete(s.roleBindings, bindingKey)
+	return bindingKey, nil
+}
+
+// GetRevocation gets a revocation by the key
+func (s *InMemoryHandler) GetRevocation(key string) (*model.Revocation, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if v, ok := s.revocations[key]; ok {
+		return &v, nil
+	}
+	return &model.Revocation{}, errors.New(DocNotFound)
+}
+
+// GetRevocations gets all revocations
+func (s *InMemoryHandler) GetRevocations() ([]*model.Revocation, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	results := []*model.Revocation{}
+	for _, v := range s.revocations {
+		rv := v
+		results = append(results, &rv)
+	}
+	return results, nil
+}
+
+// Revoke creates or updates a revocation
+func (s *InMemoryHandler) Revoke(revocation *model.Revocation) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.revocations[revocation.ID] = *revocation
+	return revocation.ID, nil
+}
+
+// DeleteRevocation deletes a revocation
+func (s *InMemoryHandler) DeleteRevocation(key string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.revocations[key]; !ok {
+		return "", errors.New(DocNotFound)
+	}
+	delete(s.revocations, key)
+	return key, nil
+}
+
+// GetWorkers gets all registered workers
+func (s *InMemoryHandler) GetWorkers() ([]*model.Worker, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	results := []*model.Worker{}
+	for _, v := range s.workers {
+		worker := v
+		results = append(results, &worker)
+	}
+	return results, nil
+}
+
+// UpdateWorker registers or renews a worker
+func (s *InMemoryHandler) UpdateWorker(worker *model.Worker) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.workers[worker.ID] = *worker
+	return worker.ID, nil
+}
+
+// DeleteWorker deregisters a worker
+func (s *InMemoryHandler) DeleteWorker(id string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.workers[id]; !ok {
+		return "", errors.New(DocNotFound)
+	}
+	delete(s.workers, id)
+	return id, nil
+}
+
+// GetLease gets a leader election lease by the name
+func (s *InMemoryHandler) GetLease(name string) (*model.LeaderLease, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if v, ok := s.leases[name]; ok {
+		return &v, nil
+	}
+	return &model.LeaderLease{}, errors.New(DocNotFound)
+}
+
+// UpdateLease creates or renews a leader election lease
+func (s *InMemoryHandler) UpdateLease(lease *model.LeaderLease) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.leases[lease.Name] = *lease
+	return lease.Name, nil
+}
@@ -0,0 +1,47 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+)
+
+func TestFunctionKeysOfTenants(t *testing.T) {
+	handler, err := NewInMemoryHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the concatenated names of both functions are "abc"
+	functions := []*model.FunctionConfig{
+		{Tenant: "a", Name: "bc", LanguagePack: "javascript"},
+		{Tenant: "ab", Name: "c", LanguagePack: "nodejs"},
+	}
+	for _, fn := range functions {
+		if _, err = handler.Create(fn); err != nil {
+			t.Fatalf("create %s %s error %v", fn.Tenant, fn.Name, err)
+		}
+	}
+	if functions[0].ID == functions[1].ID {
+		t.Fatalf("got the same key %s of two tenants", functions[0].ID)
+	}
+
+	for _, want := range functions {
+		fn, err := handler.GetByTopic(want.Tenant, want.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fn.Tenant != want.Tenant || fn.LanguagePack != want.LanguagePack {
+			t.Errorf("got function %s %s %s, want %s %s %s", fn.Tenant, fn.Name, fn.LanguagePack, want.Tenant, want.Name, want.LanguagePack)
+		}
+	}
+
+	if _, err = handler.Delete("a", "bc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = handler.GetByTopic("ab", "c"); err != nil {
+		t.Errorf("deleting the function of the other tenant got error %v", err)
+	}
+	if model.GenKey("a", "bc") == model.GenKey("ab", "c") {
+		t.Error("got the same hashed key of two tenants")
+	}
+}
@@ -24,6 +24,34 @@ type Crud interface {
 	Load() ([]*model.FunctionConfig, error)
 }
 
+// PolicyCrud interface specifies operations on role bindings stored alongside function configs
+type PolicyCrud interface {
+	GetRoleBindings(tenant string) ([]*model.RoleBinding, error)
+	UpdateRoleBinding(binding *model.RoleBinding) (string, error)
+	DeleteRoleBinding(tenant, bindingKey string) (string, error)
+}
+
+// RevocationCrud interface specifies operations on token revocations
+type RevocationCrud interface {
+	GetRevocation(key string) (*model.Revocation, error)
+	GetRevocations() ([]*model.Revocation, error)
+	Revoke(revocation *model.Revocation) (string, error)
+	DeleteRevocation(key string) (string, error)
+}
+
+// WorkerCrud interface specifies operations on the worker cluster membership
+type WorkerCrud interface {
+	GetWorkers() ([]*model.Worker, error)
+	UpdateWorker(worker *model.Worker) (string, error)
+	DeleteWorker(id string) (string, error)
+}
+
+// LeaseCrud interface specifies operations on leader election leases
+type LeaseCrud interface {
+	GetLease(name string) (*model.LeaderLease, error)
+	UpdateLease(lease *model.LeaderLease) (string, error)
+}
+
 // Ops interface specifies required database access operations
 type Ops interface {
 	Init() error
@@ -32,9 +60,13 @@ type Ops interface {
 	Health() bool
 }
 
-// Db interface embeds two other database interfaces
+// Db interface embeds other database interfaces
 type Db interface {
 	Crud
+	PolicyCrud
+	RevocationCrud
+	WorkerCrud
+	LeaseCrud
 	Ops
 }
 
@@ -57,6 +89,14 @@ func NewDb(reqDbType string) (Db, error) {
 	return dbConn, err
 }
 
+// CloseDb closes the database if it has been created
+func CloseDb() error {
+	if dbConn == nil {
+		return nil
+	}
+	return dbConn.Close()
+}
+
 // NewDbWithPanic ensures a database is returned panic otherwise
 func NewDbWithPanic(reqDbType string) Db {
 	newDb, err := NewDb(reqDbType)
@@ -72,6 +112,16 @@ var DocNotFound = "no document found"
 // DocAlreadyExisted means document already existed in the database when a new creation is requested
 var DocAlreadyExisted = "document already existed"
 
+// document types stored in the database
+const (
+	docTypeProperty    = "docType"
+	functionDocType    = "function"
+	roleBindingDocType = "rolebinding"
+	revocationDocType  = "revocation"
+	workerDocType      = "worker"
+	leaseDocType       = "lease"
+)
+
 func getKey(cfg *model.FunctionConfig) (string, error) {
-	return cfg.Tenant + cfg.Name, nil
+	return model.FunctionKey(cfg.Tenant, cfg.Name), nil
 }
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/apache/pulsar-client-go/pulsar"
@@ -28,6 +29,9 @@ import (
 // the signal to track if the liveness of the reader process
 type liveSignal struct{}
 
+// syncTimeout is the max wait for the listener to read the database topic to the end
+const syncTimeout = 60 * time.Second
+
 // a map of FunctionConfig struct with Key, hash of pulsar URL and topic full name, is the key
 // var topics = make(map[string]model.FunctionConfig)
 
@@ -40,13 +44,32 @@ type PulsarHandler struct {
 	client      pulsar.Client
 	producer    pulsar.Producer
 	topics      map[string]model.FunctionConfig
-	logger      *log.Entry
+	// role bindings share the same database topic with a different document type
+	roleBindings map[string]model.RoleBinding
+	revocations  map[string]model.Revocation
+	workers      map[string]model.Worker
+	leases       map[string]model.LeaderLease
+	logger       *log.Entry
+	closed       int32
+	// synced is closed when the listener has read the database topic to the end for the first time
+	synced   chan struct{}
+	syncOnce sync.Once
+	// migrateOnce re-keys the documents of the previous key format once the database topic is read
+	migrateOnce sync.Once
+	// writeLock serializes the writes so that a read, send and cache update is consistent,
+	// the topics lock is only held to update the cache and not across the send
+	writeLock sync.Mutex
 }
 
 //Init is a Db interface method.
 func (s *PulsarHandler) Init() error {
 	s.logger = log.WithFields(log.Fields{"app": "pulsardb"})
 	s.topics = make(map[string]model.FunctionConfig)
+	s.roleBindings = make(map[string]model.RoleBinding)
+	s.revocations = make(map[string]model.Revocation)
+	s.workers = make(map[string]model.Worker)
+	s.leases = make(map[string]model.LeaderLease)
+	s.synced = make(chan struct{})
 
 	s.logger.Infof("database pulsar URL: %s", s.PulsarURL)
 	if log.GetLevel() == log.DebugLevel {
@@ -74,6 +97,9 @@ func (s *PulsarHandler) Init() error {
 		for {
 			select {
 			case <-sig:
+				if atomic.LoadInt32(&s.closed) == 1 {
+					return
+				}
 				go s.dbListener(sig)
 			}
 		}
@@ -102,28 +128,95 @@ func (s *PulsarHandler) dbListener(sig chan *liveSignal) error {
 	defer reader.Close()
 
 	ctx := context.Background()
+	caughtUp := false
 	// infinite loop to receive messages
 	for {
+		if !caughtUp && !reader.HasNext() {
+			caughtUp = true
+			s.syncOnce.Do(func() { close(s.synced) })
+		}
 		data, err := reader.Next(ctx)
 		if err != nil {
 			log.Errorf("dbListener reader.Next() error %v", err)
 			return err
 		}
-		doc := model.FunctionConfig{}
-		if err = json.Unmarshal(data.Payload(), &doc); err != nil {
+		if err = s.applyDoc(data); err != nil {
 			s.logger.Errorf("dblistener reader unmarshal error %v", err)
 			// ignore error and move on
+		}
+	}
+}
+
+// applyDoc applies a database message to the in memory cache based on the document type
+func (s *PulsarHandler) applyDoc(msg pulsar.Message) error {
+	s.topicsLock.Lock()
+	defer s.topicsLock.Unlock()
+
+	switch msg.Properties()[docTypeProperty] {
+	case roleBindingDocType:
+		// an empty payload is the tombstone of a deleted role binding
+		if len(msg.Payload()) == 0 {
+			delete(s.roleBindings, msg.Key())
+			return nil
+		}
+		binding := model.RoleBinding{}
+		if err := json.Unmarshal(msg.Payload(), &binding); err != nil {
+			return err
+		}
+		s.roleBindings[binding.ID] = binding
+	case revocationDocType:
+		if len(msg.Payload()) == 0 {
+			delete(s.revocations, msg.Key())
+			return nil
+		}
+		revocation := model.Revocation{}
+		if err := json.Unmarshal(msg.Payload(), &revocation); err != nil {
+			return err
+		}
+		s.revocations[revocation.ID] = revocation
+	case workerDocType:
+		if len(msg.Payload()) == 0 {
+			delete(s.workers, msg.Key())
+			return nil
+		}
+		worker := model.Worker{}
+		if err := json.Unmarshal(msg.Payload(), &worker); err != nil {
+			return err
+		}
+		s.workers[worker.ID] = worker
+	case leaseDocType:
+		lease := model.LeaderLease{}
+		if err := json.Unmarshal(msg.Payload(), &lease); err != nil {
+			return err
+		}
+		// a lease of an older epoch is stale
+		if v, ok := s.leases[lease.Name]; !ok || v.Epoch <= lease.Epoch {
+			s.leases[lease.Name] = lease
+		}
+	default:
+		doc := model.FunctionConfig{}
+		if err := json.Unmarshal(msg.Payload(), &doc); err != nil {
+			return err
+		}
+		if doc.FunctionStatus != model.Deleted {
+			s.logger.Infof("add topic configuration %s", doc.ID)
+			s.topics[doc.ID] = doc
 		} else {
-			s.topicsLock.Lock()
-			defer s.topicsLock.Unlock()
-			if doc.FunctionStatus != model.Deleted {
-				s.logger.Infof("add topic configuration %s", doc.ID)
-				s.topics[doc.ID] = doc
-			} else {
-				delete(s.topics, doc.ID)
-			}
+			delete(s.topics, doc.ID)
 		}
 	}
+	return nil
+}
+
+// sendDoc sends a document to the database topic
+func (s *PulsarHandler) sendDoc(docType, key string, data []byte) error {
+	msg := pulsar.ProducerMessage{
+		Payload:    data,
+		Key:        key,
+		Properties: map[string]string{docTypeProperty: docType},
+	}
+	_, err := s.producer.Send(context.Background(), &msg)
+	return err
 }
 
 func (s *PulsarHandler) createProducer() error {
@@ -135,9 +228,93 @@ func (s *PulsarHandler) createProducer() error {
 	return err
 }
 
-//Sync is a Db interface method.
+// Sync waits until the listener has read the database topic to the end, so that Load returns all the documents
 func (s *PulsarHandler) Sync() error {
-	return errors.New("Unsupported since this is automatically sync-ed")
+	select {
+	case <-s.synced:
+	case <-time.After(syncTimeout):
+		return errors.New("timed out reading the database topic")
+	}
+	s.migrateOnce.Do(func() {
+		if err := s.migrateKeys(); err != nil {
+			s.logger.Errorf("failed to migrate the database keys error %v", err)
+		}
+	})
+	return nil
+}
+
+// migrateKeys re-keys the functions and the role bindings stored before the keys separated the tenant from the name.
+// A document is written under the new key before the old key is deleted, a document already under the new key is kept.
+func (s *PulsarHandler) migrateKeys() error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	s.topicsLock.RLock()
+	functions := []model.FunctionConfig{}
+	for id, fn := range s.topics {
+		if id != model.FunctionKey(fn.Tenant, fn.Name) {
+			functions = append(functions, fn)
+		}
+	}
+	bindings := []model.RoleBinding{}
+	for id, binding := range s.roleBindings {
+		if id != model.RoleBindingKey(binding.Tenant, binding.Claim, binding.Subject) {
+			bindings = append(bindings, binding)
+		}
+	}
+	s.topicsLock.RUnlock()
+
+	for _, fn := range functions {
+		oldKey := fn.ID
+		fn.ID = model.FunctionKey(fn.Tenant, fn.Name)
+		if _, err := s.GetByKey(fn.ID); err != nil {
+			if _, err = s.updateCacheAndPulsar(&fn); err != nil {
+				return err
+			}
+		}
+		deleted := fn
+		deleted.ID = oldKey
+		deleted.FunctionStatus = model.Deleted
+		data, err := json.Marshal(deleted)
+		if err != nil {
+			return err
+		}
+		if err = s.sendDoc(functionDocType, oldKey, data); err != nil {
+			return err
+		}
+		s.topicsLock.Lock()
+		delete(s.topics, oldKey)
+		s.topicsLock.Unlock()
+		s.logger.Infof("migrated function %s to key %s", oldKey, fn.ID)
+	}
+
+	for _, binding := range bindings {
+		oldKey := binding.ID
+		binding.ID = model.RoleBindingKey(binding.Tenant, binding.Claim, binding.Subject)
+		s.topicsLock.RLock()
+		_, ok := s.roleBindings[binding.ID]
+		s.topicsLock.RUnlock()
+		if !ok {
+			data, err := json.Marshal(binding)
+			if err != nil {
+				return err
+			}
+			if err = s.sendDoc(roleBindingDocType, binding.ID, data); err != nil {
+				return err
+			}
+		}
+		if err := s.sendDoc(roleBindingDocType, oldKey, []byte{}); err != nil {
+			return err
+		}
+		s.topicsLock.Lock()
+		if !ok {
+			s.roleBindings[binding.ID] = binding
+		}
+		delete(s.roleBindings, oldKey)
+		s.topicsLock.Unlock()
+		s.logger.Infof("migrated role binding %s to key %s", oldKey, binding.ID)
+	}
+	return nil
 }
 
 //Health is a Db interface method
@@ -145,12 +322,13 @@ func (s *PulsarHandler) Health() bool {
 	return true
 }
 
-// Close closes database
+// Close flushes and closes the producer, and closes the client so that the listener stops
 func (s *PulsarHandler) Close() error {
+	atomic.StoreInt32(&s.closed, 1)
+	err := s.producer.Flush()
 	s.producer.Close()
-	// s.client.Close()
-	// Here is a Client object leak
-	return nil
+	s.client.Close()
+	return err
 }
 
 //NewPulsarHandler initialize a Pulsar Db
@@ -170,12 +348,18 @@ func NewPulsarHandler() (*PulsarHandler, error) {
 
 // Create creates a new document
 func (s *PulsarHandler) Create(functionCfg *model.FunctionConfig) (string, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	return s.create(functionCfg)
+}
+
+func (s *PulsarHandler) create(functionCfg *model.FunctionConfig) (string, error) {
 	key, err := getKey(functionCfg)
 	if err != nil {
 		return key, err
 	}
 
-	if _, ok := s.topics[key]; ok {
+	if _, err = s.GetByKey(key); err == nil {
 		return key, errors.New(DocAlreadyExisted)
 	}
 
@@ -187,31 +371,27 @@ func (s *PulsarHandler) Create(functionCfg *model.FunctionConfig) (string, error
 }
 
 func (s *PulsarHandler) updateCacheAndPulsar(functionCfg *model.FunctionConfig) (string, error) {
-
-	ctx := context.Background()
 	data, err := json.Marshal(*functionCfg)
 	if err != nil {
 		return "", err
 	}
-	msg := pulsar.ProducerMessage{
-		Payload: data,
-		Key:     functionCfg.ID,
-	}
 
-	if _, err = s.producer.Send(ctx, &msg); err != nil {
+	if err = s.sendDoc(functionDocType, functionCfg.ID, data); err != nil {
 		return "", err
 	}
 	// s.producer.Flush() do not use it's a blocking call
 
 	s.logger.Infof("send to Pulsar %s", functionCfg.ID)
 
+	s.topicsLock.Lock()
 	s.topics[functionCfg.ID] = *functionCfg
+	s.topicsLock.Unlock()
 	return functionCfg.ID, nil
 }
 
 // GetByTopic gets a document by the topic name and pulsar URL
 func (s *PulsarHandler) GetByTopic(tenant, functionName string) (*model.FunctionConfig, error) {
-	key, err := model.GetKeyFromNames(tenant, functionName)
+	key, err := getKey(&model.FunctionConfig{Tenant: tenant, Name: functionName})
 	if err != nil {
 		return &model.FunctionConfig{}, err
 	}
@@ -220,6 +400,8 @@ func (s *PulsarHandler) GetByTopic(tenant, functionName string) (*model.Function
 
 // GetByKey gets a document by the key
 func (s *PulsarHandler) GetByKey(hashedTopicKey string) (*model.FunctionConfig, error) {
+	s.topicsLock.RLock()
+	defer s.topicsLock.RUnlock()
 	if v, ok := s.topics[hashedTopicKey]; ok {
 		return &v, nil
 	}
@@ -229,28 +411,28 @@ func (s *PulsarHandler) GetByKey(hashedTopicKey string) (*model.FunctionConfig,
 // Load loads the entire database into memory
 func (s *PulsarHandler) Load() ([]*model.FunctionConfig, error) {
 	results := []*model.FunctionConfig{}
+	s.topicsLock.RLock()
+	defer s.topicsLock.RUnlock()
 	for _, v := range s.topics {
-		results = append(results, &v)
+		fn := v
+		results = append(results, &fn)
 	}
 	return results, nil
 }
 
 // Update updates or creates a topic config document
 func (s *PulsarHandler) Update(functionCfg *model.FunctionConfig) (string, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
 	key, err := getKey(functionCfg)
 	if err != nil {
 		return key, err
 	}
 
-	if _, ok := s.topics[key]; !ok {
-		return s.Create(functionCfg)
+	if _, err = s.GetByKey(key); err != nil {
+		return s.create(functionCfg)
 	}
 
-	v := s.topics[key]
-	v.Tenant = functionCfg.Tenant
-	v.FunctionStatus = functionCfg.FunctionStatus
-	v.UpdatedAt = time.Now()
-
 	s.logger.Infof("upsert %s", key)
 	return s.updateCacheAndPulsar(functionCfg)
 
@@ -258,7 +440,7 @@ func (s *PulsarHandler) Update(functionCfg *model.FunctionConfig) (string, error
 
 // Delete deletes a document
 func (s *PulsarHandler) Delete(tenant, functionName string) (string, error) {
-	key, err := model.GetKeyFromNames(tenant, functionName)
+	key, err := getKey(&model.FunctionConfig{Tenant: tenant, Name: functionName})
 	if err != nil {
 		return "", err
 	}
@@ -267,28 +449,214 @@ func (s *PulsarHandler) Delete(tenant, functionName string) (string, error) {
 
 // DeleteByKey deletes a document based on key
 func (s *PulsarHandler) DeleteByKey(hashedTopicKey string) (string, error) {
-	if _, ok := s.topics[hashedTopicKey]; !ok {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	v, err := s.GetByKey(hashedTopicKey)
+	if err != nil {
+		return "", err
+	}
+	v.FunctionStatus = model.Deleted
+
+	data, err := json.Marshal(*v)
+	if err != nil {
+		return "", err
+	}
+
+	if err = s.sendDoc(functionDocType, v.ID, data); err != nil {
+		return "", err
+	}
+
+	s.topicsLock.Lock()
+	delete(s.topics, v.ID)
+	s.topicsLock.Unlock()
+	return hashedTopicKey, nil
+}
+
+// GetRoleBindings gets all role bindings of a tenant
+func (s *PulsarHandler) GetRoleBindings(tenant string) ([]*model.RoleBinding, error) {
+	s.topicsLock.RLock()
+	defer s.topicsLock.RUnlock()
+	results := []*model.RoleBinding{}
+	for _, v := range s.roleBindings {
+		if v.Tenant == tenant {
+			binding := v
+			results = append(results, &binding)
+		}
+	}
+	return results, nil
+}
+
+// UpdateRoleBinding updates or creates a role binding
+func (s *PulsarHandler) UpdateRoleBinding(binding *model.RoleBinding) (string, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.topicsLock.RLock()
+	if v, ok := s.roleBindings[binding.ID]; ok {
+		binding.CreatedAt = v.CreatedAt
+	}
+	s.topicsLock.RUnlock()
+	binding.UpdatedAt = time.Now()
+
+	data, err := json.Marshal(*binding)
+	if err != nil {
+		return "", err
+	}
+	if err = s.sendDoc(roleBindingDocType, binding.ID, data); err != nil {
+		return "", err
+	}
+	s.topicsLock.Lock()
+	s.roleBindings[binding.ID] = *binding
+	s.topicsLock.Unlock()
+	return binding.ID, nil
+}
+
+// DeleteRoleBinding deletes a role binding
+func (s *PulsarHandler) DeleteRoleBinding(tenant, bindingKey string) (string, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.topicsLock.RLock()
+	v, ok := s.roleBindings[bindingKey]
+	s.topicsLock.RUnlock()
+	if !ok || v.Tenant != tenant {
 		return "", errors.New(DocNotFound)
 	}
 
-	v := s.topics[hashedTopicKey]
-	v.FunctionStatus = model.Deleted
+	// an empty payload is a tombstone that also allows topic compaction to remove the key
+	if err := s.sendDoc(roleBindingDocType, bindingKey, []byte{}); err != nil {
+		return "", err
+	}
+	s.topicsLock.Lock()
+	delete(s.roleBindings, bindingKey)
+	s.topicsLock.Unlock()
+	return bindingKey, nil
+}
 
-	ctx := context.Background()
-	data, err := json.Marshal(v)
+// GetRevocation gets a revocation by the key
+func (s *PulsarHandler) GetRevocation(key string) (*model.Revocation, error) {
+	s.topicsLock.RLock()
+	defer s.topicsLock.RUnlock()
+	if v, ok := s.revocations[key]; ok {
+		return &v, nil
+	}
+	return &model.Revocation{}, errors.New(DocNotFound)
+}
+
+// GetRevocations gets all revocations
+func (s *PulsarHandler) GetRevocations() ([]*model.Revocation, error) {
+	s.topicsLock.RLock()
+	defer s.topicsLock.RUnlock()
+	results := []*model.Revocation{}
+	for _, v := range s.revocations {
+		rv := v
+		results = append(results, &rv)
+	}
+	return results, nil
+}
+
+// Revoke creates or updates a revocation, it is replicated to other workers through the database topic
+func (s *PulsarHandler) Revoke(revocation *model.Revocation) (string, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	data, err := json.Marshal(*revocation)
 	if err != nil {
 		return "", err
 	}
+	if err = s.sendDoc(revocationDocType, revocation.ID, data); err != nil {
+		return "", err
+	}
+	s.topicsLock.Lock()
+	s.revocations[revocation.ID] = *revocation
+	s.topicsLock.Unlock()
+	return revocation.ID, nil
+}
 
-	msg := pulsar.ProducerMessage{
-		Payload: data,
-		Key:     v.ID,
+// DeleteRevocation deletes a revocation
+func (s *PulsarHandler) DeleteRevocation(key string) (string, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if _, err := s.GetRevocation(key); err != nil {
+		return "", err
+	}
+	if err := s.sendDoc(revocationDocType, key, []byte{}); err != nil {
+		return "", err
 	}
+	s.topicsLock.Lock()
+	delete(s.revocations, key)
+	s.topicsLock.Unlock()
+	return key, nil
+}
+
+// GetWorkers gets all registered workers
+func (s *PulsarHandler) GetWorkers() ([]*model.Worker, error) {
+	s.topicsLock.RLock()
+	defer s.topicsLock.RUnlock()
+	results := []*model.Worker{}
+	for _, v := range s.workers {
+		worker := v
+		results = append(results, &worker)
+	}
+	return results, nil
+}
 
-	if _, err = s.producer.Send(ctx, &msg); err != nil {
+// UpdateWorker registers or renews a worker, it is replicated to other workers through the database topic
+func (s *PulsarHandler) UpdateWorker(worker *model.Worker) (string, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	data, err := json.Marshal(*worker)
+	if err != nil {
+		return "", err
+	}
+	if err = s.sendDoc(workerDocType, worker.ID, data); err != nil {
 		return "", err
 	}
+	s.topicsLock.Lock()
+	s.workers[worker.ID] = *worker
+	s.topicsLock.Unlock()
+	return worker.ID, nil
+}
 
-	delete(s.topics, v.ID)
-	return hashedTopicKey, nil
+// DeleteWorker deregisters a worker
+func (s *PulsarHandler) DeleteWorker(id string) (string, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.topicsLock.RLock()
+	_, ok := s.workers[id]
+	s.topicsLock.RUnlock()
+	if !ok {
+		return "", errors.New(DocNotFound)
+	}
+	if err := s.sendDoc(workerDocType, id, []byte{}); err != nil {
+		return "", err
+	}
+	s.topicsLock.Lock()
+	delete(s.workers, id)
+	s.topicsLock.Unlock()
+	return id, nil
+}
+
+// GetLease gets a leader election lease by the name
+func (s *PulsarHandler) GetLease(name string) (*model.LeaderLease, error) {
+	s.topicsLock.RLock()
+	defer s.topicsLock.RUnlock()
+	if v, ok := s.leases[name]; ok {
+		return &v, nil
+	}
+	return &model.LeaderLease{}, errors.New(DocNotFound)
+}
+
+// UpdateLease creates or renews a leader election lease, it is replicated to other workers through the database topic
+func (s *PulsarHandler) UpdateLease(lease *model.LeaderLease) (string, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	data, err := json.Marshal(*lease)
+	if err != nil {
+		return "", err
+	}
+	if err = s.sendDoc(leaseDocType, lease.Name, data); err != nil {
+		return "", err
+	}
+	s.topicsLock.Lock()
+	s.leases[lease.Name] = *lease
+	s.topicsLock.Unlock()
+	return lease.Name, nil
 }
@@ -0,0 +1,80 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// fakeProducer records the keys and the payloads sent to the database topic
+type fakeProducer struct {
+	pulsar.Producer
+	sent []*pulsar.ProducerMessage
+}
+
+func (p *fakeProducer) Send(ctx context.Context, msg *pulsar.ProducerMessage) (pulsar.MessageID, error) {
+	p.sent = append(p.sent, msg)
+	return nil, nil
+}
+
+func TestMigrateKeys(t *testing.T) {
+	// the previous key of a function is the concatenated names
+	migrated := model.FunctionConfig{ID: "abc", Tenant: "ab", Name: "c"}
+	current := model.FunctionConfig{ID: model.FunctionKey("a", "bc"), Tenant: "a", Name: "bc"}
+	binding := model.NewRoleBinding("acme", "", "ci-pipeline", model.DeployerRole)
+	oldBinding := binding
+	oldBinding.ID = "old-binding"
+
+	producer := &fakeProducer{}
+	s := &PulsarHandler{
+		producer:     producer,
+		logger:       log.WithFields(log.Fields{"app": "pulsardb"}),
+		topics:       map[string]model.FunctionConfig{migrated.ID: migrated, current.ID: current},
+		roleBindings: map[string]model.RoleBinding{oldBinding.ID: oldBinding},
+	}
+	if err := s.migrateKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{}
+	for key := range s.topics {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if want := []string{"a/bc", "ab/c"}; len(keys) != 2 || keys[0] != want[0] || keys[1] != want[1] {
+		t.Errorf("got function keys %v, want %v", keys, want)
+	}
+	if fn := s.topics["ab/c"]; fn.ID != "ab/c" {
+		t.Errorf("got migrated function id %s", fn.ID)
+	}
+	if _, ok := s.roleBindings[binding.ID]; !ok || len(s.roleBindings) != 1 {
+		t.Errorf("got role bindings %v, want the key %s", s.roleBindings, binding.ID)
+	}
+
+	// the other workers apply the new documents and the deletions of the old keys
+	sent := map[string]*pulsar.ProducerMessage{}
+	for _, msg := range producer.sent {
+		sent[msg.Key] = msg
+	}
+	if len(producer.sent) != 4 {
+		t.Errorf("got %d documents sent, want 4", len(producer.sent))
+	}
+	deleted := model.FunctionConfig{}
+	if err := json.Unmarshal(sent["abc"].Payload, &deleted); err != nil || deleted.FunctionStatus != model.Deleted {
+		t.Errorf("got the old function key document %+v error %v, want deleted", deleted, err)
+	}
+	if msg := sent[oldBinding.ID]; msg == nil || len(msg.Payload) != 0 {
+		t.Errorf("got the old role binding key document %v, want a tombstone", msg)
+	}
+
+	producer.sent = nil
+	if err := s.migrateKeys(); err != nil || len(producer.sent) != 0 {
+		t.Errorf("migrating again sent %d documents error %v", len(producer.sent), err)
+	}
+}
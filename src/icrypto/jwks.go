@@ -0,0 +1,351 @@
+package icrypto
+
+// This is JWT verification with keys published as a JWKS document by an OIDC provider.
+// Keys are identified by `kid` and refreshed periodically, so that the provider can rotate them.
+// A token signed by an unknown `kid` also refreshes the keys, from the URL or the local file.
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// clockSkew is the leeway allowed for exp and nbf validation
+	clockSkew = 30 * time.Second
+
+	// minJWKSRefreshInterval throttles the on demand refresh triggered by an unknown kid
+	minJWKSRefreshInterval = 30 * time.Second
+
+	defaultJWKSRefreshInterval = time.Hour
+)
+
+var jwksSigningMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// JWKSOptions is the configuration of JWKS based token verification
+type JWKSOptions struct {
+	// URL is the JWKS endpoint of the OIDC provider
+	URL string
+	// File is a local JWKS document, used when URL is empty
+	File string
+	// Issuer is the required `iss` claim, skipped if empty
+	Issuer string
+	// Audiences are the accepted `aud` claims, skipped if empty
+	Audiences []string
+	// SubjectClaim is the claim to extract subjects from, default `sub`
+	SubjectClaim string
+	// RefreshInterval is the JWKS document refresh interval
+	RefreshInterval time.Duration
+}
+
+// JWKSVerifier verifies JWT against a JWKS document
+type JWKSVerifier struct {
+	opts        JWKSOptions
+	keys        map[string]interface{}
+	lastRefresh time.Time
+	client      *http.Client
+	// refreshLock serializes the on demand refreshes, so that the tokens of an unknown kid only read the JWKS once
+	refreshLock sync.Mutex
+	sync.RWMutex
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// NewJWKSVerifier creates a JWKS verifier and loads the initial JWKS document
+func NewJWKSVerifier(opts JWKSOptions) (*JWKSVerifier, error) {
+	if opts.URL == "" && opts.File == "" {
+		return nil, errors.New("either JWKS URL or JWKS file is required")
+	}
+	if opts.SubjectClaim == "" {
+		opts.SubjectClaim = "sub"
+	}
+	if opts.RefreshInterval <= 0 {
+		opts.RefreshInterval = defaultJWKSRefreshInterval
+	}
+
+	v := &JWKSVerifier{
+		opts:   opts,
+		keys:   make(map[string]interface{}),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	if err := v.Refresh(); err != nil {
+		return nil, err
+	}
+
+	if opts.URL != "" {
+		go func() {
+			for range time.Tick(opts.RefreshInterval) {
+				if err := v.Refresh(); err != nil {
+					log.Errorf("failed to refresh JWKS from %s error %v", opts.URL, err)
+				}
+			}
+		}()
+	}
+	return v, nil
+}
+
+// Refresh reloads the JWKS document from the URL or the local file
+func (v *JWKSVerifier) Refresh() error {
+	data, err := v.readJWKS()
+	if err != nil {
+		return err
+	}
+
+	doc := jwks{}
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	keys := make(map[string]interface{})
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Warnf("skip JWKS key kid %s error %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return errors.New("no signing key found in JWKS")
+	}
+
+	v.Lock()
+	v.keys = keys
+	v.lastRefresh = time.Now()
+	v.Unlock()
+	log.Infof("loaded %d JWKS keys", len(keys))
+	return nil
+}
+
+func (v *JWKSVerifier) readJWKS() ([]byte, error) {
+	if v.opts.URL == "" {
+		return ioutil.ReadFile(v.opts.File)
+	}
+
+	res, err := v.client.Get(v.opts.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch JWKS failed with status %d", res.StatusCode)
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+// lookup returns the key of a kid and whether the keys are older than the min refresh interval
+func (v *JWKSVerifier) lookup(kid string) (interface{}, bool, bool) {
+	v.RLock()
+	defer v.RUnlock()
+	key, ok := v.keys[kid]
+	return key, ok, time.Since(v.lastRefresh) > minJWKSRefreshInterval
+}
+
+// getKey looks up the key by kid, the JWKS is refreshed once if the kid is unknown because of key rotation.
+// Concurrent lookups of an unknown kid wait for a single refresh.
+func (v *JWKSVerifier) getKey(kid string) (interface{}, error) {
+	key, ok, stale := v.lookup(kid)
+	if ok {
+		return key, nil
+	}
+
+	if stale {
+		v.refreshLock.Lock()
+		// the keys may have been refreshed while waiting for the lock
+		if key, ok, stale = v.lookup(kid); !ok && stale {
+			if err := v.Refresh(); err != nil {
+				v.refreshLock.Unlock()
+				return nil, err
+			}
+			key, ok, _ = v.lookup(kid)
+		}
+		v.refreshLock.Unlock()
+		if ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key id %s", kid)
+}
+
+// DecodeToken decodes and verifies a token string
+func (v *JWKSVerifier) DecodeToken(tokenStr string) (*jwt.Token, error) {
+	parser := jwt.Parser{
+		ValidMethods:         jwksSigningMethods,
+		SkipClaimsValidation: true,
+	}
+	token, err := parser.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return v.getKey(kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	if err = v.validateClaims(token.Claims.(jwt.MapClaims)); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// validateClaims validates iss, aud, exp, and nbf claims
+func (v *JWKSVerifier) validateClaims(claims jwt.MapClaims) error {
+	now := time.Now()
+	if !claims.VerifyExpiresAt(now.Add(-clockSkew).Unix(), true) {
+		return errors.New("token is expired or missing exp")
+	}
+	if !claims.VerifyNotBefore(now.Add(clockSkew).Unix(), false) {
+		return errors.New("token is not valid yet")
+	}
+	if v.opts.Issuer != "" && !claims.VerifyIssuer(v.opts.Issuer, true) {
+		return errors.New("invalid issuer")
+	}
+	if len(v.opts.Audiences) > 0 && !verifyAudience(claims["aud"], v.opts.Audiences) {
+		return errors.New("invalid audience")
+	}
+	return nil
+}
+
+// GetTokenClaims gets all claims from a verified token
+func (v *JWKSVerifier) GetTokenClaims(tokenStr string) (jwt.MapClaims, error) {
+	token, err := v.DecodeToken(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+	return token.Claims.(jwt.MapClaims), nil
+}
+
+// GetTokenSubject gets the subjects from the configured subject claim of a token
+func (v *JWKSVerifier) GetTokenSubject(tokenStr string) (string, error) {
+	claims, err := v.GetTokenClaims(tokenStr)
+	if err != nil {
+		return "", err
+	}
+	return v.SubjectFromClaims(claims)
+}
+
+// SubjectFromClaims gets the subjects from the configured subject claim
+func (v *JWKSVerifier) SubjectFromClaims(claims jwt.MapClaims) (string, error) {
+	return claimValues(claims, v.opts.SubjectClaim)
+}
+
+// verifyAudience accepts either a single string or an array of audiences
+func verifyAudience(aud interface{}, accepted []string) bool {
+	var auds []string
+	switch a := aud.(type) {
+	case string:
+		auds = []string{a}
+	case []interface{}:
+		for _, item := range a {
+			if str, ok := item.(string); ok {
+				auds = append(auds, str)
+			}
+		}
+	}
+	for _, a := range auds {
+		for _, v := range accepted {
+			if a == strings.TrimSpace(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimValues returns a claim as comma separated values, a claim can be a string or an array of strings
+func claimValues(claims jwt.MapClaims, name string) (string, error) {
+	switch v := claims[name].(type) {
+	case string:
+		if v != "" {
+			return v, nil
+		}
+	case []interface{}:
+		values := []string{}
+		for _, item := range v {
+			if str, ok := item.(string); ok {
+				values = append(values, str)
+			}
+		}
+		if len(values) > 0 {
+			return strings.Join(values, ","), nil
+		}
+	}
+	return "", fmt.Errorf("missing subjects in claim %s", name)
+}
+
+func (k *jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBase64URLInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBase64URLInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeBase64URLInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBase64URLInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+}
+
+func decodeBase64URLInt(str string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(str, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,264 @@
+package icrypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func rsaJWK(kid string, key *rsa.PrivateKey) jwk {
+	return jwk{
+		Kid: kid,
+		Kty: "RSA",
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PrivateKey) jwk {
+	return jwk{
+		Kid: kid,
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+	}
+}
+
+func writeJWKS(t *testing.T, file string, keys ...jwk) {
+	data, err := json.Marshal(jwks{Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	tokenStr, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokenStr
+}
+
+func TestJWKSVerifier(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "jwks.json")
+	// an encryption key is not used to verify signatures
+	encryption := rsaJWK("enc", rsaKey)
+	encryption.Use = "enc"
+	writeJWKS(t, file, rsaJWK("rsa", rsaKey), ecJWK("ec", ecKey), encryption)
+
+	v, err := NewJWKSVerifier(JWKSOptions{
+		File:         file,
+		Issuer:       "https://issuer",
+		Audiences:    []string{"api", "cli"},
+		SubjectClaim: "groups",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	claims := func(overrides jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"sub":    "user",
+			"groups": []string{"acme", "ops"},
+			"iss":    "https://issuer",
+			"aud":    "api",
+			"exp":    now.Add(time.Hour).Unix(),
+		}
+		for k, value := range overrides {
+			if value == nil {
+				delete(c, k)
+			} else {
+				c[k] = value
+			}
+		}
+		return c
+	}
+	cases := []struct {
+		name    string
+		method  jwt.SigningMethod
+		kid     string
+		claims  jwt.MapClaims
+		wantErr bool
+	}{
+		{"rsa key", jwt.SigningMethodRS256, "rsa", claims(nil), false},
+		{"ec key", jwt.SigningMethodES256, "ec", claims(nil), false},
+		{"unknown kid", jwt.SigningMethodRS256, "rotated", claims(nil), true},
+		{"encryption key", jwt.SigningMethodRS256, "enc", claims(nil), true},
+		{"expired", jwt.SigningMethodRS256, "rsa", claims(jwt.MapClaims{"exp": now.Add(-time.Minute).Unix()}), true},
+		{"expired within clock skew", jwt.SigningMethodRS256, "rsa", claims(jwt.MapClaims{"exp": now.Add(-10 * time.Second).Unix()}), false},
+		{"missing exp", jwt.SigningMethodRS256, "rsa", claims(jwt.MapClaims{"exp": nil}), true},
+		{"not valid yet", jwt.SigningMethodRS256, "rsa", claims(jwt.MapClaims{"nbf": now.Add(time.Minute).Unix()}), true},
+		{"not valid yet within clock skew", jwt.SigningMethodRS256, "rsa", claims(jwt.MapClaims{"nbf": now.Add(10 * time.Second).Unix()}), false},
+		{"wrong issuer", jwt.SigningMethodRS256, "rsa", claims(jwt.MapClaims{"iss": "https://other"}), true},
+		{"missing issuer", jwt.SigningMethodRS256, "rsa", claims(jwt.MapClaims{"iss": nil}), true},
+		{"audience in a list", jwt.SigningMethodRS256, "rsa", claims(jwt.MapClaims{"aud": []string{"web", "cli"}}), false},
+		{"wrong audience", jwt.SigningMethodRS256, "rsa", claims(jwt.MapClaims{"aud": "web"}), true},
+		{"missing audience", jwt.SigningMethodRS256, "rsa", claims(jwt.MapClaims{"aud": nil}), true},
+		{"missing subject claim", jwt.SigningMethodRS256, "rsa", claims(jwt.MapClaims{"groups": nil}), true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var key interface{} = rsaKey
+			if c.method == jwt.SigningMethodES256 {
+				key = ecKey
+			}
+			subjects, err := v.GetTokenSubject(signToken(t, c.method, c.kid, key, c.claims))
+			if (err != nil) != c.wantErr {
+				t.Fatalf("got error %v, want error %v", err, c.wantErr)
+			}
+			if !c.wantErr && subjects != "acme,ops" {
+				t.Errorf("got subjects %s, want acme,ops", subjects)
+			}
+		})
+	}
+
+	// a token signed with a symmetric key is rejected even if the kid is known
+	hmac := signToken(t, jwt.SigningMethodHS256, "rsa", []byte("secret"), claims(nil))
+	if _, err = v.DecodeToken(hmac); err == nil {
+		t.Error("got no error for a HS256 token")
+	}
+}
+
+func TestJWKSRotation(t *testing.T) {
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "jwks.json")
+	writeJWKS(t, file, rsaJWK("old", oldKey))
+
+	v, err := NewJWKSVerifier(JWKSOptions{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := jwt.MapClaims{"sub": "user", "exp": time.Now().Add(time.Hour).Unix()}
+	oldToken := signToken(t, jwt.SigningMethodRS256, "old", oldKey, claims)
+	newToken := signToken(t, jwt.SigningMethodRS256, "new", newKey, claims)
+	if _, err = v.DecodeToken(oldToken); err != nil {
+		t.Fatal(err)
+	}
+
+	writeJWKS(t, file, rsaJWK("new", newKey))
+	// the keys were just loaded, an unknown kid does not refresh them within the min refresh interval
+	if _, err = v.DecodeToken(newToken); err == nil {
+		t.Error("got no error for an unknown kid within the min refresh interval")
+	}
+	v.Lock()
+	v.lastRefresh = time.Now().Add(-2 * minJWKSRefreshInterval)
+	v.Unlock()
+	if _, err = v.DecodeToken(newToken); err != nil {
+		t.Errorf("got error %v for the rotated key", err)
+	}
+	if _, err = v.DecodeToken(oldToken); err == nil {
+		t.Error("got no error for the removed key")
+	}
+
+	// a periodic refresh loads the rotated keys
+	writeJWKS(t, file, rsaJWK("old", oldKey))
+	if err = v.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = v.DecodeToken(oldToken); err != nil {
+		t.Errorf("got error %v after refresh", err)
+	}
+	writeJWKS(t, file)
+	if err = v.Refresh(); err == nil {
+		t.Error("got no error for a JWKS without keys")
+	}
+	if _, err = v.DecodeToken(oldToken); err != nil {
+		t.Errorf("got error %v, a failed refresh should keep the keys", err)
+	}
+}
+
+func TestJWKSRefreshSingleFlight(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches int32
+	var doc atomic.Value
+	doc.Store(jwks{Keys: []jwk{rsaJWK("old", key)}})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		// a slow provider lets the concurrent tokens pile up
+		time.Sleep(50 * time.Millisecond)
+		json.NewEncoder(w).Encode(doc.Load())
+	}))
+	defer server.Close()
+
+	v, err := NewJWKSVerifier(JWKSOptions{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc.Store(jwks{Keys: []jwk{rsaJWK("new", key)}})
+	v.Lock()
+	v.lastRefresh = time.Now().Add(-2 * minJWKSRefreshInterval)
+	v.Unlock()
+
+	token := signToken(t, jwt.SigningMethodRS256, "new", key, jwt.MapClaims{"sub": "user", "exp": time.Now().Add(time.Hour).Unix()})
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := v.DecodeToken(token)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("got error %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("got %d JWKS fetches, want the initial one and a single refresh", n)
+	}
+}
@@ -4,11 +4,14 @@ package icrypto
 
 import (
 	"bufio"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"time"
@@ -17,16 +20,37 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// TokenVerifier verifies a JWT and extracts its claims and subjects
+type TokenVerifier interface {
+	GetTokenClaims(tokenStr string) (jwt.MapClaims, error)
+	GetTokenSubject(tokenStr string) (string, error)
+	SubjectFromClaims(claims jwt.MapClaims) (string, error)
+}
+
 // RSAKeyPair for JWT token sign and verification
 type RSAKeyPair struct {
 	PrivateKey *rsa.PrivateKey
 	PublicKey  *rsa.PublicKey
+
+	// AllowNoExpiry accepts tokens without exp claim, exp is required by default
+	AllowNoExpiry bool
 }
 
-const (
-	tokenDuration = 24
-	expireOffset  = 3600
-)
+// TokenOptions are the optional claims of a generated token
+type TokenOptions struct {
+	// TTL is the token time to live, default 24 hours
+	TTL time.Duration
+	// Audience is the optional aud claim
+	Audience string
+	// Claims are extra custom claims, they cannot overwrite the registered claims
+	Claims map[string]interface{}
+}
+
+// DefaultTokenTTL is the time to live of a token unless specified
+const DefaultTokenTTL = 24 * time.Hour
+
+// registeredClaims are set by the token server only
+var registeredClaims = []string{"sub", "exp", "iat", "nbf", "aud", "iss", "jti"}
 
 var jwtRsaKeys *RSAKeyPair
 
@@ -42,14 +66,39 @@ func NewRSAKeyPair(privateKeyPath, publicKeyPath string) *RSAKeyPair {
 	return jwtRsaKeys
 }
 
-// GenerateToken generates token with user defined subject
+// GenerateToken generates token with user defined subject and the default expiry
 func (keys *RSAKeyPair) GenerateToken(userSubject string) (string, error) {
-	token := jwt.New(jwt.SigningMethodRS256)
-	token.Claims = jwt.MapClaims{
-		// "exp": time.Now().Add(time.Hour * time.Duration(24)).Unix(),
-		// "iat": time.Now().Unix(),
-		"sub": userSubject,
+	return keys.GenerateTokenWithOptions(userSubject, TokenOptions{})
+}
+
+// GenerateTokenWithOptions generates token with user defined subject, expiry, audience, and custom claims
+func (keys *RSAKeyPair) GenerateTokenWithOptions(userSubject string, opts TokenOptions) (string, error) {
+	ttl := opts.TTL
+	if ttl <= 0 {
+		ttl = DefaultTokenTTL
 	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{}
+	for k, v := range opts.Claims {
+		claims[k] = v
+	}
+	for _, k := range registeredClaims {
+		delete(claims, k)
+	}
+	jti, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	claims["sub"] = userSubject
+	claims["jti"] = jti
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(ttl).Unix()
+	if opts.Audience != "" {
+		claims["aud"] = opts.Audience
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
 	tokenString, err := token.SignedString(keys.PrivateKey)
 	if err != nil {
 		return "", err
@@ -58,34 +107,51 @@ func (keys *RSAKeyPair) GenerateToken(userSubject string) (string, error) {
 }
 
 // DecodeToken decodes a token string
+// exp is required unless the key pair allows tokens without expiry, an expired token is always rejected
 func (keys *RSAKeyPair) DecodeToken(tokenStr string) (*jwt.Token, error) {
 	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-		return jwtRsaKeys.PublicKey, nil
+		return keys.PublicKey, nil
 	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	if token.Valid {
-		return token, nil
+	if !token.Valid {
+		return nil, errors.New("invalid token")
 	}
 
-	return nil, errors.New("invalid token")
+	claims := token.Claims.(jwt.MapClaims)
+	if !claims.VerifyExpiresAt(time.Now().Unix(), !keys.AllowNoExpiry) {
+		return nil, errors.New("token is expired or missing exp")
+	}
+	return token, nil
 }
 
 //TODO: support multiple subjects in claims
 
 // GetTokenSubject gets the subjects from a token
 func (keys *RSAKeyPair) GetTokenSubject(tokenStr string) (string, error) {
-	token, err := keys.DecodeToken(tokenStr)
+	claims, err := keys.GetTokenClaims(tokenStr)
 	if err != nil {
 		return "", err
 	}
-	claims := token.Claims.(jwt.MapClaims)
-	subjects, ok := claims["sub"]
-	if ok {
-		return subjects.(string), nil
+	return keys.SubjectFromClaims(claims)
+}
+
+// GetTokenClaims gets all claims from a verified token
+func (keys *RSAKeyPair) GetTokenClaims(tokenStr string) (jwt.MapClaims, error) {
+	token, err := keys.DecodeToken(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+	return token.Claims.(jwt.MapClaims), nil
+}
+
+// SubjectFromClaims gets the subjects from token claims
+func (keys *RSAKeyPair) SubjectFromClaims(claims jwt.MapClaims) (string, error) {
+	if subjects, ok := claims["sub"].(string); ok {
+		return subjects, nil
 	}
 	return "", errors.New("missing subjects")
 }
@@ -107,16 +173,27 @@ func (keys *RSAKeyPair) VerifyTokenSubject(tokenStr, subject string) (bool, erro
 	return false, errors.New("incorrect sub")
 }
 
-// GetTokenRemainingValidity is the remaining seconds before token expires
+// GetTokenRemainingValidity is the remaining seconds before token expires based on the exp claim.
+// It returns 0 if the token has expired, and -1 if the token never expires.
 func (keys *RSAKeyPair) GetTokenRemainingValidity(timestamp interface{}) int {
 	if validity, ok := timestamp.(float64); ok {
 		tm := time.Unix(int64(validity), 0)
 		remainer := tm.Sub(time.Now())
 		if remainer > 0 {
-			return int(remainer.Seconds() + expireOffset)
+			return int(remainer.Seconds())
 		}
+		return 0
+	}
+	return -1
+}
+
+// newTokenID generates a random jti for token revocation
+func newTokenID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", err
 	}
-	return expireOffset
+	return hex.EncodeToString(id), nil
 }
 
 // supports pk12 jks binary format
@@ -0,0 +1,118 @@
+package icrypto
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func newTestKeyPair(t *testing.T) *RSAKeyPair {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &RSAKeyPair{PrivateKey: key, PublicKey: &key.PublicKey}
+}
+
+func TestGenerateTokenWithOptions(t *testing.T) {
+	keys := newTestKeyPair(t)
+	cases := []struct {
+		name     string
+		opts     TokenOptions
+		ttl      time.Duration
+		audience interface{}
+		claims   map[string]interface{}
+	}{
+		{"default ttl", TokenOptions{}, 24 * time.Hour, nil, nil},
+		{"ttl and audience", TokenOptions{TTL: 2 * time.Hour, Audience: "pubsub-function"}, 2 * time.Hour, "pubsub-function", nil},
+		{"custom claims", TokenOptions{Claims: map[string]interface{}{"groups": []interface{}{"ci"}, "team": "ops"}}, 24 * time.Hour, nil,
+			map[string]interface{}{"team": "ops"}},
+		{"registered claims are not overwritten", TokenOptions{TTL: time.Hour, Claims: map[string]interface{}{
+			"sub": "admin", "exp": float64(0), "jti": "chosen", "aud": "other", "iss": "me", "team": "ops"}},
+			time.Hour, nil, map[string]interface{}{"team": "ops"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			now := time.Now()
+			tokenStr, err := keys.GenerateTokenWithOptions("alice", c.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims, err := keys.GetTokenClaims(tokenStr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sub, _ := keys.SubjectFromClaims(claims); sub != "alice" {
+				t.Errorf("got subject %s, want alice", sub)
+			}
+			exp := time.Unix(int64(claims["exp"].(float64)), 0)
+			if d := exp.Sub(now.Add(c.ttl)); d < -time.Second || d > time.Second {
+				t.Errorf("got exp %v, want %v", exp, now.Add(c.ttl))
+			}
+			if iat := int64(claims["iat"].(float64)); iat < now.Unix()-1 || iat > now.Unix()+1 {
+				t.Errorf("got iat %d, want %d", iat, now.Unix())
+			}
+			if jti, _ := claims["jti"].(string); len(jti) != 32 {
+				t.Errorf("got jti %s, want 16 random bytes in hex", jti)
+			}
+			if claims["aud"] != c.audience {
+				t.Errorf("got aud %v, want %v", claims["aud"], c.audience)
+			}
+			if _, ok := claims["iss"]; ok {
+				t.Errorf("got iss %v set by a custom claim", claims["iss"])
+			}
+			for k, v := range c.claims {
+				if claims[k] != v {
+					t.Errorf("got claim %s %v, want %v", k, claims[k], v)
+				}
+			}
+		})
+	}
+
+	first, _ := keys.GenerateToken("alice")
+	second, _ := keys.GenerateToken("alice")
+	firstClaims, _ := keys.GetTokenClaims(first)
+	secondClaims, _ := keys.GetTokenClaims(second)
+	if firstClaims["jti"] == secondClaims["jti"] {
+		t.Error("got the same jti of two tokens")
+	}
+}
+
+func TestDecodeTokenExpiry(t *testing.T) {
+	keys := newTestKeyPair(t)
+	other := newTestKeyPair(t)
+	sign := func(keys *RSAKeyPair, claims jwt.MapClaims) string {
+		tokenStr, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(keys.PrivateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokenStr
+	}
+	now := time.Now()
+	cases := []struct {
+		name          string
+		token         string
+		allowNoExpiry bool
+		wantErr       bool
+	}{
+		{"valid", sign(keys, jwt.MapClaims{"sub": "alice", "exp": now.Add(time.Hour).Unix()}), false, false},
+		{"expired", sign(keys, jwt.MapClaims{"sub": "alice", "exp": now.Add(-time.Minute).Unix()}), false, true},
+		{"missing exp", sign(keys, jwt.MapClaims{"sub": "alice"}), false, true},
+		{"missing exp allowed", sign(keys, jwt.MapClaims{"sub": "alice"}), true, false},
+		{"expired with missing exp allowed", sign(keys, jwt.MapClaims{"sub": "alice", "exp": now.Add(-time.Minute).Unix()}), true, true},
+		{"signed by another key", sign(other, jwt.MapClaims{"sub": "alice", "exp": now.Add(time.Hour).Unix()}), false, true},
+		{"not a token", "a.b.c", false, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			keys.AllowNoExpiry = c.allowNoExpiry
+			_, err := keys.DecodeToken(c.token)
+			if (err != nil) != c.wantErr {
+				t.Errorf("got error %v, want error %v", err, c.wantErr)
+			}
+		})
+	}
+}
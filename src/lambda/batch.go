@@ -0,0 +1,82 @@
+package lambda
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+)
+
+// BatchHeader is the format of a batch invocation, json or ndjson
+const BatchHeader = "PulsarBatch"
+
+// BatchMessage is a message in a batch invocation, the payload is base64 encoded in JSON
+type BatchMessage struct {
+	// ID is the base64 encoded Pulsar message id
+	ID          string            `json:"id"`
+	Key         string            `json:"key,omitempty"`
+	Topic       string            `json:"topic"`
+	Properties  map[string]string `json:"properties,omitempty"`
+	PublishTime time.Time         `json:"publishTime"`
+	Payload     []byte            `json:"payload"`
+}
+
+// BatchResult is the result of a message in a batch invocation. A message without a result, or with an error,
+// is negatively acknowledged. A non empty output is sent to the output topic.
+type BatchResult struct {
+	ID     string `json:"id"`
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// EncodeBatch encodes the messages of a batch invocation in the format, and returns the content type
+func EncodeBatch(messages []BatchMessage, format string) ([]byte, string, error) {
+	if format == model.NDJSONBatchFormat {
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		for i := range messages {
+			if err := encoder.Encode(&messages[i]); err != nil {
+				return nil, "", err
+			}
+		}
+		return buf.Bytes(), "application/x-ndjson", nil
+	}
+	data, err := json.Marshal(messages)
+	return data, "application/json", err
+}
+
+// DecodeBatchResults decodes the results of a batch invocation by message id, either a JSON array or ndjson
+func DecodeBatchResults(body []byte) (map[string]BatchResult, error) {
+	results := []BatchResult{}
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &results); err != nil {
+			return nil, fmt.Errorf("invalid batch results %v", err)
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(trimmed))
+		scanner.Buffer(make([]byte, 64<<10), len(trimmed)+1)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			var result BatchResult
+			if err := json.Unmarshal(line, &result); err != nil {
+				return nil, fmt.Errorf("invalid batch result %v", err)
+			}
+			results = append(results, result)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	byID := make(map[string]BatchResult, len(results))
+	for _, result := range results {
+		byID[result.ID] = result
+	}
+	return byID, nil
+}
@@ -0,0 +1,72 @@
+package lambda
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+)
+
+func TestDecodeBatchResults(t *testing.T) {
+	cases := []struct {
+		name    string
+		body    string
+		want    map[string]BatchResult
+		wantErr bool
+	}{
+		{"json array", ` [{"id":"a","output":"x"},{"id":"b","error":"failed"}]`,
+			map[string]BatchResult{"a": {ID: "a", Output: "x"}, "b": {ID: "b", Error: "failed"}}, false},
+		{"ndjson", "{\"id\":\"a\",\"output\":\"x\"}\n\n{\"id\":\"b\"}\n",
+			map[string]BatchResult{"a": {ID: "a", Output: "x"}, "b": {ID: "b"}}, false},
+		{"ndjson line longer than the scanner buffer", `{"id":"a","output":"` + strings.Repeat("x", 100<<10) + `"}`,
+			map[string]BatchResult{"a": {ID: "a", Output: strings.Repeat("x", 100<<10)}}, false},
+		{"empty body", "", map[string]BatchResult{}, false},
+		{"last result of an id wins", `[{"id":"a","error":"failed"},{"id":"a","output":"x"}]`,
+			map[string]BatchResult{"a": {ID: "a", Output: "x"}}, false},
+		{"invalid json array", `[{"id":"a"`, nil, true},
+		{"invalid ndjson line", "{\"id\":\"a\"}\nnot json\n", nil, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := DecodeBatchResults([]byte(c.body))
+			if (err != nil) != c.wantErr {
+				t.Fatalf("got error %v, want error %v", err, c.wantErr)
+			}
+			if !c.wantErr && !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestEncodeBatch(t *testing.T) {
+	messages := []BatchMessage{
+		{ID: "a", Topic: "t", PublishTime: time.Unix(0, 0).UTC(), Payload: []byte("1")},
+		{ID: "b", Key: "k", Topic: "t", PublishTime: time.Unix(0, 0).UTC(), Payload: []byte("2")},
+	}
+	cases := []struct {
+		format      string
+		contentType string
+		want        string
+	}{
+		{model.JSONBatchFormat, "application/json",
+			`[{"id":"a","topic":"t","publishTime":"1970-01-01T00:00:00Z","payload":"MQ=="},` +
+				`{"id":"b","key":"k","topic":"t","publishTime":"1970-01-01T00:00:00Z","payload":"Mg=="}]`},
+		{model.NDJSONBatchFormat, "application/x-ndjson",
+			`{"id":"a","topic":"t","publishTime":"1970-01-01T00:00:00Z","payload":"MQ=="}` + "\n" +
+				`{"id":"b","key":"k","topic":"t","publishTime":"1970-01-01T00:00:00Z","payload":"Mg=="}` + "\n"},
+	}
+	for _, c := range cases {
+		t.Run(c.format, func(t *testing.T) {
+			data, contentType, err := EncodeBatch(messages, c.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if contentType != c.contentType || string(data) != c.want {
+				t.Errorf("got %s %s, want %s %s", contentType, data, c.contentType, c.want)
+			}
+		})
+	}
+}
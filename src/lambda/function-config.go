@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/apache/pulsar-client-go/pulsar"
 	"github.com/kafkaesque-io/pubsub-function/src/model"
+	"github.com/kafkaesque-io/pubsub-function/src/util"
 )
 
 const (
@@ -16,21 +18,236 @@ const (
 
 	// CronTrigger is time based cron trigger
 	CronTrigger = "cron"
+
+	// WindowTrigger is pulsar input topic trigger invoked once per window of messages
+	WindowTrigger = "pulsar-window"
 )
 
-// ValidateFunctionConfig validates function config
-func ValidateFunctionConfig(cfg *model.FunctionTopic) error {
-	if !model.IsURL(cfg.PulsarURL) {
-		return fmt.Errorf("not a URL %s", cfg.PulsarURL)
+// FieldError is an invalid field of a function config
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists all of the invalid fields of a function config
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+// Error joins the field errors
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return "invalid function config " + strings.Join(msgs, "; ")
+}
+
+func (e *ValidationError) add(field, format string, args ...interface{}) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// err returns nil if there is no field error
+func (e *ValidationError) err() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+// ValidateFunction validates all fields of a function config before any instance is started,
+// the error is a ValidationError listing every invalid field including the ones found by the caller
+func ValidateFunction(cfg *model.FunctionConfig, fieldErrors ...FieldError) error {
+	v := &ValidationError{Fields: fieldErrors}
+	maxParallelism := util.StringToInt(util.GetConfig().MaxFunctionParallelism, 100)
+
+	switch strings.ToLower(cfg.LanguagePack) {
+	case "js", "javascript", "node", "nodejs":
+	default:
+		v.add("languagePack", "unsupported function language pack %s", cfg.LanguagePack)
+	}
+	if cfg.Parallelism < 0 || cfg.Parallelism > maxParallelism {
+		v.add("parallelism", "parallelism %d must be between 0 and %d", cfg.Parallelism, maxParallelism)
+	}
+	v.nonNegative("maxConcurrency", cfg.MaxConcurrency)
+	v.nonNegative("queueDepth", cfg.QueueDepth)
+	v.nonNegative("timeout", cfg.Timeout)
+	v.nonNegative("maxRedeliveries", cfg.MaxRedeliveries)
+	v.nonNegative("resources.memoryMB", cfg.Resources.MemoryMB)
+	v.nonNegative("resources.cpuMillis", cfg.Resources.CPUMillis)
+	v.nonNegative("resources.cpuTimeSeconds", cfg.Resources.CPUTimeSeconds)
+	v.nonNegative("resources.openFiles", cfg.Resources.OpenFiles)
+
+	scaling := cfg.Scaling
+	v.nonNegative("scaling.minParallelism", scaling.MinParallelism)
+	v.nonNegative("scaling.targetBacklog", scaling.TargetBacklog)
+	v.nonNegative("scaling.targetLatencyMs", scaling.TargetLatencyMs)
+	v.nonNegative("scaling.scaleUpCooldown", scaling.ScaleUpCooldown)
+	v.nonNegative("scaling.scaleDownCooldown", scaling.ScaleDownCooldown)
+	if scaling.MaxParallelism < 0 || scaling.MaxParallelism > maxParallelism {
+		v.add("scaling.maxParallelism", "max parallelism %d must be between 0 and %d", scaling.MaxParallelism, maxParallelism)
 	}
-	if strings.TrimSpace(cfg.Subscription) == "" {
-		return fmt.Errorf("subscription name is missing")
+	if scaling.Enabled() && scaling.MinParallelism > scaling.MaxParallelism {
+		v.add("scaling.minParallelism", "min parallelism %d is greater than max parallelism %d", scaling.MinParallelism, scaling.MaxParallelism)
 	}
-	if _, err := model.GetSubscriptionType(cfg.SubscriptionType); err != nil {
-		return err
+
+	batch := cfg.Batch
+	v.nonNegative("batch.maxSize", batch.MaxSize)
+	v.nonNegative("batch.maxBytes", batch.MaxBytes)
+	v.nonNegative("batch.maxWaitMs", batch.MaxWaitMs)
+	switch batch.Format {
+	case "", model.JSONBatchFormat, model.NDJSONBatchFormat:
+	default:
+		v.add("batch.format", "unsupported batch format %s", batch.Format)
+	}
+	if batch.Enabled() && cfg.TriggerType != PulsarTrigger {
+		v.add("batch.maxSize", "batch invocation requires the %s trigger", PulsarTrigger)
+	}
+	if batch.Enabled() && cfg.KeyOrdered() {
+		v.add("batch.maxSize", "batch invocation does not support the %s dispatch mode", model.KeyOrderedDispatch)
+	}
+
+	switch cfg.TriggerType {
+	case PulsarTrigger:
+		if cfg.InputTopic.TopicFullName == "" {
+			v.add("inputTopics.topicFullName", "input topic is required by the %s trigger", PulsarTrigger)
+		} else {
+			v.validateInputTopic("inputTopics", &cfg.InputTopic)
+		}
+		switch cfg.DispatchMode {
+		case "", model.RoundRobinDispatch, model.KeyOrderedDispatch:
+		default:
+			v.add("dispatchMode", "unsupported dispatch mode %s", cfg.DispatchMode)
+		}
+		if cfg.DeadLetterTopic != "" {
+			if _, _, _, _, err := util.ParseTopicFn(cfg.DeadLetterTopic); err != nil {
+				v.add("deadLetterTopic", "%v", err)
+			}
+		}
+	case WindowTrigger:
+		if cfg.InputTopic.TopicFullName == "" {
+			v.add("inputTopics.topicFullName", "input topic is required by the %s trigger", WindowTrigger)
+		} else {
+			v.validateInputTopic("inputTopics", &cfg.InputTopic)
+			// a window needs all messages of the subscription on a single consumer
+			if subType, err := model.GetSubscriptionType(cfg.InputTopic.SubscriptionType); err == nil &&
+				subType != pulsar.Exclusive && subType != pulsar.Failover {
+				v.add("inputTopics.subscriptionType", "the %s trigger requires an exclusive or failover subscription", WindowTrigger)
+			}
+		}
+		if cfg.OutputTopic.TopicFullName == "" {
+			v.add("outputTopics.topicFullName", "output topic is required by the %s trigger", WindowTrigger)
+		}
+		if cfg.DispatchMode != "" {
+			v.add("dispatchMode", "dispatch mode requires the %s trigger", PulsarTrigger)
+		}
+		v.validateWindow(cfg.Window)
+	case CronTrigger:
+		if cfg.DispatchMode != "" {
+			v.add("dispatchMode", "dispatch mode requires the %s trigger", PulsarTrigger)
+		}
+		if cfg.Cron == "" {
+			v.add("cron", "cron expression is required by the %s trigger", CronTrigger)
+		} else if _, err := model.ParseCron(cfg.Cron); err != nil {
+			v.add("cron", "%v", err)
+		}
+	case HTTPTrigger:
+		if cfg.DispatchMode != "" {
+			v.add("dispatchMode", "dispatch mode requires the %s trigger", PulsarTrigger)
+		}
+	default:
+		v.add("triggerType", "unsupported trigger type %s", cfg.TriggerType)
+	}
+	if !cfg.Window.IsZero() && cfg.TriggerType != WindowTrigger {
+		v.add("window.type", "window requires the %s trigger", WindowTrigger)
+	}
+	if cfg.OutputTopic.TopicFullName != "" {
+		v.validateTopic("outputTopics", &cfg.OutputTopic)
+	}
+	if cfg.LogTopic.TopicFullName != "" {
+		v.validateTopic("logTopic", &cfg.LogTopic)
+	}
+	return v.err()
+}
+
+// validateWindow validates a window is defined by either count or event time, session windows by event time
+func (e *ValidationError) validateWindow(w model.WindowPolicy) {
+	e.nonNegative("window.count", w.Count)
+	e.nonNegative("window.slideCount", w.SlideCount)
+	e.nonNegative("window.sizeMs", w.SizeMs)
+	e.nonNegative("window.slideMs", w.SlideMs)
+	e.nonNegative("window.gapMs", w.GapMs)
+	e.nonNegative("window.allowedLatenessMs", w.AllowedLatenessMs)
+	switch w.Format {
+	case "", model.JSONBatchFormat, model.NDJSONBatchFormat:
+	default:
+		e.add("window.format", "unsupported window format %s", w.Format)
+	}
+
+	switch w.GetType() {
+	case model.TumblingWindow, model.SlidingWindow:
+		if (w.Count > 0) == (w.SizeMs > 0) {
+			e.add("window.count", "a %s window requires either count or sizeMs", w.GetType())
+		}
+		if w.GapMs != 0 {
+			e.add("window.gapMs", "gap only applies to a %s window", model.SessionWindow)
+		}
+	case model.SessionWindow:
+		if w.GapMs <= 0 {
+			e.add("window.gapMs", "a %s window requires gapMs", model.SessionWindow)
+		}
+		if w.Count != 0 || w.SizeMs != 0 {
+			e.add("window.count", "a %s window is only defined by gapMs", model.SessionWindow)
+		}
+	default:
+		e.add("window.type", "unsupported window type %s", w.Type)
+		return
+	}
+
+	if w.GetType() == model.SlidingWindow {
+		if w.Count > 0 && (w.SlideCount <= 0 || w.SlideCount > w.Count) {
+			e.add("window.slideCount", "slide count %d must be between 1 and count %d", w.SlideCount, w.Count)
+		}
+		if w.SizeMs > 0 && (w.SlideMs <= 0 || w.SlideMs > w.SizeMs) {
+			e.add("window.slideMs", "slide %d must be between 1 and size %d", w.SlideMs, w.SizeMs)
+		}
+	} else if w.SlideCount != 0 || w.SlideMs != 0 {
+		e.add("window.slideMs", "slide only applies to a %s window", model.SlidingWindow)
+	}
+	if w.Count > 0 && w.AllowedLatenessMs != 0 {
+		e.add("window.allowedLatenessMs", "allowed lateness only applies to an event time window")
+	}
+}
+
+func (e *ValidationError) nonNegative(field string, value int) {
+	if value < 0 {
+		e.add(field, "%d is negative", value)
+	}
+}
+
+// validateTopic validates the topic name and the Pulsar URL
+func (e *ValidationError) validateTopic(field string, topic *model.FunctionTopic) {
+	if _, _, _, _, err := util.ParseTopicFn(topic.TopicFullName); err != nil {
+		e.add(field+".topicFullName", "%v", err)
+	}
+	if !model.IsURL(topic.PulsarURL) {
+		e.add(field+".pulsarURL", "not a URL %s", topic.PulsarURL)
+	} else if !util.IsAllowedPulsarURL(topic.PulsarURL) {
+		e.add(field+".pulsarURL", "pulsar cluster %s is not allowed", topic.PulsarURL)
+	}
+}
+
+// validateInputTopic validates the topic and the subscription, an empty subscription name defaults to tenant-function
+func (e *ValidationError) validateInputTopic(field string, topic *model.FunctionTopic) {
+	e.validateTopic(field, topic)
+	if _, err := model.GetInitialPosition(topic.InitialPosition); err != nil {
+		e.add(field+".initialPosition", "%v", err)
 	}
-	if _, err := model.GetInitialPosition(cfg.InitialPosition); err != nil {
-		return err
+	if _, err := model.GetSubscriptionType(topic.SubscriptionType); err != nil {
+		e.add(field+".subscriptionType", "%v", err)
+	} else {
+		if _, err := topic.GetKeySharedPolicy(); err != nil {
+			e.add(field+".keySharedPolicy", "%v", err)
+		}
 	}
-	return nil
 }
@@ -0,0 +1,167 @@
+package lambda
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+	"github.com/kafkaesque-io/pubsub-function/src/util"
+)
+
+func TestValidateFunction(t *testing.T) {
+	defer func(urls []string) { util.AllowedPulsarURLs = urls }(util.AllowedPulsarURLs)
+	util.AllowedPulsarURLs = []string{"pulsar://localhost:6650"}
+
+	topic := func(name string) model.FunctionTopic {
+		return model.FunctionTopic{TopicFullName: name, PulsarURL: "pulsar://localhost:6650"}
+	}
+	config := func(mutate func(*model.FunctionConfig)) *model.FunctionConfig {
+		cfg := &model.FunctionConfig{
+			LanguagePack: "js",
+			Parallelism:  1,
+			TriggerType:  PulsarTrigger,
+			InputTopic:   topic("persistent://a/b/in"),
+		}
+		mutate(cfg)
+		return cfg
+	}
+	window := func(cfg *model.FunctionConfig) {
+		cfg.TriggerType = WindowTrigger
+		cfg.OutputTopic = topic("persistent://a/b/out")
+	}
+
+	cases := []struct {
+		name   string
+		cfg    *model.FunctionConfig
+		fields []string
+	}{
+		{"valid", config(func(cfg *model.FunctionConfig) {}), nil},
+		{"language pack", config(func(cfg *model.FunctionConfig) { cfg.LanguagePack = "python" }), []string{"languagePack"}},
+		{"parallelism", config(func(cfg *model.FunctionConfig) { cfg.Parallelism = 101 }), []string{"parallelism"}},
+		{"negative numbers", config(func(cfg *model.FunctionConfig) {
+			cfg.MaxConcurrency, cfg.QueueDepth, cfg.Timeout, cfg.MaxRedeliveries = -1, -1, -1, -1
+			cfg.Resources = model.FunctionResources{MemoryMB: -1, CPUMillis: -1, CPUTimeSeconds: -1, OpenFiles: -1}
+		}), []string{"maxConcurrency", "queueDepth", "timeout", "maxRedeliveries",
+			"resources.memoryMB", "resources.cpuMillis", "resources.cpuTimeSeconds", "resources.openFiles"}},
+		{"scaling", config(func(cfg *model.FunctionConfig) {
+			cfg.Scaling = model.ScalingPolicy{MinParallelism: -1, TargetBacklog: -1, TargetLatencyMs: -1, ScaleUpCooldown: -1, ScaleDownCooldown: -1, MaxParallelism: 101}
+		}), []string{"scaling.minParallelism", "scaling.targetBacklog", "scaling.targetLatencyMs",
+			"scaling.scaleUpCooldown", "scaling.scaleDownCooldown", "scaling.maxParallelism"}},
+		{"scaling min above max", config(func(cfg *model.FunctionConfig) {
+			cfg.Scaling = model.ScalingPolicy{MinParallelism: 5, MaxParallelism: 2}
+		}), []string{"scaling.minParallelism"}},
+		{"batch", config(func(cfg *model.FunctionConfig) {
+			cfg.Batch = model.BatchPolicy{MaxBytes: -1, MaxWaitMs: -1, Format: "xml"}
+		}), []string{"batch.maxBytes", "batch.maxWaitMs", "batch.format"}},
+		{"batch of key ordered", config(func(cfg *model.FunctionConfig) {
+			cfg.Batch.MaxSize = 10
+			cfg.DispatchMode = model.KeyOrderedDispatch
+		}), []string{"batch.maxSize"}},
+		{"batch of http trigger", config(func(cfg *model.FunctionConfig) {
+			cfg.Batch.MaxSize = 10
+			cfg.TriggerType = HTTPTrigger
+		}), []string{"batch.maxSize"}},
+		{"missing input topic", config(func(cfg *model.FunctionConfig) { cfg.InputTopic = model.FunctionTopic{} }),
+			[]string{"inputTopics.topicFullName"}},
+		{"input topic", config(func(cfg *model.FunctionConfig) {
+			cfg.InputTopic = model.FunctionTopic{TopicFullName: "in", PulsarURL: "pulsar://other:6650", InitialPosition: "middle", SubscriptionType: "fanout"}
+		}), []string{"inputTopics.topicFullName", "inputTopics.pulsarURL", "inputTopics.initialPosition", "inputTopics.subscriptionType"}},
+		{"input topic url", config(func(cfg *model.FunctionConfig) { cfg.InputTopic.PulsarURL = "not a url" }),
+			[]string{"inputTopics.pulsarURL"}},
+		{"key shared policy", config(func(cfg *model.FunctionConfig) {
+			cfg.InputTopic.SubscriptionType = "keyshared"
+			cfg.InputTopic.KeySharedPolicy = "bogus"
+		}), []string{"inputTopics.keySharedPolicy"}},
+		{"dispatch mode", config(func(cfg *model.FunctionConfig) { cfg.DispatchMode = "random" }), []string{"dispatchMode"}},
+		{"dead letter topic", config(func(cfg *model.FunctionConfig) { cfg.DeadLetterTopic = "dlq" }), []string{"deadLetterTopic"}},
+		{"output and log topics", config(func(cfg *model.FunctionConfig) {
+			cfg.OutputTopic = model.FunctionTopic{TopicFullName: "out", PulsarURL: "pulsar://localhost:6650"}
+			cfg.LogTopic = model.FunctionTopic{TopicFullName: "persistent://a/b/log"}
+		}), []string{"outputTopics.topicFullName", "logTopic.pulsarURL"}},
+		{"trigger type", config(func(cfg *model.FunctionConfig) { cfg.TriggerType = "webhook" }), []string{"triggerType"}},
+		{"cron", config(func(cfg *model.FunctionConfig) {
+			cfg.TriggerType = CronTrigger
+			cfg.DispatchMode = model.RoundRobinDispatch
+		}), []string{"dispatchMode", "cron"}},
+		{"cron expression", config(func(cfg *model.FunctionConfig) {
+			cfg.TriggerType = CronTrigger
+			cfg.Cron = "every minute"
+		}), []string{"cron"}},
+		{"http dispatch mode", config(func(cfg *model.FunctionConfig) {
+			cfg.TriggerType = HTTPTrigger
+			cfg.DispatchMode = model.RoundRobinDispatch
+		}), []string{"dispatchMode"}},
+		{"window of pulsar trigger", config(func(cfg *model.FunctionConfig) { cfg.Window.Count = 10 }), []string{"window.type"}},
+		{"window trigger", config(func(cfg *model.FunctionConfig) {
+			cfg.TriggerType = WindowTrigger
+			cfg.InputTopic.SubscriptionType = "shared"
+			cfg.DispatchMode = model.RoundRobinDispatch
+			cfg.Window.Count = 10
+		}), []string{"inputTopics.subscriptionType", "outputTopics.topicFullName", "dispatchMode"}},
+		{"window missing input topic", config(func(cfg *model.FunctionConfig) {
+			window(cfg)
+			cfg.InputTopic = model.FunctionTopic{}
+			cfg.Window.Count = 10
+		}), []string{"inputTopics.topicFullName"}},
+		{"window negative numbers and format", config(func(cfg *model.FunctionConfig) {
+			window(cfg)
+			cfg.Window = model.WindowPolicy{Count: 10, SlideCount: -1, SizeMs: -1, SlideMs: -1, GapMs: -1, AllowedLatenessMs: -1, Format: "xml"}
+		}), []string{"window.slideCount", "window.sizeMs", "window.slideMs", "window.gapMs", "window.allowedLatenessMs",
+			"window.format", "window.gapMs", "window.slideMs", "window.allowedLatenessMs"}},
+		{"tumbling window by count and size", config(func(cfg *model.FunctionConfig) {
+			window(cfg)
+			cfg.Window = model.WindowPolicy{Count: 10, SizeMs: 1000}
+		}), []string{"window.count"}},
+		{"session window", config(func(cfg *model.FunctionConfig) {
+			window(cfg)
+			cfg.Window = model.WindowPolicy{Type: model.SessionWindow, Count: 10}
+		}), []string{"window.gapMs", "window.count"}},
+		{"window type", config(func(cfg *model.FunctionConfig) {
+			window(cfg)
+			cfg.Window = model.WindowPolicy{Type: "hopping", Count: 10}
+		}), []string{"window.type"}},
+		{"sliding window slide", config(func(cfg *model.FunctionConfig) {
+			window(cfg)
+			cfg.Window = model.WindowPolicy{Type: model.SlidingWindow, Count: 10, SlideCount: 20}
+		}), []string{"window.slideCount"}},
+		{"sliding window slide time", config(func(cfg *model.FunctionConfig) {
+			window(cfg)
+			cfg.Window = model.WindowPolicy{Type: model.SlidingWindow, SizeMs: 1000}
+		}), []string{"window.slideMs"}},
+		{"valid event time window", config(func(cfg *model.FunctionConfig) {
+			window(cfg)
+			cfg.Window = model.WindowPolicy{Type: model.SlidingWindow, SizeMs: 1000, SlideMs: 500, AllowedLatenessMs: 100}
+		}), nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := ValidateFunction(c.cfg)
+			if c.fields == nil {
+				if err != nil {
+					t.Fatalf("got error %v", err)
+				}
+				return
+			}
+			verr, ok := err.(*ValidationError)
+			if !ok {
+				t.Fatalf("got error %v, want a validation error", err)
+			}
+			fields := []string{}
+			for _, f := range verr.Fields {
+				if f.Message == "" {
+					t.Errorf("got field %s without a message", f.Field)
+				}
+				fields = append(fields, f.Field)
+			}
+			if !reflect.DeepEqual(fields, c.fields) {
+				t.Errorf("got fields %v, want %v", fields, c.fields)
+			}
+		})
+	}
+
+	// the field errors found by the caller are listed first
+	err := ValidateFunction(config(func(cfg *model.FunctionConfig) { cfg.Timeout = -1 }), FieldError{Field: "parallelism", Message: "not a number"})
+	if verr, ok := err.(*ValidationError); !ok || len(verr.Fields) != 2 || verr.Fields[0].Field != "parallelism" {
+		t.Errorf("got error %v, want the caller's field error and timeout", err)
+	}
+}
@@ -0,0 +1,100 @@
+package lambda
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// invocation headers carry the Pulsar message metadata to the function
+const (
+	// MessageIDHeader is the base64 encoded Pulsar message id
+	MessageIDHeader = "PulsarMessageId"
+	// MessageKeyHeader is the Pulsar message key
+	MessageKeyHeader = "PulsarMessageKey"
+	// TopicHeader is the Pulsar topic full name
+	TopicHeader = "PulsarTopic"
+	// PropertyHeaderPrefix prefixes each Pulsar message property
+	PropertyHeaderPrefix = "PulsarProperty-"
+	// WindowStartHeader is the start of a window in RFC 3339, the event time of its first message for a count window
+	WindowStartHeader = "PulsarWindowStart"
+	// WindowEndHeader is the end of a window in RFC 3339, the event time of its last message for a count window
+	WindowEndHeader = "PulsarWindowEnd"
+)
+
+// FailureType classifies invocation failures
+type FailureType string
+
+// invocation failure types
+const (
+	// TimeoutFailure is an invocation exceeding the function timeout
+	TimeoutFailure FailureType = "timeout"
+	// FunctionFailure is a non 2xx response from the function
+	FunctionFailure FailureType = "function"
+	// ConnectionFailure is a failure to reach the function instance
+	ConnectionFailure FailureType = "connection"
+)
+
+// InvocationError is a failed function invocation
+type InvocationError struct {
+	Type FailureType
+	Err  error
+}
+
+func (e *InvocationError) Error() string {
+	return fmt.Sprintf("%s failure: %v", e.Type, e.Err)
+}
+
+// IsTimeout evaluates whether an error is an invocation timeout
+func IsTimeout(err error) bool {
+	var invErr *InvocationError
+	return errors.As(err, &invErr) && invErr.Type == TimeoutFailure
+}
+
+// FailureTypeOf returns the failure type of an invocation error
+func FailureTypeOf(err error) FailureType {
+	var invErr *InvocationError
+	if errors.As(err, &invErr) {
+		return invErr.Type
+	}
+	return ConnectionFailure
+}
+
+var invokeClient = &http.Client{}
+
+// Invoke sends a payload to a function instance and returns the response body.
+// The invocation is cancelled when the context is done, a deadline exceeded is a TimeoutFailure.
+func Invoke(ctx context.Context, url string, payload []byte, headers map[string]string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := invokeClient.Do(req)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, &InvocationError{Type: TimeoutFailure, Err: ctx.Err()}
+		}
+		return nil, &InvocationError{Type: ConnectionFailure, Err: err}
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, &InvocationError{Type: TimeoutFailure, Err: ctx.Err()}
+		}
+		return nil, &InvocationError{Type: ConnectionFailure, Err: err}
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return body, &InvocationError{Type: FunctionFailure, Err: fmt.Errorf("function %s responded with status %d", url, res.StatusCode)}
+	}
+	return body, nil
+}
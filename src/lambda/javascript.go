@@ -2,15 +2,21 @@ package lambda
 
 import (
 	"fmt"
+	"io/ioutil"
 	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/kafkaesque-io/pubsub-function/src/artifact"
 	"github.com/kafkaesque-io/pubsub-function/src/model"
 	"github.com/kafkaesque-io/pubsub-function/src/util"
 
@@ -26,15 +32,37 @@ type FunctionInstance struct {
 	URI       url.URL
 	comm      chan *WorkerSignal
 	Pid       int
+	cmd       *exec.Cmd
+	cgroup    string
+	stopping  int32
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
 
-// TODO: make the map thread safe
-// key is function tenant + name
-var functionInstances = make(map[string]FunctionInstance)
+// key is the instance url since a function has as many instances as its parallelism
+var functionInstances = make(map[string]*FunctionInstance)
 
-var port = 2999
+var instancesLock = &sync.RWMutex{}
+
+// instance ports in use, a port is released when its instance exits
+var (
+	ports     = make(map[int]bool)
+	nextPort  = minPort
+	portsLock = &sync.Mutex{}
+)
+
+// the port range of function instances
+const (
+	minPort = 3000
+	maxPort = 49151
+)
+
+// instanceStopTimeout is the grace period for an instance to exit before it is killed
+const instanceStopTimeout = 5 * time.Second
+
+var healthCheckClient = &http.Client{
+	Timeout: 2 * time.Second,
+}
 
 // CreateFnInstance creates function instance
 func CreateFnInstance(cfg model.FunctionConfig) (string, error) {
@@ -49,37 +77,198 @@ func CreateFnInstance(cfg model.FunctionConfig) (string, error) {
 
 // StartNodeInstance starts node/javascript instance
 func StartNodeInstance(cfg model.FunctionConfig) (url string, err error) {
-	port, err = getPort()
+	if err = EnsureSource(cfg); err != nil {
+		return "", err
+	}
+	port, err := getPort()
 	if err != nil {
 		return "", err
 	}
 
 	log.Infof("file path %s port %d", cfg.FunctionFilePath, port)
-	cmd := exec.Command("node", "../function-pack/js/loader.js", strconv.Itoa(port), cfg.FunctionFilePath)
-	if err := cmd.Start(); err != nil {
+	// the cgroup of an instance is named by its port, both are released when the instance exits
+	cgroup, err := createInstanceCgroup(cfg, strconv.Itoa(port))
+	if err != nil {
+		log.Errorf("function %s failed to create cgroup %v", cfg.ID, err)
+		releasePort(port)
+		return "", err
+	}
+	cmd, usage, err := nodeCommand(cfg, port, cgroup)
+	if err == nil {
+		err = cmd.Start()
+		// the child has its own copies of the pipes
+		for _, f := range cmd.ExtraFiles {
+			f.Close()
+		}
+	}
+	if err != nil {
+		if usage != nil {
+			usage.Close()
+		}
+		removeCgroup(cgroup)
+		releasePort(port)
 		return "", err
 	}
 	log.Infof("command %d", cmd.Process.Pid)
 
-	url = "http://localhost:" + strconv.Itoa(port)
+	url = "http://" + util.GetWorkerAddress() + ":" + strconv.Itoa(port)
+	instance := registerInstance(cfg, url, port, cmd, usage, cgroup)
 	if err := HealthCheckRetry(url, 3); err != nil {
+		StopInstance(url)
 		return "", err
 	}
 
+	log.Infof("function %s instance %s pid %d started", cfg.ID, url, instance.Pid)
 	return url, nil
 }
 
-// TODO: recycle and add more checks
-func getPort() (int, error) {
-	port++
-	if port == 8085 { // do use the local http port
-		port++
+// nodeCommand builds the node command of an instance, in a sandbox if the tenant policy enables it.
+// The limits and the cgroup are applied before node starts. A sandboxed instance also returns the pipe
+// that reports the resource usage of node.
+func nodeCommand(cfg model.FunctionConfig, port int, cgroup string) (*exec.Cmd, *os.File, error) {
+	policy, err := GetSandboxPolicy(cfg.Tenant)
+	if err != nil {
+		return nil, nil, err
+	}
+	if policy.Enabled {
+		return sandboxCommand(cfg, policy, cgroup, nodeArgs(cfg, port))
+	}
+	cmd, err := limitedCommand(cfg, cgroup, nodeArgs(cfg, port))
+	return cmd, nil, err
+}
+
+// registerInstance tracks a started instance and reaps its process when it exits
+// an exit that is not requested by StopInstance is reported as a termination
+func registerInstance(cfg model.FunctionConfig, instanceURL string, port int, cmd *exec.Cmd, usage *os.File, cgroup string) *FunctionInstance {
+	uri, _ := url.Parse(instanceURL)
+	now := time.Now()
+	functionID := cfg.ID
+	instance := &FunctionInstance{
+		ID:        functionID,
+		URI:       *uri,
+		comm:      make(chan *WorkerSignal),
+		Pid:       cmd.Process.Pid,
+		cmd:       cmd,
+		cgroup:    cgroup,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	instancesLock.Lock()
+	functionInstances[instanceURL] = instance
+	instancesLock.Unlock()
+
+	go func() {
+		err := cmd.Wait()
+		cpuTime := nodeCPUTime(cmd.ProcessState, usage)
+		log.Infof("function %s instance %s pid %d exited %v cpu time %v", functionID, instanceURL, instance.Pid, err, cpuTime)
+		close(instance.comm)
+		instancesLock.Lock()
+		if v, ok := functionInstances[instanceURL]; ok && v == instance {
+			delete(functionInstances, instanceURL)
+		}
+		instancesLock.Unlock()
+
+		if atomic.LoadInt32(&instance.stopping) == 0 {
+			exitStatus := ""
+			if cmd.ProcessState != nil {
+				exitStatus = cmd.ProcessState.String()
+			}
+			reportTermination(cfg, model.InstanceTermination{
+				Function:     functionID,
+				Instance:     instanceURL,
+				Pid:          instance.Pid,
+				Reason:       terminationReason(cfg, cgroup, cmd.ProcessState, cpuTime),
+				ExitStatus:   exitStatus,
+				TerminatedAt: time.Now(),
+			})
+		}
+		removeCgroup(cgroup)
+		releasePort(port)
+	}()
+	return instance
+}
+
+// StopInstance terminates a function instance, it is killed if it does not exit within the grace period
+func StopInstance(instanceURL string) error {
+	instancesLock.RLock()
+	instance, ok := functionInstances[instanceURL]
+	instancesLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("function instance %s not found", instanceURL)
+	}
+
+	atomic.StoreInt32(&instance.stopping, 1)
+	instance.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-instance.comm:
+		return nil
+	case <-time.After(instanceStopTimeout):
+		log.Warnf("kill function %s instance %s pid %d", instance.ID, instanceURL, instance.Pid)
+		return instance.cmd.Process.Kill()
+	}
+}
+
+// StopAllInstances terminates all function instances on this worker so that no child process is orphaned
+func StopAllInstances() {
+	instancesLock.RLock()
+	urls := make([]string, 0, len(functionInstances))
+	for url := range functionInstances {
+		urls = append(urls, url)
+	}
+	instancesLock.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, url := range urls {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			if err := StopInstance(url); err != nil {
+				log.Errorf("failed to stop function instance %s error %v", url, err)
+			}
+		}(url)
+	}
+	wg.Wait()
+}
+
+// IsRunning returns whether the instance is running on this worker
+func IsRunning(instanceURL string) bool {
+	instancesLock.RLock()
+	defer instancesLock.RUnlock()
+	_, ok := functionInstances[instanceURL]
+	return ok
+}
+
+// RecycleInstance replaces a function instance with a new one and returns the new instance url
+func RecycleInstance(cfg model.FunctionConfig, instanceURL string) (string, error) {
+	if err := StopInstance(instanceURL); err != nil {
+		log.Warnf("recycle function %s instance error %v", cfg.ID, err)
 	}
+	return CreateFnInstance(cfg)
+}
 
-	if port > 49151 {
-		return -1, fmt.Errorf("port pool exhausted")
+// getPort allocates a free instance port, the ports of the exited instances are reused after the range wraps around
+func getPort() (int, error) {
+	portsLock.Lock()
+	defer portsLock.Unlock()
+	for i := 0; i <= maxPort-minPort; i++ {
+		port := nextPort
+		if nextPort++; nextPort > maxPort {
+			nextPort = minPort
+		}
+		if port == 8085 || ports[port] { // do use the local http port
+			continue
+		}
+		ports[port] = true
+		return port, nil
 	}
-	return port, nil
+	return -1, fmt.Errorf("port pool exhausted")
+}
+
+// releasePort returns the port of an exited instance to the pool
+func releasePort(port int) {
+	portsLock.Lock()
+	delete(ports, port)
+	portsLock.Unlock()
 }
 
 // GetSourceFilePath gets the directory to source file
@@ -88,7 +277,7 @@ func GetSourceFilePath(tenant string) string {
 		tenant = "public"
 	}
 
-	path := util.AssignString(os.Getenv("FunctionBaseDir"), "/pulsar/functions") + "/" + tenant
+	path := SourceBaseDir() + "/" + tenant
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		os.Mkdir(path, 0755)
 	}
@@ -96,6 +285,44 @@ func GetSourceFilePath(tenant string) string {
 	return path
 }
 
+// EnsureSource verifies that the source of a function is available on this worker.
+// A source referenced by content hash is fetched from the artifact store when the local file is missing or stale.
+func EnsureSource(cfg model.FunctionConfig) error {
+	if cfg.SourceHash == "" {
+		if _, err := os.Stat(cfg.FunctionFilePath); err != nil {
+			return fmt.Errorf("function %s source is not available %v", cfg.ID, err)
+		}
+		return nil
+	}
+	if data, err := ioutil.ReadFile(cfg.FunctionFilePath); err == nil && artifact.Verify(cfg.SourceHash, data) == nil {
+		return nil
+	}
+
+	store, err := artifact.GetStore()
+	if err != nil {
+		return err
+	}
+	data, err := store.Get(cfg.SourceHash)
+	if err != nil {
+		return fmt.Errorf("function %s failed to fetch source %s error %v", cfg.ID, cfg.SourceHash, err)
+	}
+	if err = os.MkdirAll(filepath.Dir(cfg.FunctionFilePath), 0755); err != nil {
+		return err
+	}
+	// the source is renamed into place so that an instance never loads a partial file
+	tmp := cfg.FunctionFilePath + "." + cfg.SourceHash[:8]
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	log.Infof("function %s fetched source %s", cfg.ID, cfg.SourceHash)
+	return os.Rename(tmp, cfg.FunctionFilePath)
+}
+
+// SourceBaseDir is the directory of the function sources of all tenants
+func SourceBaseDir() string {
+	return util.AssignString(os.Getenv("FunctionBaseDir"), "/pulsar/functions")
+}
+
 // HealthCheck checks the any language pack is running
 func HealthCheck(url string) error {
 	// Update the headers to allow for SSL redirection
@@ -104,8 +331,7 @@ func HealthCheck(url string) error {
 		log.Errorf("make http request url %s error %v", url, err)
 		return err
 	}
-	client := &http.Client{}
-	response, err := client.Do(newRequest)
+	response, err := healthCheckClient.Do(newRequest)
 	if response != nil {
 		defer response.Body.Close()
 	}
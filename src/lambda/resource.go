@@ -0,0 +1,99 @@
+package lambda
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+	"github.com/kafkaesque-io/pubsub-function/src/pulsardriver"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// InstanceInitArg is the first command line argument of the worker re-executed to apply the limits of an instance
+const InstanceInitArg = "instance-init"
+
+// nodeUsage is the resource usage of node that the sandbox init reports to the worker when node exits
+type nodeUsage struct {
+	UserTime   time.Duration `json:"userTime"`
+	SystemTime time.Duration `json:"systemTime"`
+}
+
+// nodeCPUTime is the cpu time of node in an exited instance. It is reported by the sandbox init if node is its child,
+// otherwise the instance process is node itself.
+func nodeCPUTime(state *os.ProcessState, usage *os.File) time.Duration {
+	if usage != nil {
+		defer usage.Close()
+		var u nodeUsage
+		if err := json.NewDecoder(usage).Decode(&u); err == nil {
+			return u.UserTime + u.SystemTime
+		}
+	}
+	if state == nil {
+		return 0
+	}
+	return state.UserTime() + state.SystemTime()
+}
+
+// TerminationHandler is called when a function instance terminates unexpectedly
+type TerminationHandler func(cfg model.FunctionConfig, termination model.InstanceTermination)
+
+var terminationHandler TerminationHandler
+
+// OnTermination registers the handler of unexpected function instance terminations
+func OnTermination(handler TerminationHandler) {
+	terminationHandler = handler
+}
+
+// reportTermination reports an unexpected instance termination to the handler and the function's log topic
+func reportTermination(cfg model.FunctionConfig, termination model.InstanceTermination) {
+	log.Warnf("function %s instance %s pid %d terminated reason %s exit status %s",
+		cfg.ID, termination.Instance, termination.Pid, termination.Reason, termination.ExitStatus)
+	if terminationHandler != nil {
+		terminationHandler(cfg, termination)
+	}
+
+	logTopic := cfg.LogTopic
+	if logTopic.TopicFullName == "" {
+		return
+	}
+	data, err := json.Marshal(termination)
+	if err != nil {
+		log.Errorf("function %s marshal termination error %v", cfg.ID, err)
+		return
+	}
+	if err = pulsardriver.SendToPulsar(logTopic.PulsarURL, logTopic.Token, logTopic.TopicFullName, data, true); err != nil {
+		log.Errorf("function %s failed to send termination to log topic %s error %v", cfg.ID, logTopic.TopicFullName, err)
+	}
+}
+
+// nodeArgs builds the node command line arguments of an instance
+// the V8 heap is capped below the memory limit so that a runaway function fails in node before it is killed
+func nodeArgs(cfg model.FunctionConfig, port int) []string {
+	args := []string{}
+	if cfg.Resources.MemoryMB > 0 {
+		args = append(args, "--max-old-space-size="+strconv.Itoa(cfg.Resources.MemoryMB*3/4))
+	}
+	return append(args, loaderPath(), strconv.Itoa(port), functionFilePath(cfg))
+}
+
+// loaderPath is the absolute path of the javascript loader so that it can be exposed in a sandbox
+func loaderPath() string {
+	path, err := filepath.Abs("../function-pack/js/loader.js")
+	if err != nil {
+		return "../function-pack/js/loader.js"
+	}
+	return path
+}
+
+// functionFilePath is the absolute path of the function source
+func functionFilePath(cfg model.FunctionConfig) string {
+	path, err := filepath.Abs(cfg.FunctionFilePath)
+	if err != nil {
+		return cfg.FunctionFilePath
+	}
+	return path
+}
@@ -0,0 +1,246 @@
+//go:build linux
+// +build linux
+
+package lambda
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+	"github.com/kafkaesque-io/pubsub-function/src/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// cgroup v2 is mounted if the unified hierarchy exposes its controllers
+var cgroupControllersFile = "/sys/fs/cgroup/cgroup.controllers"
+
+// cpuPeriod is the cgroup cpu.max period in microseconds
+const cpuPeriod = 100000
+
+// instanceLimits are applied by the process that executes node before node starts,
+// so that a function never runs outside of its limits
+type instanceLimits struct {
+	// Cgroup is the instance cgroup directory, empty if the instance is not in a cgroup
+	Cgroup         string `json:"cgroup"`
+	OpenFiles      int    `json:"openFiles"`
+	CPUTimeSeconds int    `json:"cpuTimeSeconds"`
+}
+
+// instanceSpec is passed to the instance init process on the command line
+type instanceSpec struct {
+	Limits instanceLimits `json:"limits"`
+	Args   []string       `json:"args"`
+}
+
+func newInstanceLimits(cfg model.FunctionConfig, cgroup string) instanceLimits {
+	return instanceLimits{
+		Cgroup:         cgroup,
+		OpenFiles:      cfg.Resources.OpenFiles,
+		CPUTimeSeconds: cfg.Resources.CPUTimeSeconds,
+	}
+}
+
+// apply moves the calling process into the instance cgroup and sets its rlimits,
+// both are inherited by node whether it is executed in place or started as a child process
+func (l instanceLimits) apply() error {
+	if l.Cgroup != "" {
+		// 0 is the writing process
+		if err := writeCgroupFile(l.Cgroup, "cgroup.procs", "0"); err != nil {
+			return err
+		}
+	}
+	if l.OpenFiles > 0 {
+		limit := &syscall.Rlimit{Cur: uint64(l.OpenFiles), Max: uint64(l.OpenFiles)}
+		if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, limit); err != nil {
+			return fmt.Errorf("set open files limit error %v", err)
+		}
+	}
+	if l.CPUTimeSeconds > 0 {
+		// SIGXCPU at the soft limit, SIGKILL at the hard limit if the signal is handled
+		limit := &syscall.Rlimit{Cur: uint64(l.CPUTimeSeconds), Max: uint64(l.CPUTimeSeconds + 5)}
+		if err := syscall.Setrlimit(syscall.RLIMIT_CPU, limit); err != nil {
+			return fmt.Errorf("set cpu time limit error %v", err)
+		}
+	}
+	return nil
+}
+
+// limitedCommand builds the node command of an instance without a sandbox. If the function has limits,
+// the worker is re-executed as the instance init which applies them and then executes node in place,
+// so that the instance process is node itself.
+func limitedCommand(cfg model.FunctionConfig, cgroup string, args []string) (*exec.Cmd, error) {
+	limits := newInstanceLimits(cfg, cgroup)
+	if limits == (instanceLimits{}) {
+		return exec.Command("node", args...), nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	nodePath, err := exec.LookPath("node")
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(instanceSpec{Limits: limits, Args: append([]string{nodePath}, args...)})
+	if err != nil {
+		return nil, err
+	}
+	return exec.Command(self, InstanceInitArg, string(data)), nil
+}
+
+// InstanceInit applies the limits of a function instance and executes node in place. It never returns.
+func InstanceInit(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "instance init expects a spec argument\n")
+		os.Exit(125)
+	}
+	var spec instanceSpec
+	if err := json.Unmarshal([]byte(args[0]), &spec); err != nil || len(spec.Args) == 0 {
+		fmt.Fprintf(os.Stderr, "instance init invalid spec %v\n", err)
+		os.Exit(125)
+	}
+	if err := spec.Limits.apply(); err != nil {
+		fmt.Fprintf(os.Stderr, "instance init error %v\n", err)
+		os.Exit(125)
+	}
+	err := syscall.Exec(spec.Args[0], spec.Args, os.Environ())
+	fmt.Fprintf(os.Stderr, "instance init exec %s error %v\n", spec.Args[0], err)
+	os.Exit(126)
+}
+
+// createInstanceCgroup creates the cgroup of an instance before it starts.
+// It returns the instance cgroup directory, or an empty string if the instance is not in a cgroup.
+// Without cgroup v2, or when the cgroup root is not delegated to the worker, the instance only has
+// the rlimits and the node heap size.
+func createInstanceCgroup(cfg model.FunctionConfig, name string) (string, error) {
+	if !cfg.Resources.HasCgroupLimits() {
+		return "", nil
+	}
+	if _, err := os.Stat(cgroupControllersFile); err != nil {
+		log.Warnf("cgroup v2 is not available, function %s memory is only limited by the node heap size and cpu is not limited", cfg.ID)
+		return "", nil
+	}
+	dir, err := createCgroup(cfg, name)
+	if err != nil {
+		log.Warnf("cgroup is not delegated to the worker, function %s memory is only limited by the node heap size and cpu is not limited, %v", cfg.ID, err)
+		return "", nil
+	}
+	return dir, nil
+}
+
+// createCgroup creates the cgroup <root>/<tenant>/<function>/<name> with the function limits, the instance joins it before node starts
+// limits are set per instance, the tenant and function subtrees only group the instances
+func createCgroup(cfg model.FunctionConfig, name string) (string, error) {
+	root := util.AssignString(util.GetConfig().FunctionCgroupRoot, "/sys/fs/cgroup/pubsub-function")
+	tenantDir := filepath.Join(root, cfg.Tenant)
+	functionDir := filepath.Join(tenantDir, cfg.Name)
+	instanceDir := filepath.Join(functionDir, name)
+
+	if err := os.MkdirAll(functionDir, 0755); err != nil {
+		return "", err
+	}
+	for _, dir := range []string{root, tenantDir, functionDir} {
+		if err := writeCgroupFile(dir, "cgroup.subtree_control", "+memory +cpu"); err != nil {
+			return "", err
+		}
+	}
+	if err := os.Mkdir(instanceDir, 0755); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+
+	res := cfg.Resources
+	if res.MemoryMB > 0 {
+		if err := writeCgroupFile(instanceDir, "memory.max", strconv.Itoa(res.MemoryMB*1024*1024)); err != nil {
+			removeCgroup(instanceDir)
+			return "", err
+		}
+		// swap would only delay the oom kill, not every kernel has swap accounting
+		writeCgroupFile(instanceDir, "memory.swap.max", "0")
+	}
+	if res.CPUMillis > 0 {
+		quota := res.CPUMillis * cpuPeriod / 1000
+		if err := writeCgroupFile(instanceDir, "cpu.max", fmt.Sprintf("%d %d", quota, cpuPeriod)); err != nil {
+			removeCgroup(instanceDir)
+			return "", err
+		}
+	}
+	return instanceDir, nil
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(value), 0644); err != nil {
+		return fmt.Errorf("write cgroup %s/%s error %v", dir, name, err)
+	}
+	return nil
+}
+
+// removeCgroup removes an instance cgroup, it can only be removed after the process has exited
+func removeCgroup(dir string) {
+	if dir == "" {
+		return
+	}
+	if err := os.Remove(dir); err != nil {
+		log.Warnf("failed to remove cgroup %s error %v", dir, err)
+	}
+}
+
+// oomKilled returns whether the kernel oom killer has killed any process in the cgroup
+func oomKilled(dir string) bool {
+	f, err := os.Open(filepath.Join(dir, "memory.events"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			return fields[1] != "0"
+		}
+	}
+	return false
+}
+
+// terminationReason tells whether an exited instance has been killed for exceeding a resource limit
+func terminationReason(cfg model.FunctionConfig, cgroupDir string, state *os.ProcessState, cpuTime time.Duration) string {
+	if state == nil {
+		return model.InstanceExited
+	}
+	if cgroupDir != "" && oomKilled(cgroupDir) {
+		return model.MemoryLimitExceeded
+	}
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok {
+		return model.InstanceExited
+	}
+
+	// the sandbox init exits with 128 + signal when the instance is killed by a signal
+	signaled, signal := status.Signaled(), status.Signal()
+	if !signaled && status.ExitStatus() > 128 {
+		signaled, signal = true, syscall.Signal(status.ExitStatus()-128)
+	}
+
+	res := cfg.Resources
+	switch {
+	case signaled && signal == syscall.SIGXCPU:
+		return model.CPUTimeLimitExceeded
+	case signaled && signal == syscall.SIGKILL && res.CPUTimeSeconds > 0 && int(cpuTime.Seconds()) >= res.CPUTimeSeconds:
+		return model.CPUTimeLimitExceeded
+	case signaled && signal == syscall.SIGABRT && res.MemoryMB > 0:
+		// node aborts when the capped V8 heap is out of memory
+		return model.MemoryLimitExceeded
+	}
+	return model.InstanceExited
+}
@@ -0,0 +1,87 @@
+//go:build linux
+// +build linux
+
+package lambda
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+	"github.com/kafkaesque-io/pubsub-function/src/util"
+)
+
+func TestCreateInstanceCgroup(t *testing.T) {
+	base, err := ioutil.TempDir("", "cgroup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	controllers := filepath.Join(base, "cgroup.controllers")
+	if err = ioutil.WriteFile(controllers, []byte("cpu memory"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(file, root string) {
+		cgroupControllersFile, util.Config.FunctionCgroupRoot = file, root
+	}(cgroupControllersFile, util.Config.FunctionCgroupRoot)
+
+	limits := model.FunctionResources{MemoryMB: 64, CPUMillis: 500}
+	cases := []struct {
+		name        string
+		resources   model.FunctionResources
+		controllers string
+		// root is relative to the test directory
+		root string
+		// want is the instance cgroup relative to the root, empty if the instance is not in a cgroup
+		want   string
+		memory string
+		cpu    string
+	}{
+		{"delegated root", limits, controllers, "delegated", "acme/fn/8080", "67108864", "50000 100000"},
+		{"memory only", model.FunctionResources{MemoryMB: 32}, controllers, "memory", "acme/fn/8080", "33554432", ""},
+		{"no cgroup limits", model.FunctionResources{OpenFiles: 64}, controllers, "none", "", "", ""},
+		{"no cgroup v2", limits, filepath.Join(base, "missing"), "v1", "", "", ""},
+		// a root under a regular file cannot be created, as a root that is not delegated to the worker
+		{"root not delegated", limits, controllers, "cgroup.controllers/root", "", "", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			root := filepath.Join(base, c.root)
+			cgroupControllersFile, util.Config.FunctionCgroupRoot = c.controllers, root
+			cfg := model.FunctionConfig{Name: "fn", Tenant: "acme", ID: model.FunctionKey("acme", "fn"), Resources: c.resources}
+
+			dir, err := createInstanceCgroup(cfg, "8080")
+			if err != nil {
+				t.Fatalf("got error %v, want the instance to start", err)
+			}
+			if c.want == "" {
+				if dir != "" {
+					t.Errorf("got cgroup %s, want none", dir)
+				}
+				return
+			}
+			if want := filepath.Join(root, c.want); dir != want {
+				t.Fatalf("got cgroup %s, want %s", dir, want)
+			}
+			for file, want := range map[string]string{"memory.max": c.memory, "cpu.max": c.cpu} {
+				data, err := ioutil.ReadFile(filepath.Join(dir, file))
+				if want == "" {
+					if err == nil {
+						t.Errorf("got %s %q, want none", file, data)
+					}
+					continue
+				}
+				if err != nil || string(data) != want {
+					t.Errorf("got %s %q error %v, want %q", file, data, err, want)
+				}
+			}
+			for _, d := range []string{root, filepath.Join(root, "acme"), filepath.Join(root, "acme", "fn")} {
+				if data, err := ioutil.ReadFile(filepath.Join(d, "cgroup.subtree_control")); err != nil || string(data) != "+memory +cpu" {
+					t.Errorf("got %s subtree control %q error %v", d, data, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+//go:build !linux
+// +build !linux
+
+package lambda
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// createInstanceCgroup only caps the node heap on platforms other than Linux
+func createInstanceCgroup(cfg model.FunctionConfig, name string) (string, error) {
+	res := cfg.Resources
+	if res.CPUMillis > 0 || res.CPUTimeSeconds > 0 || res.OpenFiles > 0 {
+		log.Warnf("function %s cpu and open files limits are only supported on Linux", cfg.ID)
+	}
+	return "", nil
+}
+
+// limitedCommand runs node directly, the node heap limit is in the arguments
+func limitedCommand(cfg model.FunctionConfig, cgroup string, args []string) (*exec.Cmd, error) {
+	return exec.Command("node", args...), nil
+}
+
+// InstanceInit is only supported on Linux
+func InstanceInit(args []string) {
+	fmt.Fprintf(os.Stderr, "function instance init is only supported on Linux\n")
+	os.Exit(125)
+}
+
+func removeCgroup(dir string) {}
+
+// terminationReason tells whether an exited instance has been killed for exceeding a resource limit
+func terminationReason(cfg model.FunctionConfig, cgroupDir string, state *os.ProcessState, cpuTime time.Duration) string {
+	// node aborts when the capped V8 heap is out of memory
+	if state != nil && cfg.Resources.MemoryMB > 0 && state.ExitCode() == 134 {
+		return model.MemoryLimitExceeded
+	}
+	return model.InstanceExited
+}
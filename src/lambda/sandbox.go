@@ -0,0 +1,183 @@
+package lambda
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ghodss/yaml"
+	"github.com/kafkaesque-io/pubsub-function/src/util"
+)
+
+// SandboxInitArg is the first command line argument of the worker re-executed to set up a sandbox
+const SandboxInitArg = "sandbox-init"
+
+// network policies of a sandbox
+const (
+	// HostNetwork has no network restriction
+	HostNetwork = "host"
+
+	// NoNetwork rejects all outbound connections
+	NoNetwork = "none"
+
+	// AllowListNetwork only allows outbound connections to AllowedHosts
+	AllowListNetwork = "allowlist"
+)
+
+// SandboxPolicy is the isolation of the function instances of a tenant
+type SandboxPolicy struct {
+	Enabled bool `json:"enabled"`
+
+	// UID is the unprivileged user the instances run as, default a uid allocated to the tenant
+	// GID is the unprivileged group the instances run as, default nogroup 65534
+	UID int `json:"uid"`
+	GID int `json:"gid"`
+
+	// Network is host, none or allowlist, default host
+	Network string `json:"network"`
+
+	// AllowedHosts are `<ip, cidr or host name>[:<port>]` allowed by the allowlist network policy
+	AllowedHosts []string `json:"allowedHosts"`
+}
+
+// SandboxConfig is the sandbox configuration file, a tenant policy replaces the default policy
+type SandboxConfig struct {
+	Default SandboxPolicy            `json:"default"`
+	Tenants map[string]SandboxPolicy `json:"tenants"`
+}
+
+var sandboxConfig *SandboxConfig
+var sandboxConfigErr error
+var sandboxConfigOnce sync.Once
+
+// the uids allocated to the tenants whose policy does not set a uid, so that no two tenants share a network policy chain
+const (
+	sandboxUIDBase = 100000
+	maxSandboxUIDs = 65536
+)
+
+var sandboxUIDs = make(map[string]int)
+var nextSandboxUID = sandboxUIDBase
+var sandboxUIDsLock = &sync.Mutex{}
+
+// loadSandboxConfig loads the sandbox configuration once from FunctionSandboxConfig,
+// or enables the default policy for all tenants with FunctionSandbox
+func loadSandboxConfig() (*SandboxConfig, error) {
+	sandboxConfigOnce.Do(func() {
+		config := util.GetConfig()
+		sandboxConfig = &SandboxConfig{
+			Default: SandboxPolicy{Enabled: util.StringToBool(config.FunctionSandbox)},
+		}
+		if config.FunctionSandboxConfig == "" {
+			return
+		}
+		data, err := ioutil.ReadFile(config.FunctionSandboxConfig)
+		if err != nil {
+			sandboxConfigErr = fmt.Errorf("read sandbox config %s error %v", config.FunctionSandboxConfig, err)
+			return
+		}
+		if err = yaml.Unmarshal(data, sandboxConfig); err != nil {
+			sandboxConfigErr = fmt.Errorf("parse sandbox config %s error %v", config.FunctionSandboxConfig, err)
+			return
+		}
+		sandboxConfigErr = validateSandboxConfig(sandboxConfig)
+	})
+	return sandboxConfig, sandboxConfigErr
+}
+
+// ValidateSandboxConfig loads the sandbox configuration so that the worker refuses to start with an invalid one
+func ValidateSandboxConfig() error {
+	_, err := loadSandboxConfig()
+	return err
+}
+
+// validateSandboxConfig rejects the policies that set the same uid with different network policies,
+// since the network policy of a uid is a single iptables chain
+func validateSandboxConfig(config *SandboxConfig) error {
+	names := map[int]string{}
+	networks := map[int]string{}
+	check := func(name string, policy SandboxPolicy) error {
+		if policy.UID == 0 {
+			return nil
+		}
+		network := networkSignature(policy)
+		if v, ok := networks[policy.UID]; ok && v != network {
+			return fmt.Errorf("sandbox policies %s and %s share uid %d with different network policies", names[policy.UID], name, policy.UID)
+		}
+		names[policy.UID], networks[policy.UID] = name, network
+		return nil
+	}
+
+	if err := check("default", config.Default); err != nil {
+		return err
+	}
+	tenants := make([]string, 0, len(config.Tenants))
+	for tenant := range config.Tenants {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	for _, tenant := range tenants {
+		if err := check("tenant "+tenant, config.Tenants[tenant]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// networkSignature identifies the network policy applied to a uid
+func networkSignature(policy SandboxPolicy) string {
+	return util.AssignString(policy.Network, HostNetwork) + strings.Join(policy.AllowedHosts, ",")
+}
+
+// sandboxUID returns the uid allocated to a tenant, the uids set by the policies are skipped
+func sandboxUID(config *SandboxConfig, tenant string) (int, error) {
+	sandboxUIDsLock.Lock()
+	defer sandboxUIDsLock.Unlock()
+	if uid, ok := sandboxUIDs[tenant]; ok {
+		return uid, nil
+	}
+
+	configured := map[int]bool{config.Default.UID: true}
+	for _, policy := range config.Tenants {
+		configured[policy.UID] = true
+	}
+	for nextSandboxUID < sandboxUIDBase+maxSandboxUIDs {
+		uid := nextSandboxUID
+		nextSandboxUID++
+		if !configured[uid] {
+			sandboxUIDs[tenant] = uid
+			return uid, nil
+		}
+	}
+	return 0, fmt.Errorf("sandbox uid pool exhausted")
+}
+
+// GetSandboxPolicy returns the sandbox policy of a tenant with the defaults applied
+func GetSandboxPolicy(tenant string) (SandboxPolicy, error) {
+	config, err := loadSandboxConfig()
+	if err != nil {
+		return SandboxPolicy{}, err
+	}
+	policy := config.Default
+	if v, ok := config.Tenants[tenant]; ok {
+		policy = v
+	}
+	if policy.Enabled && policy.UID == 0 {
+		if policy.UID, err = sandboxUID(config, tenant); err != nil {
+			return policy, err
+		}
+	}
+	if policy.GID == 0 {
+		policy.GID = 65534
+	}
+	switch policy.Network {
+	case "":
+		policy.Network = HostNetwork
+	case HostNetwork, NoNetwork, AllowListNetwork:
+	default:
+		return policy, fmt.Errorf("unsupported sandbox network policy %s", policy.Network)
+	}
+	return policy, nil
+}
@@ -0,0 +1,337 @@
+//go:build linux
+// +build linux
+
+package lambda
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sandboxSystemPaths are exposed read-only in every sandbox for the node runtime
+var sandboxSystemPaths = []string{
+	"/bin", "/lib", "/lib32", "/lib64", "/usr",
+	"/etc/ssl", "/etc/ca-certificates", "/etc/resolv.conf", "/etc/hosts", "/etc/nsswitch.conf", "/etc/localtime",
+}
+
+// sandboxDevices are exposed read-write in every sandbox
+var sandboxDevices = []string{"/dev/null", "/dev/zero", "/dev/random", "/dev/urandom"}
+
+// sandboxUsageFd is the file descriptor of the sandbox init to report the resource usage of node
+const sandboxUsageFd = 3
+
+// sandboxSpec is passed to the sandbox init process on the command line
+type sandboxSpec struct {
+	Root     string         `json:"root"`
+	ReadOnly []string       `json:"readOnly"`
+	UID      int            `json:"uid"`
+	GID      int            `json:"gid"`
+	Limits   instanceLimits `json:"limits"`
+	Args     []string       `json:"args"`
+}
+
+// sandboxCommand builds the command that re-executes the worker as the init process of a sandbox,
+// in a private mount and pid namespace, which then runs node as the unprivileged user of the policy.
+// It returns the pipe the sandbox init reports the resource usage of node to.
+func sandboxCommand(cfg model.FunctionConfig, policy SandboxPolicy, cgroup string, args []string) (*exec.Cmd, *os.File, error) {
+	if err := applyNetworkPolicy(cfg.Tenant, policy); err != nil {
+		return nil, nil, err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+	nodePath, err := exec.LookPath("node")
+	if err != nil {
+		return nil, nil, err
+	}
+	if nodePath, err = filepath.Abs(nodePath); err != nil {
+		return nil, nil, err
+	}
+	realNodePath, err := filepath.EvalSymlinks(nodePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// only the function's own directory is exposed besides the runtime
+	paths := append([]string{
+		filepath.Dir(nodePath),
+		filepath.Dir(realNodePath),
+		filepath.Dir(loaderPath()),
+		filepath.Dir(functionFilePath(cfg)),
+	}, sandboxSystemPaths...)
+	spec := sandboxSpec{
+		Root:     filepath.Join(os.TempDir(), "pubsub-function-sandbox"),
+		ReadOnly: topLevelPaths(paths),
+		UID:      policy.UID,
+		GID:      policy.GID,
+		Limits:   newInstanceLimits(cfg, cgroup),
+		Args:     append([]string{nodePath}, args...),
+	}
+	if err = os.MkdirAll(spec.Root, 0755); err != nil {
+		return nil, nil, err
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	usage, usageWriter, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cmd := exec.Command(self, SandboxInitArg, string(data))
+	cmd.Stderr = os.Stderr
+	// the write end is the file descriptor 3 of the sandbox init
+	cmd.ExtraFiles = []*os.File{usageWriter}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWPID,
+		Pdeathsig:  syscall.SIGKILL,
+	}
+	return cmd, usage, nil
+}
+
+// topLevelPaths sorts and removes the paths already exposed by a parent path
+func topLevelPaths(paths []string) []string {
+	sorted := append([]string{}, paths...)
+	sort.Strings(sorted)
+	results := []string{}
+	for _, p := range sorted {
+		p = filepath.Clean(p)
+		if len(results) > 0 {
+			last := results[len(results)-1]
+			if p == last || strings.HasPrefix(p, last+"/") || last == "/" {
+				continue
+			}
+		}
+		results = append(results, p)
+	}
+	return results
+}
+
+// SandboxInit applies the instance limits, sets up the sandbox file system, runs the function instance
+// as the unprivileged user, forwards termination signals, and exits with the exit status of the instance.
+// It never returns.
+func SandboxInit(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "sandbox init expects a spec argument\n")
+		os.Exit(125)
+	}
+	var spec sandboxSpec
+	if err := json.Unmarshal([]byte(args[0]), &spec); err != nil || len(spec.Args) == 0 {
+		fmt.Fprintf(os.Stderr, "sandbox init invalid spec %v\n", err)
+		os.Exit(125)
+	}
+	// the usage pipe is not inherited by node
+	usage := os.NewFile(sandboxUsageFd, "usage")
+	syscall.CloseOnExec(sandboxUsageFd)
+	// the cgroup is joined before the root changes, node inherits the cgroup and the rlimits
+	if err := spec.Limits.apply(); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox init error %v\n", err)
+		os.Exit(125)
+	}
+	if err := setupSandboxRoot(spec); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox init error %v\n", err)
+		os.Exit(125)
+	}
+
+	cmd := exec.Command(spec.Args[0], spec.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// the worker environment has the database password and keys
+	cmd.Env = []string{"PATH=/usr/local/bin:/usr/bin:/bin", "HOME=/tmp"}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(spec.UID), Gid: uint32(spec.GID), Groups: []uint32{}},
+	}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox init start %s error %v\n", spec.Args[0], err)
+		os.Exit(126)
+	}
+
+	// the init process of a pid namespace only receives the signals it handles
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	cmd.Wait()
+	// the rusage of the sandbox init would include itself
+	json.NewEncoder(usage).Encode(nodeUsage{UserTime: cmd.ProcessState.UserTime(), SystemTime: cmd.ProcessState.SystemTime()})
+	usage.Close()
+	status, _ := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if status.Signaled() {
+		os.Exit(128 + int(status.Signal()))
+	}
+	os.Exit(status.ExitStatus())
+}
+
+// setupSandboxRoot mounts a tmpfs root with the exposed paths, a private /tmp and /proc, and changes root to it
+func setupSandboxRoot(spec sandboxSpec) error {
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("make mounts private error %v", err)
+	}
+	root := spec.Root
+	if err := syscall.Mount("tmpfs", root, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755,size=16m"); err != nil {
+		return fmt.Errorf("mount sandbox root error %v", err)
+	}
+	tmp := filepath.Join(root, "tmp")
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", tmp, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777,size=64m"); err != nil {
+		return fmt.Errorf("mount sandbox tmp error %v", err)
+	}
+	proc := filepath.Join(root, "proc")
+	if err := os.MkdirAll(proc, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("proc", proc, "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mount sandbox proc error %v", err)
+	}
+	// exposed paths are mounted after /tmp so that they are not hidden by it
+	for _, p := range spec.ReadOnly {
+		if err := bindMount(root, p, true); err != nil {
+			return err
+		}
+	}
+	for _, p := range sandboxDevices {
+		if err := bindMount(root, p, false); err != nil {
+			return err
+		}
+	}
+
+	if err := syscall.Chroot(root); err != nil {
+		return fmt.Errorf("chroot error %v", err)
+	}
+	return os.Chdir("/")
+}
+
+// bindMount exposes a host path at the same path under the sandbox root, a missing path is skipped
+func bindMount(root, path string, readOnly bool) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	target := filepath.Join(root, path)
+	if info.IsDir() {
+		err = os.MkdirAll(target, 0755)
+	} else if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+		var f *os.File
+		if f, err = os.OpenFile(target, os.O_CREATE, 0644); err == nil {
+			f.Close()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("create sandbox mount point %s error %v", target, err)
+	}
+
+	if err = syscall.Mount(path, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind mount %s error %v", path, err)
+	}
+	if readOnly {
+		flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY | syscall.MS_NOSUID)
+		if err = syscall.Mount("", target, "", flags, ""); err != nil {
+			return fmt.Errorf("remount %s read-only error %v", path, err)
+		}
+	}
+	return nil
+}
+
+// appliedNetworkPolicies tracks the network policy applied to every sandbox uid
+var appliedNetworkPolicies = make(map[int]string)
+
+var networkPolicyLock = &sync.Mutex{}
+
+// applyNetworkPolicy restricts the outbound connections of the sandbox uid with an iptables owner match chain
+// replies of the connections accepted by the instance are always allowed
+func applyNetworkPolicy(tenant string, policy SandboxPolicy) error {
+	signature := networkSignature(policy)
+
+	networkPolicyLock.Lock()
+	defer networkPolicyLock.Unlock()
+	if v, ok := appliedNetworkPolicies[policy.UID]; ok {
+		if v == signature {
+			return nil
+		}
+		// the configuration is validated, a uid is either set by the policies or allocated to one tenant
+		return fmt.Errorf("tenant %s cannot replace the network policy of sandbox uid %d", tenant, policy.UID)
+	}
+
+	uid := strconv.Itoa(policy.UID)
+	chain := "PUBSUB-FN-" + uid
+	jump := []string{"OUTPUT", "-m", "owner", "--uid-owner", uid, "-j", chain}
+	if policy.Network == HostNetwork {
+		// an allocated uid may have had another policy in a previous run of the worker
+		if iptables(append([]string{"-C"}, jump...)...) == nil {
+			log.Infof("remove the network policy of sandbox uid %d for tenant %s", policy.UID, tenant)
+			if err := iptables(append([]string{"-D"}, jump...)...); err != nil {
+				return err
+			}
+		}
+		appliedNetworkPolicies[policy.UID] = signature
+		return nil
+	}
+
+	iptables("-N", chain) // the chain may already exist
+	rules := [][]string{
+		{"-F", chain},
+		{"-A", chain, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+	}
+	if policy.Network == AllowListNetwork {
+		for _, allowed := range policy.AllowedHosts {
+			host, port, err := net.SplitHostPort(allowed)
+			if err != nil {
+				host, port = allowed, ""
+			}
+			if port == "" {
+				rules = append(rules, []string{"-A", chain, "-d", host, "-j", "ACCEPT"})
+				continue
+			}
+			for _, protocol := range []string{"tcp", "udp"} {
+				rules = append(rules, []string{"-A", chain, "-d", host, "-p", protocol, "--dport", port, "-j", "ACCEPT"})
+			}
+		}
+	}
+	rules = append(rules, []string{"-A", chain, "-j", "REJECT"})
+	for _, rule := range rules {
+		if err := iptables(rule...); err != nil {
+			return err
+		}
+	}
+
+	if iptables(append([]string{"-C"}, jump...)...) != nil {
+		if err := iptables(append([]string{"-I", "OUTPUT", "1"}, jump[1:]...)...); err != nil {
+			return err
+		}
+	}
+	appliedNetworkPolicies[policy.UID] = signature
+	return nil
+}
+
+func iptables(args ...string) error {
+	if out, err := exec.Command("iptables", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("iptables %s error %v %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+//go:build linux
+// +build linux
+
+package lambda
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+)
+
+// TestMain runs the test binary as the sandbox init when a sandboxed instance re-executes it
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == SandboxInitArg {
+		SandboxInit(os.Args[2:])
+	}
+	if len(os.Args) > 1 && os.Args[1] == InstanceInitArg {
+		InstanceInit(os.Args[2:])
+	}
+	os.Exit(m.Run())
+}
+
+// readerSource is a function that reads the file of the Path header,
+// the loader also calls the function for the health checks which have no Path header
+const readerSource = `const fs = require('fs')
+module.exports = {
+  trigger: (req, res) => {
+    if (!req.headers['path']) {
+      return
+    }
+    try {
+      fs.readFileSync(req.headers['path'])
+      res.end('read')
+    } catch (e) {
+      res.end(e.code)
+    }
+  }
+}
+`
+
+func TestSandboxIsolatesTenantSources(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the sandbox requires root")
+	}
+	if _, err := exec.LookPath("node"); err != nil {
+		t.Skip("node is not installed")
+	}
+
+	base, err := ioutil.TempDir("", "sandbox-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	// the sandbox user traverses the base directory to its tenant directory
+	if err = os.Chmod(base, 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("FunctionBaseDir", base)
+	defer os.Unsetenv("FunctionBaseDir")
+
+	// the loader path is relative to the working directory of the worker
+	wd, _ := os.Getwd()
+	if err = os.Chdir(filepath.Dir(wd)); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	otherSource := filepath.Join(GetSourceFilePath("bob"), "secret.js")
+	if err = ioutil.WriteFile(otherSource, []byte("module.exports = {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ownSource := filepath.Join(GetSourceFilePath("alice"), "reader.js")
+	if err = ioutil.WriteFile(ownSource, []byte(readerSource), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sandboxConfigOnce.Do(func() {
+		sandboxConfig = &SandboxConfig{Default: SandboxPolicy{Enabled: true}}
+	})
+	cfg := model.FunctionConfig{ID: "alicereader", Tenant: "alice", LanguagePack: "javascript", FunctionFilePath: ownSource}
+	url, err := StartNodeInstance(cfg)
+	if err != nil {
+		t.Fatalf("start sandboxed instance error %v", err)
+	}
+	defer StopInstance(url)
+
+	cases := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"own source", ownSource, "read"},
+		{"other tenant source", otherSource, "ENOENT"},
+		{"other tenant directory", filepath.Dir(otherSource), "ENOENT"},
+		{"worker executable", os.Args[0], "ENOENT"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			body, err := Invoke(ctx, url, nil, map[string]string{"Path": c.path})
+			if err != nil {
+				t.Fatalf("invoke error %v", err)
+			}
+			if string(body) != c.want {
+				t.Errorf("read %s got %q, want %q", c.path, body, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package lambda
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+)
+
+// sandboxCommand is only supported on Linux
+func sandboxCommand(cfg model.FunctionConfig, policy SandboxPolicy, cgroup string, args []string) (*exec.Cmd, *os.File, error) {
+	return nil, nil, fmt.Errorf("function sandbox is only supported on Linux")
+}
+
+// SandboxInit is only supported on Linux
+func SandboxInit(args []string) {
+	fmt.Fprintf(os.Stderr, "function sandbox is only supported on Linux\n")
+	os.Exit(125)
+}
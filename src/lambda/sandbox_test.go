@@ -0,0 +1,52 @@
+package lambda
+
+import (
+	"testing"
+)
+
+func TestValidateSandboxConfig(t *testing.T) {
+	restricted := SandboxPolicy{Enabled: true, UID: 20001, Network: NoNetwork}
+	cases := []struct {
+		name    string
+		config  SandboxConfig
+		wantErr bool
+	}{
+		{"allocated uids", SandboxConfig{Default: SandboxPolicy{Enabled: true}, Tenants: map[string]SandboxPolicy{"a": {Enabled: true, Network: NoNetwork}}}, false},
+		{"same uid same policy", SandboxConfig{Tenants: map[string]SandboxPolicy{"a": restricted, "b": restricted}}, false},
+		{"same uid host and default network", SandboxConfig{Default: SandboxPolicy{UID: 20001, Network: HostNetwork}, Tenants: map[string]SandboxPolicy{"a": {UID: 20001}}}, false},
+		{"same uid different policies", SandboxConfig{Default: SandboxPolicy{UID: 20001}, Tenants: map[string]SandboxPolicy{"a": restricted}}, true},
+		{"same uid different allowed hosts", SandboxConfig{Tenants: map[string]SandboxPolicy{
+			"a": {UID: 20001, Network: AllowListNetwork, AllowedHosts: []string{"10.0.0.1"}},
+			"b": {UID: 20001, Network: AllowListNetwork, AllowedHosts: []string{"10.0.0.2"}},
+		}}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := validateSandboxConfig(&c.config)
+			if (err != nil) != c.wantErr {
+				t.Errorf("got error %v, want error %v", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestSandboxUID(t *testing.T) {
+	config := &SandboxConfig{Tenants: map[string]SandboxPolicy{"a": {UID: sandboxUIDBase + 1}}}
+	uids := map[int]string{}
+	for _, tenant := range []string{"b", "c", "d", "b"} {
+		uid, err := sandboxUID(config, tenant)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uid == sandboxUIDBase+1 {
+			t.Errorf("tenant %s is allocated the uid %d set by a policy", tenant, uid)
+		}
+		if v, ok := uids[uid]; ok && v != tenant {
+			t.Errorf("tenants %s and %s share uid %d", v, tenant, uid)
+		}
+		uids[uid] = tenant
+	}
+	if len(uids) != 3 {
+		t.Errorf("got %d uids for 3 tenants", len(uids))
+	}
+}
@@ -1,10 +1,20 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/kafkaesque-io/pubsub-function/src/artifact"
 	"github.com/kafkaesque-io/pubsub-function/src/broker"
+	"github.com/kafkaesque-io/pubsub-function/src/cluster"
+	"github.com/kafkaesque-io/pubsub-function/src/db"
+	"github.com/kafkaesque-io/pubsub-function/src/lambda"
+	"github.com/kafkaesque-io/pubsub-function/src/pulsardriver"
 	"github.com/kafkaesque-io/pubsub-function/src/route"
 	"github.com/kafkaesque-io/pubsub-function/src/util"
 	"github.com/rs/cors"
@@ -14,7 +24,17 @@ import (
 var mode = util.AssignString(os.Getenv("ProcessMode"), *flag.String("mode", "hybrid", "server running mode"))
 
 func main() {
-	exit := make(chan bool)
+	// the worker is re-executed as the init process of a function sandbox
+	if len(os.Args) > 1 && os.Args[1] == lambda.SandboxInitArg {
+		lambda.SandboxInit(os.Args[2:])
+	}
+	// or to apply the limits of a function instance before executing node
+	if len(os.Args) > 1 && os.Args[1] == lambda.InstanceInitArg {
+		lambda.InstanceInit(os.Args[2:])
+	}
+
+	exit := make(chan os.Signal, 1)
+	signal.Notify(exit, syscall.SIGINT, syscall.SIGTERM)
 	util.Init()
 
 	flag.Parse()
@@ -24,7 +44,11 @@ func main() {
 	}
 
 	if util.IsBrokerRequired(&mode) {
+		if err := lambda.ValidateSandboxConfig(); err != nil {
+			log.Fatal(err)
+		}
 		broker.Init()
+		cluster.Init(broker.Refresh)
 	}
 
 	if util.IsHTTPRouterRequired(&mode) {
@@ -43,11 +67,47 @@ func main() {
 		port := util.AssignString(config.PORT, "8081")
 		certFile := util.GetConfig().CertFile
 		keyFile := util.GetConfig().KeyFile
-		log.Fatal(util.ListenAndServeTLS(":"+port, certFile, keyFile, handler))
+		go func() {
+			if err := util.ListenAndServeTLS(":"+port, certFile, keyFile, handler); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	sig := <-exit
+	log.Warnf("received signal %v, shut down the server", sig)
+	shutdown()
+	os.Exit(0)
+}
+
+// shutdown stops accepting http requests, drains the in-flight invocations, terminates the function instances,
+// and flushes and closes the Pulsar resources within the ShutdownTimeout
+func shutdown() {
+	timeout, err := time.ParseDuration(util.AssignString(util.GetConfig().ShutdownTimeout, "25s"))
+	if err != nil {
+		log.Errorf("invalid ShutdownTimeout %v, use the default 25s", err)
+		timeout = 25 * time.Second
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	select {
-	case <-exit:
-		os.Exit(2)
+	if util.IsHTTPRouterRequired(&mode) {
+		if err := util.ShutdownServer(ctx); err != nil {
+			log.Errorf("http server shutdown error %v", err)
+		}
+	}
+	if util.IsBrokerRequired(&mode) {
+		cluster.Shutdown()
+		broker.Shutdown(ctx)
+	}
+	// function instances are also started by the function rest api
+	lambda.StopAllInstances()
+	if err := db.CloseDb(); err != nil {
+		log.Errorf("database close error %v", err)
+	}
+	if err := artifact.CloseStore(); err != nil {
+		log.Errorf("artifact store close error %v", err)
 	}
+	pulsardriver.CloseAll()
+	log.Warnf("server has been shut down")
 }
@@ -2,6 +2,7 @@ package middleware
 
 //middleware includes auth, rate limit, and etc.
 import (
+	"context"
 	"net/http"
 	"strings"
 
@@ -14,9 +15,41 @@ var (
 	// Rate is the default global rate limit
 	// This rate only limits the rate hitting on endpoint
 	// It does not limit the underline resource access
-	Rate = NewSema(200)
+	Rate = util.NewSema(200)
 )
 
+type contextKey int
+
+// request context keys of the verified JWT
+const (
+	// claimsKey is the request context key of the verified JWT claims
+	claimsKey contextKey = iota
+	// subjectsKey is the request context key of the verified JWT subjects
+	subjectsKey
+)
+
+// TokenClaims returns the verified JWT claims injected by AuthVerifyJWT
+func TokenClaims(r *http.Request) map[string]interface{} {
+	if claims, ok := r.Context().Value(claimsKey).(map[string]interface{}); ok {
+		return claims
+	}
+	return map[string]interface{}{}
+}
+
+// TokenSubjects returns the verified JWT subjects injected by AuthVerifyJWT, empty if the request is not authenticated
+func TokenSubjects(r *http.Request) string {
+	subjects, _ := r.Context().Value(subjectsKey).(string)
+	return subjects
+}
+
+// StripInjectedHeaders removes the headers that only the auth middleware sets, so that a caller cannot forge them
+func StripInjectedHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del("injectedSubs")
+		next.ServeHTTP(w, r)
+	})
+}
+
 // AuthFunc is a function type to allow pluggable authentication middleware
 type AuthFunc func(next http.Handler) http.Handler
 
@@ -31,12 +64,24 @@ func AuthVerifyJWT(next http.Handler) http.Handler {
 	default:
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			tokenStr := strings.TrimSpace(strings.Replace(r.Header.Get("Authorization"), "Bearer", "", 1))
-			subjects, err := util.JWTAuth.GetTokenSubject(tokenStr)
+			claims, err := util.TokenVerifier.GetTokenClaims(tokenStr)
+			var subjects string
+			if err == nil {
+				subjects, err = util.TokenVerifier.SubjectFromClaims(claims)
+			}
+
+			if err == nil && IsRevoked(claims, subjects) {
+				log.Warnf("revoked token with subjects %s", subjects)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
 
 			if err == nil {
 				log.Infof("Authenticated with subjects %s", subjects)
 				r.Header.Set("injectedSubs", subjects)
-				next.ServeHTTP(w, r)
+				ctx := context.WithValue(r.Context(), claimsKey, map[string]interface{}(claims))
+				ctx = context.WithValue(ctx, subjectsKey, subjects)
+				next.ServeHTTP(w, r.WithContext(ctx))
 			} else {
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			}
@@ -66,16 +111,15 @@ func NoAuth(next http.Handler) http.Handler {
 	})
 }
 
-// LimitRate rate limites against http handler
-// use semaphore as a simple rate limiter
+// LimitRate limits the global concurrent requests against http handler
+// use semaphore as a simple concurrency limiter, LimitRateByRoute limits the rate
 func LimitRate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		err := Rate.Acquire()
-		if err != nil {
+		if err := Rate.Acquire(); err != nil {
 			http.Error(w, "Too many requests", http.StatusTooManyRequests)
-		} else {
-			next.ServeHTTP(w, r)
+			return
 		}
-		Rate.Release()
+		defer Rate.Release()
+		next.ServeHTTP(w, r)
 	})
 }
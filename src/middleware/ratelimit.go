@@ -0,0 +1,302 @@
+package middleware
+
+// token bucket rate limits are keyed by the route name and the verified JWT subjects or the client address,
+// and by the tenant of the route
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kafkaesque-io/pubsub-function/src/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RateBudget is the name of a rate limit budget configured in Configuration
+type RateBudget string
+
+// rate limit budgets
+const (
+	// NoRateLimit skips the token bucket rate limit
+	NoRateLimit RateBudget = ""
+	// FirehoseBudget is the budget of firehose ingestion
+	FirehoseBudget RateBudget = "firehose"
+	// FunctionBudget is the budget of function management
+	FunctionBudget RateBudget = "function"
+	// DefaultBudget is the budget of all other routes
+	DefaultBudget RateBudget = "default"
+	// TenantBudget is the budget shared by all callers of a tenant across the routes of the tenant
+	TenantBudget RateBudget = "tenant"
+)
+
+// default budgets in requests per second and burst
+var defaultRateBudgets = map[RateBudget]string{
+	FirehoseBudget: "1000,2000",
+	FunctionBudget: "10,20",
+	DefaultBudget:  "50,100",
+	TenantBudget:   "100,200",
+}
+
+// idle buckets are evicted from the cache after bucketTTL
+const bucketTTL = 10 * time.Minute
+
+// TokenBucket is a token bucket rate limiter
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	sync.Mutex
+}
+
+// NewTokenBucket creates a full token bucket refilled at rate tokens per second up to burst
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Take takes a token from the bucket. It returns whether a token is taken, the remaining tokens,
+// and the duration until a token is available (if denied) or the bucket is full (if taken).
+func (b *TokenBucket) Take() (bool, int, time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, 0, b.duration(1 - b.tokens)
+	}
+	b.tokens--
+	return true, int(b.tokens), b.duration(b.burst - b.tokens)
+}
+
+// Limit is the bucket size
+func (b *TokenBucket) Limit() int {
+	return int(b.burst)
+}
+
+func (b *TokenBucket) duration(tokens float64) time.Duration {
+	return time.Duration(tokens / b.rate * float64(time.Second))
+}
+
+// RateLimiter keeps a token bucket per key with the same rate and burst
+type RateLimiter struct {
+	rate    float64
+	burst   int
+	buckets *util.Cache
+	sync.Mutex
+}
+
+// NewRateLimiter creates a rate limiter
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:  rate,
+		burst: burst,
+		buckets: util.NewCache(util.CacheOption{
+			TTL:            bucketTTL,
+			CleanInterval:  bucketTTL,
+			ExpireCallback: func(key string, value interface{}) {},
+		}),
+	}
+}
+
+// Bucket gets or creates the token bucket of the key
+func (l *RateLimiter) Bucket(key string) *TokenBucket {
+	l.Lock()
+	defer l.Unlock()
+	if obj, ok := l.buckets.Get(key); ok {
+		return obj.(*TokenBucket)
+	}
+	bucket := NewTokenBucket(l.rate, l.burst)
+	l.buckets.Set(key, bucket)
+	return bucket
+}
+
+var (
+	rateLimiters     = make(map[RateBudget]*RateLimiter)
+	rateLimitersLock = &sync.Mutex{}
+)
+
+// ParseRateBudget parses a budget in the format of `<requests per second>,<burst>`
+func ParseRateBudget(budget string) (float64, int, error) {
+	parts := strings.Split(budget, ",")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("rate limit %s must be in the format of rate,burst", budget)
+	}
+	rate, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil || rate <= 0 {
+		return 0, 0, fmt.Errorf("invalid rate in rate limit %s", budget)
+	}
+	burst, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil || burst < 1 {
+		return 0, 0, fmt.Errorf("invalid burst in rate limit %s", budget)
+	}
+	return rate, burst, nil
+}
+
+func configuredBudget(budget RateBudget) string {
+	config := util.GetConfig()
+	switch budget {
+	case FirehoseBudget:
+		return util.AssignString(config.RateLimitFirehose, defaultRateBudgets[budget])
+	case FunctionBudget:
+		return util.AssignString(config.RateLimitFunction, defaultRateBudgets[budget])
+	case TenantBudget:
+		return util.AssignString(config.RateLimitTenant, defaultRateBudgets[budget])
+	default:
+		return util.AssignString(config.RateLimitDefault, defaultRateBudgets[DefaultBudget])
+	}
+}
+
+func getRateLimiter(budget RateBudget) *RateLimiter {
+	rateLimitersLock.Lock()
+	defer rateLimitersLock.Unlock()
+	if limiter, ok := rateLimiters[budget]; ok {
+		return limiter
+	}
+
+	rate, burst, err := ParseRateBudget(configuredBudget(budget))
+	if err != nil {
+		log.Errorf("%v, fall back to the default budget", err)
+		rate, burst, _ = ParseRateBudget(defaultRateBudgets[DefaultBudget])
+	}
+	limiter := NewRateLimiter(rate, burst)
+	rateLimiters[budget] = limiter
+	return limiter
+}
+
+// ParseTrustedProxies parses a comma separated list of IPs or CIDRs
+func ParseTrustedProxies(proxies string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, proxy := range strings.Split(proxies, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %s", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %s", proxy)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func getTrustedProxies() []*net.IPNet {
+	proxies, err := ParseTrustedProxies(util.GetConfig().TrustedProxies)
+	if err != nil {
+		log.Errorf("%v, the client address of unauthenticated requests is not forwarded", err)
+		return nil
+	}
+	return proxies
+}
+
+func isTrusted(proxies []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range proxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddress is the address of the caller. A request from a trusted proxy is from the last address
+// in X-Forwarded-For that is not a trusted proxy, since a client can prepend any address to the header.
+func clientAddress(r *http.Request, proxies []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrusted(proxies, host) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(addr) == nil {
+			// the chain is broken by an address the proxies would not have appended
+			break
+		}
+		if !isTrusted(proxies, addr) {
+			return addr
+		}
+		host = addr
+	}
+	return host
+}
+
+// rateLimitPrincipal identifies the caller by the JWT subjects verified by the auth middleware,
+// otherwise by the client address. Headers are only used as forwarded by a trusted proxy,
+// since a caller can rotate them for a fresh bucket.
+func rateLimitPrincipal(r *http.Request, proxies []*net.IPNet) string {
+	if subjects := TokenSubjects(r); subjects != "" {
+		return "sub:" + subjects
+	}
+	return clientAddress(r, proxies)
+}
+
+// LimitRateByRoute rate limits a route with a token bucket per caller within the budget,
+// and a route of a tenant with a token bucket per tenant within the tenant budget.
+// It must be placed inside the auth middleware to be keyed by the JWT subjects, and to only
+// take from the tenant budget for the callers authorized on the tenant.
+func LimitRateByRoute(routeName string, budget RateBudget) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if budget == NoRateLimit {
+			return next
+		}
+		limiter, tenantLimiter := getRateLimiter(budget), getRateLimiter(TenantBudget)
+		proxies := getTrustedProxies()
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			bucket := limiter.Bucket(routeName + "|" + rateLimitPrincipal(r, proxies))
+			ok, remaining, wait := bucket.Take()
+			limit := bucket.Limit()
+			if tenant := mux.Vars(r)["tenant"]; ok && tenant != "" {
+				// the headers are of the bucket closer to its limit
+				tenantBucket := tenantLimiter.Bucket(tenant)
+				tenantOK, tenantRemaining, tenantWait := tenantBucket.Take()
+				if !tenantOK || tenantRemaining < remaining {
+					ok, remaining, wait, limit = tenantOK, tenantRemaining, tenantWait, tenantBucket.Limit()
+				}
+			}
+			seconds := strconv.Itoa(int(math.Ceil(wait.Seconds())))
+
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+			w.Header().Set("X-RateLimit-Reset", seconds)
+			if !ok {
+				w.Header().Set("Retry-After", seconds)
+				util.ResponseErrorJSON(fmt.Errorf("rate limit exceeded"), w, http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kafkaesque-io/pubsub-function/src/util"
+)
+
+func TestTokenBucket(t *testing.T) {
+	cases := []struct {
+		name  string
+		rate  float64
+		burst int
+		// the time elapsed before each take
+		elapsed []time.Duration
+		taken   []bool
+	}{
+		{"burst then denied", 1, 3, []time.Duration{0, 0, 0, 0}, []bool{true, true, true, false}},
+		{"refill at the rate", 2, 1, []time.Duration{0, 0, 250 * time.Millisecond, 250 * time.Millisecond, 0}, []bool{true, false, false, true, false}},
+		{"refill up to the burst", 10, 2, []time.Duration{0, 0, time.Hour, 0, 0, 0}, []bool{true, true, true, true, false, false}},
+		{"fractional rate", 0.5, 1, []time.Duration{0, time.Second, time.Second}, []bool{true, false, true}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b := NewTokenBucket(c.rate, c.burst)
+			for i, elapsed := range c.elapsed {
+				b.last = b.last.Add(-elapsed)
+				taken, remaining, wait := b.Take()
+				if taken != c.taken[i] {
+					t.Fatalf("take %d got %v, want %v", i, taken, c.taken[i])
+				}
+				if remaining < 0 || remaining >= c.burst {
+					t.Errorf("take %d got %d remaining tokens of burst %d", i, remaining, c.burst)
+				}
+				// a denied take waits for one token, a granted take reports the time to refill the bucket
+				if max := time.Duration(float64(c.burst) / c.rate * float64(time.Second)); wait <= 0 || wait > max {
+					t.Errorf("take %d got wait %v, want within %v", i, wait, max)
+				}
+			}
+			if b.Limit() != c.burst {
+				t.Errorf("got limit %d, want %d", b.Limit(), c.burst)
+			}
+		})
+	}
+}
+
+func TestParseRateBudget(t *testing.T) {
+	cases := []struct {
+		budget  string
+		rate    float64
+		burst   int
+		wantErr bool
+	}{
+		{"10,20", 10, 20, false},
+		{" 0.5 , 1 ", 0.5, 1, false},
+		{"10", 0, 0, true},
+		{"10,20,30", 0, 0, true},
+		{"0,20", 0, 0, true},
+		{"-1,20", 0, 0, true},
+		{"10,0", 0, 0, true},
+		{"10,1.5", 0, 0, true},
+		{"a,b", 0, 0, true},
+	}
+	for _, c := range cases {
+		t.Run(c.budget, func(t *testing.T) {
+			rate, burst, err := ParseRateBudget(c.budget)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("got error %v, want error %v", err, c.wantErr)
+			}
+			if rate != c.rate || burst != c.burst {
+				t.Errorf("got %v,%d, want %v,%d", rate, burst, c.rate, c.burst)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	cases := []struct {
+		proxies string
+		want    []string
+		wantErr bool
+	}{
+		{"", []string{}, false},
+		{"10.0.0.1", []string{"10.0.0.1/32"}, false},
+		{"10.0.0.0/8, 192.168.1.5", []string{"10.0.0.0/8", "192.168.1.5/32"}, false},
+		{"::1,fd00::/8", []string{"::1/128", "fd00::/8"}, false},
+		{"10.0.0.0/33", nil, true},
+		{"proxy.local", nil, true},
+	}
+	for _, c := range cases {
+		t.Run(c.proxies, func(t *testing.T) {
+			nets, err := ParseTrustedProxies(c.proxies)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("got error %v, want error %v", err, c.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got := []string{}
+			for _, n := range nets {
+				got = append(got, n.String())
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitPrincipal(t *testing.T) {
+	cases := []struct {
+		name       string
+		proxies    string
+		remoteAddr string
+		subjects   string
+		headers    map[string]string
+		want       string
+	}{
+		{"verified subjects", "", "10.0.0.1:5000", "alice", nil, "sub:alice"},
+		{"client address", "", "10.0.0.1:5000", "", nil, "10.0.0.1"},
+		{"client address of another port", "", "10.0.0.1:5001", "", nil, "10.0.0.1"},
+		{"headers are ignored", "", "10.0.0.1:5000", "", map[string]string{"injectedSubs": "bob", "TopicFn": "t", "X-Forwarded-For": "10.0.0.2"}, "10.0.0.1"},
+		{"address without port", "", "10.0.0.1", "", nil, "10.0.0.1"},
+		{"forwarded by a trusted proxy", "10.0.0.0/8", "10.0.0.1:5000", "", map[string]string{"X-Forwarded-For": "203.0.113.7"}, "203.0.113.7"},
+		{"forwarded address prepended by the client", "10.0.0.0/8", "10.0.0.1:5000", "", map[string]string{"X-Forwarded-For": "198.51.100.1, 203.0.113.7"}, "203.0.113.7"},
+		{"chain of trusted proxies", "10.0.0.0/8,192.168.1.5", "10.0.0.1:5000", "", map[string]string{"X-Forwarded-For": "203.0.113.7, 192.168.1.5"}, "203.0.113.7"},
+		{"forwarded by an untrusted proxy", "10.0.0.0/8", "172.16.0.1:5000", "", map[string]string{"X-Forwarded-For": "203.0.113.7"}, "172.16.0.1"},
+		{"trusted proxy without forwarded address", "10.0.0.0/8", "10.0.0.1:5000", "", nil, "10.0.0.1"},
+		{"invalid forwarded address", "10.0.0.0/8", "10.0.0.1:5000", "", map[string]string{"X-Forwarded-For": "203.0.113.7, unknown"}, "10.0.0.1"},
+		{"verified subjects behind a trusted proxy", "10.0.0.0/8", "10.0.0.1:5000", "alice", map[string]string{"X-Forwarded-For": "203.0.113.7"}, "sub:alice"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			proxies, err := ParseTrustedProxies(c.proxies)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "/v2/function/a/f", nil)
+			r.RemoteAddr = c.remoteAddr
+			for k, v := range c.headers {
+				r.Header.Set(k, v)
+			}
+			if c.subjects != "" {
+				r = r.WithContext(context.WithValue(r.Context(), subjectsKey, c.subjects))
+			}
+			if got := rateLimitPrincipal(r, proxies); got != c.want {
+				t.Errorf("got %s, want %s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestLimitRateByRoute(t *testing.T) {
+	defer func(config util.Configuration) {
+		util.Config = config
+		rateLimiters = make(map[RateBudget]*RateLimiter)
+	}(util.Config)
+	util.Config.RateLimitFunction = "0.001,2"
+	util.Config.RateLimitFirehose = "0.001,1"
+	util.Config.RateLimitTenant = "0.001,3"
+	util.Config.TrustedProxies = "10.0.0.1"
+	rateLimiters = make(map[RateBudget]*RateLimiter)
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	function := LimitRateByRoute("function", FunctionBudget)(ok)
+	firehose := LimitRateByRoute("firehose", FirehoseBudget)(ok)
+
+	cases := []struct {
+		name      string
+		handler   http.Handler
+		tenant    string
+		subjects  string
+		forwarded string
+		want      int
+		remaining string
+	}{
+		{"caller budget", function, "a", "alice", "", http.StatusOK, "1"},
+		{"tenant budget closer to its limit", function, "a", "alice", "", http.StatusOK, "0"},
+		{"caller budget exhausted", function, "a", "alice", "", http.StatusTooManyRequests, "0"},
+		{"another caller of the tenant", function, "a", "bob", "", http.StatusOK, "0"},
+		{"tenant budget exhausted", function, "a", "carol", "", http.StatusTooManyRequests, "0"},
+		{"another tenant", function, "b", "dave", "", http.StatusOK, "1"},
+		{"forwarded client", firehose, "", "", "203.0.113.7", http.StatusOK, "0"},
+		{"forwarded client exhausted", firehose, "", "", "203.0.113.7", http.StatusTooManyRequests, "0"},
+		{"another client behind the proxy", firehose, "", "", "203.0.113.8", http.StatusOK, "0"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = "10.0.0.1:5000"
+			if c.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", c.forwarded)
+			}
+			if c.subjects != "" {
+				r = r.WithContext(context.WithValue(r.Context(), subjectsKey, c.subjects))
+			}
+			if c.tenant != "" {
+				r = mux.SetURLVars(r, map[string]string{"tenant": c.tenant})
+			}
+			w := httptest.NewRecorder()
+			c.handler.ServeHTTP(w, r)
+			if w.Code != c.want {
+				t.Errorf("got status %d, want %d", w.Code, c.want)
+			}
+			if got := w.Header().Get("X-RateLimit-Remaining"); got != c.remaining {
+				t.Errorf("got remaining %s, want %s", got, c.remaining)
+			}
+			if c.want == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+				t.Error("got no Retry-After header")
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package middleware
+
+// role based access control evaluates the token subjects and claims against tenant role bindings
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+	"github.com/kafkaesque-io/pubsub-function/src/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RoleBindingStore looks up the role bindings of a tenant
+type RoleBindingStore interface {
+	GetRoleBindings(tenant string) ([]*model.RoleBinding, error)
+}
+
+var (
+	roleBindings RoleBindingStore
+
+	// tenantMatcher evaluates whether the token subjects own the tenant
+	tenantMatcher = func(tenant, subjects string) bool { return false }
+)
+
+// InitRBAC sets up the role binding store and the tenant ownership evaluation
+func InitRBAC(store RoleBindingStore, matcher func(tenant, subjects string) bool) {
+	roleBindings = store
+	tenantMatcher = matcher
+}
+
+// ResolveRole resolves the role of the token subjects and claims within a tenant.
+// A super role is always an admin as the break-glass role.
+// Explicit role bindings take precedence over the tenant ownership evaluation,
+// so that a subject evaluated to the tenant can be restricted to a lesser role.
+func ResolveRole(tenant, subjects string, claims map[string]interface{}) model.Role {
+	for _, v := range strings.Split(subjects, ",") {
+		if util.StrContains(util.SuperRoles, v) {
+			return model.AdminRole
+		}
+	}
+
+	if roleBindings != nil {
+		bindings, err := roleBindings.GetRoleBindings(tenant)
+		if err != nil {
+			log.Errorf("failed to load role bindings of tenant %s error %v", tenant, err)
+			return model.NoRole
+		}
+		role, bound := model.NoRole, false
+		for _, b := range bindings {
+			if b.Matches(subjects, claims) {
+				role, bound = model.HigherRole(role, b.Role), true
+			}
+		}
+		if bound {
+			return role
+		}
+	}
+
+	if tenantMatcher(tenant, subjects) {
+		return model.AdminRole
+	}
+	return model.NoRole
+}
+
+// AuthRole verifies the JWT and authorizes the action against the role of the token within the {tenant} route variable
+func AuthRole(action model.Action) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return AuthVerifyJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tenant, ok := mux.Vars(r)["tenant"]
+			if !ok || tenant == "" {
+				util.ResponseErrorJSON(fmt.Errorf("missing tenant"), w, http.StatusUnprocessableEntity)
+				return
+			}
+			role := ResolveRole(tenant, r.Header.Get("injectedSubs"), TokenClaims(r))
+			if !role.Allows(action) {
+				util.ResponseErrorJSON(fmt.Errorf("subject is not authorized for the operation in tenant %s", tenant), w, http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}))
+	}
+}
+
+// SuperRoleRequired verifies the JWT and requires one of the super roles
+func SuperRoleRequired(next http.Handler) http.Handler {
+	return AuthVerifyJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, v := range strings.Split(r.Header.Get("injectedSubs"), ",") {
+			if util.StrContains(util.SuperRoles, v) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		util.ResponseErrorJSON(fmt.Errorf("super role is required"), w, http.StatusForbidden)
+	}))
+}
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+	"github.com/kafkaesque-io/pubsub-function/src/util"
+)
+
+type fakeRoleBindings map[string][]*model.RoleBinding
+
+func (f fakeRoleBindings) GetRoleBindings(tenant string) ([]*model.RoleBinding, error) {
+	if tenant == "broken" {
+		return nil, errors.New("store is down")
+	}
+	return f[tenant], nil
+}
+
+func TestResolveRole(t *testing.T) {
+	superRoles, store, matcher := util.SuperRoles, roleBindings, tenantMatcher
+	defer func() {
+		util.SuperRoles, roleBindings, tenantMatcher = superRoles, store, matcher
+	}()
+	util.SuperRoles = []string{"superuser"}
+	InitRBAC(fakeRoleBindings{
+		"a": {
+			{Tenant: "a", Subject: "alice", Role: model.ReadOnlyRole},
+			{Tenant: "a", Subject: "alice", Role: model.DeployerRole},
+			{Tenant: "a", Subject: "a-owner", Role: model.ReadOnlyRole},
+			{Tenant: "a", Subject: "ops", Claim: "groups", Role: model.AdminRole},
+		},
+	}, func(tenant, subjects string) bool { return subjects == tenant+"-owner" || subjects == "broken-owner" })
+
+	cases := []struct {
+		name     string
+		tenant   string
+		subjects string
+		claims   map[string]interface{}
+		want     model.Role
+	}{
+		{"super role", "a", "bob,superuser", nil, model.AdminRole},
+		{"highest bound role", "a", "alice", nil, model.DeployerRole},
+		{"binding of another claim", "a", "bob", map[string]interface{}{"groups": []interface{}{"dev", "ops"}}, model.AdminRole},
+		{"claim as a comma separated string", "a", "bob", map[string]interface{}{"groups": "dev, ops"}, model.AdminRole},
+		{"binding restricts the tenant owner", "a", "a-owner", nil, model.ReadOnlyRole},
+		{"tenant owner without binding", "b", "b-owner", nil, model.AdminRole},
+		{"no binding", "a", "bob", map[string]interface{}{"groups": "dev"}, model.NoRole},
+		{"binding of another tenant", "b", "alice", nil, model.NoRole},
+		{"store failure denies the owner", "broken", "broken-owner", nil, model.NoRole},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := ResolveRole(c.tenant, c.subjects, c.claims); got != c.want {
+				t.Errorf("got role %q, want %q", got, c.want)
+			}
+		})
+	}
+}
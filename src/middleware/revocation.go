@@ -0,0 +1,75 @@
+package middleware
+
+// token revocation is checked against the in memory revocations replicated by the database
+import (
+	"strings"
+	"time"
+
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RevocationStore looks up and garbage collects token revocations
+type RevocationStore interface {
+	GetRevocation(key string) (*model.Revocation, error)
+	GetRevocations() ([]*model.Revocation, error)
+	DeleteRevocation(key string) (string, error)
+}
+
+// revocationGCInterval is the interval to garbage collect revocations of naturally expired tokens
+const revocationGCInterval = 10 * time.Minute
+
+var revocations RevocationStore
+
+// InitRevocation sets up the revocation store and starts the garbage collection
+func InitRevocation(store RevocationStore) {
+	revocations = store
+	go func() {
+		for range time.Tick(revocationGCInterval) {
+			collectRevocations()
+		}
+	}()
+}
+
+// IsRevoked evaluates whether a token is revoked by its jti or any of its subjects
+func IsRevoked(claims map[string]interface{}, subjects string) bool {
+	if revocations == nil {
+		return false
+	}
+
+	jti, _ := claims["jti"].(string)
+	var issuedAt time.Time
+	if iat, ok := claims["iat"].(float64); ok {
+		issuedAt = time.Unix(int64(iat), 0)
+	}
+
+	keys := []string{}
+	if jti != "" {
+		keys = append(keys, model.JTIRevocationKey(jti))
+	}
+	for _, v := range strings.Split(subjects, ",") {
+		keys = append(keys, model.SubjectRevocationKey(strings.TrimSpace(v)))
+	}
+	for _, key := range keys {
+		if rv, err := revocations.GetRevocation(key); err == nil && rv.Revokes(jti, subjects, issuedAt) {
+			return true
+		}
+	}
+	return false
+}
+
+func collectRevocations() {
+	list, err := revocations.GetRevocations()
+	if err != nil {
+		log.Errorf("failed to load revocations error %v", err)
+		return
+	}
+	for _, rv := range list {
+		if rv.Expired() {
+			if _, err := revocations.DeleteRevocation(rv.ID); err != nil {
+				log.Errorf("failed to garbage collect revocation %s error %v", rv.ID, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+)
+
+type fakeRevocations map[string]*model.Revocation
+
+func (f fakeRevocations) GetRevocation(key string) (*model.Revocation, error) {
+	if rv, ok := f[key]; ok {
+		return rv, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func (f fakeRevocations) GetRevocations() ([]*model.Revocation, error) {
+	list := []*model.Revocation{}
+	for _, rv := range f {
+		list = append(list, rv)
+	}
+	return list, nil
+}
+
+func (f fakeRevocations) DeleteRevocation(key string) (string, error) {
+	delete(f, key)
+	return key, nil
+}
+
+func TestIsRevoked(t *testing.T) {
+	defer func(store RevocationStore) { revocations = store }(revocations)
+	revocations = nil
+	if IsRevoked(map[string]interface{}{"jti": "token-1"}, "alice") {
+		t.Error("got revoked without a revocation store")
+	}
+
+	now := time.Now()
+	byJTI := model.NewRevocation("token-1", "", "leaked", time.Time{})
+	bySubject := model.NewRevocation("", "bob", "left the team", time.Time{})
+	bySubject.RevokedAt = now.Add(-time.Hour)
+	revocations = fakeRevocations{byJTI.ID: &byJTI, bySubject.ID: &bySubject}
+
+	iat := func(at time.Time) float64 { return float64(at.Unix()) }
+	cases := []struct {
+		name     string
+		claims   map[string]interface{}
+		subjects string
+		want     bool
+	}{
+		{"revoked jti", map[string]interface{}{"jti": "token-1", "iat": iat(now)}, "alice", true},
+		{"other jti", map[string]interface{}{"jti": "token-2", "iat": iat(now)}, "alice", false},
+		{"no jti", map[string]interface{}{"iat": iat(now)}, "alice", false},
+		{"subject issued before the revocation", map[string]interface{}{"iat": iat(now.Add(-2 * time.Hour))}, "bob", true},
+		{"subject issued at the revocation", map[string]interface{}{"iat": iat(bySubject.RevokedAt)}, "bob", true},
+		{"subject issued after the revocation", map[string]interface{}{"iat": iat(now)}, "bob", false},
+		{"subject without issued at", map[string]interface{}{}, "bob", true},
+		{"one of the subjects", map[string]interface{}{"iat": iat(now.Add(-2 * time.Hour))}, "alice, bob", true},
+		{"other subject", map[string]interface{}{"iat": iat(now.Add(-2 * time.Hour))}, "alice,carol", false},
+		{"jti of a token issued after the subject revocation", map[string]interface{}{"jti": "token-1", "iat": iat(now)}, "bob", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := IsRevoked(c.claims, c.subjects); got != c.want {
+				t.Errorf("got revoked %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestCollectRevocations(t *testing.T) {
+	defer func(store RevocationStore) { revocations = store }(revocations)
+	now := time.Now()
+	expired := model.NewRevocation("token-1", "", "", now.Add(-time.Minute))
+	active := model.NewRevocation("token-2", "", "", now.Add(time.Hour))
+	permanent := model.NewRevocation("", "bob", "", time.Time{})
+	store := fakeRevocations{expired.ID: &expired, active.ID: &active, permanent.ID: &permanent}
+	revocations = store
+
+	collectRevocations()
+	keys := []string{}
+	for key := range store {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != active.ID || keys[1] != permanent.ID {
+		t.Errorf("got revocations %v after garbage collection, want %s and %s", keys, active.ID, permanent.ID)
+	}
+	// the token of the collected revocation has expired, so it is rejected by its exp instead
+	if IsRevoked(map[string]interface{}{"jti": "token-1"}, "alice") {
+		t.Error("got revoked by a collected revocation")
+	}
+	if !IsRevoked(map[string]interface{}{"jti": "token-2"}, "alice") {
+		t.Error("got not revoked by an active revocation")
+	}
+}
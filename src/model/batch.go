@@ -0,0 +1,67 @@
+package model
+
+import (
+	"time"
+)
+
+// batch formats of the messages sent to a function instance
+const (
+	// JSONBatchFormat is a JSON array of messages
+	JSONBatchFormat = "json"
+
+	// NDJSONBatchFormat is newline delimited JSON, one message per line
+	NDJSONBatchFormat = "ndjson"
+)
+
+// default function batch policy
+const (
+	// DefaultBatchMaxBytes is the max total payload size of a batch
+	DefaultBatchMaxBytes = 1 << 20
+
+	// DefaultBatchMaxWaitMs is the max milliseconds from the first message to sending a batch
+	DefaultBatchMaxWaitMs = 100
+)
+
+// BatchPolicy is the batch invocation of a function, batching is disabled if MaxSize is 0
+type BatchPolicy struct {
+	// MaxSize is the max number of messages of a batch
+	MaxSize int `json:"maxSize"`
+
+	// MaxBytes is the max total payload bytes of a batch, a single larger message is sent in a batch by itself
+	MaxBytes int `json:"maxBytes"`
+
+	// MaxWaitMs is the max milliseconds a batch waits for more messages after its first message
+	MaxWaitMs int `json:"maxWaitMs"`
+
+	// Format is json (default) or ndjson
+	Format string `json:"format"`
+}
+
+// Enabled returns whether batch invocation is enabled
+func (p BatchPolicy) Enabled() bool {
+	return p.MaxSize > 0
+}
+
+// GetMaxBytes returns the max total payload bytes of a batch
+func (p BatchPolicy) GetMaxBytes() int {
+	if p.MaxBytes > 0 {
+		return p.MaxBytes
+	}
+	return DefaultBatchMaxBytes
+}
+
+// GetMaxWait returns the max duration a batch waits for more messages
+func (p BatchPolicy) GetMaxWait() time.Duration {
+	if p.MaxWaitMs > 0 {
+		return time.Duration(p.MaxWaitMs) * time.Millisecond
+	}
+	return DefaultBatchMaxWaitMs * time.Millisecond
+}
+
+// GetFormat returns the batch format
+func (p BatchPolicy) GetFormat() string {
+	if p.Format != "" {
+		return p.Format
+	}
+	return JSONBatchFormat
+}
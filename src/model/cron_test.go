@@ -0,0 +1,71 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	cases := []struct {
+		name    string
+		expr    string
+		wantErr bool
+	}{
+		{"every minute", "* * * * *", false},
+		{"lists ranges and steps", "*/5 9-17 1,15 1-12/3 1-5", false},
+		{"sunday as 7", "0 0 * * 7", false},
+		{"too few fields", "* * * *", true},
+		{"too many fields", "* * * * * *", true},
+		{"minute out of range", "60 * * * *", true},
+		{"day of month zero", "0 0 0 * *", true},
+		{"reversed range", "0 17-9 * * *", true},
+		{"zero step", "*/0 * * * *", true},
+		{"invalid value", "a * * * *", true},
+		{"invalid range", "1-b * * * *", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := ParseCron(c.expr); (err != nil) != c.wantErr {
+				t.Errorf("got error %v, want error %v", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestCronMatches(t *testing.T) {
+	// 2020-06-15 is a Monday
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2020, month, day, hour, minute, 30, 0, time.UTC)
+	}
+	cases := []struct {
+		name string
+		expr string
+		time time.Time
+		want bool
+	}{
+		{"every minute", "* * * * *", at(6, 15, 10, 7), true},
+		{"step matches", "*/5 * * * *", at(6, 15, 10, 10), true},
+		{"step does not match", "*/5 * * * *", at(6, 15, 10, 7), false},
+		{"value with step runs to the max", "10/20 * * * *", at(6, 15, 10, 50), true},
+		{"hour range", "0 9-17 * * *", at(6, 15, 18, 0), false},
+		{"list", "0 0 1,15 * *", at(6, 15, 0, 0), true},
+		{"month", "0 0 * 7 *", at(6, 15, 0, 0), false},
+		{"weekday", "0 0 * * 1-5", at(6, 15, 0, 0), true},
+		{"weekend", "0 0 * * 0,6", at(6, 15, 0, 0), false},
+		{"sunday as 7", "0 0 * * 7", at(6, 14, 0, 0), true},
+		{"either day of month or day of week", "0 0 1 * 1", at(6, 15, 0, 0), true},
+		{"neither day of month nor day of week", "0 0 1 * 2", at(6, 15, 0, 0), false},
+		{"day of month only", "0 0 15 * *", at(6, 15, 0, 0), true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			schedule, err := ParseCron(c.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := schedule.Matches(c.time); got != c.want {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// key shared policies of the input subscription
+const (
+	// AutoSplitPolicy splits the hash range of the keys evenly across the consumers of the subscription
+	AutoSplitPolicy = "auto-split"
+
+	// StickyPolicy pins the hash ranges of the keys to the consumer
+	StickyPolicy = "sticky"
+
+	// KeySharedHashRangeSize is the size of the message key hash range of a Key_Shared subscription
+	KeySharedHashRangeSize = 65536
+)
+
+// HashRange is an inclusive range of message key hashes
+type HashRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// KeySharedPolicy is the Key_Shared subscription policy of the input topic
+type KeySharedPolicy struct {
+	Mode            string      `json:"mode"`
+	HashRanges      []HashRange `json:"hashRanges"`
+	AllowOutOfOrder bool        `json:"allowOutOfOrder"`
+}
+
+// GetKeySharedPolicy returns the Key_Shared policy of a topic, nil if the subscription is not Key_Shared
+func (t *FunctionTopic) GetKeySharedPolicy() (*KeySharedPolicy, error) {
+	if strings.ToLower(t.SubscriptionType) != "keyshared" {
+		if t.KeySharedPolicy != "" || t.KeySharedHashRanges != "" || t.AllowOutOfOrderDelivery {
+			return nil, fmt.Errorf("key shared policy requires the keyshared subscription type")
+		}
+		return nil, nil
+	}
+	policy := &KeySharedPolicy{
+		Mode:            t.KeySharedPolicy,
+		AllowOutOfOrder: t.AllowOutOfOrderDelivery,
+	}
+	switch policy.Mode {
+	case "", AutoSplitPolicy:
+		policy.Mode = AutoSplitPolicy
+		if t.KeySharedHashRanges != "" {
+			return nil, fmt.Errorf("hash ranges require the %s key shared policy", StickyPolicy)
+		}
+	case StickyPolicy:
+		ranges, err := ParseHashRanges(t.KeySharedHashRanges)
+		if err != nil {
+			return nil, err
+		}
+		if len(ranges) == 0 {
+			return nil, fmt.Errorf("the %s key shared policy requires hash ranges", StickyPolicy)
+		}
+		policy.HashRanges = ranges
+	default:
+		return nil, fmt.Errorf("unsupported key shared policy %s", t.KeySharedPolicy)
+	}
+	return policy, nil
+}
+
+// ParseHashRanges parses comma separated inclusive hash ranges, i.e. `0-16383,32768-49151`,
+// the ranges are sorted and must not overlap
+func ParseHashRanges(ranges string) ([]HashRange, error) {
+	result := []HashRange{}
+	if strings.TrimSpace(ranges) == "" {
+		return result, nil
+	}
+	for _, part := range strings.Split(ranges, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("hash range %q must be in the form of start-end", part)
+		}
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("hash range %q has an invalid start", part)
+		}
+		end, err := strconv.Atoi(bounds[1])
+		if err != nil {
+			return nil, fmt.Errorf("hash range %q has an invalid end", part)
+		}
+		if start < 0 || end >= KeySharedHashRangeSize || start > end {
+			return nil, fmt.Errorf("hash range %q must be within 0-%d", part, KeySharedHashRangeSize-1)
+		}
+		result = append(result, HashRange{Start: start, End: end})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Start < result[j].Start })
+	for i := 1; i < len(result); i++ {
+		if result[i].Start <= result[i-1].End {
+			return nil, fmt.Errorf("hash ranges %d-%d and %d-%d overlap",
+				result[i-1].Start, result[i-1].End, result[i].Start, result[i].End)
+		}
+	}
+	return result, nil
+}
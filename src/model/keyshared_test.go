@@ -0,0 +1,69 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseHashRanges(t *testing.T) {
+	cases := []struct {
+		name    string
+		ranges  string
+		want    []HashRange
+		wantErr bool
+	}{
+		{"empty", " ", []HashRange{}, false},
+		{"single", "0-65535", []HashRange{{0, 65535}}, false},
+		{"single hash", "7-7", []HashRange{{7, 7}}, false},
+		{"sorted", " 32768-49151, 0-16383", []HashRange{{0, 16383}, {32768, 49151}}, false},
+		{"adjacent", "0-99,100-199", []HashRange{{0, 99}, {100, 199}}, false},
+		{"overlap", "0-100,100-200", nil, true},
+		{"contained", "0-1000,10-20", nil, true},
+		{"reversed", "200-100", nil, true},
+		{"out of range", "0-65536", nil, true},
+		{"negative", "-1-10", nil, true},
+		{"missing end", "100", nil, true},
+		{"not a number", "a-10", nil, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := ParseHashRanges(c.ranges)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("got error %v, want error %v", err, c.wantErr)
+			}
+			if !c.wantErr && !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestGetKeySharedPolicy(t *testing.T) {
+	cases := []struct {
+		name    string
+		topic   FunctionTopic
+		want    *KeySharedPolicy
+		wantErr bool
+	}{
+		{"not key shared", FunctionTopic{SubscriptionType: "shared"}, nil, false},
+		{"policy without key shared", FunctionTopic{SubscriptionType: "shared", KeySharedPolicy: StickyPolicy}, nil, true},
+		{"out of order without key shared", FunctionTopic{SubscriptionType: "exclusive", AllowOutOfOrderDelivery: true}, nil, true},
+		{"default", FunctionTopic{SubscriptionType: "KeyShared"}, &KeySharedPolicy{Mode: AutoSplitPolicy}, false},
+		{"auto split with ranges", FunctionTopic{SubscriptionType: "keyshared", KeySharedHashRanges: "0-10"}, nil, true},
+		{"sticky", FunctionTopic{SubscriptionType: "keyshared", KeySharedPolicy: StickyPolicy, KeySharedHashRanges: "0-10", AllowOutOfOrderDelivery: true},
+			&KeySharedPolicy{Mode: StickyPolicy, HashRanges: []HashRange{{0, 10}}, AllowOutOfOrder: true}, false},
+		{"sticky without ranges", FunctionTopic{SubscriptionType: "keyshared", KeySharedPolicy: StickyPolicy}, nil, true},
+		{"unknown policy", FunctionTopic{SubscriptionType: "keyshared", KeySharedPolicy: "random"}, nil, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := c.topic.GetKeySharedPolicy()
+			if (err != nil) != c.wantErr {
+				t.Fatalf("got error %v, want error %v", err, c.wantErr)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
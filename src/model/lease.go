@@ -0,0 +1,20 @@
+package model
+
+import (
+	"time"
+)
+
+// LeaderLease is the lease of a leader election
+// the epoch increases with every new leader, it is the fencing token of the writes made by the leader
+type LeaderLease struct {
+	Name      string    `json:"name"`
+	HolderID  string    `json:"holderId"`
+	Epoch     int64     `json:"epoch"`
+	RenewedAt time.Time `json:"renewedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Expired returns whether the lease has not been renewed in time
+func (l *LeaderLease) Expired(now time.Time) bool {
+	return !now.Before(l.ExpiresAt)
+}
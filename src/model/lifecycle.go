@@ -0,0 +1,59 @@
+package model
+
+import (
+	"fmt"
+)
+
+// lifecycle transitions of a function
+const (
+	// ActivateTransition starts a deactivated function
+	ActivateTransition = "activate"
+	// SuspendTransition pauses the consumer and stops the instances of an activated function
+	SuspendTransition = "suspend"
+	// ResumeTransition restarts a suspended function from the saved subscription position
+	ResumeTransition = "resume"
+)
+
+// lifecycle is the state machine of the function status, the status each transition is allowed from and leads to
+var lifecycle = map[string]struct{ from, to Status }{
+	ActivateTransition: {Deactivated, Activated},
+	SuspendTransition:  {Activated, Suspended},
+	ResumeTransition:   {Suspended, Activated},
+}
+
+var statusNames = map[Status]string{
+	Deactivated: "deactivated",
+	Activated:   "activated",
+	Suspended:   "suspended",
+	Deleted:     "deleted",
+}
+
+// String is the status name accepted by StringToStatus
+func (s Status) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("status(%d)", int(s))
+}
+
+// Transition returns the status after the transition, it fails if the transition is not allowed from the status
+func (s Status) Transition(transition string) (Status, error) {
+	t, ok := lifecycle[transition]
+	if !ok {
+		return s, fmt.Errorf("unknown function lifecycle transition %s", transition)
+	}
+	if s != t.from {
+		return s, fmt.Errorf("cannot %s a function in %s status", transition, s)
+	}
+	return t.to, nil
+}
+
+// TransitionTo returns the transition from the status to the target status, it fails if no transition leads there
+func (s Status) TransitionTo(target Status) (string, error) {
+	for transition, t := range lifecycle {
+		if t.from == s && t.to == target {
+			return transition, nil
+		}
+	}
+	return "", fmt.Errorf("cannot change a function in %s status to %s", s, target)
+}
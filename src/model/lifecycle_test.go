@@ -0,0 +1,62 @@
+package model
+
+import "testing"
+
+func TestTransition(t *testing.T) {
+	cases := []struct {
+		from       Status
+		transition string
+		want       Status
+		wantErr    bool
+	}{
+		{Deactivated, ActivateTransition, Activated, false},
+		{Activated, SuspendTransition, Suspended, false},
+		{Suspended, ResumeTransition, Activated, false},
+		{Activated, ActivateTransition, Activated, true},
+		{Suspended, ActivateTransition, Suspended, true},
+		{Deactivated, SuspendTransition, Deactivated, true},
+		{Suspended, SuspendTransition, Suspended, true},
+		{Deactivated, ResumeTransition, Deactivated, true},
+		{Activated, ResumeTransition, Activated, true},
+		{Deleted, ActivateTransition, Deleted, true},
+		{Activated, "restart", Activated, true},
+	}
+	for _, c := range cases {
+		t.Run(c.transition+" from "+c.from.String(), func(t *testing.T) {
+			got, err := c.from.Transition(c.transition)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("got error %v, want error %v", err, c.wantErr)
+			}
+			if got != c.want {
+				t.Errorf("got status %s, want %s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestTransitionTo(t *testing.T) {
+	cases := []struct {
+		from    Status
+		to      Status
+		want    string
+		wantErr bool
+	}{
+		{Deactivated, Activated, ActivateTransition, false},
+		{Activated, Suspended, SuspendTransition, false},
+		{Suspended, Activated, ResumeTransition, false},
+		{Deactivated, Suspended, "", true},
+		{Activated, Deactivated, "", true},
+		{Activated, Activated, "", true},
+	}
+	for _, c := range cases {
+		t.Run(c.from.String()+" to "+c.to.String(), func(t *testing.T) {
+			got, err := c.from.TransitionTo(c.to)
+			if (err != nil) != c.wantErr || got != c.want {
+				t.Errorf("got transition %s error %v, want %s error %v", got, err, c.want, c.wantErr)
+			}
+		})
+	}
+	if name := Status(42).String(); name != "status(42)" {
+		t.Errorf("got unknown status name %s", name)
+	}
+}
@@ -0,0 +1,148 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// readOnlyFields are the function config fields maintained by the server, they cannot be patched.
+// The source is changed by uploading the function, and the status by the lifecycle transitions.
+var readOnlyFields = map[string]bool{
+	"name":             true,
+	"id":               true,
+	"tenant":           true,
+	"functionStatus":   true,
+	"functionFilePath": true,
+	"sourceHash":       true,
+	"terminations":     true,
+	"webhookURLs":      true,
+	"assignments":      true,
+	"assignmentEpoch":  true,
+	"workerId":         true,
+	"createdAt":        true,
+	"updatedAt":        true,
+	"deletedAt":        true,
+}
+
+// readOnlyTopicFields are set from the request credentials
+var readOnlyTopicFields = map[string]bool{
+	"pulsarURL": true,
+	"token":     true,
+	"tenant":    true,
+}
+
+// topicFields are the function config fields of FunctionTopic type
+var topicFields = []string{"inputTopics", "outputTopics", "logTopic"}
+
+// MergePatch applies a JSON merge patch, RFC 7396, to a JSON document
+func MergePatch(doc, patch []byte) ([]byte, error) {
+	var target, p interface{}
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, fmt.Errorf("invalid merge patch %v", err)
+	}
+	return json.Marshal(mergeValue(target, p))
+}
+
+// mergeValue merges a patch value into a target value, a null member removes the member from the target
+func mergeValue(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergeValue(t[k], v)
+	}
+	return t
+}
+
+// Patch returns a copy of the function config with a JSON merge patch applied, and the patched topics
+func (cfg *FunctionConfig) Patch(patch []byte) (*FunctionConfig, []string, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(patch, &fields); err != nil {
+		return nil, nil, fmt.Errorf("merge patch must be a JSON object %v", err)
+	}
+	for k := range fields {
+		if readOnlyFields[k] {
+			return nil, nil, fmt.Errorf("field %s cannot be patched", k)
+		}
+	}
+	topics := []string{}
+	for _, name := range topicFields {
+		v, ok := fields[name]
+		if !ok {
+			continue
+		}
+		topics = append(topics, name)
+		if topic, ok := v.(map[string]interface{}); ok {
+			for k := range topic {
+				if readOnlyTopicFields[k] {
+					return nil, nil, fmt.Errorf("field %s.%s cannot be patched", name, k)
+				}
+			}
+		}
+	}
+
+	doc, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	merged, err := MergePatch(doc, patch)
+	if err != nil {
+		return nil, nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(merged))
+	decoder.DisallowUnknownFields()
+	patched := &FunctionConfig{}
+	if err = decoder.Decode(patched); err != nil {
+		return nil, nil, fmt.Errorf("invalid function config %v", err)
+	}
+	return patched, topics, nil
+}
+
+// NeedsRestart returns whether the function consumer and instances have to be restarted for the patched config,
+// a change of parallelism alone only scales the instances
+func (cfg *FunctionConfig) NeedsRestart(patched *FunctionConfig) bool {
+	return cfg.FunctionStatus != patched.FunctionStatus ||
+		cfg.SourceHash != patched.SourceHash ||
+		cfg.LanguagePack != patched.LanguagePack ||
+		cfg.TriggerType != patched.TriggerType ||
+		cfg.DispatchMode != patched.DispatchMode ||
+		cfg.Cron != patched.Cron ||
+		cfg.MaxConcurrency != patched.MaxConcurrency ||
+		cfg.QueueDepth != patched.QueueDepth ||
+		cfg.Timeout != patched.Timeout ||
+		cfg.MaxRedeliveries != patched.MaxRedeliveries ||
+		cfg.DeadLetterTopic != patched.DeadLetterTopic ||
+		cfg.Resources != patched.Resources ||
+		cfg.Scaling != patched.Scaling ||
+		cfg.Batch != patched.Batch ||
+		cfg.Window != patched.Window ||
+		cfg.InputTopic != patched.InputTopic ||
+		cfg.OutputTopic != patched.OutputTopic ||
+		cfg.LogTopic != patched.LogTopic
+}
+
+// TopicByField returns the topic of a function config by its JSON field name
+func (cfg *FunctionConfig) TopicByField(name string) *FunctionTopic {
+	switch name {
+	case "inputTopics":
+		return &cfg.InputTopic
+	case "outputTopics":
+		return &cfg.OutputTopic
+	case "logTopic":
+		return &cfg.LogTopic
+	}
+	return nil
+}
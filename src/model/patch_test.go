@@ -0,0 +1,111 @@
+package model
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+	// the examples of RFC 7396 appendix A
+	cases := []struct {
+		doc   string
+		patch string
+		want  string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, c := range cases {
+		t.Run(c.doc+" "+c.patch, func(t *testing.T) {
+			got, err := MergePatch([]byte(c.doc), []byte(c.patch))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var a, b interface{}
+			json.Unmarshal(got, &a)
+			json.Unmarshal([]byte(c.want), &b)
+			if !reflect.DeepEqual(a, b) {
+				t.Errorf("got %s, want %s", got, c.want)
+			}
+		})
+	}
+	if _, err := MergePatch([]byte(`{}`), []byte(`{`)); err == nil {
+		t.Error("got no error for an invalid patch")
+	}
+}
+
+func TestFunctionConfigPatch(t *testing.T) {
+	cfg := &FunctionConfig{
+		ID:              "id",
+		Tenant:          "a",
+		Name:            "f",
+		Parallelism:     1,
+		MaxConcurrency:  4,
+		WebhookURLs:     []string{"http://localhost:3000"},
+		InputTopic:      FunctionTopic{TopicFullName: "persistent://a/b/in", Token: "secret"},
+		OutputTopic:     FunctionTopic{TopicFullName: "persistent://a/b/out"},
+		AssignmentEpoch: 3,
+	}
+	cases := []struct {
+		name    string
+		patch   string
+		check   func(*FunctionConfig) bool
+		topics  []string
+		restart bool
+		wantErr bool
+	}{
+		{"parallelism only scales", `{"parallelism":3}`,
+			func(p *FunctionConfig) bool { return p.Parallelism == 3 && p.MaxConcurrency == 4 }, []string{}, false, false},
+		{"concurrency restarts", `{"maxConcurrency":8}`,
+			func(p *FunctionConfig) bool { return p.MaxConcurrency == 8 }, []string{}, true, false},
+		{"nested topic field keeps the token", `{"inputTopics":{"subscription":"s"}}`,
+			func(p *FunctionConfig) bool {
+				return p.InputTopic.Subscription == "s" && p.InputTopic.Token == "secret"
+			},
+			[]string{"inputTopics"}, true, false},
+		{"null removes the topic", `{"outputTopics":null}`,
+			func(p *FunctionConfig) bool { return p.OutputTopic.TopicFullName == "" }, []string{"outputTopics"}, true, false},
+		{"server fields are kept", `{"timeout":10}`,
+			func(p *FunctionConfig) bool { return p.ID == "id" && p.AssignmentEpoch == 3 && len(p.WebhookURLs) == 1 }, []string{}, true, false},
+		{"read-only field", `{"functionStatus":1}`, nil, nil, false, true},
+		{"owning worker", `{"workerId":"w"}`, nil, nil, false, true},
+		{"read-only topic field", `{"inputTopics":{"token":"t"}}`, nil, nil, false, true},
+		{"unknown field", `{"parallel":3}`, nil, nil, false, true},
+		{"wrong type", `{"parallelism":"3"}`, nil, nil, false, true},
+		{"not an object", `[1]`, nil, nil, false, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			patched, topics, err := cfg.Patch([]byte(c.patch))
+			if (err != nil) != c.wantErr {
+				t.Fatalf("got error %v, want error %v", err, c.wantErr)
+			}
+			if c.wantErr {
+				return
+			}
+			if !c.check(patched) {
+				t.Errorf("got patched config %+v", patched)
+			}
+			if !reflect.DeepEqual(topics, c.topics) {
+				t.Errorf("got patched topics %v, want %v", topics, c.topics)
+			}
+			if got := cfg.NeedsRestart(patched); got != c.restart {
+				t.Errorf("got restart %v, want %v", got, c.restart)
+			}
+		})
+	}
+}
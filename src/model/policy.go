@@ -0,0 +1,139 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Role is a tenant level role for function management
+type Role string
+
+// roles ordered from the least to the most privileged
+const (
+	// NoRole has no access to the tenant
+	NoRole Role = ""
+	// ReadOnlyRole can read functions and logs
+	ReadOnlyRole Role = "read-only"
+	// DeployerRole can read and deploy functions but not delete them
+	DeployerRole Role = "deployer"
+	// AdminRole can do everything within the tenant including managing role bindings
+	AdminRole Role = "admin"
+)
+
+// Action is an operation guarded by role based access control
+type Action int
+
+const (
+	// ReadAction reads functions and logs
+	ReadAction Action = iota
+	// DeployAction creates or updates functions
+	DeployAction
+	// DeleteAction deletes functions
+	DeleteAction
+	// ManageAction manages role bindings
+	ManageAction
+)
+
+var rolePermissions = map[Role][]Action{
+	ReadOnlyRole: {ReadAction},
+	DeployerRole: {ReadAction, DeployAction},
+	AdminRole:    {ReadAction, DeployAction, DeleteAction, ManageAction},
+}
+
+var roleRanks = map[Role]int{
+	NoRole:       0,
+	ReadOnlyRole: 1,
+	DeployerRole: 2,
+	AdminRole:    3,
+}
+
+// RoleBinding binds a JWT subject, or a value of a JWT claim, to a role within a tenant
+type RoleBinding struct {
+	ID        string    `json:"id"`
+	Tenant    string    `json:"tenant"`
+	Subject   string    `json:"subject"`
+	Claim     string    `json:"claim"`
+	Role      Role      `json:"role"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// StringToRole converts a role in string to Role type
+func StringToRole(role string) (Role, error) {
+	switch Role(strings.ToLower(strings.TrimSpace(role))) {
+	case ReadOnlyRole, "readonly":
+		return ReadOnlyRole, nil
+	case DeployerRole:
+		return DeployerRole, nil
+	case AdminRole:
+		return AdminRole, nil
+	default:
+		return NoRole, fmt.Errorf("unsupported role %s", role)
+	}
+}
+
+// Allows evaluates whether the role is permitted to perform the action
+func (r Role) Allows(action Action) bool {
+	for _, v := range rolePermissions[r] {
+		if v == action {
+			return true
+		}
+	}
+	return false
+}
+
+// HigherRole returns the more privileged role of the two
+func HigherRole(r1, r2 Role) Role {
+	if roleRanks[r1] >= roleRanks[r2] {
+		return r1
+	}
+	return r2
+}
+
+// RoleBindingKey generates the key of a role binding.
+// The claim is empty when the binding matches the JWT subject.
+func RoleBindingKey(tenant, claim, subject string) string {
+	return GenKey(tenant, "rolebinding/"+claim+"/"+subject)
+}
+
+// NewRoleBinding creates a role binding
+func NewRoleBinding(tenant, claim, subject string, role Role) RoleBinding {
+	now := time.Now()
+	return RoleBinding{
+		ID:        RoleBindingKey(tenant, claim, subject),
+		Tenant:    tenant,
+		Subject:   subject,
+		Claim:     claim,
+		Role:      role,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+// Matches evaluates whether the role binding matches the token subjects or claims
+func (b *RoleBinding) Matches(subjects string, claims map[string]interface{}) bool {
+	if b.Claim == "" || b.Claim == "sub" {
+		return containsValue(strings.Split(subjects, ","), b.Subject)
+	}
+	switch v := claims[b.Claim].(type) {
+	case string:
+		return containsValue(strings.Split(v, ","), b.Subject)
+	case []interface{}:
+		for _, item := range v {
+			if str, ok := item.(string); ok && strings.TrimSpace(str) == b.Subject {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsValue(values []string, value string) bool {
+	for _, v := range values {
+		if strings.TrimSpace(v) == value {
+			return true
+		}
+	}
+	return false
+}
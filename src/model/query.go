@@ -0,0 +1,163 @@
+package model
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sort fields of a function query
+const (
+	SortByName      = "name"
+	SortByCreatedAt = "createdAt"
+	SortByUpdatedAt = "updatedAt"
+)
+
+// page sizes of a function query
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 500
+)
+
+// FunctionQuery filters, sorts and paginates function configs.
+// An empty filter matches any value, and the cursor is the position after the last function of the previous page.
+type FunctionQuery struct {
+	Tenant       string
+	Status       *Status
+	LanguagePack string
+	TriggerType  string
+	InputTopic   string
+	OutputTopic  string
+	Sort         string
+	Descending   bool
+	Limit        int
+	Cursor       string
+}
+
+// queryCursor is the position in the sorted functions, it is only valid for the same sort order
+type queryCursor struct {
+	Sort       string `json:"s"`
+	Descending bool   `json:"d"`
+	Key        string `json:"k"`
+	ID         string `json:"i"`
+}
+
+// ParseStatus parses a status name, unlike StringToStatus an unknown name is an error
+func ParseStatus(name string) (Status, error) {
+	for status, v := range statusNames {
+		if strings.EqualFold(v, name) {
+			return status, nil
+		}
+	}
+	return Deactivated, fmt.Errorf("unknown function status %s", name)
+}
+
+// Validate validates the sort field and the page size, and sets their defaults
+func (q *FunctionQuery) Validate() error {
+	if q.Sort == "" {
+		q.Sort = SortByName
+	}
+	if q.Sort != SortByName && q.Sort != SortByCreatedAt && q.Sort != SortByUpdatedAt {
+		return fmt.Errorf("unsupported sort field %s", q.Sort)
+	}
+	if q.Limit == 0 {
+		q.Limit = DefaultPageSize
+	}
+	if q.Limit < 0 || q.Limit > MaxPageSize {
+		return fmt.Errorf("limit must be between 1 and %d", MaxPageSize)
+	}
+	return nil
+}
+
+// Matches returns whether the function matches all the filters of the query
+func (q *FunctionQuery) Matches(fn *FunctionConfig) bool {
+	return (q.Tenant == "" || fn.Tenant == q.Tenant) &&
+		(q.Status == nil || fn.FunctionStatus == *q.Status) &&
+		(q.LanguagePack == "" || strings.EqualFold(fn.LanguagePack, q.LanguagePack)) &&
+		(q.TriggerType == "" || fn.TriggerType == q.TriggerType) &&
+		(q.InputTopic == "" || fn.InputTopic.TopicFullName == q.InputTopic) &&
+		(q.OutputTopic == "" || fn.OutputTopic.TopicFullName == q.OutputTopic)
+}
+
+// sortKey is the value of the sort field, times are zero padded so that keys compare as strings
+func (q *FunctionQuery) sortKey(fn *FunctionConfig) string {
+	switch q.Sort {
+	case SortByCreatedAt:
+		return timeKey(fn.CreatedAt)
+	case SortByUpdatedAt:
+		return timeKey(fn.UpdatedAt)
+	default:
+		return fn.Name
+	}
+}
+
+func timeKey(t time.Time) string {
+	if t.IsZero() {
+		return fmt.Sprintf("%020d", 0)
+	}
+	return fmt.Sprintf("%020d", t.UnixNano())
+}
+
+// before returns whether the function at (keyA, idA) comes before (keyB, idB) in the sort order
+func (q *FunctionQuery) before(keyA, idA, keyB, idB string) bool {
+	if q.Descending {
+		return keyA > keyB || (keyA == keyB && idA > idB)
+	}
+	return keyA < keyB || (keyA == keyB && idA < idB)
+}
+
+// Page returns a page of the matching functions in the sort order, and the cursor of the next page if there is one
+func (q *FunctionQuery) Page(fns []*FunctionConfig) ([]*FunctionConfig, string, error) {
+	if err := q.Validate(); err != nil {
+		return nil, "", err
+	}
+	var after *queryCursor
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor)
+		if err != nil || c.Sort != q.Sort || c.Descending != q.Descending {
+			return nil, "", fmt.Errorf("invalid cursor for the sort order")
+		}
+		after = c
+	}
+
+	matched := []*FunctionConfig{}
+	for _, fn := range fns {
+		if q.Matches(fn) && (after == nil || q.before(after.Key, after.ID, q.sortKey(fn), fn.ID)) {
+			matched = append(matched, fn)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return q.before(q.sortKey(matched[i]), matched[i].ID, q.sortKey(matched[j]), matched[j].ID)
+	})
+
+	if len(matched) <= q.Limit {
+		return matched, "", nil
+	}
+	page := matched[:q.Limit]
+	last := page[len(page)-1]
+	next, err := encodeCursor(queryCursor{Sort: q.Sort, Descending: q.Descending, Key: q.sortKey(last), ID: last.ID})
+	return page, next, err
+}
+
+func encodeCursor(c queryCursor) (string, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(cursor string) (*queryCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	var c queryCursor
+	if err = json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
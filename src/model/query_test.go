@@ -0,0 +1,85 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFunctionQueryPage(t *testing.T) {
+	base := time.Date(2020, 6, 15, 0, 0, 0, 0, time.UTC)
+	suspended := Suspended
+	fns := []*FunctionConfig{
+		{ID: "1", Tenant: "a", Name: "delta", LanguagePack: "js", CreatedAt: base.Add(3 * time.Second)},
+		{ID: "2", Tenant: "a", Name: "alpha", LanguagePack: "js", CreatedAt: base.Add(1 * time.Second)},
+		{ID: "3", Tenant: "b", Name: "charlie", LanguagePack: "JS", CreatedAt: base.Add(1 * time.Second), FunctionStatus: Suspended},
+		{ID: "4", Tenant: "a", Name: "bravo", LanguagePack: "go", CreatedAt: base.Add(2 * time.Second)},
+		{ID: "5", Tenant: "b", Name: "alpha", LanguagePack: "js", CreatedAt: base},
+	}
+	cases := []struct {
+		name  string
+		query FunctionQuery
+		// the ids of all the pages
+		pages [][]string
+	}{
+		{"by name", FunctionQuery{}, [][]string{{"2", "5", "4", "3", "1"}}},
+		{"by name pages", FunctionQuery{Limit: 2}, [][]string{{"2", "5"}, {"4", "3"}, {"1"}}},
+		{"by name descending pages", FunctionQuery{Limit: 2, Descending: true}, [][]string{{"1", "3"}, {"4", "5"}, {"2"}}},
+		{"by created at pages", FunctionQuery{Sort: SortByCreatedAt, Limit: 3}, [][]string{{"5", "2", "3"}, {"4", "1"}}},
+		{"exact page", FunctionQuery{Sort: SortByCreatedAt, Limit: 5}, [][]string{{"5", "2", "3", "4", "1"}}},
+		{"tenant", FunctionQuery{Tenant: "b"}, [][]string{{"5", "3"}}},
+		{"status", FunctionQuery{Status: &suspended}, [][]string{{"3"}}},
+		{"language pack ignores case", FunctionQuery{LanguagePack: "js", Limit: 1}, [][]string{{"2"}, {"5"}, {"3"}, {"1"}}},
+		{"no match", FunctionQuery{Tenant: "c"}, [][]string{{}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			q := c.query
+			pages := [][]string{}
+			for {
+				page, next, err := q.Page(fns)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids := []string{}
+				for _, fn := range page {
+					ids = append(ids, fn.ID)
+				}
+				pages = append(pages, ids)
+				if next == "" || len(pages) > len(fns) {
+					break
+				}
+				q.Cursor = next
+			}
+			if !reflect.DeepEqual(pages, c.pages) {
+				t.Errorf("got pages %v, want %v", pages, c.pages)
+			}
+		})
+	}
+}
+
+func TestFunctionQueryInvalid(t *testing.T) {
+	q := FunctionQuery{Limit: 1}
+	_, cursor, err := q.Page([]*FunctionConfig{{ID: "1", Name: "a"}, {ID: "2", Name: "b"}})
+	if err != nil || cursor == "" {
+		t.Fatalf("got cursor %q error %v", cursor, err)
+	}
+	cases := []struct {
+		name  string
+		query FunctionQuery
+	}{
+		{"unsupported sort", FunctionQuery{Sort: "tenant"}},
+		{"negative limit", FunctionQuery{Limit: -1}},
+		{"limit too large", FunctionQuery{Limit: MaxPageSize + 1}},
+		{"malformed cursor", FunctionQuery{Cursor: "not a cursor"}},
+		{"cursor of another sort", FunctionQuery{Sort: SortByUpdatedAt, Cursor: cursor}},
+		{"cursor of another order", FunctionQuery{Descending: true, Cursor: cursor}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, _, err := c.query.Page(nil); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
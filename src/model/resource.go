@@ -0,0 +1,58 @@
+package model
+
+import (
+	"time"
+)
+
+// MaxTerminations is the number of the most recent instance terminations kept in a function configuration
+const MaxTerminations = 10
+
+// reasons of an unexpected function instance termination
+const (
+	// MemoryLimitExceeded is an instance killed for exceeding the memory limit
+	MemoryLimitExceeded = "memory-limit-exceeded"
+
+	// CPUTimeLimitExceeded is an instance killed for exceeding the cpu time limit
+	CPUTimeLimitExceeded = "cpu-time-limit-exceeded"
+
+	// InstanceExited is an instance exited for any other reason
+	InstanceExited = "exited"
+)
+
+// FunctionResources is the resource limits of every instance of a function, zero means unlimited
+type FunctionResources struct {
+	// MemoryMB is the memory limit in MiB
+	MemoryMB int `json:"memoryMB"`
+
+	// CPUMillis is the cpu bandwidth in millicores, 500 is half a core. It requires cgroup v2.
+	CPUMillis int `json:"cpuMillis"`
+
+	// CPUTimeSeconds is the total cpu time an instance can consume before it is killed
+	CPUTimeSeconds int `json:"cpuTimeSeconds"`
+
+	// OpenFiles is the max number of open file descriptors
+	OpenFiles int `json:"openFiles"`
+}
+
+// InstanceTermination is an unexpected termination of a function instance
+type InstanceTermination struct {
+	Function     string    `json:"function"`
+	Instance     string    `json:"instance"`
+	Pid          int       `json:"pid"`
+	Reason       string    `json:"reason"`
+	ExitStatus   string    `json:"exitStatus"`
+	TerminatedAt time.Time `json:"terminatedAt"`
+}
+
+// HasCgroupLimits returns whether any limit requires a cgroup
+func (r FunctionResources) HasCgroupLimits() bool {
+	return r.MemoryMB > 0 || r.CPUMillis > 0
+}
+
+// AddTermination records an instance termination, only the most recent MaxTerminations are kept
+func (cfg *FunctionConfig) AddTermination(termination InstanceTermination) {
+	cfg.Terminations = append(cfg.Terminations, termination)
+	if len(cfg.Terminations) > MaxTerminations {
+		cfg.Terminations = cfg.Terminations[len(cfg.Terminations)-MaxTerminations:]
+	}
+}
@@ -0,0 +1,64 @@
+package model
+
+import (
+	"strings"
+	"time"
+)
+
+// Revocation revokes a token by its jti, or all tokens of a subject issued before the revocation
+type Revocation struct {
+	ID        string    `json:"id"`
+	JTI       string    `json:"jti,omitempty"`
+	Subject   string    `json:"subject,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	RevokedAt time.Time `json:"revokedAt"`
+	// ExpiresAt is the natural expiry of the revoked tokens, the revocation is garbage collected afterwards.
+	// Zero value means the revocation never expires.
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// JTIRevocationKey is the key of a revocation by jti
+func JTIRevocationKey(jti string) string {
+	return "jti/" + jti
+}
+
+// SubjectRevocationKey is the key of a revocation by subject
+func SubjectRevocationKey(subject string) string {
+	return "sub/" + subject
+}
+
+// NewRevocation creates a revocation by either jti or subject
+func NewRevocation(jti, subject, reason string, expiresAt time.Time) Revocation {
+	rv := Revocation{
+		JTI:       jti,
+		Subject:   subject,
+		Reason:    reason,
+		RevokedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+	if jti != "" {
+		rv.ID = JTIRevocationKey(jti)
+	} else {
+		rv.ID = SubjectRevocationKey(subject)
+	}
+	return rv
+}
+
+// Expired evaluates whether the revoked tokens have all expired naturally
+func (rv *Revocation) Expired() bool {
+	return !rv.ExpiresAt.IsZero() && rv.ExpiresAt.Before(time.Now())
+}
+
+// Revokes evaluates whether a token is revoked.
+// A subject revocation only revokes tokens issued before the revocation, or tokens without issued at.
+func (rv *Revocation) Revokes(jti, subjects string, issuedAt time.Time) bool {
+	if rv.JTI != "" {
+		return rv.JTI == jti
+	}
+	for _, v := range strings.Split(subjects, ",") {
+		if strings.TrimSpace(v) == rv.Subject {
+			return issuedAt.IsZero() || !issuedAt.After(rv.RevokedAt)
+		}
+	}
+	return false
+}
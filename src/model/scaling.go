@@ -0,0 +1,89 @@
+package model
+
+import (
+	"time"
+)
+
+// default function autoscaling policy
+const (
+	// DefaultTargetBacklog is the number of backlog messages per instance
+	DefaultTargetBacklog = 100
+
+	// DefaultScaleUpCooldown is the minimum seconds between two scale ups
+	DefaultScaleUpCooldown = 30
+
+	// DefaultScaleDownCooldown is the minimum seconds after any scaling, or the last message for scaling to zero, before a scale down
+	DefaultScaleDownCooldown = 300
+)
+
+// ScalingPolicy is the autoscaling policy of function instances, autoscaling is disabled if MaxParallelism is 0
+type ScalingPolicy struct {
+	// MinParallelism is the min number of instances, 0 allows scaling to zero
+	MinParallelism int `json:"minParallelism"`
+
+	// MaxParallelism is the max number of instances
+	MaxParallelism int `json:"maxParallelism"`
+
+	// TargetBacklog is the number of input subscription backlog messages per instance
+	TargetBacklog int `json:"targetBacklog"`
+
+	// TargetLatencyMs is the p95 invocation latency to scale up beyond, 0 to ignore latency
+	TargetLatencyMs int `json:"targetLatencyMs"`
+
+	// ScaleUpCooldown and ScaleDownCooldown are in seconds
+	ScaleUpCooldown   int `json:"scaleUpCooldown"`
+	ScaleDownCooldown int `json:"scaleDownCooldown"`
+}
+
+// Enabled returns whether autoscaling is enabled
+func (p ScalingPolicy) Enabled() bool {
+	return p.MaxParallelism > 0
+}
+
+// Clamp bounds the number of instances by the min and max parallelism
+func (p ScalingPolicy) Clamp(parallelism int) int {
+	if parallelism < p.MinParallelism {
+		parallelism = p.MinParallelism
+	}
+	if parallelism > p.MaxParallelism {
+		parallelism = p.MaxParallelism
+	}
+	return parallelism
+}
+
+// GetTargetBacklog returns the number of backlog messages per instance
+func (p ScalingPolicy) GetTargetBacklog() int {
+	if p.TargetBacklog > 0 {
+		return p.TargetBacklog
+	}
+	return DefaultTargetBacklog
+}
+
+// GetTargetLatency returns the p95 invocation latency target, 0 to ignore latency
+func (p ScalingPolicy) GetTargetLatency() time.Duration {
+	return time.Duration(p.TargetLatencyMs) * time.Millisecond
+}
+
+// GetScaleUpCooldown returns the minimum duration between two scale ups
+func (p ScalingPolicy) GetScaleUpCooldown() time.Duration {
+	if p.ScaleUpCooldown > 0 {
+		return time.Duration(p.ScaleUpCooldown) * time.Second
+	}
+	return DefaultScaleUpCooldown * time.Second
+}
+
+// GetScaleDownCooldown returns the minimum duration after any scaling before a scale down
+func (p ScalingPolicy) GetScaleDownCooldown() time.Duration {
+	if p.ScaleDownCooldown > 0 {
+		return time.Duration(p.ScaleDownCooldown) * time.Second
+	}
+	return DefaultScaleDownCooldown * time.Second
+}
+
+// DesiredInstances is the number of instances of a function, the parallelism within the autoscaling bounds
+func (cfg *FunctionConfig) DesiredInstances() int {
+	if !cfg.Scaling.Enabled() {
+		return cfg.Parallelism
+	}
+	return cfg.Scaling.Clamp(cfg.Parallelism)
+}
@@ -0,0 +1,271 @@
+package model
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/ghodss/yaml"
+)
+
+// FunctionSpec is the declarative spec of a function in JSON or YAML, an alternative to the multipart upload form
+type FunctionSpec struct {
+	LanguagePack    string            `json:"languagePack,omitempty"`
+	Parallelism     *int              `json:"parallelism,omitempty"`
+	MaxConcurrency  int               `json:"maxConcurrency,omitempty"`
+	QueueDepth      int               `json:"queueDepth,omitempty"`
+	Timeout         int               `json:"timeout,omitempty"`
+	MaxRedeliveries int               `json:"maxRedeliveries,omitempty"`
+	DeadLetterTopic string            `json:"deadLetterTopic,omitempty"`
+	TriggerType     string            `json:"triggerType,omitempty"`
+	DispatchMode    string            `json:"dispatchMode,omitempty"`
+	Cron            string            `json:"cron,omitempty"`
+	FunctionStatus  string            `json:"functionStatus,omitempty"`
+	Resources       FunctionResources `json:"resources"`
+	Scaling         ScalingPolicy     `json:"scaling"`
+	Batch           BatchPolicy       `json:"batch"`
+	Window          WindowPolicy      `json:"window"`
+	InputTopic      *TopicSpec        `json:"inputTopic,omitempty"`
+	OutputTopic     string            `json:"outputTopic,omitempty"`
+	LogTopic        string            `json:"logTopic,omitempty"`
+	Source          *SourceSpec       `json:"source,omitempty"`
+}
+
+// TopicSpec is the input topic and its subscription in a function spec
+type TopicSpec struct {
+	TopicFullName           string `json:"topicFullName"`
+	Subscription            string `json:"subscription,omitempty"`
+	SubscriptionType        string `json:"subscriptionType,omitempty"`
+	InitialPosition         string `json:"initialPosition,omitempty"`
+	KeySharedPolicy         string `json:"keySharedPolicy,omitempty"`
+	KeySharedHashRanges     string `json:"keySharedHashRanges,omitempty"`
+	AllowOutOfOrderDelivery bool   `json:"allowOutOfOrderDelivery,omitempty"`
+}
+
+// SourceSpec references the function source by the artifact hash, or embeds it in base64
+type SourceSpec struct {
+	Hash   string `json:"hash,omitempty"`
+	Base64 string `json:"base64,omitempty"`
+}
+
+// SpecChange is a field that differs between the current and the applied function spec
+type SpecChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// ParseFunctionSpec parses a function spec in JSON or YAML, unknown fields are rejected
+func ParseFunctionSpec(data []byte) (*FunctionSpec, error) {
+	doc, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid function spec %v", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(doc))
+	decoder.DisallowUnknownFields()
+	spec := &FunctionSpec{}
+	if err = decoder.Decode(spec); err != nil {
+		return nil, fmt.Errorf("invalid function spec %v", err)
+	}
+	return spec, nil
+}
+
+// SourceBytes decodes the embedded source, it returns nil if the source is referenced by hash
+func (s *SourceSpec) SourceBytes() ([]byte, error) {
+	if s.Hash != "" && s.Base64 != "" {
+		return nil, fmt.Errorf("source must have either hash or base64")
+	}
+	if s.Base64 == "" {
+		if s.Hash == "" {
+			return nil, fmt.Errorf("source must have either hash or base64")
+		}
+		return nil, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(s.Base64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 source %v", err)
+	}
+	return data, nil
+}
+
+// Config returns the function config of the spec with the source hash,
+// an existing function keeps its status and source unless the spec sets them
+func (s *FunctionSpec) Config(current *FunctionConfig, tenant, name, sourceHash string) (*FunctionConfig, error) {
+	cfg := FunctionConfig{
+		Name:            name,
+		Tenant:          tenant,
+		ID:              FunctionKey(tenant, name),
+		LanguagePack:    s.LanguagePack,
+		Parallelism:     1,
+		MaxConcurrency:  s.MaxConcurrency,
+		QueueDepth:      s.QueueDepth,
+		Timeout:         s.Timeout,
+		MaxRedeliveries: s.MaxRedeliveries,
+		DeadLetterTopic: s.DeadLetterTopic,
+		TriggerType:     s.TriggerType,
+		DispatchMode:    s.DispatchMode,
+		Cron:            s.Cron,
+		FunctionStatus:  Activated,
+		Resources:       s.Resources,
+		Scaling:         s.Scaling,
+		Batch:           s.Batch,
+		Window:          s.Window,
+		SourceHash:      sourceHash,
+	}
+	if cfg.LanguagePack == "" {
+		cfg.LanguagePack = "javascript"
+	}
+	if cfg.TriggerType == "" {
+		cfg.TriggerType = "pulsar-topic"
+	}
+	if s.Parallelism != nil {
+		cfg.Parallelism = *s.Parallelism
+	}
+	if current != nil {
+		cfg.FunctionStatus = current.FunctionStatus
+		cfg.FunctionFilePath = current.FunctionFilePath
+		cfg.WebhookURLs = current.WebhookURLs
+		cfg.Assignments = current.Assignments
+		cfg.AssignmentEpoch = current.AssignmentEpoch
+		cfg.WorkerID = current.WorkerID
+		cfg.Terminations = current.Terminations
+		cfg.CreatedAt = current.CreatedAt
+		cfg.UpdatedAt = current.UpdatedAt
+		if cfg.SourceHash == "" {
+			cfg.SourceHash = current.SourceHash
+		}
+	}
+	if s.FunctionStatus != "" {
+		status, err := ParseStatus(s.FunctionStatus)
+		if err != nil {
+			return nil, err
+		}
+		if current == nil && status != Activated && status != Deactivated {
+			return nil, fmt.Errorf("a function can only be created as activated or deactivated")
+		}
+		if current != nil && status != current.FunctionStatus {
+			if _, err = current.FunctionStatus.TransitionTo(status); err != nil {
+				return nil, err
+			}
+		}
+		cfg.FunctionStatus = status
+	}
+	if s.InputTopic != nil {
+		cfg.InputTopic = FunctionTopic{
+			TopicFullName:           s.InputTopic.TopicFullName,
+			Subscription:            s.InputTopic.Subscription,
+			SubscriptionType:        s.InputTopic.SubscriptionType,
+			InitialPosition:         s.InputTopic.InitialPosition,
+			KeySharedPolicy:         s.InputTopic.KeySharedPolicy,
+			KeySharedHashRanges:     s.InputTopic.KeySharedHashRanges,
+			AllowOutOfOrderDelivery: s.InputTopic.AllowOutOfOrderDelivery,
+		}
+	}
+	cfg.OutputTopic.TopicFullName = s.OutputTopic
+	cfg.LogTopic.TopicFullName = s.LogTopic
+	return &cfg, nil
+}
+
+// SpecOf returns the spec of a function config with the source referenced by hash
+func SpecOf(cfg *FunctionConfig) *FunctionSpec {
+	parallelism := cfg.Parallelism
+	spec := &FunctionSpec{
+		LanguagePack:    cfg.LanguagePack,
+		Parallelism:     &parallelism,
+		MaxConcurrency:  cfg.MaxConcurrency,
+		QueueDepth:      cfg.QueueDepth,
+		Timeout:         cfg.Timeout,
+		MaxRedeliveries: cfg.MaxRedeliveries,
+		DeadLetterTopic: cfg.DeadLetterTopic,
+		TriggerType:     cfg.TriggerType,
+		DispatchMode:    cfg.DispatchMode,
+		Cron:            cfg.Cron,
+		FunctionStatus:  cfg.FunctionStatus.String(),
+		Resources:       cfg.Resources,
+		Scaling:         cfg.Scaling,
+		Batch:           cfg.Batch,
+		Window:          cfg.Window,
+		OutputTopic:     cfg.OutputTopic.TopicFullName,
+		LogTopic:        cfg.LogTopic.TopicFullName,
+		Source:          &SourceSpec{Hash: cfg.SourceHash},
+	}
+	if cfg.InputTopic.TopicFullName != "" {
+		spec.InputTopic = &TopicSpec{
+			TopicFullName:           cfg.InputTopic.TopicFullName,
+			Subscription:            cfg.InputTopic.Subscription,
+			SubscriptionType:        cfg.InputTopic.SubscriptionType,
+			InitialPosition:         cfg.InputTopic.InitialPosition,
+			KeySharedPolicy:         cfg.InputTopic.KeySharedPolicy,
+			KeySharedHashRanges:     cfg.InputTopic.KeySharedHashRanges,
+			AllowOutOfOrderDelivery: cfg.InputTopic.AllowOutOfOrderDelivery,
+		}
+	}
+	return spec
+}
+
+// DiffSpecs returns the changed fields from one function spec to another sorted by the field path,
+// nested fields are separated by a dot
+func DiffSpecs(from, to *FunctionSpec) ([]SpecChange, error) {
+	a, err := flattenSpec(from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := flattenSpec(to)
+	if err != nil {
+		return nil, err
+	}
+	changes := []SpecChange{}
+	for field, v := range b {
+		if !reflect.DeepEqual(a[field], v) {
+			changes = append(changes, SpecChange{Field: field, From: a[field], To: v})
+		}
+	}
+	for field, v := range a {
+		if _, ok := b[field]; !ok {
+			changes = append(changes, SpecChange{Field: field, From: v})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes, nil
+}
+
+// flattenSpec flattens a spec into field paths and values, the zero values are omitted
+func flattenSpec(spec *FunctionSpec) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	if spec == nil {
+		return fields, nil
+	}
+	doc, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err = json.Unmarshal(doc, &m); err != nil {
+		return nil, err
+	}
+	flatten("", m, fields)
+	return fields, nil
+}
+
+func flatten(prefix string, m map[string]interface{}, fields map[string]interface{}) {
+	for k, v := range m {
+		field := prefix + k
+		switch value := v.(type) {
+		case map[string]interface{}:
+			flatten(field+".", value, fields)
+		case float64:
+			if value != 0 {
+				fields[field] = value
+			}
+		case string:
+			if value != "" {
+				fields[field] = value
+			}
+		default:
+			fields[field] = value
+		}
+	}
+}
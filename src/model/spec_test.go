@@ -0,0 +1,55 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffSpecs(t *testing.T) {
+	one, two := 1, 2
+	current := &FunctionSpec{
+		LanguagePack: "js",
+		Parallelism:  &one,
+		TriggerType:  "pulsar-topic",
+		InputTopic:   &TopicSpec{TopicFullName: "persistent://a/b/in", SubscriptionType: "shared"},
+		OutputTopic:  "persistent://a/b/out",
+	}
+	cases := []struct {
+		name string
+		from *FunctionSpec
+		to   *FunctionSpec
+		want []SpecChange
+	}{
+		{"same spec", current, current, []SpecChange{}},
+		{"new function", nil, &FunctionSpec{LanguagePack: "js", Timeout: 10},
+			[]SpecChange{{Field: "languagePack", To: "js"}, {Field: "timeout", To: float64(10)}}},
+		{"changed and nested fields sorted", current, &FunctionSpec{
+			LanguagePack: "js",
+			Parallelism:  &two,
+			TriggerType:  "pulsar-topic",
+			InputTopic:   &TopicSpec{TopicFullName: "persistent://a/b/in", SubscriptionType: "keyshared", AllowOutOfOrderDelivery: true},
+			OutputTopic:  "persistent://a/b/out",
+		}, []SpecChange{
+			{Field: "inputTopic.allowOutOfOrderDelivery", To: true},
+			{Field: "inputTopic.subscriptionType", From: "shared", To: "keyshared"},
+			{Field: "parallelism", From: float64(1), To: float64(2)},
+		}},
+		{"removed fields", current, &FunctionSpec{LanguagePack: "js", Parallelism: &one, TriggerType: "pulsar-topic"}, []SpecChange{
+			{Field: "inputTopic.subscriptionType", From: "shared"},
+			{Field: "inputTopic.topicFullName", From: "persistent://a/b/in"},
+			{Field: "outputTopic", From: "persistent://a/b/out"},
+		}},
+		{"zero values are omitted", &FunctionSpec{Scaling: ScalingPolicy{}}, &FunctionSpec{}, []SpecChange{}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := DiffSpecs(c.from, c.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
@@ -58,22 +58,37 @@ type TopicConfig struct {
 
 // FunctionConfig is the function configuration
 type FunctionConfig struct {
-	Name             string        `json:"name"`
-	ID               string        `json:"id"`
-	Tenant           string        `json:"tenant"`
-	FunctionStatus   Status        `json:"functionStatus"`
-	FunctionFilePath string        `json:"functionFilePath"`
-	LanguagePack     string        `json:"languagePack"`
-	Parallelism      int           `json:"parallelism"`
-	WebhookURLs      []string      `json:"webhookURLs"`
-	InputTopic       FunctionTopic `json:"inputTopics"`
-	OutputTopic      FunctionTopic `json:"outputTopics"`
-	LogTopic         FunctionTopic `json:"logTopic"`
-	TriggerType      string        `json:"triggerType"`
-	Cron             string        `json:"cron"`
-	CreatedAt        time.Time     `json:"createdAt"`
-	UpdatedAt        time.Time     `json:"updatedAt"`
-	DeletedAt        time.Time     `json:"deletedAt"`
+	Name             string                `json:"name"`
+	ID               string                `json:"id"`
+	Tenant           string                `json:"tenant"`
+	FunctionStatus   Status                `json:"functionStatus"`
+	FunctionFilePath string                `json:"functionFilePath"`
+	SourceHash       string                `json:"sourceHash"`
+	LanguagePack     string                `json:"languagePack"`
+	Parallelism      int                   `json:"parallelism"`
+	MaxConcurrency   int                   `json:"maxConcurrency"`
+	QueueDepth       int                   `json:"queueDepth"`
+	Timeout          int                   `json:"timeout"`
+	MaxRedeliveries  int                   `json:"maxRedeliveries"`
+	DeadLetterTopic  string                `json:"deadLetterTopic"`
+	Resources        FunctionResources     `json:"resources"`
+	Scaling          ScalingPolicy         `json:"scaling"`
+	Batch            BatchPolicy           `json:"batch"`
+	Window           WindowPolicy          `json:"window"`
+	Terminations     []InstanceTermination `json:"terminations"`
+	WebhookURLs      []string              `json:"webhookURLs"`
+	Assignments      map[string]int        `json:"assignments"`
+	AssignmentEpoch  int64                 `json:"assignmentEpoch"`
+	WorkerID         string                `json:"workerId"`
+	InputTopic       FunctionTopic         `json:"inputTopics"`
+	OutputTopic      FunctionTopic         `json:"outputTopics"`
+	LogTopic         FunctionTopic         `json:"logTopic"`
+	TriggerType      string                `json:"triggerType"`
+	DispatchMode     string                `json:"dispatchMode"`
+	Cron             string                `json:"cron"`
+	CreatedAt        time.Time             `json:"createdAt"`
+	UpdatedAt        time.Time             `json:"updatedAt"`
+	DeletedAt        time.Time             `json:"deletedAt"`
 }
 
 // FunctionTopic is the topic configurtion for function
@@ -85,8 +100,12 @@ type FunctionTopic struct {
 	Key              string `json:"key"`
 	Subscription     string `json:"subscription"`
 	SubscriptionType string `json:"subscriptionType"`
-	KeySharedPolicy  string `json:"keySharedPolicy"`
 	InitialPosition  string `json:"initialPosition"`
+
+	// KeySharedPolicy is auto-split (default) or sticky with the KeySharedHashRanges of a Key_Shared subscription
+	KeySharedPolicy         string `json:"keySharedPolicy"`
+	KeySharedHashRanges     string `json:"keySharedHashRanges"`
+	AllowOutOfOrderDelivery bool   `json:"allowOutOfOrderDelivery"`
 }
 
 // TopicKey represents a struct to identify a topic
@@ -95,11 +114,87 @@ type TopicKey struct {
 	PulsarURL     string `json:"PulsarURL"`
 }
 
-//
 const (
 	NonResumable = "NonResumable"
 )
 
+// dispatch modes of the input messages to the function instances
+const (
+	// RoundRobinDispatch invokes the instances in turn, messages run concurrently regardless of their keys
+	RoundRobinDispatch = "round-robin"
+
+	// KeyOrderedDispatch invokes the instance of the message key by consistent hashing,
+	// messages with the same key run one at a time in order
+	KeyOrderedDispatch = "key-ordered"
+)
+
+// default function invocation limits
+const (
+	// DefaultQueueDepth is the number of messages waiting for invocation before the consumer is paused
+	DefaultQueueDepth = 100
+
+	// DefaultTimeout is the function invocation timeout in seconds
+	DefaultTimeout = 30
+)
+
+// GetMaxConcurrency returns the max concurrent invocations of a function, default one per instance
+// or one per instance at the max parallelism with autoscaling
+func (cfg *FunctionConfig) GetMaxConcurrency() int {
+	if cfg.MaxConcurrency > 0 {
+		return cfg.MaxConcurrency
+	}
+	if cfg.Scaling.Enabled() {
+		return cfg.Scaling.MaxParallelism
+	}
+	if cfg.Parallelism > 0 {
+		return cfg.Parallelism
+	}
+	return 1
+}
+
+// GetTimeout returns the function invocation timeout
+func (cfg *FunctionConfig) GetTimeout() time.Duration {
+	if cfg.Timeout > 0 {
+		return time.Duration(cfg.Timeout) * time.Second
+	}
+	return DefaultTimeout * time.Second
+}
+
+// GetDeadLetterTopic returns the dead letter topic, default to the Pulsar convention <input topic>-<subscription>-DLQ
+func (cfg *FunctionConfig) GetDeadLetterTopic(subscription string) string {
+	if cfg.DeadLetterTopic != "" {
+		return cfg.DeadLetterTopic
+	}
+	return cfg.InputTopic.TopicFullName + "-" + subscription + "-DLQ"
+}
+
+// GetQueueDepth returns the invocation queue depth of a function
+func (cfg *FunctionConfig) GetQueueDepth() int {
+	if cfg.QueueDepth > 0 {
+		return cfg.QueueDepth
+	}
+	return DefaultQueueDepth
+}
+
+// KeyOrdered returns whether the messages with the same key are dispatched in order
+func (cfg *FunctionConfig) KeyOrdered() bool {
+	return cfg.DispatchMode == KeyOrderedDispatch
+}
+
+// GetSubscription returns the durable subscription of the input topic, default to tenant-function
+func (cfg *FunctionConfig) GetSubscription() string {
+	if cfg.InputTopic.Subscription != "" {
+		return cfg.InputTopic.Subscription
+	}
+	return cfg.Tenant + "-" + cfg.Name
+}
+
+// RunsOn returns whether the function runs on a worker outside of a worker cluster,
+// a function without a worker has not been started by any worker yet
+func (cfg *FunctionConfig) RunsOn(workerID string) bool {
+	return cfg.WorkerID == "" || cfg.WorkerID == workerID
+}
+
 // StringToStatus converts status in string to Status type
 func StringToStatus(status string) Status {
 	switch strings.ToLower(status) {
@@ -150,10 +245,16 @@ func GetKeyFromNames(tenant, functionName string) (string, error) {
 	return GenKey(tenant, functionName), nil
 }
 
+// FunctionKey is the database key of a function.
+// The names are separated by a slash that a tenant name cannot contain so that the keys of different tenants cannot collide.
+func FunctionKey(tenant, functionName string) string {
+	return tenant + "/" + functionName
+}
+
 // GenKey generates a unique key based on pulsar url and topic full name
 func GenKey(tenant, functionName string) string {
 	h := sha1.New()
-	h.Write([]byte(tenant + functionName))
+	h.Write([]byte(tenant + "/" + functionName))
 	return hex.EncodeToString(h.Sum(nil))
 }
 
@@ -0,0 +1,91 @@
+package model
+
+import (
+	"time"
+)
+
+// window types of a windowed trigger
+const (
+	// TumblingWindow is fixed size windows that do not overlap
+	TumblingWindow = "tumbling"
+
+	// SlidingWindow is fixed size windows that start every slide, a message can be in more than one window
+	SlidingWindow = "sliding"
+
+	// SessionWindow groups messages until no message arrives within the gap in event time
+	SessionWindow = "session"
+)
+
+// WindowPolicy is the window of a windowed trigger. A window is defined either by Count, the number of messages,
+// or by event time with SizeMs. A session window is defined by GapMs in event time.
+type WindowPolicy struct {
+	// Type is tumbling (default), sliding or session
+	Type string `json:"type"`
+
+	// Count is the number of messages of a count window
+	Count int `json:"count"`
+
+	// SlideCount is the number of messages between the starts of sliding count windows
+	SlideCount int `json:"slideCount"`
+
+	// SizeMs is the milliseconds of an event time window
+	SizeMs int `json:"sizeMs"`
+
+	// SlideMs is the milliseconds between the starts of sliding event time windows
+	SlideMs int `json:"slideMs"`
+
+	// GapMs is the milliseconds of event time without a message that closes a session window
+	GapMs int `json:"gapMs"`
+
+	// AllowedLatenessMs is the milliseconds an event time window waits for late messages after its end
+	AllowedLatenessMs int `json:"allowedLatenessMs"`
+
+	// Format is json (default) or ndjson, the same as a batch invocation
+	Format string `json:"format"`
+}
+
+// IsZero returns whether no window is configured
+func (p WindowPolicy) IsZero() bool {
+	return p == WindowPolicy{}
+}
+
+// GetType returns the window type
+func (p WindowPolicy) GetType() string {
+	if p.Type != "" {
+		return p.Type
+	}
+	return TumblingWindow
+}
+
+// ByCount returns whether the window is defined by the number of messages rather than event time
+func (p WindowPolicy) ByCount() bool {
+	return p.Count > 0
+}
+
+// GetSize returns the duration of an event time window
+func (p WindowPolicy) GetSize() time.Duration {
+	return time.Duration(p.SizeMs) * time.Millisecond
+}
+
+// GetSlide returns the duration between the starts of sliding event time windows
+func (p WindowPolicy) GetSlide() time.Duration {
+	return time.Duration(p.SlideMs) * time.Millisecond
+}
+
+// GetGap returns the gap in event time of a session window
+func (p WindowPolicy) GetGap() time.Duration {
+	return time.Duration(p.GapMs) * time.Millisecond
+}
+
+// GetAllowedLateness returns how long an event time window waits for late messages
+func (p WindowPolicy) GetAllowedLateness() time.Duration {
+	return time.Duration(p.AllowedLatenessMs) * time.Millisecond
+}
+
+// GetFormat returns the format of the messages of a window invocation
+func (p WindowPolicy) GetFormat() string {
+	if p.Format != "" {
+		return p.Format
+	}
+	return JSONBatchFormat
+}
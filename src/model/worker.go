@@ -0,0 +1,36 @@
+package model
+
+import (
+	"time"
+)
+
+// Worker is a member of the worker cluster, it is registered and renewed by the worker's heartbeat
+type Worker struct {
+	ID string `json:"id"`
+
+	// Address is the routable host name or IP of the function instances on the worker
+	Address string `json:"address"`
+
+	// Capacity is the max number of function instances on the worker
+	Capacity int `json:"capacity"`
+
+	// Instances are the urls of the running function instances, key is the function ID
+	Instances map[string][]string `json:"instances"`
+
+	StartedAt   time.Time `json:"startedAt"`
+	HeartbeatAt time.Time `json:"heartbeatAt"`
+}
+
+// Alive returns whether the worker has sent a heartbeat within the ttl
+func (w *Worker) Alive(now time.Time, ttl time.Duration) bool {
+	return now.Sub(w.HeartbeatAt) < ttl
+}
+
+// InstanceCount returns the number of running function instances on the worker
+func (w *Worker) InstanceCount() int {
+	count := 0
+	for _, urls := range w.Instances {
+		count += len(urls)
+	}
+	return count
+}
@@ -0,0 +1,83 @@
+package pulsardriver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SubscriptionStats is a subset of the Pulsar subscription stats
+type SubscriptionStats struct {
+	MsgBacklog int64   `json:"msgBacklog"`
+	MsgRateOut float64 `json:"msgRateOut"`
+}
+
+// TopicStats is a subset of the Pulsar topic stats
+type TopicStats struct {
+	MsgRateIn     float64                      `json:"msgRateIn"`
+	Subscriptions map[string]SubscriptionStats `json:"subscriptions"`
+}
+
+var adminClient = &http.Client{
+	Timeout: 5 * time.Second,
+}
+
+// GetTopicStats gets the topic stats from the Pulsar admin REST API,
+// the stats of a partitioned topic are aggregated across partitions
+func GetTopicStats(adminURL, token, topicFullName string) (*TopicStats, error) {
+	path := strings.Replace(topicFullName, "://", "/", 1)
+	stats, status, err := getTopicStats(adminURL+"/admin/v2/"+path+"/stats", token)
+	if status == http.StatusNotFound || status == http.StatusConflict {
+		stats, _, err = getTopicStats(adminURL+"/admin/v2/"+path+"/partitioned-stats", token)
+	}
+	return stats, err
+}
+
+func getTopicStats(url, token string) (*TopicStats, int, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := adminClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, res.StatusCode, fmt.Errorf("get topic stats %s status %d", url, res.StatusCode)
+	}
+	var stats TopicStats
+	if err = json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		return nil, res.StatusCode, err
+	}
+	return &stats, res.StatusCode, nil
+}
+
+// CompactTopic triggers the compaction of a topic through the Pulsar admin REST API
+func CompactTopic(adminURL, token, topicFullName string) error {
+	url := adminURL + "/admin/v2/" + strings.Replace(topicFullName, "://", "/", 1) + "/compaction"
+	req, err := http.NewRequest(http.MethodPut, url, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := adminClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// conflict means a compaction is already in progress
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusConflict {
+		return fmt.Errorf("compact topic %s status %d", topicFullName, res.StatusCode)
+	}
+	return nil
+}
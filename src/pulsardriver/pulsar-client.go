@@ -96,6 +96,25 @@ func (c *PulsarClient) Reconnect() (pulsar.Client, error) {
 	return c.GetClient(c.pulsarURL, c.token)
 }
 
+// CloseAll flushes and closes the cached producers, then closes the cached consumers and clients
+func CloseAll() {
+	ProducerCache.Close()
+
+	consumerSync.Lock()
+	for key, c := range ConsumerCache {
+		c.Close()
+		delete(ConsumerCache, key)
+	}
+	consumerSync.Unlock()
+
+	clientSync.Lock()
+	for key, c := range ClientCache {
+		c.Close()
+		delete(ClientCache, key)
+	}
+	clientSync.Unlock()
+}
+
 // NewPulsarClient always creates a new pulsar.Client connection
 func NewPulsarClient(url, tokenStr string) (pulsar.Client, error) {
 	clientOpt := pulsar.ClientOptions{
@@ -18,8 +18,44 @@ var ConsumerCache = make(map[string]*PulsarConsumer)
 
 var consumerSync = &sync.RWMutex{}
 
+// ConsumerConfig is the optional configuration of a Pulsar consumer
+type ConsumerConfig struct {
+	// ReceiverQueueSize bounds the number of messages prefetched by the client, default 1000
+	ReceiverQueueSize int
+
+	// DLQ routes a message to the dead letter topic after the max deliveries, no dead letter topic if nil
+	DLQ *pulsar.DLQPolicy
+
+	// KeyShared is the policy of a Key_Shared subscription
+	KeyShared *model.KeySharedPolicy
+}
+
+// keySharedPolicy converts the Key_Shared policy of a function to the policy of the Pulsar client, nil if the
+// subscription is not Key_Shared
+func keySharedPolicy(policy *model.KeySharedPolicy) *pulsar.KeySharedPolicy {
+	if policy == nil {
+		return nil
+	}
+	result := &pulsar.KeySharedPolicy{
+		Mode:                    pulsar.KeySharedPolicyModeAutoSplit,
+		AllowOutOfOrderDelivery: policy.AllowOutOfOrder,
+	}
+	if policy.Mode == model.StickyPolicy {
+		result.Mode = pulsar.KeySharedPolicyModeSticky
+		for _, r := range policy.HashRanges {
+			result.HashRanges = append(result.HashRanges, r.Start, r.End)
+		}
+	}
+	return result
+}
+
 // GetPulsarConsumer gets a Pulsar consumer object
 func GetPulsarConsumer(pulsarURL, pulsarToken, topic, subName, subInitPos, subType, subKey string) (pulsar.Consumer, error) {
+	return GetPulsarConsumerWithConfig(pulsarURL, pulsarToken, topic, subName, subInitPos, subType, subKey, ConsumerConfig{})
+}
+
+// GetPulsarConsumerWithConfig gets a Pulsar consumer object with optional configuration
+func GetPulsarConsumerWithConfig(pulsarURL, pulsarToken, topic, subName, subInitPos, subType, subKey string, cfg ConsumerConfig) (pulsar.Consumer, error) {
 	key := subKey
 	consumerSync.RLock()
 	prod, ok := ConsumerCache[key]
@@ -31,6 +67,7 @@ func GetPulsarConsumer(pulsarURL, pulsarToken, topic, subName, subInitPos, subTy
 		prod.token = pulsarToken
 		prod.topic = topic
 		prod.subscriptionName = subName
+		prod.config = cfg
 		var err error
 		prod.subscriptionType, err = model.GetSubscriptionType(subType)
 		if err != nil {
@@ -83,6 +120,7 @@ type PulsarConsumer struct {
 	subscriptionKey  string
 	initPosition     pulsar.SubscriptionInitialPosition
 	subscriptionType pulsar.SubscriptionType
+	config           ConsumerConfig
 	createdAt        time.Time
 	lastUsed         time.Time
 	sync.Mutex
@@ -110,6 +148,9 @@ func (c *PulsarConsumer) GetConsumer() (pulsar.Consumer, error) {
 		SubscriptionName:            c.subscriptionName,
 		SubscriptionInitialPosition: c.initPosition,
 		Type:                        c.subscriptionType,
+		ReceiverQueueSize:           c.config.ReceiverQueueSize,
+		DLQ:                         c.config.DLQ,
+		KeySharedPolicy:             keySharedPolicy(c.config.KeyShared),
 	})
 	if err != nil {
 		log.Errorf("consumer subscribe error:%s\n", err.Error())
@@ -0,0 +1,38 @@
+package pulsardriver
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+)
+
+func TestKeySharedPolicy(t *testing.T) {
+	cases := []struct {
+		name  string
+		topic model.FunctionTopic
+		want  *pulsar.KeySharedPolicy
+	}{
+		{"not key shared", model.FunctionTopic{SubscriptionType: "shared"}, nil},
+		{"default auto split", model.FunctionTopic{SubscriptionType: "keyshared"},
+			&pulsar.KeySharedPolicy{Mode: pulsar.KeySharedPolicyModeAutoSplit}},
+		{"auto split out of order", model.FunctionTopic{SubscriptionType: "keyshared", KeySharedPolicy: model.AutoSplitPolicy, AllowOutOfOrderDelivery: true},
+			&pulsar.KeySharedPolicy{Mode: pulsar.KeySharedPolicyModeAutoSplit, AllowOutOfOrderDelivery: true}},
+		{"sticky", model.FunctionTopic{SubscriptionType: "keyshared", KeySharedPolicy: model.StickyPolicy, KeySharedHashRanges: "32768-49151,0-16383"},
+			&pulsar.KeySharedPolicy{Mode: pulsar.KeySharedPolicyModeSticky, HashRanges: []int{0, 16383, 32768, 49151}}},
+		{"sticky single hash", model.FunctionTopic{SubscriptionType: "keyshared", KeySharedPolicy: model.StickyPolicy, KeySharedHashRanges: "7-7"},
+			&pulsar.KeySharedPolicy{Mode: pulsar.KeySharedPolicyModeSticky, HashRanges: []int{7, 7}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			policy, err := c.topic.GetKeySharedPolicy()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := keySharedPolicy(policy); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
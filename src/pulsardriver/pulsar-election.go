@@ -0,0 +1,20 @@
+package pulsardriver
+
+import (
+	"github.com/apache/pulsar-client-go/pulsar"
+)
+
+// AcquireExclusiveSubscription subscribes to a topic with an exclusive subscription.
+// Only one consumer in the cluster holds the subscription, it is released when the consumer is closed
+// or its connection to the broker is lost, so the holder can be elected as a leader.
+func AcquireExclusiveSubscription(pulsarURL, pulsarToken, topic, subName string) (pulsar.Consumer, error) {
+	client, err := GetPulsarClient(pulsarURL, pulsarToken, false)
+	if err != nil {
+		return nil, err
+	}
+	return client.Subscribe(pulsar.ConsumerOptions{
+		Topic:            topic,
+		SubscriptionName: subName,
+		Type:             pulsar.Exclusive,
+	})
+}
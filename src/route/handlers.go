@@ -13,8 +13,13 @@ import (
 
 	"github.com/apache/pulsar-client-go/pulsar"
 	"github.com/gorilla/mux"
+	"github.com/kafkaesque-io/pubsub-function/src/artifact"
+	"github.com/kafkaesque-io/pubsub-function/src/broker"
+	"github.com/kafkaesque-io/pubsub-function/src/cluster"
 	"github.com/kafkaesque-io/pubsub-function/src/db"
+	"github.com/kafkaesque-io/pubsub-function/src/icrypto"
 	"github.com/kafkaesque-io/pubsub-function/src/lambda"
+	"github.com/kafkaesque-io/pubsub-function/src/middleware"
 	"github.com/kafkaesque-io/pubsub-function/src/model"
 	"github.com/kafkaesque-io/pubsub-function/src/pulsardriver"
 	"github.com/kafkaesque-io/pubsub-function/src/util"
@@ -29,15 +34,52 @@ const subDelimiter = "-"
 // Init initializes database
 func Init() {
 	singleDb = db.NewDbWithPanic(util.GetConfig().PbDbType)
+	middleware.InitRBAC(singleDb, func(tenant, subjects string) bool {
+		return VerifySubject(tenant, subjects, ExtractEvalTenant)
+	})
+	middleware.InitRevocation(singleDb)
+	lambda.OnTermination(recordTermination)
+}
+
+// recordTermination keeps an unexpected instance termination in the function configuration
+// the function config keeps the same UpdatedAt so that the function consumer is not restarted
+func recordTermination(cfg model.FunctionConfig, termination model.InstanceTermination) {
+	doc, err := singleDb.GetByKey(cfg.ID)
+	if err != nil {
+		log.Errorf("function %s failed to load config error %v", cfg.ID, err)
+		return
+	}
+	doc.AddTermination(termination)
+	if _, err = singleDb.Update(doc); err != nil {
+		log.Errorf("function %s failed to record termination error %v", cfg.ID, err)
+	}
 }
 
 // TokenServerResponse is the json object for token server response
 type TokenServerResponse struct {
-	Subject string `json:"subject"`
-	Token   string `json:"token"`
+	Subject   string `json:"subject"`
+	Token     string `json:"token"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// TokenRequest is the optional json body to request a token
+type TokenRequest struct {
+	TTL      string                 `json:"ttl"`
+	Audience string                 `json:"audience"`
+	Claims   map[string]interface{} `json:"claims"`
+}
+
+// TokenIntrospection is the json object for token introspection response
+type TokenIntrospection struct {
+	Active            bool                   `json:"active"`
+	Revoked           bool                   `json:"revoked,omitempty"`
+	Subject           string                 `json:"subject,omitempty"`
+	RemainingValidity int                    `json:"remainingValidity"`
+	Claims            map[string]interface{} `json:"claims,omitempty"`
 }
 
 // TokenSubjectHandler issues new token
+// The requested ttl and audience can be query parameters, or a json body with custom claims
 func TokenSubjectHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	subject, ok := vars["sub"]
@@ -45,33 +87,138 @@ func TokenSubjectHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusUnprocessableEntity)
 		return
 	}
+	if util.JWTAuth == nil {
+		util.ResponseErrorJSON(errors.New("token server requires Pulsar private and public keys"), w, http.StatusNotImplemented)
+		return
+	}
 
-	if util.StrContains(util.SuperRoles, util.AssignString(r.Header.Get("injectedSubs"), "BOGUSROLE")) {
-		tokenString, err := util.JWTAuth.GenerateToken(subject)
-		if err != nil {
-			util.ResponseErrorJSON(errors.New("failed to generate token"), w, http.StatusInternalServerError)
-		} else {
-			respJSON, err := json.Marshal(&TokenServerResponse{
-				Subject: subject,
-				Token:   tokenString,
-			})
-			if err != nil {
-				util.ResponseErrorJSON(errors.New("failed to marshal token response json object"), w, http.StatusInternalServerError)
-				return
-			}
-			w.Write(respJSON)
-			w.WriteHeader(http.StatusOK)
+	if !util.StrContains(util.SuperRoles, util.AssignString(r.Header.Get("injectedSubs"), "BOGUSROLE")) {
+		util.ResponseErrorJSON(errors.New("incorrect subject"), w, http.StatusUnauthorized)
+		return
+	}
+
+	req := TokenRequest{
+		TTL:      util.QueryParamString(r.URL.Query(), "ttl", ""),
+		Audience: util.QueryParamString(r.URL.Query(), "aud", ""),
+	}
+	if r.Method == http.MethodPost {
+		decoder := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+		if err := decoder.Decode(&req); err != nil && err != io.EOF {
+			util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+			return
 		}
+	}
+	opts := icrypto.TokenOptions{
+		Audience: req.Audience,
+		Claims:   req.Claims,
+	}
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			util.ResponseErrorJSON(fmt.Errorf("invalid ttl %s", req.TTL), w, http.StatusUnprocessableEntity)
+			return
+		}
+		opts.TTL = ttl
+	}
+	if opts.TTL == 0 {
+		opts.TTL = icrypto.DefaultTokenTTL
+	}
+	if maxTTL := tokenMaxTTL(); opts.TTL > maxTTL {
+		opts.TTL = maxTTL
+	}
+
+	tokenString, err := util.JWTAuth.GenerateTokenWithOptions(subject, opts)
+	if err != nil {
+		util.ResponseErrorJSON(errors.New("failed to generate token"), w, http.StatusInternalServerError)
 		return
 	}
-	util.ResponseErrorJSON(errors.New("incorrect subject"), w, http.StatusUnauthorized)
-	return
+	var expiresAt int64
+	if claims, err := util.JWTAuth.GetTokenClaims(tokenString); err == nil {
+		if exp, ok := claims["exp"].(float64); ok {
+			expiresAt = int64(exp)
+		}
+	}
+	respJSON, err := json.Marshal(&TokenServerResponse{
+		Subject:   subject,
+		Token:     tokenString,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		util.ResponseErrorJSON(errors.New("failed to marshal token response json object"), w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respJSON)
+}
+
+// TokenIntrospectHandler introspects a token issued by the token server.
+// The token is the `token` form value, or the bearer token itself if not specified.
+// Super roles can introspect any token, other callers only the tokens of their own subject.
+func TokenIntrospectHandler(w http.ResponseWriter, r *http.Request) {
+	if util.JWTAuth == nil {
+		util.ResponseErrorJSON(errors.New("token server requires Pulsar private and public keys"), w, http.StatusNotImplemented)
+		return
+	}
+	tokenStr := strings.TrimSpace(r.FormValue("token"))
+	if tokenStr == "" {
+		tokenStr = strings.TrimSpace(strings.Replace(r.Header.Get("Authorization"), "Bearer", "", 1))
+	}
+
+	result := TokenIntrospection{}
+	if claims, err := util.JWTAuth.GetTokenClaims(tokenStr); err == nil {
+		result.Subject, _ = util.JWTAuth.SubjectFromClaims(claims)
+		if subjects := r.Header.Get("injectedSubs"); subjects != result.Subject && !isSuperRole(subjects) {
+			util.ResponseErrorJSON(errors.New("subject is not authorized to introspect the token"), w, http.StatusForbidden)
+			return
+		}
+		result.Revoked = middleware.IsRevoked(claims, result.Subject)
+		result.Active = !result.Revoked
+		result.RemainingValidity = util.JWTAuth.GetTokenRemainingValidity(claims["exp"])
+		result.Claims = claims
+	}
+	respJSON, err := json.Marshal(&result)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(respJSON)
+}
+
+// isSuperRole returns whether any of the token subjects is a super role
+func isSuperRole(subjects string) bool {
+	for _, v := range strings.Split(subjects, ",") {
+		if util.StrContains(util.SuperRoles, v) {
+			return true
+		}
+	}
+	return false
 }
 
-// StatusPage replies with basic status code
+// workerStatus is the cluster status and the progress of the startup reconciliation of this worker
+type workerStatus struct {
+	cluster.Status
+	Reconciliation *cluster.ReconcileStatus `json:"reconciliation,omitempty"`
+}
+
+// StatusPage replies with the cluster leader and workers seen by this worker, and the startup reconciliation progress
 func StatusPage(w http.ResponseWriter, r *http.Request) {
+	status := workerStatus{}
+	var err error
+	if status.Status, err = cluster.GetStatus(); err != nil {
+		log.Errorf("failed to get cluster status error %v", err)
+	}
+	status.Reconciliation = cluster.GetReconcileStatus()
+	respJSON, err := json.Marshal(&status)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	return
+	w.Write(respJSON)
 }
 
 // ReceiveHandler - the message receiver handler
@@ -164,6 +311,25 @@ func VerifySubject(requiredSubject, tokenSubjects string, evalTenant func(tenant
 	return false
 }
 
+// verifyFunctionTopics verifies the token is authorized to deploy to the tenants of the function's input, output, log and dead letter topics,
+// the same role resolution as the function routes applies to the tenant of every topic
+func verifyFunctionTopics(cfg *model.FunctionConfig, r *http.Request) error {
+	topics := []string{cfg.InputTopic.TopicFullName, cfg.OutputTopic.TopicFullName, cfg.LogTopic.TopicFullName, cfg.DeadLetterTopic}
+	for _, topicFN := range topics {
+		if topicFN == "" {
+			continue
+		}
+		_, tenant, _, _, err := util.ParseTopicFn(topicFN)
+		if err != nil {
+			return err
+		}
+		if !middleware.ResolveRole(tenant, r.Header.Get("injectedSubs"), middleware.TokenClaims(r)).Allows(model.DeployAction) {
+			return fmt.Errorf("subject is not authorized to access topic %s", topicFN)
+		}
+	}
+	return nil
+}
+
 // ExtractEvalTenant is a customized function to evaluate subject against tenant
 func ExtractEvalTenant(requiredSubject, tokenSub string) bool {
 	// expect - in subject unless it is superuser
@@ -245,6 +411,124 @@ func ConsumerConfigFromHTTPParts(allowedClusters []string, h *http.Header, vars
 
 // GetFunctionHandler gets a function
 func GetFunctionHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, functionName, err := tenantFunctionName(mux.Vars(r))
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	doc, err := singleDb.GetByTopic(tenant, functionName)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusNotFound)
+		return
+	}
+	writeFunctionJSON(w, http.StatusOK, doc)
+}
+
+// validationErrorResponse is the 422 response listing all of the invalid fields of a function config
+type validationErrorResponse struct {
+	Error  string              `json:"error"`
+	Fields []lambda.FieldError `json:"fields"`
+}
+
+// responseValidationError writes a validation error with every invalid field
+func responseValidationError(err error, w http.ResponseWriter) {
+	verr, ok := err.(*lambda.ValidationError)
+	if !ok {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	resJSON, err := json.Marshal(validationErrorResponse{Error: verr.Error(), Fields: verr.Fields})
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	w.Write(resJSON)
+}
+
+// maskTokens masks the Pulsar tokens of a function configuration
+func maskTokens(doc *model.FunctionConfig) {
+	doc.InputTopic.Token = "***"
+	doc.OutputTopic.Token = "***"
+	doc.LogTopic.Token = "***"
+}
+
+// writeFunctionJSON writes a function configuration with the Pulsar tokens masked
+func writeFunctionJSON(w http.ResponseWriter, status int, doc *model.FunctionConfig) {
+	maskTokens(doc)
+	resJSON, err := json.Marshal(doc)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(resJSON)
+}
+
+// FunctionList is a page of functions
+type FunctionList struct {
+	Functions  []*model.FunctionConfig `json:"functions"`
+	NextCursor string                  `json:"nextCursor,omitempty"`
+}
+
+// ListFunctionsHandler lists the functions of a tenant
+func ListFunctionsHandler(w http.ResponseWriter, r *http.Request) {
+	listFunctions(w, r, mux.Vars(r)["tenant"])
+}
+
+// ListAllFunctionsHandler lists the functions across tenants
+func ListAllFunctionsHandler(w http.ResponseWriter, r *http.Request) {
+	listFunctions(w, r, r.URL.Query().Get("tenant"))
+}
+
+// listFunctions lists the functions matching the query parameters, sorted and paginated by cursor
+func listFunctions(w http.ResponseWriter, r *http.Request, tenant string) {
+	params := r.URL.Query()
+	query := model.FunctionQuery{
+		Tenant:       tenant,
+		LanguagePack: params.Get("language-pack"),
+		TriggerType:  params.Get("trigger-type"),
+		InputTopic:   params.Get("input-topic"),
+		OutputTopic:  params.Get("output-topic"),
+		Sort:         params.Get("sort"),
+		Descending:   strings.ToLower(params.Get("order")) == "desc",
+		Limit:        util.StringToInt(params.Get("limit"), 0),
+		Cursor:       params.Get("cursor"),
+	}
+	if params.Get("status") != "" {
+		status, err := model.ParseStatus(params.Get("status"))
+		if err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+			return
+		}
+		query.Status = &status
+	}
+
+	fns, err := singleDb.Load()
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	page, next, err := query.Page(fns)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	list := FunctionList{Functions: make([]*model.FunctionConfig, 0, len(page)), NextCursor: next}
+	for _, fn := range page {
+		doc := *fn
+		maskTokens(&doc)
+		list.Functions = append(list.Functions, &doc)
+	}
+	resJSON, err := json.Marshal(&list)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resJSON)
 }
 
 // UpdateFunctionHandler creates or updates a function
@@ -266,37 +550,77 @@ func UpdateFunctionHandler(w http.ResponseWriter, r *http.Request) {
 
 	now := time.Now()
 	doc := model.FunctionConfig{
-		Name:           functionName,
-		Tenant:         tenant,
-		ID:             tenant + functionName,
-		LanguagePack:   util.AssignString(r.FormValue("language-pack"), "javascript"),
-		Parallelism:    util.GetEnvInt(r.FormValue("parallelism"), 1),
-		TriggerType:    util.AssignString(r.FormValue("trigger-type"), "pulsar-topic"),
-		FunctionStatus: model.StringToStatus(r.FormValue("function-status")),
-		CreatedAt:      now,
-		UpdatedAt:      now,
+		Name:            functionName,
+		Tenant:          tenant,
+		ID:              model.FunctionKey(tenant, functionName),
+		LanguagePack:    util.AssignString(r.FormValue("language-pack"), "javascript"),
+		Parallelism:     util.StringToInt(r.FormValue("parallelism"), 1),
+		MaxConcurrency:  util.StringToInt(r.FormValue("max-concurrency"), 0),
+		QueueDepth:      util.StringToInt(r.FormValue("queue-depth"), 0),
+		Timeout:         util.StringToInt(r.FormValue("timeout"), 0),
+		MaxRedeliveries: util.StringToInt(r.FormValue("max-redeliveries"), 0),
+		DeadLetterTopic: r.FormValue("dead-letter-topic"),
+		TriggerType:     util.AssignString(r.FormValue("trigger-type"), "pulsar-topic"),
+		DispatchMode:    r.FormValue("dispatch-mode"),
+		Cron:            r.FormValue("cron"),
+		FunctionStatus:  model.StringToStatus(util.AssignString(r.FormValue("function-status"), "activated")),
+		CreatedAt:       now,
+		UpdatedAt:       now,
+		Resources: model.FunctionResources{
+			MemoryMB:       util.StringToInt(r.FormValue("memory-mb"), 0),
+			CPUMillis:      util.StringToInt(r.FormValue("cpu-millis"), 0),
+			CPUTimeSeconds: util.StringToInt(r.FormValue("cpu-time-seconds"), 0),
+			OpenFiles:      util.StringToInt(r.FormValue("open-files"), 0),
+		},
+		Scaling: model.ScalingPolicy{
+			MinParallelism:    util.StringToInt(r.FormValue("min-parallelism"), 0),
+			MaxParallelism:    util.StringToInt(r.FormValue("max-parallelism"), 0),
+			TargetBacklog:     util.StringToInt(r.FormValue("target-backlog"), 0),
+			TargetLatencyMs:   util.StringToInt(r.FormValue("target-latency-ms"), 0),
+			ScaleUpCooldown:   util.StringToInt(r.FormValue("scale-up-cooldown"), 0),
+			ScaleDownCooldown: util.StringToInt(r.FormValue("scale-down-cooldown"), 0),
+		},
+		Batch: model.BatchPolicy{
+			MaxSize:   util.StringToInt(r.FormValue("batch-max-size"), 0),
+			MaxBytes:  util.StringToInt(r.FormValue("batch-max-bytes"), 0),
+			MaxWaitMs: util.StringToInt(r.FormValue("batch-max-wait-ms"), 0),
+			Format:    r.FormValue("batch-format"),
+		},
+		Window: model.WindowPolicy{
+			Type:              r.FormValue("window-type"),
+			Count:             util.StringToInt(r.FormValue("window-count"), 0),
+			SlideCount:        util.StringToInt(r.FormValue("window-slide-count"), 0),
+			SizeMs:            util.StringToInt(r.FormValue("window-size-ms"), 0),
+			SlideMs:           util.StringToInt(r.FormValue("window-slide-ms"), 0),
+			GapMs:             util.StringToInt(r.FormValue("window-gap-ms"), 0),
+			AllowedLatenessMs: util.StringToInt(r.FormValue("window-allowed-lateness-ms"), 0),
+			Format:            r.FormValue("window-format"),
+		},
+	}
+	// all fields are validated before the source is stored and any instance is started
+	formErrors := []lambda.FieldError{}
+	if doc.FunctionStatus != model.Activated && doc.FunctionStatus != model.Deactivated {
+		formErrors = append(formErrors, lambda.FieldError{Field: "functionStatus", Message: "a function can only be uploaded as activated or deactivated"})
 	}
 	file, fileReader, err := r.FormFile("source")
 	if file != nil {
 		defer file.Close()
 	}
 	if err != nil {
-		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
-		return
+		formErrors = append(formErrors, lambda.FieldError{Field: "source", Message: err.Error()})
 	}
-
-	log.Infof("MIME Header: %+v\nUploaded File: %+v\nFile Size: %+v\n, languagePack %s, parallel instance %d, triggerType %s",
-		fileReader.Header, fileReader.Filename, fileReader.Size, doc.LanguagePack, doc.Parallelism, doc.TriggerType)
-	if doc.TriggerType == lambda.PulsarTrigger {
+	if doc.TriggerType == lambda.PulsarTrigger || doc.TriggerType == lambda.WindowTrigger {
 		doc.InputTopic = model.FunctionTopic{
-			PulsarURL:        pulsarURL,
-			TopicFullName:    r.FormValue("input-topic"),
-			Token:            tokenStr,
-			Tenant:           tenant,
-			Subscription:     r.FormValue("subscription-name"),
-			SubscriptionType: r.FormValue("subscription-type"),
-			InitialPosition:  r.FormValue("subscription-initial-position"),
-			KeySharedPolicy:  r.FormValue("key-shared-policy"),
+			PulsarURL:               pulsarURL,
+			TopicFullName:           r.FormValue("input-topic"),
+			Token:                   tokenStr,
+			Tenant:                  tenant,
+			Subscription:            r.FormValue("subscription-name"),
+			SubscriptionType:        r.FormValue("subscription-type"),
+			InitialPosition:         r.FormValue("subscription-initial-position"),
+			KeySharedPolicy:         r.FormValue("key-shared-policy"),
+			KeySharedHashRanges:     r.FormValue("key-shared-hash-ranges"),
+			AllowOutOfOrderDelivery: util.StringToBool(r.FormValue("allow-out-of-order-delivery")),
 		}
 	}
 	if r.FormValue("output-topic") != "" {
@@ -307,6 +631,24 @@ func UpdateFunctionHandler(w http.ResponseWriter, r *http.Request) {
 			Tenant:        tenant,
 		}
 	}
+	if r.FormValue("log-topic") != "" {
+		doc.LogTopic = model.FunctionTopic{
+			PulsarURL:     pulsarURL,
+			Token:         tokenStr,
+			TopicFullName: r.FormValue("log-topic"),
+			Tenant:        tenant,
+		}
+	}
+	if err = lambda.ValidateFunction(&doc, formErrors...); err != nil {
+		responseValidationError(err, w)
+		return
+	}
+	if err = verifyFunctionTopics(&doc, r); err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusForbidden)
+		return
+	}
+	log.Infof("MIME Header: %+v\nUploaded File: %+v\nFile Size: %+v\n, languagePack %s, parallel instance %d, triggerType %s",
+		fileReader.Header, fileReader.Filename, fileReader.Size, doc.LanguagePack, doc.Parallelism, doc.TriggerType)
 
 	// read all of the contents of our uploaded file into a byte array
 	fileBytes, err := ioutil.ReadAll(file)
@@ -314,6 +656,16 @@ func UpdateFunctionHandler(w http.ResponseWriter, r *http.Request) {
 		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
 		return
 	}
+	// the source is referenced by its content hash so that any worker can fetch it from the artifact store
+	store, err := artifact.GetStore()
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	if doc.SourceHash, err = store.Put(fileBytes); err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
 	doc.FunctionFilePath = lambda.GetSourceFilePath(doc.Tenant) + "/" + functionName + ".js"
 	// write this byte array to our temporary file
 	if err = ioutil.WriteFile(doc.FunctionFilePath, fileBytes, 0644); err != nil {
@@ -321,17 +673,16 @@ func UpdateFunctionHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	functionURLs := []string{}
-	for i := 0; i < doc.Parallelism; i++ {
-		url, err := lambda.StartNodeInstance(doc)
-		if err != nil {
-			log.Errorf("start function node failure %v", err)
-			util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
-			return
-		}
-		// return that we have successfully uploaded our file!
-		// fmt.Fprintf(w, "Successfully Uploaded File server started with url %s\n", url)
-		functionURLs = append(functionURLs, url)
+	// the instances of the uploaded function are replaced
+	var running []string
+	if previous, err := singleDb.GetByTopic(tenant, functionName); err == nil {
+		running = previous.WebhookURLs
+	}
+	functionURLs, err := startInstances(&doc)
+	if err != nil {
+		log.Errorf("start function node failure %v", err)
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
 	}
 	doc.WebhookURLs = functionURLs
 
@@ -339,28 +690,417 @@ func UpdateFunctionHandler(w http.ResponseWriter, r *http.Request) {
 
 	id, err := singleDb.Update(&doc)
 	if err != nil {
+		stopInstances(doc.WebhookURLs)
 		util.ResponseErrorJSON(err, w, http.StatusConflict)
 		return
 	}
+	// the invocations of the replaced instances drain before they stop
+	broker.StopConsumer(id)
+	stopInstances(running)
+	broker.Refresh()
 	if len(id) > 1 {
 		savedDoc, err := singleDb.GetByKey(id)
 		if err != nil {
 			util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
 			return
 		}
-		w.WriteHeader(http.StatusCreated)
-		savedDoc.InputTopic.Token = "***"
-		savedDoc.OutputTopic.Token = "***"
-		savedDoc.LogTopic.Token = "***"
-		resJSON, err := json.Marshal(savedDoc)
+		writeFunctionJSON(w, http.StatusCreated, savedDoc)
+		return
+	}
+	util.ResponseErrorJSON(fmt.Errorf("failed to update"), w, http.StatusInternalServerError)
+}
+
+// PatchFunctionHandler applies a JSON merge patch to a function config without uploading the source.
+// A change of parallelism scales the instances, any other change restarts the consumer and the instances.
+func PatchFunctionHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, functionName, err := tenantFunctionName(mux.Vars(r))
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	patch, err := ioutil.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusBadRequest)
+		return
+	}
+	doc, err := singleDb.GetByTopic(tenant, functionName)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusNotFound)
+		return
+	}
+	patched, topics, err := doc.Patch(patch)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	if len(topics) > 0 {
+		// the patched topics use the credentials of the request as in the function upload
+		tokenStr, _, pulsarURL, err := util.ReceiverHeader(util.AllowedPulsarURLs, &r.Header)
 		if err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusUnauthorized)
+			return
+		}
+		for _, name := range topics {
+			if topic := patched.TopicByField(name); topic.TopicFullName != "" {
+				topic.PulsarURL = pulsarURL
+				topic.Token = tokenStr
+				topic.Tenant = tenant
+			} else {
+				*topic = model.FunctionTopic{}
+			}
+		}
+	}
+	if err = lambda.ValidateFunction(patched); err != nil {
+		responseValidationError(err, w)
+		return
+	}
+	if err = verifyFunctionTopics(patched, r); err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusForbidden)
+		return
+	}
+
+	if err = applyConfig(doc, patched); err != nil {
+		log.Errorf("function %s failed to apply patch error %v", doc.ID, err)
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	writeFunctionJSON(w, http.StatusOK, patched)
+}
+
+// applyConfig updates a function to the new config. A change of parallelism scales the instances,
+// any other change restarts the consumer and the instances.
+func applyConfig(doc, updated *model.FunctionConfig) error {
+	var err error
+	running := doc.WebhookURLs
+	restart := doc.NeedsRestart(updated)
+	if restart {
+		// the consumer resubscribes and the instances restart with the new config
+		updated.UpdatedAt = time.Now()
+		updated.WebhookURLs, err = startInstances(updated)
+	} else {
+		updated.WebhookURLs, err = scaleInstances(updated, running)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = singleDb.Update(updated); err != nil {
+		if restart {
+			stopInstances(updated.WebhookURLs)
+		}
+		return err
+	}
+	if restart {
+		// the invocations of the replaced instances drain before they stop
+		broker.StopConsumer(updated.ID)
+		stopInstances(running)
+		broker.Refresh()
+	} else if !cluster.Enabled() {
+		broker.SetInstances(updated)
+		stopInstances(removedURLs(running, updated.WebhookURLs))
+	}
+	log.Infof("function %s is updated, restart %t", doc.ID, restart)
+	return nil
+}
+
+// ApplyResult is the outcome of applying a function spec
+type ApplyResult struct {
+	// Action is create, update or none
+	Action   string                `json:"action"`
+	DryRun   bool                  `json:"dryRun"`
+	Changes  []model.SpecChange    `json:"changes"`
+	Function *model.FunctionConfig `json:"function"`
+}
+
+// ApplyFunctionHandler creates or updates a function from a JSON or YAML spec, or does nothing if the function matches the spec.
+// With dry-run=true, it returns the changes without applying them.
+func ApplyFunctionHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, functionName, err := tenantFunctionName(mux.Vars(r))
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 8<<20))
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusBadRequest)
+		return
+	}
+	spec, err := model.ParseFunctionSpec(body)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	dryRun := r.URL.Query().Get("dry-run") == "true"
+
+	current, err := singleDb.GetByTopic(tenant, functionName)
+	if err != nil {
+		if err.Error() != db.DocNotFound {
 			util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
 			return
 		}
-		w.Write(resJSON)
+		current = nil
+	}
+	store, err := artifact.GetStore()
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
 		return
 	}
-	util.ResponseErrorJSON(fmt.Errorf("failed to update"), w, http.StatusInternalServerError)
+	var source []byte
+	sourceHash := ""
+	if spec.Source != nil {
+		if source, err = spec.Source.SourceBytes(); err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+			return
+		}
+		if source != nil {
+			sourceHash = artifact.Hash(source)
+		} else if _, err = store.Get(spec.Source.Hash); err != nil {
+			util.ResponseErrorJSON(fmt.Errorf("source %s %v", spec.Source.Hash, err), w, http.StatusUnprocessableEntity)
+			return
+		} else {
+			sourceHash = spec.Source.Hash
+		}
+	} else if current == nil {
+		util.ResponseErrorJSON(fmt.Errorf("source is required to create a function"), w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	doc, err := spec.Config(current, tenant, functionName, sourceHash)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	// the topics use the credentials of the request as in the function upload
+	tokenStr, _, pulsarURL, err := util.ReceiverHeader(util.AllowedPulsarURLs, &r.Header)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnauthorized)
+		return
+	}
+	for _, topic := range []*model.FunctionTopic{&doc.InputTopic, &doc.OutputTopic, &doc.LogTopic} {
+		if topic.TopicFullName != "" {
+			topic.PulsarURL = pulsarURL
+			topic.Token = tokenStr
+			topic.Tenant = tenant
+		}
+	}
+	if err = lambda.ValidateFunction(doc); err != nil {
+		responseValidationError(err, w)
+		return
+	}
+	if err = verifyFunctionTopics(doc, r); err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusForbidden)
+		return
+	}
+
+	result := ApplyResult{Action: "update", DryRun: dryRun, Function: doc}
+	var from *model.FunctionSpec
+	if current == nil {
+		result.Action = "create"
+	} else {
+		from = model.SpecOf(current)
+	}
+	if result.Changes, err = model.DiffSpecs(from, model.SpecOf(doc)); err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	if current != nil && len(result.Changes) == 0 {
+		result.Action = "none"
+		result.Function = current
+	}
+	if dryRun || result.Action == "none" {
+		writeApplyResult(w, http.StatusOK, &result)
+		return
+	}
+
+	if source != nil {
+		if _, err = store.Put(source); err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+			return
+		}
+	}
+	if current != nil {
+		if err = applyConfig(current, doc); err != nil {
+			log.Errorf("function %s failed to apply spec error %v", doc.ID, err)
+			util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+			return
+		}
+		writeApplyResult(w, http.StatusOK, &result)
+		return
+	}
+
+	now := time.Now()
+	doc.CreatedAt = now
+	doc.UpdatedAt = now
+	doc.FunctionFilePath = lambda.GetSourceFilePath(tenant) + "/" + functionName + ".js"
+	if doc.WebhookURLs, err = startInstances(doc); err != nil {
+		log.Errorf("start function node failure %v", err)
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	if _, err = singleDb.Update(doc); err != nil {
+		stopInstances(doc.WebhookURLs)
+		util.ResponseErrorJSON(err, w, http.StatusConflict)
+		return
+	}
+	broker.Refresh()
+	writeApplyResult(w, http.StatusCreated, &result)
+}
+
+// writeApplyResult writes the apply result with the Pulsar tokens of the function masked
+func writeApplyResult(w http.ResponseWriter, status int, result *ApplyResult) {
+	doc := *result.Function
+	maskTokens(&doc)
+	result.Function = &doc
+	resJSON, err := json.Marshal(result)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(resJSON)
+}
+
+// UploadArtifactHandler stores a function source in the artifact store, a function spec references it by the returned hash
+func UploadArtifactHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, 8<<20))
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusBadRequest)
+		return
+	}
+	if len(data) == 0 {
+		util.ResponseErrorJSON(fmt.Errorf("artifact is empty"), w, http.StatusUnprocessableEntity)
+		return
+	}
+	store, err := artifact.GetStore()
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	hash, err := store.Put(data)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	resJSON, err := json.Marshal(artifact.Info{Hash: hash, Size: len(data), CreatedAt: time.Now()})
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(resJSON)
+}
+
+// scaleInstances starts or stops instances on this worker to the desired number of an activated function,
+// the stopped instances are removed from the returned urls but only terminated after the consumer stops using them
+func scaleInstances(doc *model.FunctionConfig, running []string) ([]string, error) {
+	urls := append([]string{}, running...)
+	if doc.FunctionStatus != model.Activated || cluster.Enabled() {
+		return urls, nil
+	}
+	// this worker restarts the instances when it restarts
+	doc.WorkerID = util.GetWorkerID()
+	desired := doc.DesiredInstances()
+	if len(urls) > desired {
+		return urls[:desired], nil
+	}
+	started := []string{}
+	for len(urls) < desired {
+		url, err := lambda.StartNodeInstance(*doc)
+		if err != nil {
+			stopInstances(started)
+			return nil, err
+		}
+		started = append(started, url)
+		urls = append(urls, url)
+	}
+	return urls, nil
+}
+
+// removedURLs returns the urls that are no longer in use
+func removedURLs(old, urls []string) []string {
+	removed := []string{}
+	for _, url := range old {
+		if !util.StrContains(urls, url) {
+			removed = append(removed, url)
+		}
+	}
+	return removed
+}
+
+// startInstances starts the instances of an activated function on this worker,
+// instances are assigned to the workers by the leader in a worker cluster
+func startInstances(doc *model.FunctionConfig) ([]string, error) {
+	urls := []string{}
+	if doc.FunctionStatus != model.Activated || cluster.Enabled() {
+		return urls, nil
+	}
+	// this worker restarts the instances when it restarts
+	doc.WorkerID = util.GetWorkerID()
+	for i := 0; i < doc.DesiredInstances(); i++ {
+		url, err := lambda.StartNodeInstance(*doc)
+		if err != nil {
+			stopInstances(urls)
+			return nil, err
+		}
+		urls = append(urls, url)
+	}
+	return urls, nil
+}
+
+// stopInstances stops the instances running on this worker
+func stopInstances(urls []string) {
+	for _, url := range urls {
+		if !lambda.IsRunning(url) {
+			continue
+		}
+		if err := lambda.StopInstance(url); err != nil {
+			log.Errorf("failed to stop function instance %s error %v", url, err)
+		}
+	}
+}
+
+// FunctionLifecycleHandler activates, suspends or resumes a function.
+// A suspended function keeps its subscription so that it resumes from the saved position.
+func FunctionLifecycleHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tenant, functionName, err := tenantFunctionName(vars)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	doc, err := singleDb.GetByTopic(tenant, functionName)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusNotFound)
+		return
+	}
+	status, err := doc.FunctionStatus.Transition(vars["transition"])
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusConflict)
+		return
+	}
+
+	running := doc.WebhookURLs
+	doc.FunctionStatus = status
+	if doc.WebhookURLs, err = startInstances(doc); err != nil {
+		log.Errorf("function %s failed to %s error %v", doc.ID, vars["transition"], err)
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	// the function config keeps the same UpdatedAt, the broker starts or stops the consumer on the status
+	if _, err = singleDb.Update(doc); err != nil {
+		stopInstances(doc.WebhookURLs)
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	if status != model.Activated {
+		// the in-flight invocations drain before the instances stop
+		broker.StopConsumer(doc.ID)
+		stopInstances(running)
+	}
+	broker.Refresh()
+	log.Infof("function %s is %s", doc.ID, status)
+	writeFunctionJSON(w, http.StatusOK, doc)
 }
 
 // DeleteFunctionHandler deletes a function
@@ -381,3 +1121,196 @@ func tenantFunctionName(vars map[string]string) (string, string, error) {
 	}
 	return tenant, name, nil
 }
+
+// RoleBindingRequest is the json object to create or update a role binding
+type RoleBindingRequest struct {
+	Role  string `json:"role"`
+	Claim string `json:"claim"`
+}
+
+// GetRoleBindingsHandler lists the role bindings of a tenant
+func GetRoleBindingsHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := mux.Vars(r)["tenant"]
+	bindings, err := singleDb.GetRoleBindings(tenant)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	resJSON, err := json.Marshal(bindings)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resJSON)
+}
+
+// UpdateRoleBindingHandler creates or updates a role binding of a JWT subject or claim value
+func UpdateRoleBindingHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tenant, subject := vars["tenant"], vars["subject"]
+
+	var req RoleBindingRequest
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&req); err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	role, err := model.StringToRole(req.Role)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	binding := model.NewRoleBinding(tenant, strings.TrimSpace(req.Claim), subject, role)
+	if _, err = singleDb.UpdateRoleBinding(&binding); err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	resJSON, err := json.Marshal(binding)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(resJSON)
+}
+
+// DeleteRoleBindingHandler deletes a role binding, the optional query parameter claim identifies a claim based binding
+func DeleteRoleBindingHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tenant, subject := vars["tenant"], vars["subject"]
+	claim := util.QueryParamString(r.URL.Query(), "claim", "")
+
+	if _, err := singleDb.DeleteRoleBinding(tenant, model.RoleBindingKey(tenant, claim, subject)); err != nil {
+		if err.Error() == db.DocNotFound {
+			util.ResponseErrorJSON(err, w, http.StatusNotFound)
+			return
+		}
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// RevocationRequest is the json object to revoke tokens by jti, subject, or the token itself
+type RevocationRequest struct {
+	JTI       string    `json:"jti"`
+	Subject   string    `json:"subject"`
+	Token     string    `json:"token"`
+	Reason    string    `json:"reason"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// defaultTokenMaxTTL is the retention of a jti revocation without a known token expiry if TokenMaxTTL is not set
+const defaultTokenMaxTTL = 720 * time.Hour
+
+// tokenMaxTTL returns TokenMaxTTL, or the default if it is not a valid duration
+func tokenMaxTTL() time.Duration {
+	if maxTTL, err := time.ParseDuration(util.GetConfig().TokenMaxTTL); err == nil {
+		return maxTTL
+	}
+	return defaultTokenMaxTTL
+}
+
+// RevokeHandler revokes tokens
+// A jti revocation expires with the token, or after TokenMaxTTL if the token is unknown. A subject revocation revokes all tokens of the subject issued
+// until now, it expires after TokenMaxTTL only if all tokens are required to expire.
+func RevokeHandler(w http.ResponseWriter, r *http.Request) {
+	var req RevocationRequest
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&req); err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	if req.Token != "" {
+		claims, err := util.TokenVerifier.GetTokenClaims(req.Token)
+		if err != nil {
+			util.ResponseErrorJSON(fmt.Errorf("invalid token %v", err), w, http.StatusUnprocessableEntity)
+			return
+		}
+		req.JTI, _ = claims["jti"].(string)
+		if exp, ok := claims["exp"].(float64); ok {
+			req.ExpiresAt = time.Unix(int64(exp), 0)
+		}
+		if req.JTI == "" {
+			req.Subject, _ = util.TokenVerifier.SubjectFromClaims(claims)
+		}
+	}
+
+	var rv model.Revocation
+	switch {
+	case req.JTI != "":
+		rv = model.NewRevocation(req.JTI, "", req.Reason, req.ExpiresAt)
+		if rv.ExpiresAt.IsZero() {
+			// the token was issued before the revocation, so it expires within the max ttl
+			rv.ExpiresAt = rv.RevokedAt.Add(tokenMaxTTL())
+		}
+	case req.Subject != "":
+		rv = model.NewRevocation("", req.Subject, req.Reason, time.Time{})
+		if util.GetConfig().TokenMaxTTL != "" && util.TokenExpiryRequired() {
+			rv.ExpiresAt = rv.RevokedAt.Add(tokenMaxTTL())
+		}
+	default:
+		util.ResponseErrorJSON(errors.New("either jti, subject, or token is required"), w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	if _, err := singleDb.Revoke(&rv); err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	resJSON, err := json.Marshal(rv)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(resJSON)
+}
+
+// GetRevocationsHandler lists all revocations
+func GetRevocationsHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := singleDb.GetRevocations()
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	resJSON, err := json.Marshal(list)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resJSON)
+}
+
+// DeleteRevocationHandler deletes a revocation identified by either jti or sub type and its value
+func DeleteRevocationHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var key string
+	switch vars["type"] {
+	case "jti":
+		key = model.JTIRevocationKey(vars["value"])
+	case "sub":
+		key = model.SubjectRevocationKey(vars["value"])
+	default:
+		util.ResponseErrorJSON(fmt.Errorf("unsupported revocation type %s", vars["type"]), w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	if _, err := singleDb.DeleteRevocation(key); err != nil {
+		if err.Error() == db.DocNotFound {
+			util.ResponseErrorJSON(err, w, http.StatusNotFound)
+			return
+		}
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
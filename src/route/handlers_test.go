@@ -0,0 +1,398 @@
+package route
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kafkaesque-io/pubsub-function/src/db"
+	"github.com/kafkaesque-io/pubsub-function/src/icrypto"
+	"github.com/kafkaesque-io/pubsub-function/src/middleware"
+	"github.com/kafkaesque-io/pubsub-function/src/model"
+	"github.com/kafkaesque-io/pubsub-function/src/util"
+)
+
+// setupHandlers initializes the handlers with an in-memory database and a local artifact store,
+// it returns a function to remove the artifact store
+func setupHandlers(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	util.Config.ArtifactStoreDir = dir
+	util.AllowedPulsarURLs = []string{"pulsar://localhost:6650"}
+	util.SuperRoles = []string{"superuser"}
+	store, err := db.NewInMemoryHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	singleDb = store
+	middleware.InitRBAC(singleDb, func(tenant, subjects string) bool {
+		return VerifySubject(tenant, subjects, ExtractEvalTenant)
+	})
+	return func() { os.RemoveAll(dir) }
+}
+
+// functionSpec returns a spec of a function with an embedded source and the topics
+func functionSpec(input, output string) []byte {
+	spec := map[string]interface{}{
+		"languagePack": "js",
+		"triggerType":  "pulsar-topic",
+		"inputTopic":   map[string]string{"topicFullName": input, "subscription": "sub"},
+		"source":       map[string]string{"base64": base64.StdEncoding.EncodeToString([]byte("module.exports = () => 'hello'"))},
+	}
+	if output != "" {
+		spec["outputTopic"] = output
+	}
+	data, _ := json.Marshal(spec)
+	return data
+}
+
+func TestFunctionTopicsAuthorization(t *testing.T) {
+	defer setupHandlers(t)()
+	for _, b := range []model.RoleBinding{
+		model.NewRoleBinding("acme", "", "ci-pipeline", model.DeployerRole),
+		model.NewRoleBinding("acme", "", "auditor", model.ReadOnlyRole),
+		// a tenant owner restricted to read only by a role binding
+		model.NewRoleBinding("acme", "", "acme-intern", model.ReadOnlyRole),
+	} {
+		binding := b
+		if _, err := singleDb.UpdateRoleBinding(&binding); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		name     string
+		subjects string
+		input    string
+		output   string
+		want     int
+	}{
+		{"bound deployer", "ci-pipeline", "persistent://acme/ns/in", "persistent://acme/ns/out", http.StatusOK},
+		{"tenant owner", "acme-user", "persistent://acme/ns/in", "", http.StatusOK},
+		{"super role", "superuser", "persistent://other/ns/in", "", http.StatusOK},
+		{"bound read only", "auditor", "persistent://acme/ns/in", "", http.StatusForbidden},
+		{"owner restricted by binding", "acme-intern", "persistent://acme/ns/in", "", http.StatusForbidden},
+		{"bound deployer to another tenant's topic", "ci-pipeline", "persistent://acme/ns/in", "persistent://other/ns/out", http.StatusForbidden},
+		{"owner of another tenant", "other-user", "persistent://acme/ns/in", "", http.StatusForbidden},
+		{"unbound subject", "someone", "persistent://acme/ns/in", "", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/v2/function/acme/fn/spec?dry-run=true", bytes.NewReader(functionSpec(c.input, c.output)))
+			r.Header.Set("injectedSubs", c.subjects)
+			r = mux.SetURLVars(r, map[string]string{"tenant": "acme", "function": "fn"})
+			w := httptest.NewRecorder()
+			ApplyFunctionHandler(w, r)
+			if w.Code != c.want {
+				t.Errorf("got status %d body %s, want %d", w.Code, w.Body.String(), c.want)
+			}
+		})
+	}
+}
+
+func TestValidationErrorResponse(t *testing.T) {
+	defer setupHandlers(t)()
+	spec := []byte(`{"languagePack": "python", "timeout": -1, "triggerType": "pulsar-topic",
+		"inputTopic": {"topicFullName": "persistent://acme/ns/in", "subscriptionType": "fanout"},
+		"source": {"base64": "bW9kdWxlLmV4cG9ydHMgPSAoKSA9PiAnaGVsbG8n"}}`)
+	r := httptest.NewRequest(http.MethodPut, "/v2/function/acme/fn/spec", bytes.NewReader(spec))
+	r.Header.Set("injectedSubs", "acme-user")
+	r = mux.SetURLVars(r, map[string]string{"tenant": "acme", "function": "fn"})
+	w := httptest.NewRecorder()
+	ApplyFunctionHandler(w, r)
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("got content type %s", ct)
+	}
+	res := validationErrorResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("got body %s error %v", w.Body.String(), err)
+	}
+	fields := []string{}
+	for _, f := range res.Fields {
+		fields = append(fields, f.Field)
+	}
+	want := []string{"languagePack", "timeout", "inputTopics.subscriptionType"}
+	if !reflect.DeepEqual(fields, want) || res.Error == "" {
+		t.Errorf("got error %s fields %v, want fields %v", res.Error, fields, want)
+	}
+	if _, err := singleDb.GetByTopic("acme", "fn"); err == nil {
+		t.Error("got an invalid function saved")
+	}
+}
+
+// setupTokenServer sets up the token server with a new key pair
+func setupTokenServer(t *testing.T) *icrypto.RSAKeyPair {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	util.JWTAuth = &icrypto.RSAKeyPair{PrivateKey: key, PublicKey: &key.PublicKey}
+	return util.JWTAuth
+}
+
+func TestTokenSubjectTTL(t *testing.T) {
+	defer setupHandlers(t)()
+	keys := setupTokenServer(t)
+	defer func(maxTTL string) { util.Config.TokenMaxTTL = maxTTL }(util.Config.TokenMaxTTL)
+
+	cases := []struct {
+		name     string
+		maxTTL   string
+		query    string
+		subjects string
+		want     int
+		ttl      time.Duration
+	}{
+		{"default ttl", "", "", "superuser", http.StatusOK, 24 * time.Hour},
+		{"requested ttl", "", "?ttl=2h", "superuser", http.StatusOK, 2 * time.Hour},
+		{"capped by the default max ttl", "", "?ttl=1000h", "superuser", http.StatusOK, 720 * time.Hour},
+		{"capped by max ttl", "1h", "?ttl=2h", "superuser", http.StatusOK, time.Hour},
+		{"default ttl capped by max ttl", "1h", "", "superuser", http.StatusOK, time.Hour},
+		{"invalid ttl", "", "?ttl=-1h", "superuser", http.StatusUnprocessableEntity, 0},
+		{"not a super role", "", "", "alice", http.StatusUnauthorized, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			util.Config.TokenMaxTTL = c.maxTTL
+			r := httptest.NewRequest(http.MethodGet, "/subject/alice"+c.query, nil)
+			r.Header.Set("injectedSubs", c.subjects)
+			r = mux.SetURLVars(r, map[string]string{"sub": "alice"})
+			w := httptest.NewRecorder()
+			now := time.Now()
+			TokenSubjectHandler(w, r)
+			if w.Code != c.want {
+				t.Fatalf("got status %d body %s, want %d", w.Code, w.Body.String(), c.want)
+			}
+			if c.want != http.StatusOK {
+				return
+			}
+			res := TokenServerResponse{}
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if sub, err := keys.GetTokenSubject(res.Token); err != nil || sub != "alice" {
+				t.Errorf("got subject %s error %v", sub, err)
+			}
+			if d := time.Unix(res.ExpiresAt, 0).Sub(now.Add(c.ttl)); d < -time.Second || d > time.Second {
+				t.Errorf("got expiry %v, want %v", time.Unix(res.ExpiresAt, 0), now.Add(c.ttl))
+			}
+		})
+	}
+}
+
+func TestTokenIntrospect(t *testing.T) {
+	defer setupHandlers(t)()
+	keys := setupTokenServer(t)
+	middleware.InitRevocation(singleDb)
+	defer middleware.InitRevocation(nil)
+
+	alice, err := keys.GenerateToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := keys.GenerateToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, _ := keys.GetTokenClaims(revoked)
+	rv := model.NewRevocation(claims["jti"].(string), "", "leaked", time.Time{})
+	if _, err = singleDb.Revoke(&rv); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		token    string
+		subjects string
+		want     int
+		active   bool
+		revoked  bool
+	}{
+		{"own token", alice, "alice", http.StatusOK, true, false},
+		{"super role", alice, "superuser", http.StatusOK, true, false},
+		{"token of another subject", alice, "bob", http.StatusForbidden, false, false},
+		{"owner of the tenant of the subject", alice, "alice-admin", http.StatusForbidden, false, false},
+		{"revoked token", revoked, "alice", http.StatusOK, false, true},
+		{"invalid token", "a.b.c", "bob", http.StatusOK, false, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v2/token/introspect", strings.NewReader("token="+c.token))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("injectedSubs", c.subjects)
+			w := httptest.NewRecorder()
+			TokenIntrospectHandler(w, r)
+			if w.Code != c.want {
+				t.Fatalf("got status %d body %s, want %d", w.Code, w.Body.String(), c.want)
+			}
+			if c.want != http.StatusOK {
+				return
+			}
+			res := TokenIntrospection{}
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Active != c.active || res.Revoked != c.revoked {
+				t.Errorf("got active %v revoked %v, want active %v revoked %v", res.Active, res.Revoked, c.active, c.revoked)
+			}
+			if c.active && (res.Subject != "alice" || res.RemainingValidity <= 0) {
+				t.Errorf("got subject %s remaining validity %d", res.Subject, res.RemainingValidity)
+			}
+		})
+	}
+}
+
+func TestFunctionLifecycleHandler(t *testing.T) {
+	defer setupHandlers(t)()
+	// the cluster assigns the instances, so that no instance starts on this worker
+	defer func(cluster string) { util.Config.WorkerCluster = cluster }(util.Config.WorkerCluster)
+	util.Config.WorkerCluster = "true"
+
+	cases := []struct {
+		name       string
+		status     model.Status
+		transition string
+		want       int
+		saved      model.Status
+	}{
+		{"activate", model.Deactivated, model.ActivateTransition, http.StatusOK, model.Activated},
+		{"suspend", model.Activated, model.SuspendTransition, http.StatusOK, model.Suspended},
+		{"resume", model.Suspended, model.ResumeTransition, http.StatusOK, model.Activated},
+		{"resume a deactivated function", model.Deactivated, model.ResumeTransition, http.StatusConflict, model.Deactivated},
+		{"activate an activated function", model.Activated, model.ActivateTransition, http.StatusConflict, model.Activated},
+		{"suspend a suspended function", model.Suspended, model.SuspendTransition, http.StatusConflict, model.Suspended},
+		{"unknown transition", model.Activated, "restart", http.StatusConflict, model.Activated},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fn := &model.FunctionConfig{ID: model.FunctionKey("acme", "fn"), Tenant: "acme", Name: "fn", FunctionStatus: c.status}
+			if _, err := singleDb.Update(fn); err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/v2/function/acme/fn/"+c.transition, nil)
+			r = mux.SetURLVars(r, map[string]string{"tenant": "acme", "function": "fn", "transition": c.transition})
+			w := httptest.NewRecorder()
+			FunctionLifecycleHandler(w, r)
+			if w.Code != c.want {
+				t.Errorf("got status code %d body %s, want %d", w.Code, w.Body.String(), c.want)
+			}
+			saved, err := singleDb.GetByTopic("acme", "fn")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if saved.FunctionStatus != c.saved {
+				t.Errorf("got saved status %s, want %s", saved.FunctionStatus, c.saved)
+			}
+		})
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/v2/function/acme/missing/activate", nil)
+	r = mux.SetURLVars(r, map[string]string{"tenant": "acme", "function": "missing", "transition": "activate"})
+	w := httptest.NewRecorder()
+	FunctionLifecycleHandler(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got status code %d for a missing function, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestCrossTenantAuthorization(t *testing.T) {
+	defer setupHandlers(t)()
+	keys := setupTokenServer(t)
+	defer func(verifier icrypto.TokenVerifier) { util.TokenVerifier = verifier }(util.TokenVerifier)
+	util.TokenVerifier = keys
+	// the cluster assigns the instances, so that no instance starts on this worker
+	defer func(cluster string) { util.Config.WorkerCluster = cluster }(util.Config.WorkerCluster)
+	util.Config.WorkerCluster = "true"
+
+	for _, tenant := range []string{"acme", "acme-x", "other"} {
+		fn := &model.FunctionConfig{ID: model.FunctionKey(tenant, "fn"), Tenant: tenant, Name: "fn", FunctionStatus: model.Activated}
+		if _, err := singleDb.Update(fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	binding := model.NewRoleBinding("acme", "", "ci-pipeline", model.DeployerRole)
+	if _, err := singleDb.UpdateRoleBinding(&binding); err != nil {
+		t.Fatal(err)
+	}
+	mode := util.Hybrid
+	router := NewRouter(&mode)
+
+	cases := []struct {
+		name    string
+		subject string
+		method  string
+		path    string
+		body    string
+		want    int
+	}{
+		{"tenant owner", "acme-admin", http.MethodGet, "/v2/function/acme/fn", "", http.StatusOK},
+		{"bound subject", "ci-pipeline", http.MethodGet, "/v2/function/acme/fn", "", http.StatusOK},
+		{"super role", "superuser", http.MethodGet, "/v2/function/other/fn", "", http.StatusOK},
+		{"no token", "", http.MethodGet, "/v2/function/acme/fn", "", http.StatusUnauthorized},
+		{"get a function of another tenant", "other-admin", http.MethodGet, "/v2/function/acme/fn", "", http.StatusForbidden},
+		{"list the functions of another tenant", "other-admin", http.MethodGet, "/v2/functions/acme", "", http.StatusForbidden},
+		{"list the functions of all tenants", "acme-admin", http.MethodGet, "/v2/functions", "", http.StatusForbidden},
+		{"create a function in another tenant", "other-admin", http.MethodPost, "/v2/function/acme/fn2", "", http.StatusForbidden},
+		{"patch a function of another tenant", "other-admin", http.MethodPatch, "/v2/function/acme/fn", `{"parallelism": 3}`, http.StatusForbidden},
+		{"apply a spec in another tenant", "other-admin", http.MethodPut, "/v2/function/acme/fn/spec", `{"parallelism": 3}`, http.StatusForbidden},
+		{"suspend a function of another tenant", "other-admin", http.MethodPost, "/v2/function/acme/fn/suspend", "", http.StatusForbidden},
+		{"delete a function of another tenant", "other-admin", http.MethodDelete, "/v2/function/acme/fn", "", http.StatusForbidden},
+		{"upload to another tenant", "other-admin", http.MethodPost, "/v2/artifacts/acme", "", http.StatusForbidden},
+		{"bind a role in another tenant", "other-admin", http.MethodPut, "/v2/rolebinding/acme/other-admin", `{"role": "admin"}`, http.StatusForbidden},
+		{"binding of another tenant", "ci-pipeline", http.MethodDelete, "/v2/function/other/fn", "", http.StatusForbidden},
+		{"tenant with the name as a prefix", "acme-x-admin", http.MethodDelete, "/v2/function/acme/fn", "", http.StatusForbidden},
+		{"tenant owner of a prefix", "acme-admin", http.MethodDelete, "/v2/function/acme-x/fn", "", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+			r.Header.Set("Content-Type", "application/json")
+			if c.subject != "" {
+				token, err := keys.GenerateToken(c.subject)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r.Header.Set("Authorization", "Bearer "+token)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != c.want {
+				t.Errorf("got status code %d body %s, want %d", w.Code, w.Body.String(), c.want)
+			}
+		})
+	}
+
+	// the denied requests have not changed the functions or the role bindings
+	for _, tenant := range []string{"acme", "acme-x", "other"} {
+		fn, err := singleDb.GetByTopic(tenant, "fn")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fn.FunctionStatus != model.Activated || fn.Parallelism != 0 {
+			t.Errorf("got function %s status %s parallelism %d", fn.ID, fn.FunctionStatus, fn.Parallelism)
+		}
+	}
+	if _, err := singleDb.GetByTopic("acme", "fn2"); err == nil {
+		t.Error("got a function created in another tenant")
+	}
+	if bindings, _ := singleDb.GetRoleBindings("acme"); len(bindings) != 1 {
+		t.Errorf("got role bindings %v of acme, want ci-pipeline only", bindings)
+	}
+}
@@ -19,6 +19,8 @@ func NewRouter(mode *string) *mux.Router {
 
 		handler = route.HandlerFunc
 		handler = Logger(handler, route.Name)
+		// the rate limit is inside the auth middleware to be keyed by the JWT subjects
+		handler = middleware.LimitRateByRoute(route.Name, route.RateLimit)(handler)
 
 		router.
 			Methods(route.Method).
@@ -27,8 +29,10 @@ func NewRouter(mode *string) *mux.Router {
 			Handler(route.AuthFunc(handler))
 
 	}
-	// TODO rate limit can be added per route basis
+	// global concurrency limit
 	router.Use(middleware.LimitRate)
+	// the injected headers are removed before the auth middleware of the route
+	router.Use(middleware.StripInjectedHeaders)
 
 	log.Infof("router added")
 	return router
@@ -46,7 +50,9 @@ func getRoutes(mode *string) Routes {
 	case util.Receiver:
 		return ReceiverRoutes
 	case util.HTTPOnly:
-		return append(ReceiverRoutes, RestRoutes...)
+		return append(append(ReceiverRoutes, RestRoutes...), TokenServerRoutes...)
+	case util.TokenServer:
+		return TokenServerRoutes
 	default:
 		return RestRoutes
 	}
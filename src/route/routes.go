@@ -5,6 +5,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/kafkaesque-io/pubsub-function/src/middleware"
+	"github.com/kafkaesque-io/pubsub-function/src/model"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -15,6 +16,7 @@ type Route struct {
 	Pattern     string
 	HandlerFunc http.HandlerFunc
 	AuthFunc    mux.MiddlewareFunc
+	RateLimit   middleware.RateBudget
 }
 
 // Routes list of HTTP Routes
@@ -28,6 +30,7 @@ var PrometheusRoute = Routes{
 		"/metrics",
 		promhttp.Handler().ServeHTTP,
 		middleware.NoAuth,
+		middleware.NoRateLimit,
 	},
 }
 
@@ -39,6 +42,7 @@ var ReceiverRoutes = Routes{
 		"/status",
 		StatusPage,
 		middleware.AuthHeaderRequired,
+		middleware.DefaultBudget,
 	},
 	Route{
 		"Receive",
@@ -46,31 +50,111 @@ var ReceiverRoutes = Routes{
 		"/v1/firehose",
 		ReceiveHandler,
 		middleware.NoAuth,
+		middleware.FirehoseBudget,
+	},
+}
+
+// TokenServerRoutes definition
+var TokenServerRoutes = Routes{
+	Route{
+		"Token server",
+		"GET",
+		"/subject/{sub}",
+		TokenSubjectHandler,
+		middleware.AuthVerifyJWT,
+		middleware.DefaultBudget,
+	},
+	Route{
+		"Token server with claims",
+		"POST",
+		"/subject/{sub}",
+		TokenSubjectHandler,
+		middleware.AuthVerifyJWT,
+		middleware.DefaultBudget,
+	},
+	Route{
+		"Token introspection",
+		"POST",
+		"/v2/token/introspect",
+		TokenIntrospectHandler,
+		middleware.AuthVerifyJWT,
+		middleware.DefaultBudget,
 	},
 }
 
 // RestRoutes definition
 var RestRoutes = Routes{
+	Route{
+		"List functions of a tenant",
+		"GET",
+		"/v2/functions/{tenant}",
+		ListFunctionsHandler,
+		middleware.AuthRole(model.ReadAction),
+		middleware.FunctionBudget,
+	},
+	Route{
+		"List functions of all tenants",
+		"GET",
+		"/v2/functions",
+		ListAllFunctionsHandler,
+		middleware.SuperRoleRequired,
+		middleware.FunctionBudget,
+	},
+	Route{
+		"Patch a function",
+		"PATCH",
+		"/v2/function/{tenant}/{function}",
+		PatchFunctionHandler,
+		middleware.AuthRole(model.DeployAction),
+		middleware.FunctionBudget,
+	},
+	Route{
+		"Apply a function spec",
+		"PUT",
+		"/v2/function/{tenant}/{function}/spec",
+		ApplyFunctionHandler,
+		middleware.AuthRole(model.DeployAction),
+		middleware.FunctionBudget,
+	},
+	Route{
+		"Upload a function source artifact",
+		"POST",
+		"/v2/artifacts/{tenant}",
+		UploadArtifactHandler,
+		middleware.AuthRole(model.DeployAction),
+		middleware.FunctionBudget,
+	},
 	Route{
 		"Get a function",
 		"GET",
 		"/v2/function/{tenant}/{function}",
 		GetFunctionHandler,
-		middleware.AuthVerifyJWT,
+		middleware.AuthRole(model.ReadAction),
+		middleware.FunctionBudget,
 	},
 	Route{
 		"Create a function",
 		"POST",
 		"/v2/function/{tenant}/{function}",
 		UpdateFunctionHandler,
-		middleware.AuthVerifyJWT,
+		middleware.AuthRole(model.DeployAction),
+		middleware.FunctionBudget,
+	},
+	Route{
+		"Activate, suspend or resume a function",
+		"POST",
+		"/v2/function/{tenant}/{function}/{transition:activate|suspend|resume}",
+		FunctionLifecycleHandler,
+		middleware.AuthRole(model.DeployAction),
+		middleware.FunctionBudget,
 	},
 	Route{
 		"Delete a function",
 		"DELETE",
 		"/v2/function/{tenant}/{function}",
 		DeleteFunctionHandler,
-		middleware.AuthVerifyJWT,
+		middleware.AuthRole(model.DeleteAction),
+		middleware.FunctionBudget,
 	},
 	Route{
 		"Trigger a function",
@@ -78,5 +162,54 @@ var RestRoutes = Routes{
 		"/v2/function",
 		TriggerFunctionHandler,
 		middleware.AuthVerifyJWT,
+		middleware.FunctionBudget,
+	},
+	Route{
+		"List role bindings",
+		"GET",
+		"/v2/rolebindings/{tenant}",
+		GetRoleBindingsHandler,
+		middleware.AuthRole(model.ManageAction),
+		middleware.DefaultBudget,
+	},
+	Route{
+		"Update a role binding",
+		"PUT",
+		"/v2/rolebinding/{tenant}/{subject}",
+		UpdateRoleBindingHandler,
+		middleware.AuthRole(model.ManageAction),
+		middleware.DefaultBudget,
+	},
+	Route{
+		"Delete a role binding",
+		"DELETE",
+		"/v2/rolebinding/{tenant}/{subject}",
+		DeleteRoleBindingHandler,
+		middleware.AuthRole(model.ManageAction),
+		middleware.DefaultBudget,
+	},
+	Route{
+		"Revoke tokens",
+		"POST",
+		"/v2/revocations",
+		RevokeHandler,
+		middleware.SuperRoleRequired,
+		middleware.DefaultBudget,
+	},
+	Route{
+		"List token revocations",
+		"GET",
+		"/v2/revocations",
+		GetRevocationsHandler,
+		middleware.SuperRoleRequired,
+		middleware.DefaultBudget,
+	},
+	Route{
+		"Delete a token revocation",
+		"DELETE",
+		"/v2/revocation/{type}/{value}",
+		DeleteRevocationHandler,
+		middleware.SuperRoleRequired,
+		middleware.DefaultBudget,
 	},
 }
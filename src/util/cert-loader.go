@@ -6,6 +6,7 @@ package util
 // openssl req -newkey rsa:2048 -nodes -keyout domain.key -x509 -days 365 -out domain.crt
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"log"
@@ -17,6 +18,9 @@ import (
 
 var cert atomic.Value
 
+// server is the http server started by ListenAndServeTLS
+var server = &http.Server{}
+
 type updatedChann struct{}
 
 func loadCert(certFile, keyFile string) error {
@@ -58,11 +62,19 @@ func watchFile(filePath string, updated chan *updatedChann) error {
 
 // ListenAndServeTLS listens HTTP with TLS option just like the default http.ListenAndServeTLS
 // in addition it also watches certificate and key file changes and reloads them if necessary
+// It returns http.ErrServerClosed after ShutdownServer is called.
 func ListenAndServeTLS(address, certFile, keyFile string, handler http.Handler) error {
+	server.Addr = address
+	server.Handler = handler
 	if len(certFile) > 1 && len(keyFile) > 1 {
 		return listenAndServeTLS(address, certFile, keyFile, handler)
 	}
-	return http.ListenAndServe(address, handler)
+	return server.ListenAndServe()
+}
+
+// ShutdownServer stops accepting connections and waits for the in-flight requests until the context is done
+func ShutdownServer(ctx context.Context) error {
+	return server.Shutdown(ctx)
 }
 
 func listenAndServeTLS(address, certFile, keyFile string, handler http.Handler) error {
@@ -118,5 +130,5 @@ func listenAndServeTLS(address, certFile, keyFile string, handler http.Handler)
 		return err
 	}
 
-	return http.Serve(l, handler)
+	return server.Serve(l)
 }
@@ -8,6 +8,7 @@ import (
 	"os"
 	"reflect"
 	"strings"
+	"time"
 
 	"unicode"
 
@@ -52,6 +53,13 @@ type Configuration struct {
 	// SuperRoles are Pulsar JWT superroles for authorization
 	SuperRoles string `json:"SuperRoles"`
 
+	// TokenRequireExpiry rejects tokens without exp claim signed by the Pulsar key pair (default: true)
+	TokenRequireExpiry string `json:"TokenRequireExpiry"`
+
+	// TokenMaxTTL caps the ttl of tokens issued by the token server, i.e. 720h.
+	// It is also the retention of subject revocations when TokenRequireExpiry is enabled.
+	TokenMaxTTL string `json:"TokenMaxTTL"`
+
 	// PulsarBrokerURL is the Pulsar Broker URL to allow direct connection to the broker
 	PulsarBrokerURL string `json:"PulsarBrokerURL"`
 
@@ -68,6 +76,16 @@ type Configuration struct {
 	// default value 180s
 	PbDbInterval string `json:"PbDbInterval"`
 
+	// PulsarAdminURL is the Pulsar admin REST endpoint, i.e. http://localhost:8080
+	// It is used to read the input subscription backlog for autoscaling.
+	PulsarAdminURL string `json:"PulsarAdminURL"`
+
+	// AutoscaleInterval is the interval the broker evaluates the autoscaling of functions, default 15s
+	AutoscaleInterval string `json:"AutoscaleInterval"`
+
+	// ShutdownTimeout is the deadline to drain in-flight requests and invocations on SIGTERM, default 25s
+	ShutdownTimeout string `json:"ShutdownTimeout"`
+
 	// Pulsar CA certificate key store
 	TrustStore string `json:"TrustStore"`
 
@@ -79,8 +97,86 @@ type Configuration struct {
 	// It is a comma separated pulsar URL string, so it can be a list of clusters
 	PulsarClusters string `json:"PulsarClusters"`
 
-	// HTTPAuthImpl specifies the jwt authen and authorization algorithm, `noauth` to skip JWT authentication
+	// Token bucket rate limits per JWT subject or tenant on each route in the format of `<requests per second>,<burst>`
+	// RateLimitFirehose is the budget of firehose ingestion, default 1000,2000
+	// RateLimitFunction is the budget of function management, default 10,20
+	// RateLimitDefault is the budget of all other routes, default 50,100
+	RateLimitFirehose string `json:"RateLimitFirehose"`
+	RateLimitFunction string `json:"RateLimitFunction"`
+	RateLimitDefault  string `json:"RateLimitDefault"`
+
+	// RateLimitTenant is the budget shared by all callers of a tenant across the routes of the tenant, default 100,200
+	RateLimitTenant string `json:"RateLimitTenant"`
+
+	// TrustedProxies is a comma separated list of the IPs or CIDRs of the reverse proxies in front of the server.
+	// Unauthenticated requests from a trusted proxy are rate limited by the client address in X-Forwarded-For.
+	TrustedProxies string `json:"TrustedProxies"`
+
+	// FunctionCgroupRoot is the cgroup v2 directory under which every function gets a subtree for its resource limits,
+	// default /sys/fs/cgroup/pubsub-function. The worker must be able to write to it.
+	FunctionCgroupRoot string `json:"FunctionCgroupRoot"`
+
+	// FunctionSandbox runs all function instances in a sandbox with the default policy (default: false)
+	// FunctionSandboxConfig is a yaml file of the default and per tenant sandbox policies
+	FunctionSandbox       string `json:"FunctionSandbox"`
+	FunctionSandboxConfig string `json:"FunctionSandboxConfig"`
+
+	// MaxFunctionParallelism is the max number of instances of a function, including autoscaling, default 100
+	MaxFunctionParallelism string `json:"MaxFunctionParallelism"`
+
+	// WorkerCluster runs function instances across the workers sharing the database (default: false)
+	// It requires pulsarAsDb as the database, and an artifact store shared by all workers.
+	WorkerCluster string `json:"WorkerCluster"`
+
+	// WorkerID identifies the worker in the cluster, default the host name
+	// WorkerAddress is the host name or IP other workers reach the function instances at, default the host name
+	WorkerID      string `json:"WorkerID"`
+	WorkerAddress string `json:"WorkerAddress"`
+
+	// WorkerCapacity is the max number of function instances on the worker, default 100
+	WorkerCapacity string `json:"WorkerCapacity"`
+
+	// WorkerHeartbeatInterval is the interval of worker heartbeats and instance assignment, default 10s
+	// A worker without heartbeat for 3 intervals is removed from the cluster.
+	WorkerHeartbeatInterval string `json:"WorkerHeartbeatInterval"`
+
+	// LeaderLeaseTTL is the lease of the leader that runs the cluster wide duties, default 30s
+	// The leader renews the lease every third of the ttl.
+	LeaderLeaseTTL string `json:"LeaderLeaseTTL"`
+
+	// DbCompactionInterval is the interval the leader compacts the database topic through PulsarAdminURL, default 1h
+	DbCompactionInterval string `json:"DbCompactionInterval"`
+
+	// ArtifactStoreType is where function sources are stored, `local` directory (default) or `pulsar` topic
+	// ArtifactStoreDir is the directory of the local artifact store, default /pulsar/artifacts.
+	// It must be a volume shared by all workers in a worker cluster.
+	ArtifactStoreType string `json:"ArtifactStoreType"`
+	ArtifactStoreDir  string `json:"ArtifactStoreDir"`
+
+	// ArtifactTopic is the topic of the pulsar artifact store on the database cluster, default <DbName>-artifacts
+	// ArtifactChunkSize is the max bytes of an artifact chunk message, default 524288
+	ArtifactTopic     string `json:"ArtifactTopic"`
+	ArtifactChunkSize string `json:"ArtifactChunkSize"`
+
+	// HTTPAuthImpl specifies the jwt authen and authorization algorithm, `noauth` to skip JWT authentication,
+	// `oidc` to verify tokens against the JWKS of an OIDC provider
 	HTTPAuthImpl string `json:"HTTPAuthImpl"`
+
+	// OIDCJwksURL is the JWKS endpoint of the OIDC provider
+	// OIDCJwksFile is a local JWKS document for tests and air-gapped installs, used when the URL is not specified
+	OIDCJwksURL  string `json:"OIDCJwksURL"`
+	OIDCJwksFile string `json:"OIDCJwksFile"`
+
+	// OIDCIssuer and OIDCAudience are the required `iss` and `aud` claims.
+	// OIDCAudience is a comma separated list of accepted audiences
+	OIDCIssuer   string `json:"OIDCIssuer"`
+	OIDCAudience string `json:"OIDCAudience"`
+
+	// OIDCSubjectClaim is the claim to extract subjects from, default `sub`
+	OIDCSubjectClaim string `json:"OIDCSubjectClaim"`
+
+	// OIDCJwksRefreshInterval is the JWKS refresh interval, default 1h
+	OIDCJwksRefreshInterval string `json:"OIDCJwksRefreshInterval"`
 }
 
 var (
@@ -96,6 +192,9 @@ var (
 	// JWTAuth is the RSA key pair for sign and verify JWT
 	JWTAuth *icrypto.RSAKeyPair
 
+	// TokenVerifier verifies JWT for http authentication, it is either the RSA key pair or the OIDC JWKS
+	TokenVerifier icrypto.TokenVerifier
+
 	// L is the logger
 	L *log.Logger
 )
@@ -108,7 +207,37 @@ func Init() {
 	log.SetLevel(logLevel(Config.LogLevel))
 
 	log.Warnf("Configuration built from file - %s", configFile)
-	JWTAuth = icrypto.NewRSAKeyPair(Config.PulsarPrivateKey, Config.PulsarPublicKey)
+	if Config.HTTPAuthImpl != "oidc" {
+		JWTAuth = icrypto.NewRSAKeyPair(Config.PulsarPrivateKey, Config.PulsarPublicKey)
+		JWTAuth.AllowNoExpiry = !TokenExpiryRequired()
+		TokenVerifier = JWTAuth
+		return
+	}
+
+	// the RSA key pair is optional for the token server under oidc
+	if Config.PulsarPrivateKey != "" && Config.PulsarPublicKey != "" {
+		JWTAuth = icrypto.NewRSAKeyPair(Config.PulsarPrivateKey, Config.PulsarPublicKey)
+		JWTAuth.AllowNoExpiry = !TokenExpiryRequired()
+	}
+	refreshInterval, err := time.ParseDuration(AssignString(Config.OIDCJwksRefreshInterval, "1h"))
+	if err != nil {
+		log.Fatalf("invalid OIDCJwksRefreshInterval %v", err)
+	}
+	audiences := []string{}
+	if Config.OIDCAudience != "" {
+		audiences = strings.Split(Config.OIDCAudience, ",")
+	}
+	TokenVerifier, err = icrypto.NewJWKSVerifier(icrypto.JWKSOptions{
+		URL:             Config.OIDCJwksURL,
+		File:            Config.OIDCJwksFile,
+		Issuer:          Config.OIDCIssuer,
+		Audiences:       audiences,
+		SubjectClaim:    Config.OIDCSubjectClaim,
+		RefreshInterval: refreshInterval,
+	})
+	if err != nil {
+		log.Fatalf("failed to load OIDC JWKS %v", err)
+	}
 }
 
 // ReadConfigFile reads configuration file.
@@ -167,6 +296,33 @@ func ReadConfigFile(configFile string) {
 		Config.PulsarBrokerURL, AllowedPulsarURLs, Config.PulsarTLSAllowInsecureConnection, Config.PulsarTLSValidateHostname)
 }
 
+// GetWorkerID returns the ID of this worker in the worker cluster
+func GetWorkerID() string {
+	if Config.WorkerID != "" {
+		return Config.WorkerID
+	}
+	host, _ := os.Hostname()
+	return AssignString(host, "localhost")
+}
+
+// GetWorkerAddress returns the host of the function instance urls,
+// it is routable from other workers in a worker cluster and localhost otherwise
+func GetWorkerAddress() string {
+	if !StringToBool(Config.WorkerCluster) {
+		return "localhost"
+	}
+	if Config.WorkerAddress != "" {
+		return Config.WorkerAddress
+	}
+	host, _ := os.Hostname()
+	return AssignString(host, "localhost")
+}
+
+// TokenExpiryRequired returns whether tokens signed by the Pulsar key pair must have exp, the default
+func TokenExpiryRequired() bool {
+	return StringToBool(AssignString(Config.TokenRequireExpiry, "true"))
+}
+
 //GetConfig returns a reference to the Configuration
 func GetConfig() *Configuration {
 	return &Config
@@ -1,6 +1,7 @@
-package middleware
+package util
 
 import (
+	"context"
 	"errors"
 )
 
@@ -19,7 +20,7 @@ func NewSema(Length int) Sema {
 	return obj
 }
 
-// Acquire aquires a semaphore lock
+// Acquire aquires a semaphore lock without blocking
 func (s *Sema) Acquire() error {
 	select {
 	case s.Ch <- 1:
@@ -29,6 +30,16 @@ func (s *Sema) Acquire() error {
 	}
 }
 
+// AcquireWithContext blocks until a semaphore lock is acquired or the context is done
+func (s *Sema) AcquireWithContext(ctx context.Context) error {
+	select {
+	case s.Ch <- 1:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Release release a semaphore lock
 func (s *Sema) Release() error {
 	select {
@@ -38,3 +49,8 @@ func (s *Sema) Release() error {
 		return errors.New("all semaphore buffer empty")
 	}
 }
+
+// InUse returns the number of acquired semaphore locks
+func (s *Sema) InUse() int {
+	return len(s.Ch)
+}
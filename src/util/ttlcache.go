@@ -81,8 +81,15 @@ func (c *Cache) eventLoop() {
 	}
 }
 
-// Close is not implmented yet
-func (c *Cache) Close() {}
+// Close expires all items so that the resources held by them are released
+func (c *Cache) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key, item := range c.items {
+		c.opt.ExpireCallback(key, item.data)
+		delete(c.items, key)
+	}
+}
 
 // Set adds a new item with a gobally set TTL by the cache
 func (c *Cache) Set(key string, data interface{}) {
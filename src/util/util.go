@@ -86,6 +86,27 @@ func BuildTopicFn(persistent, tenant, namespace, topic string) (string, error) {
 	}
 }
 
+// ParseTopicFn parses a topic fullname built by BuildTopicFn into the persistent type, tenant, namespace and topic
+func ParseTopicFn(topicFn string) (persistent, tenant, namespace, topic string, err error) {
+	parts := strings.SplitN(topicFn, "://", 2)
+	if len(parts) != 2 || (parts[0] != "persistent" && parts[0] != "non-persistent") {
+		return "", "", "", "", fmt.Errorf("topic %s must start with persistent:// or non-persistent://", topicFn)
+	}
+	names := strings.Split(parts[1], "/")
+	if len(names) != 3 || names[0] == "" || names[1] == "" || names[2] == "" {
+		return "", "", "", "", fmt.Errorf("topic %s must be in the form of %s://tenant/namespace/topic", topicFn, parts[0])
+	}
+	return parts[0], names[0], names[1], names[2], nil
+}
+
+// IsAllowedPulsarURL returns whether the Pulsar URL is in the AllowedPulsarURLs, any URL is allowed if none is configured
+func IsAllowedPulsarURL(pulsarURL string) bool {
+	if len(AllowedPulsarURLs) > 1 || (len(AllowedPulsarURLs) == 1 && AllowedPulsarURLs[0] != "") {
+		return StrContains(AllowedPulsarURLs, pulsarURL)
+	}
+	return true
+}
+
 // AssignString returns the first non-empty string
 // It is equivalent the following in Javascript
 // var value = val0 || val1 || val2 || default
@@ -122,6 +143,14 @@ func GetEnvInt(env string, defaultNum int) int {
 	return defaultNum
 }
 
+// StringToInt converts a string to integer with a default if inproper value retrieved
+func StringToInt(str string, defaultNum int) int {
+	if i, err := strconv.Atoi(strings.TrimSpace(str)); err == nil {
+		return i
+	}
+	return defaultNum
+}
+
 // StringToBool format various strings to boolean
 // strconv.ParseBool only covers `true` and `false` cases
 func StringToBool(str string) bool {